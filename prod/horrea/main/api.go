@@ -6,89 +6,569 @@ package main
 
 import (
 	"github.com/pleb/prod/horrea/main/blob"
+	"github.com/pleb/prod/horrea/main/codec"
 	pb "github.com/pleb/prod/horrea/pb"
 
 	"github.com/golang/protobuf/ptypes/empty"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
-	"fmt"
+	"context"
+	"errors"
 	"io"
 	"log"
+	"time"
 )
 
+// largest page of blobs returned by ListContent.
+const maxPageSize = 1000
+
 // shared PUT API, with streamed input and type specified by request.
+// Chunks are validated, decompressed if need be, and written straight
+// through to the backend as they arrive. Invalid streams are aborted
+// before anything is persisted.
 func (srv *server) PutContent(stream pb.Horrea_PutContentServer) error {
 	// initial message provides message attributes
-	in, err := stream.Recv()
+	up, err := startUpload(stream.Recv())
 	if err != nil {
+		log.Printf("Rejected PUT request, %v", err)
 		return err
 	}
-	info := in.GetInfo()
-
-	// create buffer of specified size.
-	writeBlob := blob.CreateBlob(info)
 
-	// pass stream to type-specific PUT
-	log.Printf("Request to put BLOB %s", writeBlob.ToString())
+	// open a pending write against the backend
+	log.Printf("Request to put BLOB %s", blob.InfoString(up.info))
+	writer, err := blob.CreateBlobWriter(up.info)
+	if err != nil {
+		log.Printf("Unable to start write, %v", err)
+		return statusError(err)
+	}
+	content, err := up.content(stream)
+	if err != nil {
+		log.Printf("Rejected PUT stream, %v", err)
+		writer.Abort()
+		return err
+	}
 
+	buffer := make([]byte, cfg.ChunkSizeKiB*1024)
 	for {
 		// receive additional content from client stream
-		in, err = stream.Recv()
+		n, err := content.Read(buffer)
+		if n > 0 {
+			// pass validated content through to the backend
+			if _, err := writer.Write(buffer[:n]); err != nil {
+				log.Printf("Unable to persist received content, %v", err)
+				writer.Abort()
+				return statusError(err)
+			}
+		}
 		if err == io.EOF {
 			break // client done sending
 		} else if err != nil {
-			log.Printf("Error receiving from client, %v", err)
+			log.Printf("Rejected PUT stream, %v", err)
+			writer.Abort()
 			return err
 		}
-		// append content to internal buffer
-		err = writeBlob.AppendChunk(in.GetChunk().Data)
-		if err != nil {
-			panic(err) // should never overfill buffer
-		}
 	}
 
-	// file we write cannot be empty (for now)
-	if writeBlob.GetSize() != writeBlob.GetCapacity() {
-		fmt.Errorf("expected file %d bytes, is %d bytes",
-			writeBlob.GetCapacity(), writeBlob.GetSize())
+	// a short stream is never persisted
+	if err = up.finish(); err != nil {
+		log.Printf("Rejected PUT stream, %v", err)
+		writer.Abort()
+		return err
 	}
 
-	// push Blob to persistent storage
-	err = writeBlob.WriteContent()
+	// make the content visible to readers, if the digest matches
+	err = writer.Commit()
 	if err != nil {
 		log.Printf("Unable to persist received content, %v", err)
-		return err
+		return statusError(err)
 	}
-	stream.SendAndClose(&empty.Empty{})
-
-	return nil
+	return stream.SendAndClose(&empty.Empty{})
 }
 
 // shared GET API, with streamed output and type-specified request.
+// Content is read from the backend one chunk at a time, starting at
+// the requested offset, and compressed with the first encoding the
+// client accepts that the server supports.
 func (srv *server) GetContent(in *pb.GetContentReq, stream pb.Horrea_GetContentServer) error {
-	// create buffer of specified size.
-	readBlob := blob.CreateBlob(in.Info)
-	readBlob.SetReadOnly() // GET is readonly
+	log.Printf("Request to get BLOB %s, range [%d, +%d]",
+		blob.InfoString(in.Info), in.Offset, in.Length)
+	if in.Offset < 0 || in.Length < 0 {
+		return status.Errorf(codes.InvalidArgument,
+			"invalid range [%d, +%d]", in.Offset, in.Length)
+	}
+	reader, err := blob.CreateVersionReader(in.Info, in.Version, in.Offset, in.Length)
+	if err != nil {
+		return statusError(err)
+	}
+	defer reader.Close()
 
-	// pass stream to type-specific GET
-	log.Printf("Request to get BLOB %s", readBlob.ToString())
-	err := readBlob.ReadContent()
+	// compress into chunk-sized messages
+	output := &chunkWriter{
+		stream:      stream,
+		compression: chooseCompression(in.Accept),
+		buffer:      make([]byte, 0, cfg.ChunkSizeKiB*1024),
+	}
+	encoder, err := codec.NewWriter(codecName(output.compression), output)
 	if err != nil {
-		return err
+		return statusError(err)
 	}
 
 	// push retrieved data to output
-	iter := blob.CreateBlobIterator(cfg.ChunkSizeKiB, 0)
+	buffer := make([]byte, cfg.ChunkSizeKiB*1024)
 	for {
-		// pop additional chunk from blob
-		dataout, err := readBlob.PopChunk(iter)
-		if err != nil {
+		// read the next chunk from the backend
+		n, err := io.ReadFull(reader, buffer)
+		if n > 0 {
+			// send next data chunk to client
+			if _, err := encoder.Write(buffer[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
 			break
+		} else if err != nil {
+			log.Printf("Unable to read persisted content, %v", err)
+			return statusError(err)
 		}
-		// send next data chunk to client
-		if err := stream.Send(&pb.Chunk{Data: dataout}); err != nil {
-			return err
+	}
+
+	if err = encoder.Close(); err != nil {
+		return err
+	}
+	return output.flush()
+}
+
+// pick the first accepted compression the server supports.
+func chooseCompression(accept []pb.Compression) pb.Compression {
+	for _, compression := range accept {
+		if codec.Supported(codecName(compression)) {
+			return compression
 		}
 	}
+	return pb.Compression_None
+}
 
+// client stream receiving chunks.
+type chunkSender interface {
+	Send(*pb.Chunk) error
+}
+
+// writer sending GET or export output as chunk-sized messages. The
+// first message names the compression of the stream.
+type chunkWriter struct {
+	stream      chunkSender    // client stream.
+	compression pb.Compression // encoding of the stream.
+	buffer      []byte         // data not yet sent.
+	sent        bool           // first chunk sent?
+}
+
+func (writer *chunkWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		n := copy(writer.buffer[len(writer.buffer):cap(writer.buffer)], data)
+		writer.buffer = writer.buffer[:len(writer.buffer)+n]
+		data = data[n:]
+		written += n
+		if len(writer.buffer) == cap(writer.buffer) {
+			if err := writer.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// send any buffered data as a chunk.
+func (writer *chunkWriter) flush() error {
+	if len(writer.buffer) == 0 {
+		return nil
+	}
+	chunk := &pb.Chunk{Data: writer.buffer}
+	if !writer.sent {
+		chunk.Compression = writer.compression
+		writer.sent = true
+	}
+	if err := writer.stream.Send(chunk); err != nil {
+		return err
+	}
+	// a sent message may still be referenced, so don't reuse it
+	writer.buffer = make([]byte, 0, cap(writer.buffer))
 	return nil
 }
+
+// remove a stored blob.
+func (srv *server) DeleteContent(ctx context.Context, in *pb.DeleteContentReq) (*empty.Empty, error) {
+	log.Printf("Request to delete BLOB %s", blob.InfoString(in.Info))
+	if err := blob.DeleteBlob(in.Info); err != nil {
+		return nil, statusError(err)
+	}
+	return &empty.Empty{}, nil
+}
+
+// copy a stored blob to another key without streaming it.
+func (srv *server) CopyContent(ctx context.Context, in *pb.CopyContentReq) (*empty.Empty, error) {
+	log.Printf("Request to copy BLOB %s to %s", blob.InfoString(in.Source), blob.InfoString(in.Dest))
+	if err := blob.CopyBlob(in.Source, in.Dest, in.Version); err != nil {
+		return nil, statusError(err)
+	}
+	return &empty.Empty{}, nil
+}
+
+// streamed write of a byte range into a stored blob, kept as a
+// delta over its content until compacted.
+func (srv *server) PatchContent(stream pb.Horrea_PatchContentServer) error {
+	in, err := stream.Recv()
+	if err == io.EOF {
+		return status.Error(codes.InvalidArgument,
+			"empty stream, expected patch header")
+	} else if err != nil {
+		return err
+	}
+	header := in.GetHeader()
+	if header == nil {
+		return status.Error(codes.InvalidArgument,
+			"first message must carry patch header")
+	}
+	log.Printf("Request to patch BLOB %s at %d", blob.InfoString(header.Info), header.Offset)
+	writer, err := blob.CreatePatchWriter(header.Info, header.Offset)
+	if err != nil {
+		return statusError(err)
+	}
+
+	end := header.Offset
+	for {
+		in, err := stream.Recv()
+		if err == io.EOF {
+			break // client done sending
+		} else if err != nil {
+			writer.Abort()
+			return err
+		}
+		chunk := in.GetChunk()
+		if chunk == nil {
+			writer.Abort()
+			return status.Error(codes.InvalidArgument,
+				"expected data chunk, patch header already sent")
+		}
+		end += int64(len(chunk.Data))
+		if end > maxBlobSize() {
+			writer.Abort()
+			return status.Errorf(codes.InvalidArgument,
+				"patched blob exceeds limit of %d bytes", maxBlobSize())
+		}
+		if _, err = writer.Write(chunk.Data); err != nil {
+			log.Printf("Unable to persist received patch, %v", err)
+			writer.Abort()
+			return statusError(err)
+		}
+	}
+	if err = writer.Commit(); err != nil {
+		log.Printf("Unable to persist received patch, %v", err)
+		return statusError(err)
+	}
+	return stream.SendAndClose(&empty.Empty{})
+}
+
+// describe a stored blob without reading its content.
+func (srv *server) StatContent(ctx context.Context, in *pb.StatContentReq) (*pb.StatContentResp, error) {
+	stat, err := blob.StatBlob(in.Info)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	resp := &pb.StatContentResp{
+		Info: &pb.BlobInfo{
+			BlobType: in.GetInfo().GetBlobType(),
+			Size:     stat.Size,
+			Major:    in.GetInfo().GetMajor(),
+			Minor:    in.GetInfo().GetMinor(),
+			Digest:   stat.Digest,
+		},
+		ModTime: timestamppb.New(stat.ModTime),
+		Version: stat.Version,
+	}
+	if !stat.HeldUntil.IsZero() {
+		resp.RetainUntil = timestamppb.New(stat.HeldUntil)
+	}
+	return resp, nil
+}
+
+// list stored blobs a page at a time.
+func (srv *server) ListContent(ctx context.Context, in *pb.ListContentReq) (*pb.ListContentResp, error) {
+	if in.PageSize < 0 || in.PageSize > maxPageSize {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"page size must be between 0 and %d", maxPageSize)
+	}
+	blobs, next, err := blob.ListBlobs(in.Major, in.PageToken, int(in.PageSize))
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &pb.ListContentResp{Blobs: blobs, NextPageToken: next}, nil
+}
+
+// list the stored versions of a blob, newest first.
+func (srv *server) ListVersions(ctx context.Context, in *pb.ListVersionsReq) (*pb.ListVersionsResp, error) {
+	versions, err := blob.ListVersions(in.Info)
+	if err != nil {
+		return nil, statusError(err)
+	} else if len(versions) == 0 {
+		return nil, status.Errorf(codes.NotFound,
+			"no versions of %s", blob.InfoString(in.Info))
+	}
+	resp := &pb.ListVersionsResp{}
+	for _, version := range versions {
+		resp.Versions = append(resp.Versions, &pb.VersionInfo{
+			Version: version.Version,
+			Size:    version.Size,
+			ModTime: timestamppb.New(version.ModTime),
+			Current: version.Current,
+		})
+	}
+	return resp, nil
+}
+
+// report the results of the last integrity scrub.
+func (srv *server) ScrubReport(ctx context.Context, in *pb.ScrubReportReq) (*pb.ScrubReportResp, error) {
+	report, err := blob.LastScrub()
+	if errors.Is(err, blob.ErrNoExist) {
+		return nil, status.Error(codes.NotFound, "no scrub has finished yet")
+	} else if err != nil {
+		return nil, statusError(err)
+	}
+	resp := &pb.ScrubReportResp{
+		StartTime:  timestamppb.New(report.Started),
+		FinishTime: timestamppb.New(report.Finished),
+		Blobs:      report.Blobs,
+		Bytes:      report.Bytes,
+	}
+	for _, finding := range report.Findings {
+		resp.Findings = append(resp.Findings, &pb.ScrubFinding{
+			Major:       finding.Key.Major,
+			Minor:       finding.Key.Minor,
+			BlobType:    finding.Key.BlobType,
+			Version:     finding.Version,
+			Error:       finding.Error,
+			Quarantined: finding.Quarantined,
+		})
+	}
+	return resp, nil
+}
+
+// start a resumable upload session.
+func (srv *server) BeginUpload(ctx context.Context, in *pb.BeginUploadReq) (*pb.BeginUploadResp, error) {
+	if in.Info == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing blob info")
+	} else if err := validateInfo(in.Info); err != nil {
+		return nil, err
+	}
+	id, expires, err := blob.BeginUpload(in.Info, uploadTTL())
+	if err != nil {
+		return nil, statusError(err)
+	}
+	log.Printf("Started upload %s of BLOB %s", id, blob.InfoString(in.Info))
+	return &pb.BeginUploadResp{
+		UploadId:   id,
+		ExpireTime: timestamppb.New(expires),
+	}, nil
+}
+
+// receive one part of an upload session. The part replaces any
+// earlier copy only once all of it has arrived.
+func (srv *server) UploadPart(stream pb.Horrea_UploadPartServer) error {
+	in, err := stream.Recv()
+	if err == io.EOF {
+		return status.Error(codes.InvalidArgument,
+			"empty stream, expected part header")
+	} else if err != nil {
+		return err
+	}
+	header := in.GetHeader()
+	if header == nil {
+		return status.Error(codes.InvalidArgument,
+			"first message must carry part header")
+	}
+	writer, err := blob.CreatePartWriter(header.UploadId, header.PartNumber)
+	if err != nil {
+		return statusError(err)
+	}
+
+	var size int64
+	for {
+		in, err := stream.Recv()
+		if err == io.EOF {
+			break // client done sending
+		} else if err != nil {
+			writer.Abort()
+			return err
+		}
+		chunk := in.GetChunk()
+		if chunk == nil {
+			writer.Abort()
+			return status.Error(codes.InvalidArgument,
+				"expected data chunk, part header already sent")
+		}
+		size += int64(len(chunk.Data))
+		if size > maxBlobSize() {
+			writer.Abort()
+			return status.Errorf(codes.InvalidArgument,
+				"part exceeds limit of %d bytes", maxBlobSize())
+		}
+		if _, err = writer.Write(chunk.Data); err != nil {
+			log.Printf("Unable to persist received part, %v", err)
+			writer.Abort()
+			return statusError(err)
+		}
+	}
+	if err = writer.Commit(); err != nil {
+		log.Printf("Unable to persist received part, %v", err)
+		return statusError(err)
+	}
+	return stream.SendAndClose(&pb.PartInfo{PartNumber: header.PartNumber, Size: size})
+}
+
+// list the parts an upload session has received.
+func (srv *server) ListParts(ctx context.Context, in *pb.ListPartsReq) (*pb.ListPartsResp, error) {
+	info, parts, err := blob.ListParts(in.UploadId)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	resp := &pb.ListPartsResp{Info: info}
+	for _, part := range parts {
+		resp.Parts = append(resp.Parts, &pb.PartInfo{PartNumber: part.Number, Size: part.Size})
+	}
+	return resp, nil
+}
+
+// assemble an upload session's parts into its blob.
+func (srv *server) CommitUpload(ctx context.Context, in *pb.CommitUploadReq) (*empty.Empty, error) {
+	log.Printf("Request to commit upload %s", in.UploadId)
+	if err := blob.CommitUpload(in.UploadId); err != nil {
+		log.Printf("Unable to commit upload, %v", err)
+		return nil, statusError(err)
+	}
+	return &empty.Empty{}, nil
+}
+
+// discard an upload session and its parts.
+func (srv *server) AbortUpload(ctx context.Context, in *pb.AbortUploadReq) (*empty.Empty, error) {
+	log.Printf("Request to abort upload %s", in.UploadId)
+	if err := blob.AbortUpload(in.UploadId); err != nil {
+		return nil, statusError(err)
+	}
+	return &empty.Empty{}, nil
+}
+
+// stream a tar archive of stored blobs, written since a given time
+// if one is set, compressed as for GET.
+func (srv *server) ExportContent(in *pb.ExportContentReq, stream pb.Horrea_ExportContentServer) error {
+	var since time.Time
+	if in.Since != nil {
+		if err := in.Since.CheckValid(); err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid since time, %v", err)
+		}
+		since = in.Since.AsTime()
+	}
+	log.Printf("Request to export major key %q since %s", in.Major, since)
+	output := &chunkWriter{
+		stream:      stream,
+		compression: chooseCompression(in.Accept),
+		buffer:      make([]byte, 0, cfg.ChunkSizeKiB*1024),
+	}
+	encoder, err := codec.NewWriter(codecName(output.compression), output)
+	if err != nil {
+		return statusError(err)
+	}
+	stats, err := blob.ExportBlobs(encoder, in.Major, since)
+	if err != nil {
+		log.Printf("Unable to export content, %v", err)
+		if _, ok := status.FromError(err); ok {
+			return err // client stream failed
+		}
+		return statusError(err)
+	}
+	if err = encoder.Close(); err != nil {
+		return err
+	}
+	log.Printf("Exported %d blobs, %d bytes", stats.Blobs, stats.Bytes)
+	return output.flush()
+}
+
+// restore blobs from a streamed archive written by ExportContent.
+// Each blob is verified before it replaces any at its key, and blobs
+// restored before a failure stay.
+func (srv *server) ImportContent(stream pb.Horrea_ImportContentServer) error {
+	first, err := stream.Recv()
+	if err == io.EOF {
+		return status.Error(codes.InvalidArgument,
+			"empty stream, expected archive")
+	} else if err != nil {
+		return err
+	} else if !codec.Supported(codecName(first.Compression)) {
+		return status.Errorf(codes.Unimplemented,
+			"unsupported compression %s", first.Compression)
+	}
+	log.Printf("Request to import archive")
+	chunks := &archiveReader{stream: stream, pending: first.Data}
+	decoder, err := codec.NewReader(codecName(first.Compression), chunks)
+	if err == nil {
+		var stats *blob.ArchiveStats
+		if stats, err = blob.ImportBlobs(decoder); err == nil {
+			log.Printf("Imported %d blobs, %d bytes", stats.Blobs, stats.Bytes)
+			return stream.SendAndClose(&pb.ImportContentResp{Blobs: stats.Blobs, Bytes: stats.Bytes})
+		}
+	}
+	log.Printf("Unable to import archive, %v", err)
+	if chunks.err != nil {
+		return chunks.err // client stream failed
+	} else if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return status.Errorf(codes.InvalidArgument, "truncated archive, %v", err)
+	}
+	return statusError(err)
+}
+
+// reader over the data of an import stream's chunks.
+type archiveReader struct {
+	stream  pb.Horrea_ImportContentServer // client stream.
+	pending []byte                        // data not yet returned.
+	err     error                         // stream failure, if any.
+}
+
+func (reader *archiveReader) Read(data []byte) (int, error) {
+	for len(reader.pending) == 0 {
+		in, err := reader.stream.Recv()
+		if err == io.EOF {
+			return 0, err // client done sending
+		} else if err != nil {
+			reader.err = err
+			return 0, err
+		}
+		reader.pending = in.Data
+	}
+	n := copy(data, reader.pending)
+	reader.pending = reader.pending[n:]
+	return n, nil
+}
+
+// map blob package errors onto gRPC status codes.
+func statusError(err error) error {
+	switch {
+	case errors.Is(err, blob.ErrNoExist), errors.Is(err, blob.ErrNoUpload):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, blob.ErrRange):
+		return status.Error(codes.OutOfRange, err.Error())
+	case errors.Is(err, blob.ErrCorrupt), errors.Is(err, blob.ErrDigest):
+		return status.Error(codes.DataLoss, err.Error())
+	case errors.Is(err, blob.ErrPageToken), errors.Is(err, blob.ErrPartNumber),
+		errors.Is(err, blob.ErrKey), errors.Is(err, blob.ErrArchive):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, blob.ErrIncomplete), errors.Is(err, blob.ErrNoKey),
+		errors.Is(err, blob.ErrHeld):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, blob.ErrNotSupp):
+		return status.Error(codes.Unimplemented, err.Error())
+	case errors.Is(err, blob.ErrQuorum):
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
@@ -6,27 +6,60 @@ package main
 
 import (
 	"github.com/pleb/prod/horrea/main/blob"
+	"github.com/pleb/prod/horrea/main/blob/fakes3"
 	pb "github.com/pleb/prod/horrea/pb"
 
 	"github.com/pleb/prod/common/config"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"log"
 	"math/rand"
 	"net"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 )
 
-// setup the unit test. unit tests hardset to local mode
-func setupTest() error {
+// setup the unit test against the named blob backend. The
+// object store backend runs against the given fake server.
+func setupTest(backend string, fake *fakes3.Server) error {
 	config.LoadConfig(&cfg, cfgPrefix)
-	err := blob.ConfigureBackend(true, "/tmp/horrea-test")
+	rules := []blob.LifecycleRule{}
+	if cfg.LifecycleFile != "" {
+		var err error
+		if rules, err = blob.LoadLifecycleFile(cfg.LifecycleFile); err != nil {
+			log.Fatalf("failed to load lifecycle rules: %v", err)
+		}
+	}
+	err := blob.ConfigureBackend(backend, &blob.Config{
+		LocalDirectory: "/tmp/horrea-test",
+		ReplicaDirs:    []string{"/tmp/horrea-r0", "/tmp/horrea-r1", "/tmp/horrea-r2"},
+		ShardDirs:      []string{"/tmp/horrea-s0", "/tmp/horrea-s1", "/tmp/horrea-s2"},
+		ParityShards:   1,
+		HotDir:         "/tmp/horrea-hot",
+		ColdBackend:    blob.LocalBackend,
+		ColdDir:        "/tmp/horrea-cold",
+		S3Endpoint:     fake.URL,
+		S3Bucket:       "horrea-test",
+		S3PathStyle:    true,
+		Versioning:     cfg.Versioning,
+		Lifecycle:      rules,
+	})
 	if err != nil {
 		log.Fatalf("failed to configure backend: %v", err)
 	}
@@ -34,38 +67,83 @@ func setupTest() error {
 }
 
 // returns closure function to run server with given listener
-func runServer(listener *bufconn.Listener) {
-            // start test server on provided listener
-		srv = grpc.NewServer()
-		pb.RegisterHorreaServer(srv, &server{})
-		if err := srv.Serve(listener); err != nil {
-			log.Fatalf("failed to serve: %v", err)
-		}
+func runServer(listener net.Listener) {
+	// start test server on provided listener
+	srv = grpc.NewServer(serverOptions()...)
+	pb.RegisterHorreaServer(srv, &server{})
+	if err := srv.Serve(listener); err != nil {
+		log.Fatalf("failed to serve: %v", err)
+	}
 }
 
 // returns closure function to shutdown server on given listener
-func createCloserFunc(listener *bufconn.Listener) func() {
+func createCloserFunc(listener *bufconn.Listener, fake *fakes3.Server) func() {
 	return func() {
 		if err := listener.Close(); err != nil {
 			log.Fatalf("error closing listener: %v", err)
 		}
 		srv.Stop()
+		fake.Close()
+	}
+}
+
+// buffered network listener giving each connection its own peer
+// address, as if every client connection came from its own host
+type peerListener struct {
+	*bufconn.Listener
+	mu    sync.Mutex
+	peers int
+}
+
+// buffered network connection from a given peer address
+type peerConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (listener *peerListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
 	}
+	listener.mu.Lock()
+	listener.peers++
+	remote := &net.TCPAddr{IP: net.IPv4(10, 0, 0, byte(listener.peers)), Port: 40000}
+	listener.mu.Unlock()
+	return &peerConn{conn, remote}, nil
+}
+
+func (conn *peerConn) RemoteAddr() net.Addr {
+	return conn.remote
 }
 
 // start a test server and return a client + server stop function
-func startTestServer(ctx context.Context) (pb.HorreaClient, func()) {
-        // setup backend and config for test
-        if err := setupTest() ; err != nil {
-            log.Fatalf("could not setup test: %v", err)
-        }
+func startTestServer(ctx context.Context, backend string) (pb.HorreaClient, func()) {
+	client, _, closer := startPeerTestServer(ctx, backend)
+	return client, closer
+}
 
-        // run server against buffered network listener
+// start a test server and return a client, a function dialing
+// further clients from other peers + server stop function
+func startPeerTestServer(ctx context.Context, backend string) (pb.HorreaClient, func() pb.HorreaClient, func()) {
+	// setup backend and config for test
+	fake := fakes3.NewServer()
+	if err := setupTest(backend, fake); err != nil {
+		log.Fatalf("could not setup test: %v", err)
+	}
+
+	// run server against buffered network listener
 	bufsize := 10 * 1024 * 1024
-        listener := bufconn.Listen(bufsize)
-        go runServer(listener)
+	listener := &peerListener{Listener: bufconn.Listen(bufsize)}
+	go runServer(listener)
+	dial := func() pb.HorreaClient {
+		return dialTestServer(ctx, listener.Listener)
+	}
+	return dial(), dial, createCloserFunc(listener.Listener, fake)
+}
 
-	// dial local buffered network context
+// dial a test server over its buffered network listener
+func dialTestServer(ctx context.Context, listener *bufconn.Listener) pb.HorreaClient {
 	conn, err := grpc.DialContext(ctx,
 		"",
 		grpc.WithContextDialer(
@@ -77,9 +155,20 @@ func startTestServer(ctx context.Context) (pb.HorreaClient, func()) {
 	if err != nil {
 		log.Fatalf("error connecting to server: %v", err)
 	}
-	client := pb.NewHorreaClient(conn)
+	return pb.NewHorreaClient(conn)
+}
 
-	return client, createCloserFunc(listener)
+// run a test against a fresh server for every registered backend
+func runForEachBackend(t *testing.T,
+	test func(t *testing.T, ctx context.Context, client pb.HorreaClient)) {
+	for _, backend := range blob.Backends() {
+		t.Run(backend, func(t *testing.T) {
+			ctx := context.Background()
+			client, closer := startTestServer(ctx, backend)
+			defer closer()
+			test(t, ctx, client)
+		})
+	}
 }
 
 // make a data blob for test purposes
@@ -103,36 +192,36 @@ func makeTestBlob(size, major, minor int) *blob.Blob {
 	return testblob
 }
 
-// just test server startup logic, but don't submit client calls
-func TestHorreaServerStartup(t *testing.T) {
-	ctx := context.Background()
-	_, closer := startTestServer(ctx)
-	defer closer()
+// utility function to check that two byte arrays are equal
+func checkBytesEqual(b1, b2 []byte) error {
+	if len(b1) != len(b2) {
+		return fmt.Errorf("byte arrays different sizes, %d != %d", len(b1), len(b2))
+	}
+	for i := range b1 {
+		if b1[i] != b2[i] {
+			return fmt.Errorf("byte %d not equal, %x != %x", i, b1[i], b2[i])
+		}
+	}
+	return nil
 }
 
-// test basic server write and readback
-func TestHorreaServerBasic(t *testing.T) {
-	ctx := context.Background()
-
-	client, closer := startTestServer(ctx)
-	defer closer()
-
-	// clients will have their own data iterators, but we
-	// can use the internal blob package for internal testing
-	size, chunksize := 1024*1024, 64*1024
-	writeblob := makeTestBlob(size, rand.Int(), rand.Int())
-
+// stream a test blob to the server in chunks of the given size
+func putTestBlob(ctx context.Context, client pb.HorreaClient,
+	writeblob *blob.Blob, chunksize int) error {
 	// create the client stream
 	wstream, err := client.PutContent(ctx)
 	if err != nil {
-		t.Fatalf("could not create client context, %v", err)
+		return err
 	}
 	// send the initial PUT request with metadata
-	wstream.Send(&pb.PutContentReq{
+	err = wstream.Send(&pb.PutContentReq{
 		Input: &pb.PutContentReq_Info{
 			Info: writeblob.GetBlobInfo(),
 		},
 	})
+	if err != nil {
+		return err
+	}
 
 	// stream the data to the server
 	iter := blob.CreateBlobIterator(chunksize, 0)
@@ -147,29 +236,94 @@ func TestHorreaServerBasic(t *testing.T) {
 			},
 		})
 		if err != nil {
-			t.Fatalf("could not send data chunk, %v", err)
+			return err
 		}
 	}
 
 	// close the stream and finalize PUT
 	_, err = wstream.CloseAndRecv()
+	return err
+}
+
+// read a blob back from the server into a single buffer
+func getTestBlob(ctx context.Context, client pb.HorreaClient,
+	info *pb.BlobInfo) ([]byte, error) {
+	return getTestRange(ctx, client, info, 0, 0)
+}
+
+// read a byte range of a blob back from the server
+func getTestRange(ctx context.Context, client pb.HorreaClient,
+	info *pb.BlobInfo, offset, length int64) ([]byte, error) {
+	rstream, err := client.GetContent(ctx, &pb.GetContentReq{
+		Info:   info,
+		Offset: offset,
+		Length: length,
+	})
 	if err != nil {
+		return nil, err
+	}
+	readbuf := []byte{}
+	for {
+		in, err := rstream.Recv()
+		if err == io.EOF {
+			return readbuf, nil
+		} else if err != nil {
+			return nil, err
+		}
+		readbuf = append(readbuf, in.Data...)
+	}
+}
+
+// just test server startup logic, but don't submit client calls
+func TestHorreaServerStartup(t *testing.T) {
+	runForEachBackend(t, func(*testing.T, context.Context, pb.HorreaClient) {})
+}
+
+// test basic server write and readback
+func TestHorreaServerBasic(t *testing.T) {
+	runForEachBackend(t, testHorreaServerBasic)
+}
+
+func testHorreaServerBasic(t *testing.T, ctx context.Context, client pb.HorreaClient) {
+	// clients will have their own data iterators, but we
+	// can use the internal blob package for internal testing
+	size, chunksize := 1024*1024, 64*1024
+	writeblob := makeTestBlob(size, rand.Int(), rand.Int())
+	if err := putTestBlob(ctx, client, writeblob, chunksize); err != nil {
 		t.Fatalf("data could not be persisted, %v", err)
 	}
 
 	// read data back from the server and compare
-	rstream, err := client.GetContent(
-		ctx,
-		&pb.GetContentReq{
-			Info: writeblob.GetBlobInfo(),
-		},
-	)
+	readbuf, err := getTestBlob(ctx, client, writeblob.GetBlobInfo())
 	if err != nil {
-		t.Fatalf("could not create read client context, %v", err)
+		t.Fatalf("could not read data back, %v", err)
+	}
+	if err = checkBytesEqual(readbuf, writeblob.GetBuffer()); err != nil {
+		t.Fatalf("data not read back correctly, %v", err)
+	}
+}
+
+// test that GET streams large blobs in configured chunk sizes
+func TestHorreaServerChunking(t *testing.T) {
+	runForEachBackend(t, testHorreaServerChunking)
+}
+
+func testHorreaServerChunking(t *testing.T, ctx context.Context, client pb.HorreaClient) {
+	// several chunks, with a short final chunk
+	chunksize := cfg.ChunkSizeKiB * 1024
+	size := 6*chunksize + 1000
+	writeblob := makeTestBlob(size, rand.Int(), rand.Int())
+	if err := putTestBlob(ctx, client, writeblob, 7*1024); err != nil {
+		t.Fatalf("data could not be persisted, %v", err)
 	}
 
-	// create a readblob to hold the data and stream from server
-	readblob := blob.CreateBlob(writeblob.GetBlobInfo())
+	rstream, err := client.GetContent(ctx,
+		&pb.GetContentReq{Info: writeblob.GetBlobInfo()})
+	if err != nil {
+		t.Fatalf("could not create read client context, %v", err)
+	}
+	chunks := 0
+	readbuf := []byte{}
 	for {
 		in, err := rstream.Recv()
 		if err == io.EOF {
@@ -177,19 +331,893 @@ func TestHorreaServerBasic(t *testing.T) {
 		} else if err != nil {
 			t.Fatalf("error receiving from server, %v", err)
 		}
-		readblob.AppendChunk(in.Data)
+		if len(in.Data) > chunksize {
+			t.Fatalf("chunk of %d bytes exceeds chunk size %d",
+				len(in.Data), chunksize)
+		}
+		chunks++
+		readbuf = append(readbuf, in.Data...)
+	}
+	if chunks != 7 {
+		t.Fatalf("expected 7 chunks, received %d", chunks)
+	}
+	if err = checkBytesEqual(readbuf, writeblob.GetBuffer()); err != nil {
+		t.Fatalf("data not read back correctly, %v", err)
+	}
+}
+
+// test ranged GET requests, including invalid ranges
+func TestHorreaServerRangedGet(t *testing.T) {
+	runForEachBackend(t, testHorreaServerRangedGet)
+}
+
+func testHorreaServerRangedGet(t *testing.T, ctx context.Context, client pb.HorreaClient) {
+	size := 256 * 1024
+	writeblob := makeTestBlob(size, rand.Int(), rand.Int())
+	if err := putTestBlob(ctx, client, writeblob, 64*1024); err != nil {
+		t.Fatalf("data could not be persisted, %v", err)
+	}
+	info, writebuf := writeblob.GetBlobInfo(), writeblob.GetBuffer()
+
+	// a single FUSE-sized read in the middle of the blob
+	readbuf, err := getTestRange(ctx, client, info, 100*1024, 4096)
+	if err != nil {
+		t.Fatalf("could not read range, %v", err)
+	}
+	if err = checkBytesEqual(readbuf, writebuf[100*1024:104*1024]); err != nil {
+		t.Fatalf("range not read back correctly, %v", err)
+	}
+
+	// a read running off the end is truncated
+	readbuf, err = getTestRange(ctx, client, info, int64(size-100), 4096)
+	if err != nil {
+		t.Fatalf("could not read range, %v", err)
+	}
+	if err = checkBytesEqual(readbuf, writebuf[size-100:]); err != nil {
+		t.Fatalf("tail range not read back correctly, %v", err)
+	}
+
+	// invalid ranges and missing blobs return matching codes
+	_, err = getTestRange(ctx, client, info, int64(size+1), 0)
+	if status.Code(err) != codes.OutOfRange {
+		t.Fatalf("expected OutOfRange, got %v", err)
+	}
+	_, err = getTestRange(ctx, client, info, -1, 0)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument, got %v", err)
+	}
+	missing := makeTestBlob(16, rand.Int(), rand.Int()).GetBlobInfo()
+	_, err = getTestBlob(ctx, client, missing)
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound, got %v", err)
+	}
+}
+
+// test that PUT checks client digests end to end
+func TestHorreaServerDigest(t *testing.T) {
+	runForEachBackend(t, testHorreaServerDigest)
+}
+
+func testHorreaServerDigest(t *testing.T, ctx context.Context, client pb.HorreaClient) {
+	size := 200 * 1024
+	writeblob := makeTestBlob(size, rand.Int(), rand.Int())
+	digest := sha256.Sum256(writeblob.GetBuffer())
+	info := writeblob.GetBlobInfo()
+
+	// a digest that doesn't match the stream is rejected
+	info.Digest = make([]byte, sha256.Size)
+	err := putTestBlob(ctx, client, writeblob, 64*1024)
+	if status.Code(err) != codes.DataLoss {
+		t.Fatalf("expected DataLoss for bad digest, got %v", err)
+	}
+	if _, err = getTestBlob(ctx, client, info); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound after rejected PUT, got %v", err)
+	}
+
+	// the correct digest is accepted and content reads back
+	info.Digest = digest[:]
+	if err = putTestBlob(ctx, client, writeblob, 64*1024); err != nil {
+		t.Fatalf("data could not be persisted, %v", err)
+	}
+	readbuf, err := getTestBlob(ctx, client, info)
+	if err != nil {
+		t.Fatalf("could not read data back, %v", err)
+	}
+	if err = checkBytesEqual(readbuf, writeblob.GetBuffer()); err != nil {
+		t.Fatalf("data not read back correctly, %v", err)
+	}
+}
+
+// send a raw sequence of PUT messages and return the result
+func sendRawPut(ctx context.Context, client pb.HorreaClient,
+	msgs []*pb.PutContentReq) error {
+	wstream, err := client.PutContent(ctx)
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		// the server may reject the stream before all messages
+		// are sent, which surfaces as io.EOF on Send
+		if err = wstream.Send(msg); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	_, err = wstream.CloseAndRecv()
+	return err
+}
+
+// test that each kind of malformed PUT stream is rejected with
+// the matching code, and that nothing is persisted
+func TestHorreaServerMalformedPut(t *testing.T) {
+	runForEachBackend(t, testHorreaServerMalformedPut)
+}
+
+func testHorreaServerMalformedPut(t *testing.T, ctx context.Context, client pb.HorreaClient) {
+	infoMsg := func(info *pb.BlobInfo) *pb.PutContentReq {
+		return &pb.PutContentReq{Input: &pb.PutContentReq_Info{Info: info}}
+	}
+	chunkMsg := func(size int) *pb.PutContentReq {
+		return &pb.PutContentReq{Input: &pb.PutContentReq_Chunk{
+			Chunk: &pb.Chunk{Data: make([]byte, size)},
+		}}
+	}
+	newInfo := func(size int64) *pb.BlobInfo {
+		return &pb.BlobInfo{
+			Size:  size,
+			Major: fmt.Sprintf("%d", rand.Int()),
+			Minor: fmt.Sprintf("%d", rand.Int()),
+		}
+	}
+
+	cases := []struct {
+		name string
+		info *pb.BlobInfo
+		msgs func(info *pb.BlobInfo) []*pb.PutContentReq
+		code codes.Code
+	}{
+		{"empty stream", newInfo(1024), func(*pb.BlobInfo) []*pb.PutContentReq {
+			return nil
+		}, codes.InvalidArgument},
+		{"missing info", newInfo(1024), func(*pb.BlobInfo) []*pb.PutContentReq {
+			return []*pb.PutContentReq{chunkMsg(1024)}
+		}, codes.InvalidArgument},
+		{"missing keys", &pb.BlobInfo{Size: 1024}, func(info *pb.BlobInfo) []*pb.PutContentReq {
+			return []*pb.PutContentReq{infoMsg(info), chunkMsg(1024)}
+		}, codes.InvalidArgument},
+		{"negative size", newInfo(-1), func(info *pb.BlobInfo) []*pb.PutContentReq {
+			return []*pb.PutContentReq{infoMsg(info)}
+		}, codes.InvalidArgument},
+		{"oversized", newInfo(maxBlobSize() + 1), func(info *pb.BlobInfo) []*pb.PutContentReq {
+			return []*pb.PutContentReq{infoMsg(info), chunkMsg(1024)}
+		}, codes.InvalidArgument},
+		{"repeated info", newInfo(1024), func(info *pb.BlobInfo) []*pb.PutContentReq {
+			return []*pb.PutContentReq{infoMsg(info), chunkMsg(512), infoMsg(info)}
+		}, codes.InvalidArgument},
+		{"overflow", newInfo(1024), func(info *pb.BlobInfo) []*pb.PutContentReq {
+			return []*pb.PutContentReq{infoMsg(info), chunkMsg(1000), chunkMsg(1000)}
+		}, codes.InvalidArgument},
+		{"short stream", newInfo(1024), func(info *pb.BlobInfo) []*pb.PutContentReq {
+			return []*pb.PutContentReq{infoMsg(info), chunkMsg(1000)}
+		}, codes.DataLoss},
+		{"no content", newInfo(1024), func(info *pb.BlobInfo) []*pb.PutContentReq {
+			return []*pb.PutContentReq{infoMsg(info)}
+		}, codes.DataLoss},
+		{"unknown compression", newInfo(1024), func(info *pb.BlobInfo) []*pb.PutContentReq {
+			msg := infoMsg(info)
+			msg.Compression = pb.Compression(99)
+			return []*pb.PutContentReq{msg, chunkMsg(1024)}
+		}, codes.Unimplemented},
+		{"malformed compression", newInfo(1024), func(info *pb.BlobInfo) []*pb.PutContentReq {
+			msg := infoMsg(info)
+			msg.Compression = pb.Compression_Gzip
+			return []*pb.PutContentReq{msg, chunkMsg(1024)}
+		}, codes.InvalidArgument},
+		{"compressed overflow", newInfo(1024), func(info *pb.BlobInfo) []*pb.PutContentReq {
+			msg := infoMsg(info)
+			msg.Compression = pb.Compression_Gzip
+			data := gzipBytes(make([]byte, 1<<20))
+			return []*pb.PutContentReq{msg, {Input: &pb.PutContentReq_Chunk{
+				Chunk: &pb.Chunk{Data: data},
+			}}}
+		}, codes.InvalidArgument},
+	}
+	for _, c := range cases {
+		err := sendRawPut(ctx, client, c.msgs(c.info))
+		if status.Code(err) != c.code {
+			t.Fatalf("%s: expected %s, got %v", c.name, c.code, err)
+		}
+		if c.info.Major == "" || c.info.Size < 0 {
+			continue // not a readable key
+		}
+		if _, err = getTestBlob(ctx, client, c.info); status.Code(err) != codes.NotFound {
+			t.Fatalf("%s: expected nothing persisted, got %v", c.name, err)
+		}
+	}
+
+	// keys that could escape a directory are rejected outright
+	unsafe := &pb.BlobInfo{Size: 1, Major: "..", Minor: "passwd"}
+	err := sendRawPut(ctx, client, []*pb.PutContentReq{infoMsg(unsafe), chunkMsg(1)})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("unsafe key: expected InvalidArgument, got %v", err)
+	}
+	if _, err = getTestBlob(ctx, client, unsafe); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("unsafe key: expected InvalidArgument on GET, got %v", err)
+	}
+
+	// the server is still healthy after rejecting every stream
+	writeblob := makeTestBlob(1024, rand.Int(), rand.Int())
+	if err := putTestBlob(ctx, client, writeblob, 256); err != nil {
+		t.Fatalf("valid PUT failed after malformed streams, %v", err)
+	}
+}
+
+// compress a buffer with gzip
+func gzipBytes(data []byte) []byte {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	writer.Write(data)
+	writer.Close()
+	return buffer.Bytes()
+}
+
+// write a blob to the server as a gzip stream
+func putCompressedBlob(ctx context.Context, client pb.HorreaClient,
+	info *pb.BlobInfo, content []byte, chunksize int) error {
+	msgs := []*pb.PutContentReq{{
+		Input:       &pb.PutContentReq_Info{Info: info},
+		Compression: pb.Compression_Gzip,
+	}}
+	compressed := gzipBytes(content)
+	for start := 0; start < len(compressed); start += chunksize {
+		end := min(start+chunksize, len(compressed))
+		msgs = append(msgs, &pb.PutContentReq{Input: &pb.PutContentReq_Chunk{
+			Chunk: &pb.Chunk{Data: compressed[start:end]},
+		}})
+	}
+	return sendRawPut(ctx, client, msgs)
+}
+
+// read a blob back accepting the given encodings, returning the
+// decoded content and the number of bytes sent on the wire
+func getCompressedBlob(ctx context.Context, client pb.HorreaClient,
+	info *pb.BlobInfo, accept ...pb.Compression) ([]byte, int, error) {
+	rstream, err := client.GetContent(ctx, &pb.GetContentReq{
+		Info:   info,
+		Accept: accept,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	compression := pb.Compression_None
+	readbuf := []byte{}
+	for first := true; ; first = false {
+		in, err := rstream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, 0, err
+		}
+		if first {
+			compression = in.Compression
+		}
+		readbuf = append(readbuf, in.Data...)
+	}
+	if compression == pb.Compression_None {
+		return readbuf, len(readbuf), nil
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(readbuf))
+	if err != nil {
+		return nil, 0, err
+	}
+	content, err := io.ReadAll(reader)
+	return content, len(readbuf), err
+}
+
+// test compressed PUT and GET streams round trip, with both
+// incompressible and highly compressible content
+func TestHorreaServerCompression(t *testing.T) {
+	runForEachBackend(t, testHorreaServerCompression)
+}
+
+func testHorreaServerCompression(t *testing.T, ctx context.Context, client pb.HorreaClient) {
+	size := 300 * 1024
+	random := makeTestBlob(size, rand.Int(), rand.Int()).GetBuffer()
+	repeated := bytes.Repeat([]byte("0123456789abcdef"), size/16)
+	for name, content := range map[string][]byte{"random": random, "repeated": repeated} {
+		info := &pb.BlobInfo{
+			Size:  int64(size),
+			Major: fmt.Sprintf("%d", rand.Int()),
+			Minor: fmt.Sprintf("%d", rand.Int()),
+		}
+		if err := putCompressedBlob(ctx, client, info, content, 10000); err != nil {
+			t.Fatalf("%s: compressed PUT failed, %v", name, err)
+		}
+
+		// plain and compressed reads return the same content
+		plain, err := getTestBlob(ctx, client, info)
+		if err != nil {
+			t.Fatalf("%s: plain GET failed, %v", name, err)
+		} else if err = checkBytesEqual(plain, content); err != nil {
+			t.Fatalf("%s: plain GET mismatch, %v", name, err)
+		}
+		readback, wire, err := getCompressedBlob(ctx, client, info,
+			pb.Compression(99), pb.Compression_Gzip)
+		if err != nil {
+			t.Fatalf("%s: compressed GET failed, %v", name, err)
+		} else if err = checkBytesEqual(readback, content); err != nil {
+			t.Fatalf("%s: compressed GET mismatch, %v", name, err)
+		}
+		if name == "repeated" && wire >= size/10 {
+			t.Fatalf("%s: expected compressed transfer, sent %d bytes", name, wire)
+		}
+	}
+}
+
+// upload one part of a session
+func uploadTestPart(ctx context.Context, client pb.HorreaClient,
+	id string, number int32, data []byte) error {
+	wstream, err := client.UploadPart(ctx)
+	if err != nil {
+		return err
+	}
+	err = wstream.Send(&pb.UploadPartReq{Input: &pb.UploadPartReq_Header{
+		Header: &pb.PartHeader{UploadId: id, PartNumber: number},
+	}})
+	if err != nil {
+		return err
+	}
+	err = wstream.Send(&pb.UploadPartReq{Input: &pb.UploadPartReq_Chunk{
+		Chunk: &pb.Chunk{Data: data},
+	}})
+	if err != nil && err != io.EOF {
+		return err
+	}
+	_, err = wstream.CloseAndRecv()
+	return err
+}
+
+// test a resumable upload with parts sent in parallel
+func TestHorreaServerResumableUpload(t *testing.T) {
+	runForEachBackend(t, testHorreaServerResumableUpload)
+}
+
+func testHorreaServerResumableUpload(t *testing.T, ctx context.Context, client pb.HorreaClient) {
+	partSize, parts := 64*1024, 5
+	writeblob := makeTestBlob(partSize*parts, rand.Int(), rand.Int())
+	content := writeblob.GetBuffer()
+	begin, err := client.BeginUpload(ctx, &pb.BeginUploadReq{Info: writeblob.GetBlobInfo()})
+	if err != nil {
+		t.Fatalf("could not begin upload, %v", err)
+	}
+	id := begin.UploadId
+
+	// send all parts but the last concurrently
+	errs := make(chan error, parts)
+	for p := 1; p < parts; p++ {
+		go func(p int) {
+			data := content[(p-1)*partSize : p*partSize]
+			errs <- uploadTestPart(ctx, client, id, int32(p), data)
+		}(p)
+	}
+	for p := 1; p < parts; p++ {
+		if err = <-errs; err != nil {
+			t.Fatalf("could not upload part, %v", err)
+		}
+	}
+
+	// the missing part is reported and blocks the commit
+	list, err := client.ListParts(ctx, &pb.ListPartsReq{UploadId: id})
+	if err != nil {
+		t.Fatalf("could not list parts, %v", err)
+	} else if len(list.Parts) != parts-1 {
+		t.Fatalf("expected %d parts, found %d", parts-1, len(list.Parts))
+	}
+	_, err = client.CommitUpload(ctx, &pb.CommitUploadReq{UploadId: id})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition for incomplete upload, got %v", err)
+	}
+	err = uploadTestPart(ctx, client, id, 0, content[:partSize])
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for part 0, got %v", err)
+	}
+
+	// resume with the last part and commit
+	if err = uploadTestPart(ctx, client, id, int32(parts), content[(parts-1)*partSize:]); err != nil {
+		t.Fatalf("could not upload last part, %v", err)
+	}
+	if _, err = client.CommitUpload(ctx, &pb.CommitUploadReq{UploadId: id}); err != nil {
+		t.Fatalf("could not commit upload, %v", err)
+	}
+	readbuf, err := getTestBlob(ctx, client, writeblob.GetBlobInfo())
+	if err != nil {
+		t.Fatalf("could not read data back, %v", err)
+	} else if err = checkBytesEqual(readbuf, content); err != nil {
+		t.Fatalf("data not read back correctly, %v", err)
+	}
+
+	// the session is gone once committed
+	_, err = client.ListParts(ctx, &pb.ListPartsReq{UploadId: id})
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound after commit, got %v", err)
+	}
+	_, err = client.AbortUpload(ctx, &pb.AbortUploadReq{UploadId: id})
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound aborting committed upload, got %v", err)
+	}
+}
+
+// test deleting, describing and listing blobs through the server
+func TestHorreaServerManagement(t *testing.T) {
+	runForEachBackend(t, testHorreaServerManagement)
+}
+
+func testHorreaServerManagement(t *testing.T, ctx context.Context, client pb.HorreaClient) {
+	// write several blobs under a fresh major key
+	major, count := rand.Int(), 5
+	infos := []*pb.BlobInfo{}
+	for minor := 0; minor < count; minor++ {
+		writeblob := makeTestBlob(1000+minor, major, minor)
+		if err := putTestBlob(ctx, client, writeblob, 256); err != nil {
+			t.Fatalf("data could not be persisted, %v", err)
+		}
+		infos = append(infos, writeblob.GetBlobInfo())
 	}
 
-	// two buffers should be the same size and content
-	readbuf, writebuf := readblob.GetBuffer(), writeblob.GetBuffer()
-	if len(readbuf) != len(writebuf) {
-		t.Fatalf("did not read all data back from server, %d != %d",
-			len(readbuf), len(writebuf))
+	// stat reports the stored size and digest
+	resp, err := client.StatContent(ctx, &pb.StatContentReq{Info: infos[2]})
+	if err != nil {
+		t.Fatalf("could not stat blob, %v", err)
+	} else if resp.Info.Size != 1002 || len(resp.Info.Digest) != sha256.Size {
+		t.Fatalf("unexpected stat response %v", resp)
+	} else if resp.ModTime.AsTime().IsZero() {
+		t.Fatalf("stat response missing mod time")
 	}
-	for i := range readbuf {
-		if readbuf[i] != writebuf[i] {
-			t.Fatalf("byte %d not read back correctly, %x != %x",
-				i, readbuf[i], writebuf[i])
+
+	// list the major key two blobs at a time
+	listed, token := 0, ""
+	for {
+		page, err := client.ListContent(ctx, &pb.ListContentReq{
+			Major:     fmt.Sprintf("%d", major),
+			PageSize:  2,
+			PageToken: token,
+		})
+		if err != nil {
+			t.Fatalf("could not list blobs, %v", err)
+		}
+		listed += len(page.Blobs)
+		if token = page.NextPageToken; token == "" {
+			break
 		}
 	}
+	if listed != count {
+		t.Fatalf("listed %d blobs, expected %d", listed, count)
+	}
+	_, err = client.ListContent(ctx, &pb.ListContentReq{PageSize: -1})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for bad page size, got %v", err)
+	}
+
+	// deleted blobs can't be read, described or deleted again
+	_, err = client.DeleteContent(ctx, &pb.DeleteContentReq{Info: infos[0]})
+	if err != nil {
+		t.Fatalf("could not delete blob, %v", err)
+	}
+	_, err = client.DeleteContent(ctx, &pb.DeleteContentReq{Info: infos[0]})
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound on second delete, got %v", err)
+	}
+	_, err = client.StatContent(ctx, &pb.StatContentReq{Info: infos[0]})
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound on stat after delete, got %v", err)
+	}
+	if _, err = getTestBlob(ctx, client, infos[0]); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound on read after delete, got %v", err)
+	}
+}
+
+func TestHorreaServerVersions(t *testing.T) {
+	t.Setenv(cfgPrefix+"VERSIONING", "true")
+	runForEachBackend(t, testHorreaServerVersions)
+}
+
+func testHorreaServerVersions(t *testing.T, ctx context.Context, client pb.HorreaClient) {
+	// overwrite a blob, keeping both versions
+	major := rand.Int()
+	first := makeTestBlob(1000, major, 0)
+	second := makeTestBlob(2000, major, 0)
+	for _, writeblob := range []*blob.Blob{first, second} {
+		if err := putTestBlob(ctx, client, writeblob, 256); err != nil {
+			t.Fatalf("data could not be persisted, %v", err)
+		}
+	}
+	info := second.GetBlobInfo()
+	resp, err := client.ListVersions(ctx, &pb.ListVersionsReq{Info: info})
+	if err != nil {
+		t.Fatalf("could not list versions, %v", err)
+	} else if len(resp.Versions) != 2 || !resp.Versions[0].Current ||
+		resp.Versions[1].Size != 1000 {
+		t.Fatalf("unexpected versions %v", resp.Versions)
+	}
+	stat, err := client.StatContent(ctx, &pb.StatContentReq{Info: info})
+	if err != nil {
+		t.Fatalf("could not stat blob, %v", err)
+	} else if stat.Version != resp.Versions[0].Version {
+		t.Fatalf("stat version %q, listed %q", stat.Version, resp.Versions[0].Version)
+	}
+
+	// the old version is still readable by ID
+	rstream, err := client.GetContent(ctx, &pb.GetContentReq{
+		Info:    info,
+		Version: resp.Versions[1].Version,
+	})
+	if err != nil {
+		t.Fatalf("could not read old version, %v", err)
+	}
+	readbuf := []byte{}
+	for {
+		in, err := rstream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("could not read old version, %v", err)
+		}
+		readbuf = append(readbuf, in.Data...)
+	}
+	if err = checkBytesEqual(readbuf, first.GetBuffer()); err != nil {
+		t.Fatalf("old version mismatch: %v", err)
+	}
+
+	// unknown versions and blobs are reported missing
+	rstream, err = client.GetContent(ctx, &pb.GetContentReq{Info: info, Version: "bogus"})
+	if err == nil {
+		_, err = rstream.Recv()
+	}
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound for unknown version, got %v", err)
+	}
+	missing := makeTestBlob(10, major, 1).GetBlobInfo()
+	_, err = client.ListVersions(ctx, &pb.ListVersionsReq{Info: missing})
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound listing a missing blob, got %v", err)
+	}
+}
+
+func TestHorreaServerCopy(t *testing.T) {
+	t.Setenv(cfgPrefix+"VERSIONING", "true")
+	runForEachBackend(t, testHorreaServerCopy)
+}
+
+func testHorreaServerCopy(t *testing.T, ctx context.Context, client pb.HorreaClient) {
+	// copy the latest content, and an old version, to new keys
+	major := rand.Int()
+	first := makeTestBlob(1000, major, 0)
+	second := makeTestBlob(2000, major, 0)
+	for _, writeblob := range []*blob.Blob{first, second} {
+		if err := putTestBlob(ctx, client, writeblob, 256); err != nil {
+			t.Fatalf("data could not be persisted, %v", err)
+		}
+	}
+	source := second.GetBlobInfo()
+	versions, err := client.ListVersions(ctx, &pb.ListVersionsReq{Info: source})
+	if err != nil || len(versions.Versions) != 2 {
+		t.Fatalf("could not list versions, %v", err)
+	}
+	copies := []struct {
+		dest    *pb.BlobInfo
+		version string
+		want    []byte
+	}{
+		{makeTestBlob(10, major, 1).GetBlobInfo(), "", second.GetBuffer()},
+		{makeTestBlob(10, major, 2).GetBlobInfo(), versions.Versions[1].Version, first.GetBuffer()},
+	}
+	for _, c := range copies {
+		_, err = client.CopyContent(ctx, &pb.CopyContentReq{Source: source, Dest: c.dest, Version: c.version})
+		if err != nil {
+			t.Fatalf("could not copy blob, %v", err)
+		}
+		readbuf, err := getTestBlob(ctx, client, c.dest)
+		if err != nil {
+			t.Fatalf("could not read copy, %v", err)
+		} else if err = checkBytesEqual(readbuf, c.want); err != nil {
+			t.Fatalf("copy mismatch: %v", err)
+		}
+	}
+
+	missing := makeTestBlob(10, major, 3).GetBlobInfo()
+	_, err = client.CopyContent(ctx, &pb.CopyContentReq{Source: missing, Dest: source})
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound copying a missing blob, got %v", err)
+	}
+}
+
+// stream a byte range into a blob on the server
+func patchTestBlob(ctx context.Context, client pb.HorreaClient,
+	info *pb.BlobInfo, offset int64, data []byte) error {
+	pstream, err := client.PatchContent(ctx)
+	if err != nil {
+		return err
+	}
+	err = pstream.Send(&pb.PatchContentReq{
+		Input: &pb.PatchContentReq_Header{
+			Header: &pb.PatchHeader{Info: info, Offset: offset},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	err = pstream.Send(&pb.PatchContentReq{
+		Input: &pb.PatchContentReq_Chunk{Chunk: &pb.Chunk{Data: data}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = pstream.CloseAndRecv()
+	return err
+}
+
+func TestHorreaServerPatch(t *testing.T) {
+	runForEachBackend(t, testHorreaServerPatch)
+}
+
+func testHorreaServerPatch(t *testing.T, ctx context.Context, client pb.HorreaClient) {
+	writeblob := makeTestBlob(1000, rand.Int(), 0)
+	info := writeblob.GetBlobInfo()
+	if err := putTestBlob(ctx, client, writeblob, 256); err != nil {
+		t.Fatalf("data could not be persisted, %v", err)
+	}
+	expect := append([]byte{}, writeblob.GetBuffer()...)
+	if err := patchTestBlob(ctx, client, info, 10, []byte("patched")); err != nil {
+		t.Fatalf("could not patch blob, %v", err)
+	}
+	copy(expect[10:], "patched")
+	if err := patchTestBlob(ctx, client, info, 995, []byte("grown past the end")); err != nil {
+		t.Fatalf("could not patch blob, %v", err)
+	}
+	expect = append(expect[:995], "grown past the end"...)
+
+	readbuf, err := getTestBlob(ctx, client, info)
+	if err != nil {
+		t.Fatalf("data could not be retrieved, %v", err)
+	} else if err = checkBytesEqual(readbuf, expect); err != nil {
+		t.Fatalf("patched data mismatch: %v", err)
+	}
+	if readbuf, err = getTestRange(ctx, client, info, 8, 12); err != nil {
+		t.Fatalf("range could not be retrieved, %v", err)
+	} else if err = checkBytesEqual(readbuf, expect[8:20]); err != nil {
+		t.Fatalf("patched range mismatch: %v", err)
+	}
+	stat, err := client.StatContent(ctx, &pb.StatContentReq{Info: info})
+	if err != nil {
+		t.Fatalf("could not stat blob, %v", err)
+	} else if stat.Info.Size != int64(len(expect)) {
+		t.Fatalf("expected size %d, got %d", len(expect), stat.Info.Size)
+	}
+
+	err = patchTestBlob(ctx, client, info, int64(len(expect))+1, []byte("gap"))
+	if status.Code(err) != codes.OutOfRange {
+		t.Fatalf("expected OutOfRange patching past the end, got %v", err)
+	}
+	missing := makeTestBlob(10, rand.Int(), 1).GetBlobInfo()
+	if err = patchTestBlob(ctx, client, missing, 0, []byte("x")); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound patching a missing blob, got %v", err)
+	}
+}
+
+// collect the chunks of an export stream from the server
+func exportTestChunks(ctx context.Context, client pb.HorreaClient,
+	in *pb.ExportContentReq) ([]*pb.Chunk, error) {
+	estream, err := client.ExportContent(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	chunks := []*pb.Chunk{}
+	for {
+		chunk, err := estream.Recv()
+		if err == io.EOF {
+			return chunks, nil
+		} else if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, chunk)
+	}
+}
+
+// stream chunks of an archive back to the server
+func importTestChunks(ctx context.Context, client pb.HorreaClient,
+	chunks []*pb.Chunk) (*pb.ImportContentResp, error) {
+	istream, err := client.ImportContent(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, chunk := range chunks {
+		if err = istream.Send(chunk); err != nil {
+			return nil, err
+		}
+	}
+	return istream.CloseAndRecv()
+}
+
+func TestHorreaServerExport(t *testing.T) {
+	runForEachBackend(t, testHorreaServerExport)
+}
+
+func testHorreaServerExport(t *testing.T, ctx context.Context, client pb.HorreaClient) {
+	// export a major key, compressed, and restore it once deleted
+	major := rand.Int()
+	writeblobs := []*blob.Blob{makeTestBlob(1000, major, 0), makeTestBlob(70000, major, 1)}
+	for _, writeblob := range writeblobs {
+		if err := putTestBlob(ctx, client, writeblob, 4096); err != nil {
+			t.Fatalf("data could not be persisted, %v", err)
+		}
+	}
+	other := makeTestBlob(10, major+1, 0)
+	if err := putTestBlob(ctx, client, other, 256); err != nil {
+		t.Fatalf("data could not be persisted, %v", err)
+	}
+	chunks, err := exportTestChunks(ctx, client, &pb.ExportContentReq{
+		Major:  fmt.Sprintf("%d", major),
+		Accept: []pb.Compression{pb.Compression_Gzip},
+	})
+	if err != nil {
+		t.Fatalf("could not export blobs, %v", err)
+	} else if len(chunks) == 0 || chunks[0].Compression != pb.Compression_Gzip {
+		t.Fatalf("expected a gzip export stream, got %d chunks", len(chunks))
+	}
+	for _, writeblob := range writeblobs {
+		_, err = client.DeleteContent(ctx, &pb.DeleteContentReq{Info: writeblob.GetBlobInfo()})
+		if err != nil {
+			t.Fatalf("could not delete blob, %v", err)
+		}
+	}
+
+	resp, err := importTestChunks(ctx, client, chunks)
+	if err != nil {
+		t.Fatalf("could not import blobs, %v", err)
+	} else if resp.Blobs != 2 || resp.Bytes != 71000 {
+		t.Fatalf("unexpected import totals %v", resp)
+	}
+	for _, writeblob := range writeblobs {
+		readbuf, err := getTestBlob(ctx, client, writeblob.GetBlobInfo())
+		if err != nil {
+			t.Fatalf("restored data could not be retrieved, %v", err)
+		} else if err = checkBytesEqual(readbuf, writeblob.GetBuffer()); err != nil {
+			t.Fatalf("restored data mismatch: %v", err)
+		}
+	}
+
+	// nothing was written since the import began
+	chunks, err = exportTestChunks(ctx, client, &pb.ExportContentReq{
+		Major: fmt.Sprintf("%d", major),
+		Since: timestamppb.Now(),
+	})
+	if err != nil {
+		t.Fatalf("could not export blobs, %v", err)
+	} else if resp, err = importTestChunks(ctx, client, chunks); err != nil || resp.Blobs != 0 {
+		t.Fatalf("expected an empty incremental export, got %v, %v", resp, err)
+	}
+	garbage := []*pb.Chunk{{Data: []byte("not an archive")}}
+	if _, err = importTestChunks(ctx, client, garbage); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument importing garbage, got %v", err)
+	}
+	if _, err = importTestChunks(ctx, client, nil); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument importing nothing, got %v", err)
+	}
+}
+
+func TestHorreaServerRetention(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lifecycle.json")
+	rules := `[{"major": "held", "retainDays": 1}]`
+	if err := os.WriteFile(path, []byte(rules), 0600); err != nil {
+		t.Fatalf("could not write lifecycle rules, %v", err)
+	}
+	t.Setenv(cfgPrefix+"LIFECYCLEFILE", path)
+	// unset variables don't reset the config of later tests
+	t.Cleanup(func() { cfg.LifecycleFile = "" })
+	ctx := context.Background()
+	client, closer := startTestServer(ctx, blob.MemoryBackend)
+	defer closer()
+
+	writeblob := makeTestBlob(1000, rand.Int(), 0)
+	info := writeblob.GetBlobInfo()
+	info.Major = "held"
+	for i := 0; i < 2; i++ {
+		err := putTestBlob(ctx, client, writeblob, 256)
+		if i == 0 && err != nil {
+			t.Fatalf("data could not be persisted, %v", err)
+		} else if i == 1 && status.Code(err) != codes.FailedPrecondition {
+			t.Fatalf("expected FailedPrecondition overwriting a held blob, got %v", err)
+		}
+	}
+	_, err := client.DeleteContent(ctx, &pb.DeleteContentReq{Info: info})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition deleting a held blob, got %v", err)
+	}
+	stat, err := client.StatContent(ctx, &pb.StatContentReq{Info: info})
+	if err != nil {
+		t.Fatalf("could not stat blob, %v", err)
+	} else if stat.RetainUntil == nil || !stat.RetainUntil.AsTime().After(time.Now()) {
+		t.Fatalf("expected a retention hold, got %v", stat.RetainUntil)
+	}
+}
+
+func TestHorreaServerLimits(t *testing.T) {
+	t.Setenv(cfgPrefix+"CLIENTMIBPS", "1")
+	t.Setenv(cfgPrefix+"CLIENTSTREAMS", "1")
+	ctx := context.Background()
+	clientA, dial, closer := startPeerTestServer(ctx, blob.MemoryBackend)
+	defer closer()
+	clientB := dial()
+
+	// a second's burst, then paced at the byte rate
+	large := makeTestBlob(2*1024*1024+512*1024, rand.Int(), 0)
+	start := time.Now()
+	if err := putTestBlob(ctx, clientB, large, 64*1024); err != nil {
+		t.Fatalf("data could not be persisted, %v", err)
+	} else if elapsed := time.Since(start); elapsed < time.Second {
+		t.Fatalf("expected a paced upload, took %v", elapsed)
+	}
+	small := makeTestBlob(1000, rand.Int(), 0)
+	if err := putTestBlob(ctx, clientA, small, 256); err != nil {
+		t.Fatalf("data could not be persisted, %v", err)
+	}
+
+	// a paced read holds client A's only stream open
+	rstream, err := clientA.GetContent(ctx, &pb.GetContentReq{Info: large.GetBlobInfo()})
+	if err != nil {
+		t.Fatalf("could not start read, %v", err)
+	}
+	in, err := rstream.Recv()
+	if err != nil {
+		t.Fatalf("could not read, %v", err)
+	}
+	readbuf := in.Data
+	if _, err = getTestBlob(ctx, clientA, small.GetBlobInfo()); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected ResourceExhausted over the stream limit, got %v", err)
+	}
+	// unverified tokens don't make a new client
+	ctxToken := metadata.AppendToOutgoingContext(ctx, "authorization", "another-client")
+	if _, err = getTestBlob(ctxToken, clientA, small.GetBlobInfo()); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected ResourceExhausted with a fresh token, got %v", err)
+	}
+	if _, err = getTestBlob(ctx, clientB, small.GetBlobInfo()); err != nil {
+		t.Fatalf("other client could not read, %v", err)
+	}
+	for {
+		in, err = rstream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("could not read, %v", err)
+		}
+		readbuf = append(readbuf, in.Data...)
+	}
+	if err = checkBytesEqual(readbuf, large.GetBuffer()); err != nil {
+		t.Fatalf("paced read mismatch: %v", err)
+	}
+}
+
+func TestHorreaServerScrubReport(t *testing.T) {
+	ctx := context.Background()
+	client, closer := startTestServer(ctx, blob.MemoryBackend)
+	defer closer()
+
+	_, err := client.ScrubReport(ctx, &pb.ScrubReportReq{})
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound before any scrub, got %v", err)
+	}
+	writeblob := makeTestBlob(1000, rand.Int(), 0)
+	if err = putTestBlob(ctx, client, writeblob, 256); err != nil {
+		t.Fatalf("data could not be persisted, %v", err)
+	}
+	if _, err = blob.Scrub(0); err != nil {
+		t.Fatalf("could not scrub, %v", err)
+	}
+	resp, err := client.ScrubReport(ctx, &pb.ScrubReportReq{})
+	if err != nil {
+		t.Fatalf("could not fetch scrub report, %v", err)
+	} else if resp.Blobs != 1 || resp.Bytes != 1000 || len(resp.Findings) != 0 {
+		t.Fatalf("unexpected scrub report %v", resp)
+	}
 }
@@ -0,0 +1,360 @@
+/*
+ * Export and import of blobs as tar archives.
+ */
+
+/*
+ * An archive starts with a manifest, then holds each blob as its
+ * content, read back and verified, followed by a JSON record of its
+ * attributes and SHA-256 digest. Content is archived in the clear
+ * and uncompressed, so an archive restores into any backend under
+ * any settings. Entries are named by the flat encoding of their key.
+ *
+ * Blobs are read quietly, so an export doesn't fill the read cache
+ * or move cold blobs back hot.
+ *
+ * Each blob is archived as one version of its content; if it keeps
+ * changing as it is opened, or changes while it is read, the export
+ * fails rather than archive it torn. With versioning enabled, the
+ * archive is a snapshot as of the start time in its manifest: a
+ * blob rewritten or patched since is archived as the old version
+ * that was current then, and blobs first written since are left
+ * out. Deletes keep no record of when they happened, so blobs
+ * deleted during an export are left out as well. Without
+ * versioning there's nothing to pin, and blobs written during an
+ * export may or may not be in it.
+ *
+ * An incremental export holds the blobs written since a given time,
+ * so passing the start time recorded in the previous manifest
+ * misses nothing. Deletions aren't recorded, and old versions
+ * aren't archived beyond the one pinned.
+ *
+ * Import checks each blob's size and digest against its record
+ * before committing it, and keeps its version ID so lifecycle ages
+ * carry over. Blobs already restored stay if a later one fails.
+ */
+
+package blob
+
+import (
+	pb "github.com/pleb/prod/horrea/pb"
+
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// version of the archive layout.
+const archiveFormat = 1
+
+// name of the manifest entry, which no key encodes to.
+const manifestName = "horrea-archive.json"
+
+// suffix on the names of blob record entries.
+const recordSuffix = ".json"
+
+// largest manifest or record read back.
+const maxRecordSize = 1 << 20
+
+// times a blob is reopened if it changes as it is opened.
+const snapshotAttempts = 3
+
+var ErrArchive = errors.New("malformed archive")
+
+// Description of an archive, its first entry.
+type archiveManifest struct {
+	Format  int       `json:"format"`          // layout version.
+	Started time.Time `json:"started"`         // time the export began.
+	Since   time.Time `json:"since"`           // earliest write archived.
+	Major   string    `json:"major,omitempty"` // major key archived, empty for all.
+}
+
+// Attributes of an archived blob, the entry after its content.
+type archiveRecord struct {
+	Major    string    `json:"major"`    // major key.
+	Minor    string    `json:"minor"`    // minor key.
+	BlobType string    `json:"blobType"` // blob type name.
+	Size     int64     `json:"size"`     // content size in bytes.
+	Digest   []byte    `json:"digest"`   // SHA-256 of the content.
+	Version  string    `json:"version"`  // version ID of the content.
+	ModTime  time.Time `json:"modTime"`  // time the content was written.
+}
+
+// Blobs and content bytes moved by an export or import.
+type ArchiveStats struct {
+	Blobs int64 // blobs archived or restored.
+	Bytes int64 // content bytes archived or restored.
+}
+
+// write a tar archive of the blobs under a major key, or all blobs
+// if none is given, written since the given time, or ever if it's
+// zero.
+func ExportBlobs(out io.Writer, major string, since time.Time) (*ArchiveStats, error) {
+	if blobio == nil {
+		return nil, ErrNotSupp
+	}
+	archive := tar.NewWriter(out)
+	manifest := archiveManifest{Format: archiveFormat, Started: time.Now(), Since: since, Major: major}
+	if err := writeRecord(archive, manifestName, manifest.Started, &manifest); err != nil {
+		return nil, err
+	}
+	stats := &ArchiveStats{}
+	after := Key{}
+	for {
+		keys, err := blobio.List(major, after, DefaultPageSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			if _, known := pb.BlobType_value[key.BlobType]; !known {
+				continue // sidecars, versions and internal keys
+			}
+			size, err := exportBlob(archive, key, since, manifest.Started)
+			if err != nil {
+				return nil, fmt.Errorf("export of %s: %w", key, err)
+			} else if size >= 0 {
+				stats.Blobs++
+				stats.Bytes += size
+			}
+		}
+		if len(keys) < DefaultPageSize {
+			break
+		}
+		after = keys[len(keys)-1]
+	}
+	return stats, archive.Close()
+}
+
+// archive the version of a blob current at the start of the
+// export if it was written since the given time, returning its
+// size, or -1 if it was skipped.
+func exportBlob(archive *tar.Writer, key Key, since, started time.Time) (int64, error) {
+	stat, reader, err := openPinned(key, started)
+	if errors.Is(err, ErrNoExist) {
+		return -1, nil // deleted since listing, or written since starting
+	} else if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+	if versionTime(stat.Version).Before(since) {
+		return -1, nil
+	}
+
+	name := encodeKey(key)
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    stat.Size,
+		ModTime: stat.ModTime,
+		Format:  tar.FormatPAX,
+	}
+	if err = archive.WriteHeader(header); err != nil {
+		return 0, err
+	}
+	digest := sha256.New()
+	n, err := io.Copy(io.MultiWriter(archive, digest), reader)
+	if err != nil {
+		return 0, err
+	} else if n != stat.Size {
+		return 0, fmt.Errorf("content changed while exported, %d of %d bytes read", n, stat.Size)
+	}
+	record := archiveRecord{
+		Major:    key.Major,
+		Minor:    key.Minor,
+		BlobType: key.BlobType,
+		Size:     stat.Size,
+		Digest:   digest.Sum(nil),
+		Version:  stat.Version,
+		ModTime:  stat.ModTime,
+	}
+	if len(stat.Digest) > 0 && !bytes.Equal(stat.Digest, record.Digest) {
+		return 0, ErrDigest
+	}
+	return stat.Size, writeRecord(archive, name+recordSuffix, stat.ModTime, &record)
+}
+
+// open a reader over a blob's content along with a description of
+// the same version of it.
+func openSnapshot(key Key) (*BlobStat, io.ReadCloser, error) {
+	stored := quiet(blobio)
+	for attempt := 1; ; attempt++ {
+		stat, err := statStored(stored, key)
+		if err != nil {
+			return nil, nil, err
+		}
+		reader, err := newChecksumReader(stored, key, 0, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		after, err := statStored(stored, key)
+		if err == nil && after.Version == stat.Version {
+			return stat, reader, nil
+		}
+		reader.Close()
+		if err != nil {
+			return nil, nil, err
+		} else if attempt == snapshotAttempts {
+			return nil, nil, fmt.Errorf("content changed while exported %d times", attempt)
+		}
+	}
+}
+
+// open a reader over the version of a blob that was current at the
+// given time, along with a description of it. Without versioning
+// only the current version can be read.
+func openPinned(key Key, at time.Time) (*BlobStat, io.ReadCloser, error) {
+	stat, reader, err := openSnapshot(key)
+	if !versioning.enabled {
+		return stat, reader, err
+	} else if err == nil && !versionTime(stat.Version).After(at) {
+		return stat, reader, nil
+	} else if err == nil {
+		reader.Close()
+	} else if !errors.Is(err, ErrNoExist) {
+		return nil, nil, err
+	}
+
+	// the content current then has been replaced since
+	versions, err := oldVersions(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, version := range versions {
+		if versionTime(version).After(at) {
+			continue
+		}
+		vkey := versionKey(key, version)
+		if stat, err = statStored(quiet(blobio), vkey); err != nil {
+			return nil, nil, err
+		}
+		if reader, err = newChecksumReader(quiet(blobio), vkey, 0, 0); err != nil {
+			return nil, nil, err
+		}
+		stat.Version, stat.ModTime = version, versionTime(version)
+		return stat, reader, nil
+	}
+	return nil, nil, ErrNoExist
+}
+
+// write a JSON record as an archive entry.
+func writeRecord(archive *tar.Writer, name string, modTime time.Time, record any) error {
+	content, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(content)),
+		ModTime: modTime,
+		Format:  tar.FormatPAX,
+	}
+	if err = archive.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = archive.Write(content)
+	return err
+}
+
+// read the JSON record in the current archive entry.
+func readRecord(archive *tar.Reader, header *tar.Header, record any) error {
+	if header.Size > maxRecordSize {
+		return fmt.Errorf("%w: record %s too large", ErrArchive, header.Name)
+	}
+	content, err := io.ReadAll(archive)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrArchive, err)
+	} else if err = json.Unmarshal(content, record); err != nil {
+		return fmt.Errorf("%w: record %s: %v", ErrArchive, header.Name, err)
+	}
+	return nil
+}
+
+// restore the blobs in a tar archive written by ExportBlobs,
+// replacing any at the same keys.
+func ImportBlobs(in io.Reader) (*ArchiveStats, error) {
+	if blobio == nil {
+		return nil, ErrNotSupp
+	}
+	archive := tar.NewReader(in)
+	header, err := archive.Next()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrArchive, err)
+	} else if header.Name != manifestName {
+		return nil, fmt.Errorf("%w: no manifest", ErrArchive)
+	}
+	manifest := archiveManifest{}
+	if err = readRecord(archive, header, &manifest); err != nil {
+		return nil, err
+	} else if manifest.Format != archiveFormat {
+		return nil, fmt.Errorf("%w: archive format %d", ErrNotSupp, manifest.Format)
+	}
+
+	stats := &ArchiveStats{}
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return stats, nil
+		} else if err != nil {
+			return stats, fmt.Errorf("%w: %v", ErrArchive, err)
+		}
+		key, ok := decodeKey(header.Name)
+		if _, known := pb.BlobType_value[key.BlobType]; !ok || !known || !validKey(key) {
+			return stats, fmt.Errorf("%w: unexpected entry %s", ErrArchive, header.Name)
+		}
+		if err = importBlob(archive, header, key); err != nil {
+			return stats, fmt.Errorf("import of %s: %w", key, err)
+		}
+		stats.Blobs++
+		stats.Bytes += header.Size
+	}
+}
+
+// restore one blob from the current archive entry and the record
+// after it, unless its content doesn't match the record.
+func importBlob(archive *tar.Reader, header *tar.Header, key Key) error {
+	if err := checkHold(key, time.Now()); err != nil {
+		return err
+	}
+	writer, err := newSidecarWriter(blobio, key, metadataKey(key), nil, storeCodec, blobKeys)
+	if err != nil {
+		return err
+	}
+	digest := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(writer, digest), archive); err != nil {
+		writer.Abort()
+		return fmt.Errorf("%w: %v", ErrArchive, err)
+	}
+
+	next, err := archive.Next()
+	if err != nil || next.Name != header.Name+recordSuffix {
+		writer.Abort()
+		return fmt.Errorf("%w: no record for %s", ErrArchive, header.Name)
+	}
+	record := archiveRecord{}
+	if err = readRecord(archive, next, &record); err != nil {
+		writer.Abort()
+		return err
+	}
+	archived := Key{Major: record.Major, Minor: record.Minor, BlobType: record.BlobType}
+	if archived != key || record.Size != header.Size {
+		writer.Abort()
+		return fmt.Errorf("%w: record doesn't match %s", ErrArchive, header.Name)
+	} else if !bytes.Equal(record.Digest, digest.Sum(nil)) {
+		writer.Abort()
+		return ErrDigest
+	}
+	if _, err = strconv.ParseUint(record.Version, 10, 64); err == nil {
+		writer.meta.Version = record.Version
+	}
+	var committer Writer = lockedWriter{writer}
+	if versioning.enabled {
+		committer = &versionWriter{Writer: committer, key: key}
+	}
+	return committer.Commit()
+}
@@ -0,0 +1,212 @@
+/*
+ * Tests for export and import of tar archives.
+ */
+
+package blob
+
+import (
+	pb "github.com/pleb/prod/horrea/pb"
+
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// test blobs exported from every backend restore into another,
+// encrypted and compressed, reading back with the same digests and
+// versions
+func TestArchiveRoundTrip(t *testing.T) {
+	for _, name := range Backends() {
+		t.Run(name, func(t *testing.T) {
+			if err := ConfigureBackend(name, testConfig(t)); err != nil {
+				t.Fatalf("could not configure %s backend: %s", name, err)
+			}
+			infos, contents := []*pb.BlobInfo{}, [][]byte{}
+			for _, size := range []int{0, 1000, 2*checksumBlockSize + 10} {
+				info, testdata := writeChecksummedBlob(t, size)
+				infos, contents = append(infos, info), append(contents, testdata)
+			}
+			// patched blobs are archived merged
+			contents[1] = patchBlob(t, infos[1], 990, 20, contents[1])
+			stats := []*BlobStat{}
+			for _, info := range infos {
+				stat, _ := StatBlob(info)
+				stats = append(stats, stat)
+			}
+			archive := &bytes.Buffer{}
+			exported, err := ExportBlobs(archive, "", time.Time{})
+			if err != nil {
+				t.Fatalf("ExportBlobs returned error: %s", err)
+			} else if exported.Blobs != 3 || exported.Bytes != int64(len(contents[1])+len(contents[2])) {
+				t.Fatalf("unexpected export totals %+v", exported)
+			}
+
+			cfg := testConfig(t)
+			cfg.Compression = "gzip"
+			configureKeys(t, MemoryBackend, cfg, testMasterKey(t))
+			imported, err := ImportBlobs(archive)
+			if err != nil {
+				t.Fatalf("ImportBlobs returned error: %s", err)
+			} else if *imported != *exported {
+				t.Fatalf("imported %+v, exported %+v", imported, exported)
+			}
+			for i, info := range infos {
+				content, err := readRange(info, 0, 0)
+				if err != nil {
+					t.Fatalf("could not read restored blob: %s", err)
+				} else if err = checkBytesEqual(content, contents[i]); err != nil {
+					t.Fatalf("restored blob mismatch: %s", err)
+				}
+				digest := sha256.Sum256(contents[i])
+				stat, err := StatBlob(info)
+				if err != nil {
+					t.Fatalf("StatBlob returned error: %s", err)
+				} else if !bytes.Equal(stat.Digest, digest[:]) || stat.Version != stats[i].Version {
+					t.Fatalf("restored stat %+v, archived %+v", stat, stats[i])
+				}
+			}
+		})
+	}
+}
+
+// test incremental exports hold only blobs written since the
+// given time
+func TestArchiveIncremental(t *testing.T) {
+	if err := ConfigureBackend(MemoryBackend, testConfig(t)); err != nil {
+		t.Fatalf("could not configure memory backend: %s", err)
+	}
+	writeChecksummedBlob(t, 100)
+	since := time.Now()
+	info, _ := writeChecksummedBlob(t, 200)
+	archive := &bytes.Buffer{}
+	exported, err := ExportBlobs(archive, "", since)
+	if err != nil {
+		t.Fatalf("ExportBlobs returned error: %s", err)
+	} else if exported.Blobs != 1 || exported.Bytes != 200 {
+		t.Fatalf("expected the later blob alone, got %+v", exported)
+	}
+	reader := tar.NewReader(archive)
+	names := []string{}
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("could not read archive: %s", err)
+		}
+		names = append(names, header.Name)
+	}
+	name := encodeKey(keyFromInfo(info))
+	if len(names) != 3 || names[0] != manifestName || names[1] != name || names[2] != name+recordSuffix {
+		t.Fatalf("unexpected archive entries %v", names)
+	}
+}
+
+// test damaged or malformed archives restore nothing they can't
+// verify
+func TestArchiveDamage(t *testing.T) {
+	if err := ConfigureBackend(MemoryBackend, testConfig(t)); err != nil {
+		t.Fatalf("could not configure memory backend: %s", err)
+	}
+	info, testdata := writeChecksummedBlob(t, 1000)
+	archive := &bytes.Buffer{}
+	if _, err := ExportBlobs(archive, "", time.Time{}); err != nil {
+		t.Fatalf("ExportBlobs returned error: %s", err)
+	}
+	damaged := bytes.Replace(archive.Bytes(), testdata[100:164], make([]byte, 64), 1)
+
+	if err := ConfigureBackend(MemoryBackend, testConfig(t)); err != nil {
+		t.Fatalf("could not configure memory backend: %s", err)
+	}
+	if _, err := ImportBlobs(bytes.NewReader(damaged)); !errors.Is(err, ErrDigest) {
+		t.Fatalf("expected ErrDigest importing damaged content, got %v", err)
+	}
+	if _, err := StatBlob(info); !errors.Is(err, ErrNoExist) {
+		t.Fatalf("expected damaged blob not restored, got %v", err)
+	}
+	truncated := archive.Bytes()[:archive.Len()/2]
+	if _, err := ImportBlobs(bytes.NewReader(truncated)); !errors.Is(err, ErrArchive) {
+		t.Fatalf("expected ErrArchive importing a truncated archive, got %v", err)
+	}
+	if _, err := ImportBlobs(bytes.NewReader(testdata)); !errors.Is(err, ErrArchive) {
+		t.Fatalf("expected ErrArchive importing garbage, got %v", err)
+	}
+}
+
+// writer running a function before its first write
+type hookWriter struct {
+	io.Writer
+	hook func()
+}
+
+func (writer *hookWriter) Write(data []byte) (int, error) {
+	if writer.hook != nil {
+		writer.hook()
+		writer.hook = nil
+	}
+	return writer.Writer.Write(data)
+}
+
+// test exports with versioning hold blobs as they were when the
+// export started, whatever is written while it runs
+func TestArchiveSnapshot(t *testing.T) {
+	configureVersioning(t, MemoryBackend, 0, 0)
+	rewritten := &pb.BlobInfo{Major: "major", Minor: "rewritten"}
+	patched := &pb.BlobInfo{Major: "major", Minor: "patched"}
+	added := &pb.BlobInfo{Major: "major", Minor: "added"}
+	writeVersion(t, rewritten, "before")
+	writeVersion(t, patched, "before")
+
+	// the manifest is written, and the start time taken, before
+	// any blob is listed
+	archive := &bytes.Buffer{}
+	out := &hookWriter{Writer: archive, hook: func() {
+		time.Sleep(time.Millisecond)
+		writeVersion(t, rewritten, "after")
+		patchBlob(t, patched, 0, 3, []byte("before"))
+		writeVersion(t, added, "after")
+	}}
+	exported, err := ExportBlobs(out, "", time.Time{})
+	if err != nil {
+		t.Fatalf("ExportBlobs returned error: %s", err)
+	} else if exported.Blobs != 2 || exported.Bytes != 12 {
+		t.Fatalf("expected the two blobs as they were, got %+v", exported)
+	}
+
+	configureVersioning(t, MemoryBackend, 0, 0)
+	if _, err = ImportBlobs(archive); err != nil {
+		t.Fatalf("ImportBlobs returned error: %s", err)
+	}
+	for _, info := range []*pb.BlobInfo{rewritten, patched} {
+		if content := readAllVersion(t, info, ""); content != "before" {
+			t.Fatalf("expected %s restored as it was, got %q", info.Minor, content)
+		}
+	}
+	if _, err = StatBlob(added); !errors.Is(err, ErrNoExist) {
+		t.Fatalf("expected a blob written during export left out, got %v", err)
+	}
+}
+
+// test exports read cold blobs from the cold tier and leave them
+// there
+func TestArchiveLeavesTiers(t *testing.T) {
+	tiers := configureTiers(t, time.Hour, 0)
+	info, _ := writeChecksummedBlob(t, 2*checksumBlockSize)
+	key := keyFromInfo(info)
+	if _, err := DemoteCold(time.Now().Add(2 * time.Hour)); err != nil {
+		t.Fatalf("could not demote: %s", err)
+	}
+	exported, err := ExportBlobs(&bytes.Buffer{}, "", time.Time{})
+	if err != nil {
+		t.Fatalf("ExportBlobs returned error: %s", err)
+	} else if exported.Blobs != 1 {
+		t.Fatalf("expected one blob exported, got %+v", exported)
+	}
+	waitPromotions(tiers)
+	checkTier(t, tiers, key, false)
+	checkTier(t, tiers, metadataKey(key), false)
+}
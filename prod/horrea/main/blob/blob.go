@@ -9,6 +9,8 @@ import (
 
 	"errors"
 	"fmt"
+	"io"
+	"time"
 )
 
 type Blob struct {
@@ -27,6 +29,23 @@ var ErrEndOfBuffer = errors.New("passed end of buffer")
 var ErrReadOnly = errors.New("cannot write, read-only blob")
 var ErrNoExist = errors.New("cannot read, file doesn't exist")
 var ErrNotSupp = errors.New("I/O mode not supported")
+var ErrRange = errors.New("read offset past end of blob")
+var ErrCorrupt = errors.New("stored content failed checksum")
+var ErrDigest = errors.New("content does not match digest")
+var ErrPageToken = errors.New("invalid page token")
+var ErrKey = errors.New("key contains a path separator or \"..\"")
+
+// Blobs per ListBlobs page when no size is given.
+const DefaultPageSize = 100
+
+// Description of a stored blob.
+type BlobStat struct {
+	Size      int64     // content size in bytes.
+	Digest    []byte    // SHA-256 of content, nil if never recorded.
+	ModTime   time.Time // time content was last written.
+	Version   string    // version ID of the content.
+	HeldUntil time.Time // end of any retention hold, zero if none.
+}
 
 // Blob constructor.
 func CreateBlob(info *pb.BlobInfo) *Blob {
@@ -70,29 +89,329 @@ func (blob *Blob) PopChunk(iter *BlobIterator) ([]byte, error) {
 	return blob.content[start:end], nil
 }
 
+// open a reader over the persisted content of a blob, starting
+// at offset. A length of 0 reads through to the end of the blob.
+// Content is verified against stored checksums as it is read.
+func CreateBlobReader(info *pb.BlobInfo, offset, length int64) (io.ReadCloser, error) {
+	return CreateVersionReader(info, "", offset, length)
+}
+
+// open a reader over a version of a blob, or the latest content
+// if no version is given.
+func CreateVersionReader(info *pb.BlobInfo, version string, offset, length int64) (io.ReadCloser, error) {
+	if blobio == nil {
+		return nil, ErrNotSupp
+	} else if offset < 0 || length < 0 {
+		return nil, ErrRange
+	}
+	key := keyFromInfo(info)
+	if !validKey(key) {
+		return nil, ErrKey
+	}
+	key, err := resolveVersion(key, version)
+	if err != nil {
+		return nil, err
+	}
+	return newChecksumReader(blobio, key, offset, length)
+}
+
+// start a write of new content for a blob, which must be
+// committed before readers can see it. If the info carries a
+// digest, the commit fails unless the content matches it.
+func CreateBlobWriter(info *pb.BlobInfo) (Writer, error) {
+	if blobio == nil {
+		return nil, ErrNotSupp
+	}
+	key := keyFromInfo(info)
+	if !validKey(key) {
+		return nil, ErrKey
+	}
+	if err := checkHold(key, time.Now()); err != nil {
+		return nil, err
+	}
+	writer, err := newChecksumWriter(blobio, key, info.GetDigest(), storeCodec)
+	if err != nil || !versioning.enabled {
+		return writer, err
+	}
+	return &versionWriter{Writer: writer, key: key}, nil
+}
+
+// remove a blob and its metadata, unless it's held. With
+// versioning, the content is kept as an old version first.
+func DeleteBlob(info *pb.BlobInfo) error {
+	if blobio == nil {
+		return ErrNotSupp
+	}
+	key := keyFromInfo(info)
+	if !validKey(key) {
+		return ErrKey
+	}
+	return deleteBlob(key, "", time.Now())
+}
+
+// remove a blob unless it's held at the given time, and only if
+// its current version is the one given, if one is.
+func deleteBlob(key Key, version string, now time.Time) error {
+	if err := checkHold(key, now); err != nil {
+		return err
+	}
+	if versioning.enabled {
+		if err := preserveVersion(key); err != nil {
+			return err
+		}
+	}
+	if err := deleteContent(key, version, now); err != nil {
+		return err
+	}
+	if versioning.enabled {
+		return pruneVersions(key, now)
+	}
+	return nil
+}
+
+// remove the content of a key, then its sidecar and deltas, unless
+// it's held at the given time. Given a version, content of any other
+// version is left alone and reported missing.
+func deleteContent(key Key, version string, now time.Time) error {
+	defer lockSidecar(key)()
+	if err := checkHold(key, now); err != nil {
+		return err
+	}
+	replaced, _ := readMetadata(blobio, key)
+	if version != "" {
+		current, _, err := currentVersion(key)
+		if err != nil {
+			return err
+		} else if current != version {
+			return fmt.Errorf("%w: version %s replaced", ErrNoExist, version)
+		}
+	}
+	if err := blobio.Delete(key); err != nil {
+		return err
+	}
+	// content goes first, so a crash leaves only an orphan sidecar
+	err := blobio.Delete(metadataKey(key))
+	if err != nil && !errors.Is(err, ErrNoExist) {
+		return err
+	}
+	dropDeltas(blobio, key, replaced, nil)
+	return nil
+}
+
+// copy a blob, or one version of it, to another key not under a
+// hold, sharing its stored content where the backend allows. With
+// versioning, the content replaced at the destination is kept as an
+// old version.
+func CopyBlob(from, to *pb.BlobInfo, version string) error {
+	if blobio == nil {
+		return ErrNotSupp
+	}
+	src, dst := keyFromInfo(from), keyFromInfo(to)
+	if !validKey(src) || !validKey(dst) {
+		return ErrKey
+	}
+	src, err := resolveVersion(src, version)
+	if err != nil {
+		return err
+	} else if src == dst {
+		return nil
+	} else if err = checkHold(dst, time.Now()); err != nil {
+		return err
+	}
+	if versioning.enabled {
+		if err = preserveVersion(dst); err != nil {
+			return err
+		}
+	}
+	if err = cloneBlob(src, dst); err != nil {
+		return err
+	}
+	if versioning.enabled {
+		return pruneVersions(dst, time.Now())
+	}
+	return nil
+}
+
+// clone a key's content, sidecar and deltas to another key. The
+// sidecar gets a new version, and any data key is re-wrapped for
+// the new key, since wrapped keys are bound to their blob.
+func cloneBlob(src, dst Key) error {
+	defer lockSidecar(src, dst)()
+	if err := checkHold(dst, time.Now()); err != nil {
+		return err
+	}
+	if _, err := blobio.Stat(src); err != nil {
+		return err
+	}
+	replaced, _ := readMetadata(blobio, dst)
+	meta, err := readMetadata(blobio, src)
+	if errors.Is(err, ErrNoExist) {
+		// content predating checksums is copied unverified
+		err = blobio.Delete(metadataKey(dst))
+		if err != nil && !errors.Is(err, ErrNoExist) {
+			return err
+		}
+		dropDeltas(blobio, dst, replaced, nil)
+		return cloneContent(blobio, src, dst)
+	} else if err != nil {
+		return err
+	}
+	for _, delta := range meta.Deltas {
+		if err = cloneDelta(src, dst, delta.ID); err != nil {
+			return err
+		}
+	}
+	var dataKey []byte
+	if meta.Encryption != nil {
+		if dataKey, err = blobKeys.unwrap(src, meta); err != nil {
+			return err
+		}
+	}
+	meta.Version = newVersionID(time.Now())
+	if dataKey != nil {
+		if err = blobKeys.wrap(dst, meta, dataKey); err != nil {
+			return err
+		}
+	}
+	// the sidecar goes first, as for any checksummed write
+	if err = writeMetadata(blobio, dst, meta); err != nil {
+		return err
+	}
+	if err = cloneContent(blobio, src, dst); err != nil {
+		return err
+	}
+	dropDeltas(blobio, dst, replaced, meta)
+	return nil
+}
+
+// describe a stored blob, including its recorded digest.
+func StatBlob(info *pb.BlobInfo) (*BlobStat, error) {
+	if blobio == nil {
+		return nil, ErrNotSupp
+	}
+	key := keyFromInfo(info)
+	if !validKey(key) {
+		return nil, ErrKey
+	}
+	stat, err := statKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if until := heldUntil(key, versionTime(stat.Version)); time.Now().Before(until) {
+		stat.HeldUntil = until
+	}
+	return stat, nil
+}
+
+// describe the content stored at a key.
+func statKey(key Key) (*BlobStat, error) {
+	return statStored(blobio, key)
+}
+
+// describe a blob through the given view of the backend.
+func statStored(backend Backend, key Key) (*BlobStat, error) {
+	attrs, err := backend.Stat(key)
+	if err != nil {
+		return nil, err
+	}
+	stat := &BlobStat{Size: attrs.Size, ModTime: attrs.ModTime}
+	meta, err := readMetadata(backend, key)
+	if err == nil {
+		// stored size differs from content size when compressed,
+		// and the digest isn't known while there are deltas
+		stat.Size = meta.contentSize()
+		if len(meta.Deltas) == 0 && openSums(key, meta) == nil {
+			stat.Digest = meta.Digest
+		}
+		stat.Version = meta.Version
+	} else if !errors.Is(err, ErrNoExist) {
+		return nil, err
+	}
+	if stat.Version == "" {
+		stat.Version = newVersionID(attrs.ModTime)
+	}
+	return stat, nil
+}
+
+// list up to pageSize blobs, optionally under one major key,
+// continuing from the token returned with the previous page.
+// The returned token is empty once there are no more blobs.
+func ListBlobs(major, pageToken string, pageSize int) ([]*pb.BlobInfo, string, error) {
+	if blobio == nil {
+		return nil, "", ErrNotSupp
+	} else if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
+	var after Key
+	if pageToken != "" {
+		var ok bool
+		if after, ok = decodeKey(pageToken); !ok {
+			return nil, "", ErrPageToken
+		}
+	}
+
+	// fetch one extra blob to learn whether another page exists
+	keys := []Key{}
+	for len(keys) <= pageSize {
+		batch, err := blobio.List(major, after, pageSize+1)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, key := range batch {
+			if _, known := pb.BlobType_value[key.BlobType]; !known {
+				continue // metadata sidecars, or unrecognized files
+			} else if len(keys) <= pageSize {
+				keys = append(keys, key)
+			}
+		}
+		if len(batch) < pageSize+1 {
+			break // backend exhausted
+		}
+		after = batch[len(batch)-1]
+	}
+
+	nextToken := ""
+	if len(keys) > pageSize {
+		keys = keys[:pageSize]
+		nextToken = encodeKey(keys[pageSize-1])
+	}
+	infos := make([]*pb.BlobInfo, len(keys))
+	for i, key := range keys {
+		infos[i] = &pb.BlobInfo{
+			BlobType: pb.BlobType(pb.BlobType_value[key.BlobType]),
+			Major:    key.Major,
+			Minor:    key.Minor,
+		}
+	}
+	return infos, nextToken, nil
+}
+
 // read the content specified by the Blob into the buffer
 func (blob *Blob) ReadContent() error {
-	var err error
-	major, minor := blob.info.Major, blob.info.Minor
-	blobtype := blob.info.BlobType.String()
-
-	// TODO the file version is simple since all files are
-	//  local and equivalent. The S3-backed version will need
-	//  a subsidiary call to map major/minor to a real ID.
-	blob.content, err = blobReadInternal(major, minor, blobtype)
+	reader, err := CreateBlobReader(blob.info, 0, 0)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	blob.content, err = io.ReadAll(reader)
 	return err
 }
 
 // write the content currently contained in the Blob buffer
 func (blob *Blob) WriteContent() error {
-	major, minor := blob.info.Major, blob.info.Minor
-	blobtype := blob.info.BlobType.String()
-
 	// ReadOnly blobs not allowed to write
 	if blob.readOnly {
 		return ErrReadOnly
 	}
-	return blobWriteInternal(major, minor, blobtype, blob.content)
+	writer, err := CreateBlobWriter(blob.info)
+	if err != nil {
+		return err
+	}
+	if _, err = writer.Write(blob.content); err != nil {
+		writer.Abort()
+		return err
+	}
+	return writer.Commit()
 }
 
 // return the underlying buffer of the Blob.
@@ -117,6 +436,11 @@ func (blob *Blob) GetSize() int {
 
 // Print summary information about the blob.
 func (blob *Blob) ToString() string {
-	return fmt.Sprintf("%s:%s, %s, %d bytes", blob.info.Major,
-		blob.info.Minor, blob.info.BlobType.String(), blob.info.Size)
+	return InfoString(blob.info)
+}
+
+// Print summary information about blob attributes.
+func InfoString(info *pb.BlobInfo) string {
+	return fmt.Sprintf("%s:%s, %s, %d bytes", info.GetMajor(),
+		info.GetMinor(), info.GetBlobType().String(), info.GetSize())
 }
@@ -5,9 +5,14 @@
 package blob
 
 import (
+	"github.com/pleb/prod/horrea/main/blob/fakes3"
 	pb "github.com/pleb/prod/horrea/pb"
 
+	"bytes"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"testing"
 )
@@ -116,7 +121,57 @@ func TestBlobBufferIO(t *testing.T) {
 
 }
 
+// storage configuration used to construct each backend under test,
+// backed by temp directories and a fake object store
+func testConfig(t *testing.T) *Config {
+	fake := fakes3.NewServer()
+	t.Cleanup(fake.Close)
+	return &Config{
+		LocalDirectory: t.TempDir(),
+		S3Endpoint:     fake.URL,
+		S3Bucket:       "horrea-test",
+		S3PathStyle:    true,
+		ReplicaDirs:    []string{t.TempDir(), t.TempDir(), t.TempDir()},
+		ShardDirs:      []string{t.TempDir(), t.TempDir(), t.TempDir(), t.TempDir(), t.TempDir()},
+		ParityShards:   2,
+		HotDir:         t.TempDir(),
+		ColdBackend:    LocalBackend,
+		ColdDir:        t.TempDir(),
+	}
+}
+
+// test that only registered backends can be configured
+func TestBackendRegistry(t *testing.T) {
+	for _, name := range []string{LocalBackend, MemoryBackend, S3Backend} {
+		if err := ConfigureBackend(name, testConfig(t)); err != nil {
+			t.Fatalf("could not configure %s backend: %s", name, err)
+		}
+	}
+	err := ConfigureBackend("nonexistent", testConfig(t))
+	if !errors.Is(err, ErrNotSupp) {
+		t.Fatalf("expected ErrNotSupp for unknown backend, got %v", err)
+	}
+	cfg := testConfig(t)
+	cfg.Compression = "nonexistent"
+	if err = ConfigureBackend(MemoryBackend, cfg); !errors.Is(err, ErrNotSupp) {
+		t.Fatalf("expected ErrNotSupp for unknown compression, got %v", err)
+	}
+}
+
+// test blob persistence against every registered backend
 func TestBlobReadWrite(t *testing.T) {
+	for _, name := range Backends() {
+		t.Run(name, func(t *testing.T) {
+			if err := ConfigureBackend(name, testConfig(t)); err != nil {
+				t.Fatalf("could not configure %s backend: %s", name, err)
+			}
+			testBlobReadWrite(t)
+		})
+	}
+}
+
+// write a blob to the configured backend and read it back
+func testBlobReadWrite(t *testing.T) {
 	// create some testdata where byte_i == i % BYTE_MAX
 	size := 1024 * 1024
 	testdata := make([]byte, size, size)
@@ -125,7 +180,6 @@ func TestBlobReadWrite(t *testing.T) {
 	}
 
 	// make the blob info struct for blobs
-	ConfigureBackend(true, "/tmp/horrea")
 	blobInfo := &pb.BlobInfo{
 		Size:     int64(size),
 		Major:    fmt.Sprintf("%d", rand.Int()),
@@ -144,8 +198,8 @@ func TestBlobReadWrite(t *testing.T) {
 	readblob := CreateBlob(blobInfo)
 	readblob.SetReadOnly()
 	err = readblob.ReadContent()
-	if err == nil {
-		t.Fatalf("expected FileNoEnt: %s", err)
+	if !errors.Is(err, ErrNoExist) {
+		t.Fatalf("expected ErrNoExist, got %v", err)
 	}
 
 	// write the data to file and read it back
@@ -163,3 +217,328 @@ func TestBlobReadWrite(t *testing.T) {
 		t.Fatalf("read content != test data, %s", err)
 	}
 }
+
+// test streamed blob writers and readers against every backend
+func TestBlobStreamIO(t *testing.T) {
+	for _, name := range Backends() {
+		t.Run(name, func(t *testing.T) {
+			if err := ConfigureBackend(name, testConfig(t)); err != nil {
+				t.Fatalf("could not configure %s backend: %s", name, err)
+			}
+			testBlobStreamIO(t)
+		})
+	}
+}
+
+// write a blob in small pieces and read it back in small pieces
+func testBlobStreamIO(t *testing.T) {
+	size := 1024*1024 + 17
+	testdata := make([]byte, size, size)
+	for b := range testdata {
+		testdata[b] = byte(rand.Intn(256))
+	}
+	blobInfo := &pb.BlobInfo{
+		Size:     int64(size),
+		Major:    fmt.Sprintf("%d", rand.Int()),
+		Minor:    fmt.Sprintf("%d", rand.Int()),
+		BlobType: pb.BlobType_Raw,
+	}
+
+	// aborted writes should not be visible
+	writer, err := CreateBlobWriter(blobInfo)
+	if err != nil {
+		t.Fatalf("CreateBlobWriter returned error: %s", err)
+	}
+	writer.Write(testdata[:1024])
+	if err = writer.Abort(); err != nil {
+		t.Fatalf("Abort returned error: %s", err)
+	}
+	if _, err = CreateBlobReader(blobInfo, 0, 0); !errors.Is(err, ErrNoExist) {
+		t.Fatalf("expected ErrNoExist after abort, got %v", err)
+	}
+
+	// committed writes should read back in full
+	writer, err = CreateBlobWriter(blobInfo)
+	if err != nil {
+		t.Fatalf("CreateBlobWriter returned error: %s", err)
+	}
+	for start := 0; start < size; start += 4096 {
+		end := min(start+4096, size)
+		if _, err = writer.Write(testdata[start:end]); err != nil {
+			t.Fatalf("Write returned error: %s", err)
+		}
+	}
+	if err = writer.Commit(); err != nil {
+		t.Fatalf("Commit returned error: %s", err)
+	}
+	reader, err := CreateBlobReader(blobInfo, 0, 0)
+	if err != nil {
+		t.Fatalf("CreateBlobReader returned error: %s", err)
+	}
+	defer reader.Close()
+	readback := []byte{}
+	chunk := make([]byte, 3000)
+	for {
+		n, err := reader.Read(chunk)
+		readback = append(readback, chunk[:n]...)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Read returned error: %s", err)
+		}
+	}
+	if err = checkBytesEqual(readback, testdata); err != nil {
+		t.Fatalf("read content != test data, %s", err)
+	}
+}
+
+// test ranged reads against every backend
+func TestBlobRangeRead(t *testing.T) {
+	for _, name := range Backends() {
+		t.Run(name, func(t *testing.T) {
+			if err := ConfigureBackend(name, testConfig(t)); err != nil {
+				t.Fatalf("could not configure %s backend: %s", name, err)
+			}
+			testBlobRangeRead(t)
+		})
+	}
+}
+
+// read several ranges of a blob, including past the end
+func testBlobRangeRead(t *testing.T) {
+	size := 64 * 1024
+	testdata := make([]byte, size, size)
+	for b := range testdata {
+		testdata[b] = byte(rand.Intn(256))
+	}
+	blobInfo := &pb.BlobInfo{
+		Size:     int64(size),
+		Major:    fmt.Sprintf("%d", rand.Int()),
+		Minor:    fmt.Sprintf("%d", rand.Int()),
+		BlobType: pb.BlobType_Raw,
+	}
+	writeblob := CreateBlob(blobInfo)
+	writeblob.AppendChunk(testdata)
+	if err := writeblob.WriteContent(); err != nil {
+		t.Fatalf("WriteContent returned error: %s", err)
+	}
+
+	// offset, length, and expected [start, end) of test data
+	ranges := [][4]int{
+		{0, 0, 0, size},
+		{4096, 4096, 4096, 8192},
+		{size - 10, 0, size - 10, size},
+		{size - 10, 4096, size - 10, size},
+		{size, 0, size, size},
+	}
+	for _, r := range ranges {
+		reader, err := CreateBlobReader(blobInfo, int64(r[0]), int64(r[1]))
+		if err != nil {
+			t.Fatalf("range [%d, +%d] returned error: %s", r[0], r[1], err)
+		}
+		readback, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatalf("range [%d, +%d] read error: %s", r[0], r[1], err)
+		}
+		if err = checkBytesEqual(readback, testdata[r[2]:r[3]]); err != nil {
+			t.Fatalf("range [%d, +%d] content mismatch: %s", r[0], r[1], err)
+		}
+	}
+
+	// ranges starting past the end, or negative, are errors
+	invalid := [][2]int64{{int64(size) + 1, 0}, {-1, 0}, {0, -1}}
+	for _, r := range invalid {
+		_, err := CreateBlobReader(blobInfo, r[0], r[1])
+		if !errors.Is(err, ErrRange) {
+			t.Fatalf("range [%d, +%d] expected ErrRange, got %v", r[0], r[1], err)
+		}
+	}
+}
+
+// test deleting, describing and listing blobs against every backend
+func TestBlobManagement(t *testing.T) {
+	for _, name := range Backends() {
+		t.Run(name, func(t *testing.T) {
+			if err := ConfigureBackend(name, testConfig(t)); err != nil {
+				t.Fatalf("could not configure %s backend: %s", name, err)
+			}
+			testBlobManagement(t)
+		})
+	}
+}
+
+// write blobs under two major keys, including keys with separator
+// characters, then stat, page through, and delete them
+func testBlobManagement(t *testing.T) {
+	majors := []string{"a.b%c", "plain"}
+	minors := []string{"1", "2.x", "3%", "4.y.", "5"}
+	for _, major := range majors {
+		for _, minor := range minors {
+			info := &pb.BlobInfo{Size: 3, Major: major, Minor: minor}
+			writeblob := CreateBlob(info)
+			writeblob.AppendChunk([]byte(minor[:1] + "xy"))
+			if err := writeblob.WriteContent(); err != nil {
+				t.Fatalf("WriteContent returned error: %s", err)
+			}
+		}
+	}
+
+	// stat reports size and recorded digest
+	stat, err := StatBlob(&pb.BlobInfo{Major: "a.b%c", Minor: "2.x"})
+	if err != nil {
+		t.Fatalf("StatBlob returned error: %s", err)
+	}
+	digest := sha256.Sum256([]byte("2xy"))
+	if stat.Size != 3 || stat.ModTime.IsZero() {
+		t.Fatalf("unexpected stat %+v", stat)
+	} else if err = checkBytesEqual(stat.Digest, digest[:]); err != nil {
+		t.Fatalf("stat digest mismatch: %s", err)
+	}
+
+	// page through one major key, two blobs at a time
+	listed, token := []string{}, ""
+	for pages := 0; ; pages++ {
+		infos, next, err := ListBlobs("a.b%c", token, 2)
+		if err != nil {
+			t.Fatalf("ListBlobs returned error: %s", err)
+		} else if pages > len(minors) {
+			t.Fatalf("listing did not terminate")
+		}
+		for _, info := range infos {
+			if info.Major != "a.b%c" {
+				t.Fatalf("listed blob under wrong major key %q", info.Major)
+			}
+			listed = append(listed, info.Minor)
+		}
+		if token = next; token == "" {
+			break
+		}
+	}
+	if len(listed) != len(minors) {
+		t.Fatalf("listed %v, expected %v", listed, minors)
+	}
+	all, next, err := ListBlobs("", "", 100)
+	if err != nil {
+		t.Fatalf("ListBlobs returned error: %s", err)
+	} else if len(all) != len(majors)*len(minors) || next != "" {
+		t.Fatalf("listed %d blobs with token %q, expected %d",
+			len(all), next, len(majors)*len(minors))
+	}
+	if _, _, err = ListBlobs("", "not-a-token", 10); !errors.Is(err, ErrPageToken) {
+		t.Fatalf("expected ErrPageToken, got %v", err)
+	}
+
+	// deleted blobs are gone, and deleting again fails
+	info := &pb.BlobInfo{Major: "plain", Minor: "3%"}
+	if err = DeleteBlob(info); err != nil {
+		t.Fatalf("DeleteBlob returned error: %s", err)
+	}
+	if err = DeleteBlob(info); !errors.Is(err, ErrNoExist) {
+		t.Fatalf("expected ErrNoExist on second delete, got %v", err)
+	}
+	if _, err = StatBlob(info); !errors.Is(err, ErrNoExist) {
+		t.Fatalf("expected ErrNoExist on stat after delete, got %v", err)
+	}
+	if _, err = readMetadata(blobio, keyFromInfo(info)); !errors.Is(err, ErrNoExist) {
+		t.Fatalf("metadata left behind after delete: %v", err)
+	}
+	remaining, _, _ := ListBlobs("plain", "", 100)
+	if len(remaining) != len(minors)-1 {
+		t.Fatalf("expected %d blobs after delete, found %d",
+			len(minors)-1, len(remaining))
+	}
+}
+
+// test server-side copies against every backend
+func TestBlobCopy(t *testing.T) {
+	for _, name := range Backends() {
+		t.Run(name, func(t *testing.T) {
+			if err := ConfigureBackend(name, testConfig(t)); err != nil {
+				t.Fatalf("could not configure %s backend: %s", name, err)
+			}
+			testBlobCopy(t)
+		})
+	}
+}
+
+// copy a blob over another, then check the copy stands apart from
+// its source as the source is rewritten and deleted
+func testBlobCopy(t *testing.T) {
+	source, testdata := writeChecksummedBlob(t, 3*checksumBlockSize+100)
+	dest, _ := writeChecksummedBlob(t, 1000)
+	dest.Digest = nil
+	if err := CopyBlob(source, dest, ""); err != nil {
+		t.Fatalf("CopyBlob returned error: %s", err)
+	}
+	content, err := readRange(dest, checksumBlockSize, 200)
+	if err != nil {
+		t.Fatalf("could not read copy: %s", err)
+	} else if err = checkBytesEqual(content, testdata[checksumBlockSize:checksumBlockSize+200]); err != nil {
+		t.Fatalf("copy mismatch: %s", err)
+	}
+	sourceStat, _ := StatBlob(source)
+	destStat, err := StatBlob(dest)
+	if err != nil {
+		t.Fatalf("StatBlob returned error: %s", err)
+	} else if destStat.Size != int64(len(testdata)) || !bytes.Equal(destStat.Digest, sourceStat.Digest) {
+		t.Fatalf("copy stat %+v doesn't match source %+v", destStat, sourceStat)
+	} else if destStat.Version == sourceStat.Version {
+		t.Fatalf("copy shares its source's version %s", destStat.Version)
+	}
+
+	rewritten := CreateBlob(&pb.BlobInfo{Size: 9, Major: source.Major, Minor: source.Minor})
+	rewritten.AppendChunk([]byte("rewritten"))
+	if err = rewritten.WriteContent(); err != nil {
+		t.Fatalf("WriteContent returned error: %s", err)
+	}
+	if err = DeleteBlob(source); err != nil {
+		t.Fatalf("DeleteBlob returned error: %s", err)
+	}
+	if content, err = readRange(dest, 0, 0); err != nil {
+		t.Fatalf("could not read copy: %s", err)
+	} else if err = checkBytesEqual(content, testdata); err != nil {
+		t.Fatalf("copy changed with its source: %s", err)
+	}
+	if err = CopyBlob(source, dest, ""); !errors.Is(err, ErrNoExist) {
+		t.Fatalf("expected ErrNoExist copying a deleted blob, got %v", err)
+	}
+	if err = CopyBlob(dest, dest, ""); err != nil {
+		t.Fatalf("CopyBlob onto itself returned error: %s", err)
+	}
+}
+
+// test that keys which could escape a directory are rejected
+// by every backend
+func TestBlobUnsafeKeys(t *testing.T) {
+	for _, name := range Backends() {
+		t.Run(name, func(t *testing.T) {
+			if err := ConfigureBackend(name, testConfig(t)); err != nil {
+				t.Fatalf("could not configure %s backend: %s", name, err)
+			}
+			unsafe := []*pb.BlobInfo{
+				{Size: 1, Major: "a/b", Minor: "c"},
+				{Size: 1, Major: "a", Minor: ".."},
+				{Size: 1, Major: "..", Minor: "b"},
+				{Size: 1, Major: "a", Minor: "b\\c"},
+				{Size: 1, Major: "a", Minor: "x..y"},
+			}
+			for _, info := range unsafe {
+				writeblob := CreateBlob(info)
+				writeblob.AppendChunk([]byte("x"))
+				if err := writeblob.WriteContent(); !errors.Is(err, ErrKey) {
+					t.Fatalf("expected ErrKey writing %s, got %v", InfoString(info), err)
+				}
+				if _, err := CreateBlobReader(info, 0, 0); !errors.Is(err, ErrKey) {
+					t.Fatalf("expected ErrKey reading %s, got %v", InfoString(info), err)
+				}
+				if err := DeleteBlob(info); !errors.Is(err, ErrKey) {
+					t.Fatalf("expected ErrKey deleting %s, got %v", InfoString(info), err)
+				}
+				if err := CopyBlob(info, info, ""); !errors.Is(err, ErrKey) {
+					t.Fatalf("expected ErrKey copying %s, got %v", InfoString(info), err)
+				}
+			}
+		})
+	}
+}
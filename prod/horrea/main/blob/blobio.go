@@ -5,59 +5,364 @@
 package blob
 
 import (
+	"github.com/pleb/prod/horrea/main/codec"
+	pb "github.com/pleb/prod/horrea/pb"
+
+	"fmt"
+	"hash/fnv"
+	"io"
 	"log"
-	"os"
-	"path/filepath"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
-type BlobWriter struct {
-	initialized    bool   // was the IO interface initialized?
-	localbacked    bool   // is the blob package running in local file mode?
-	localdirectory string // which directory to use for storage
+// Storage key identifying a persisted blob.
+type Key struct {
+	Major    string // major key string.
+	Minor    string // minor key string.
+	BlobType string // blob type name.
+}
+
+// Pending write to a backend. Content only becomes visible to
+// readers once committed, and is discarded if aborted.
+type Writer interface {
+	io.Writer
+	Commit() error // persist everything written so far.
+	Abort() error  // discard everything written so far.
+}
+
+// Attributes of persisted content.
+type Attrs struct {
+	Size    int64     // content size in bytes.
+	ModTime time.Time // time content was last committed.
+}
+
+// Storage backend for blob content. Readers cover the byte
+// range starting at offset, with length 0 reading to the end.
+// Listing returns up to limit keys under a major key (or all
+// keys if major is empty) that sort after the given key in the
+// backend's own order, starting from the beginning if after is
+// the zero Key.
+type Backend interface {
+	Reader(key Key, offset, length int64) (io.ReadCloser, error)
+	Writer(key Key) (Writer, error) // start a new write.
+	Delete(key Key) error           // remove persisted content.
+	Stat(key Key) (Attrs, error)    // describe persisted content.
+	List(major string, after Key, limit int) ([]Key, error)
+}
+
+// Backend able to copy content to another key without copying
+// its bytes, so both keys share storage until either is rewritten
+// or deleted. Content at the destination is replaced.
+type Cloner interface {
+	Clone(from, to Key) error
+}
+
+// Backend with a view of itself that reads content without the
+// side effects of client reads, such as caching it, recording the
+// access or moving it between tiers. Used by passes over the whole
+// store, which shouldn't disturb what clients are reading.
+type quieter interface {
+	quiet() Backend
+}
+
+// return the quiet view of a backend, or the backend itself if
+// its reads have no side effects.
+func quiet(backend Backend) Backend {
+	if q, ok := backend.(quieter); ok {
+		return q.quiet()
+	}
+	return backend
+}
+
+// Storage configuration handed to backend constructors.
+type Config struct {
+	LocalDirectory string          // directory used by the local backend.
+	S3Endpoint     string          // object store endpoint, empty for AWS.
+	S3Region       string          // object store region.
+	S3Bucket       string          // bucket holding all blobs.
+	S3Prefix       string          // object key prefix for all blobs.
+	S3AccessKey    string          // access key ID, anonymous if empty.
+	S3SecretKey    string          // secret access key.
+	S3PathStyle    bool            // address buckets by path, not hostname.
+	S3PartSize     int             // multipart upload part size in bytes.
+	Compression    string          // codec for content at rest, "" for none.
+	Dedup          bool            // store content as deduplicated chunks.
+	CacheSize      int64           // bytes of read cache in memory, 0 for none.
+	DiskCacheDir   string          // directory of the on-disk read cache.
+	DiskCacheSize  int64           // bytes of read cache on disk, 0 for none.
+	Versioning     bool            // keep replaced content as versions.
+	KeepVersions   int             // old versions kept per key, 0 for all.
+	KeepVersionFor time.Duration   // age old versions are kept, 0 for ever.
+	ReplicaDirs    []string        // roots used by the replicated backend.
+	WriteQuorum    int             // replicas that must commit, 0 for a majority.
+	ShardDirs      []string        // roots used by the erasure backend, one per shard.
+	ParityShards   int             // erasure parity shards, of the shard roots.
+	MasterKeys     [][]byte        // keys for encryption at rest, newest last.
+	PackThreshold  int64           // largest blob packed, 0 to not pack.
+	PackSize       int64           // bytes per compacted pack, 0 for default.
+	HotDir         string          // directory of the tiered backend's hot tier.
+	ColdBackend    string          // backend name of the cold tier.
+	ColdDir        string          // local directory of the cold tier.
+	ColdAfter      time.Duration   // time unread before blobs move cold, 0 for never.
+	HotCapacity    int64           // bytes the hot tier may hold, 0 for any.
+	Lifecycle      []LifecycleRule // expiry and retention rules.
 }
 
-var blobio = &BlobWriter{}
+// Backend constructor, registered under a unique name.
+type BackendFactory func(cfg *Config) (Backend, error)
+
+// Names of built-in backends.
+const (
+	LocalBackend      = "local"
+	MemoryBackend     = "memory"
+	S3Backend         = "s3"
+	ReplicatedBackend = "replicated"
+	ErasureBackend    = "erasure"
+	TieredBackend     = "tiered"
+)
+
+var backends = map[string]BackendFactory{}
+
+var blobio Backend
 
-func ConfigureBackend(localbacked bool, localdirectory string) error {
-	// mark the storage IO as initialized
-	blobio.initialized = true
-	// configure local IO if required
-	if localbacked {
-		blobio.localbacked = true
-		blobio.localdirectory = localdirectory
+// codec applied to newly written content.
+var storeCodec string
 
-		// if local directory does not exist, create it
-		log.Printf("Creating local file directory %s", localdirectory)
-		err := os.MkdirAll(localdirectory, 0755)
+// register a backend constructor under the given name.
+func RegisterBackend(name string, factory BackendFactory) {
+	if _, ok := backends[name]; ok {
+		panic(fmt.Sprintf("blob backend %q registered twice", name))
+	}
+	backends[name] = factory
+}
+
+// return the names of all registered backends, in sorted order.
+func Backends() []string {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// construct the named backend and use it for all blob IO.
+func ConfigureBackend(name string, cfg *Config) error {
+	factory, ok := backends[name]
+	if !ok {
+		return fmt.Errorf("%w: unknown backend %q", ErrNotSupp, name)
+	}
+	if !codec.Supported(cfg.Compression) {
+		return fmt.Errorf("%w: unknown compression %q", ErrNotSupp, cfg.Compression)
+	}
+	keys, err := newKeyring(cfg.MasterKeys)
+	if err != nil {
+		return err
+	}
+	backend, err := factory(cfg)
+	if err != nil {
+		return err
+	}
+	log.Printf("Using %s blob backend", name)
+	if keys != nil {
+		log.Printf("Encrypting blob content with master key %s", keys.current)
+	}
+	blobReplicas, _ = backend.(*replicatedBackend)
+	blobShards, _ = backend.(*shardBackend)
+	blobTiers, _ = backend.(*tieredBackend)
+	blobPacks = nil
+	if cfg.PackThreshold > 0 {
+		log.Printf("Packing blobs of up to %d bytes", cfg.PackThreshold)
+		blobPacks, err = newPackBackend(backend, cfg.PackThreshold, cfg.PackSize)
+		if err != nil {
+			return err
+		}
+		backend = blobPacks
+	}
+	if cfg.Dedup {
+		log.Printf("Deduplicating blob content")
+		if keys != nil {
+			log.Printf("Encrypted content is unique per blob, so only copies deduplicate")
+		}
+		backend = newDedupBackend(backend)
+	}
+	blobCache = nil
+	if cfg.CacheSize > 0 || (cfg.DiskCacheDir != "" && cfg.DiskCacheSize > 0) {
+		log.Printf("Caching reads, %d bytes in memory, %d on disk",
+			cfg.CacheSize, cfg.DiskCacheSize)
+		backend, err = newCacheBackend(backend, cfg.CacheSize, cfg.DiskCacheDir, cfg.DiskCacheSize)
 		if err != nil {
 			return err
 		}
+		blobCache = backend.(*cacheBackend)
+	}
+	blobio = backend
+	storeCodec = cfg.Compression
+	lifecycle = cfg.Lifecycle
+	if len(lifecycle) > 0 {
+		log.Printf("Applying %d lifecycle rules", len(lifecycle))
+	}
+	blobKeys = keys
+	versioning = retention{
+		enabled: cfg.Versioning,
+		keep:    cfg.KeepVersions,
+		keepFor: cfg.KeepVersionFor,
 	}
 	return nil
 }
 
-// construct filepath from identifiers + blob
-func constructFilePath(major, minor, blobtype string) string {
-	filename := major + "." + minor + "." + blobtype
-	return filepath.Join(blobio.localdirectory, filename)
+// return the storage key for the given blob attributes.
+func keyFromInfo(info *pb.BlobInfo) Key {
+	return Key{
+		Major:    info.GetMajor(),
+		Minor:    info.GetMinor(),
+		BlobType: info.GetBlobType().String(),
+	}
 }
 
-// read a byte buffer from disk or cloud storage
-func blobReadInternal(major, minor, blobtype string) ([]byte, error) {
-	if !blobio.localbacked {
+// report whether a key is safe to store. No part may hold a
+// path separator or "..", even though flat names escape them.
+func validKey(key Key) bool {
+	for _, part := range []string{key.Major, key.Minor, key.BlobType} {
+		if strings.ContainsAny(part, "/\\\x00") || strings.Contains(part, "..") {
+			return false
+		}
+	}
+	return true
+}
+
+// reader over part of a stream, closing the whole stream.
+type rangeReader struct {
+	io.Reader
+	io.Closer
+}
+
+// limit a reader to length bytes, or leave it as-is if 0.
+func limitReader(reader io.ReadCloser, length int64) io.ReadCloser {
+	if length == 0 {
+		return reader
+	}
+	return &rangeReader{io.LimitReader(reader, length), reader}
+}
+
+// lock the stripes of a lock set that keys fall in, in stripe
+// order so callers locking several keys can't deadlock. Returns
+// the unlock function.
+func lockStripes(locks []sync.Mutex, keys ...Key) func() {
+	stripes := []int{}
+	for _, key := range keys {
+		hash := fnv.New32a()
+		hash.Write([]byte(encodeKey(key)))
+		stripe := int(hash.Sum32() % uint32(len(locks)))
+		if !slices.Contains(stripes, stripe) {
+			stripes = append(stripes, stripe)
+		}
+	}
+	sort.Ints(stripes)
+	for _, stripe := range stripes {
+		locks[stripe].Lock()
+	}
+	return func() {
+		for _, stripe := range stripes {
+			locks[stripe].Unlock()
+		}
+	}
+}
+
+// return a readable name for the key, for logging.
+func (key Key) String() string {
+	return key.Major + "." + key.Minor + "." + key.BlobType
+}
+
+// escape characters that separate key parts in flat names.
+var keyEscaper = strings.NewReplacer("%", "%25", ".", "%2E", "/", "%2F")
+
+// escape a single key part so it contains no separators.
+func escapeKeyPart(part string) string {
+	return keyEscaper.Replace(part)
+}
+
+// return a flat name for the key, unique across keys and
+// reversible with decodeKey.
+func encodeKey(key Key) string {
+	return escapeKeyPart(key.Major) + "." + escapeKeyPart(key.Minor) +
+		"." + key.BlobType
+}
+
+// parse a name produced by encodeKey.
+func decodeKey(name string) (Key, bool) {
+	parts := strings.SplitN(name, ".", 3)
+	if len(parts) != 3 {
+		return Key{}, false
+	}
+	major, err := url.PathUnescape(parts[0])
+	if err != nil {
+		return Key{}, false
+	}
+	minor, err := url.PathUnescape(parts[1])
+	if err != nil {
+		return Key{}, false
+	}
+	return Key{Major: major, Minor: minor, BlobType: parts[2]}, true
+}
+
+// read a byte buffer from the given backend
+func blobReadInternal(backend Backend, key Key) ([]byte, error) {
+	if backend == nil {
 		return nil, ErrNotSupp
 	}
-	readpath := constructFilePath(major, minor, blobtype)
-	log.Printf("Reading local file content from %s", readpath)
-	return os.ReadFile(readpath)
+	reader, err := backend.Reader(key, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
 }
 
-// persist a byte buffer to disk or cloud storage
-func blobWriteInternal(major, minor, blobtype string, content []byte) error {
-	if !blobio.localbacked {
+// persist a byte buffer to the given backend
+func blobWriteInternal(backend Backend, key Key, content []byte) error {
+	if backend == nil {
 		return ErrNotSupp
 	}
-	writepath := constructFilePath(major, minor, blobtype)
-	log.Printf("Writing local file content to %s", writepath)
-	return os.WriteFile(writepath, content, 0644)
+	writer, err := backend.Writer(key)
+	if err != nil {
+		return err
+	}
+	if _, err = writer.Write(content); err != nil {
+		writer.Abort()
+		return err
+	}
+	return writer.Commit()
+}
+
+// copy content between keys as it is, unverified, sharing storage
+// if the backend can clone and streaming a copy if not.
+func cloneContent(backend Backend, from, to Key) error {
+	if cloner, ok := backend.(Cloner); ok {
+		return cloner.Clone(from, to)
+	}
+	return streamContent(backend, from, to)
+}
+
+// copy content between keys by reading it back and writing it.
+func streamContent(backend Backend, from, to Key) error {
+	reader, err := backend.Reader(from, 0, 0)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	writer, err := backend.Writer(to)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(writer, reader); err != nil {
+		writer.Abort()
+		return err
+	}
+	return writer.Commit()
 }
@@ -0,0 +1,445 @@
+/*
+ * Read cache in front of a storage backend.
+ */
+
+/*
+ * Whole blobs are cached in a bounded in-memory LRU, optionally
+ * backed by a larger on-disk LRU, so many clients reading the same
+ * blob only fetch it from the backend once. Blobs larger than a
+ * quarter of a tier's capacity are never cached in that tier, so a
+ * single large read can't flush everything else.
+ *
+ * A miss starts a fill that streams the blob into a disk tier file,
+ * and into memory only if it fits the memory tier, so a fill never
+ * holds more than that in memory. Readers missing a key while it is
+ * filled share the one fill. Whole reads wait for it and are served
+ * from the cache; ranged reads are served by the backend straight
+ * away, leaving the fill to run on. Disk hits stream from the file.
+ *
+ * Writes and deletes through the cache invalidate the key. A fill
+ * racing with a write is dropped rather than cached, so readers never
+ * see content older than the last commit. Writes made by other
+ * servers sharing the backend aren't seen, so the cache assumes one
+ * server owns the store.
+ *
+ * The disk tier is emptied on startup, since its entries may be
+ * stale by then.
+ *
+ * Quiet reads, made by scrubs, exports and other passes over the
+ * whole store, go straight to the backend and leave the cache be.
+ */
+
+package blob
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+type cacheBackend struct {
+	inner  Backend    // backend being cached.
+	mu     sync.Mutex // guards the tiers and counters.
+	memory *lruCache  // in-memory tier.
+	disk   *lruCache  // on-disk tier, nil if disabled.
+	dir    string     // directory of the disk tier.
+	writes uint64     // invalidations so far.
+	stats  CacheStats // hit and miss counters.
+
+	fills map[Key]*cacheFill // fills under way, by key.
+}
+
+// Fill of one key from the backend, shared by every reader that
+// misses it while it runs.
+type cacheFill struct {
+	done chan struct{} // closed once the fill ends.
+	err  error         // why the fill failed, if it did.
+}
+
+// Cache hit and miss counters.
+type CacheStats struct {
+	MemoryHits int64 // reads served from memory.
+	DiskHits   int64 // reads served from disk.
+	Misses     int64 // reads passed to the backend.
+}
+
+// Size-bounded LRU index. Memory entries hold their content,
+// disk entries are files named after their key.
+type lruCache struct {
+	capacity int64                 // bytes allowed in the tier.
+	used     int64                 // bytes currently cached.
+	order    *list.List            // entries, most recent first.
+	entries  map[Key]*list.Element // entries by key.
+	evict    func(key Key)         // called as an entry is dropped.
+}
+
+type cacheEntry struct {
+	key     Key    // cached key.
+	size    int64  // content size in bytes.
+	content []byte // content, for memory entries.
+}
+
+type cacheWriter struct {
+	Writer               // pending backend write.
+	cache  *cacheBackend // owning cache.
+	key    Key           // key being written.
+}
+
+// the active cache, for its counters.
+var blobCache *cacheBackend
+
+// wrap a backend with a memory cache of the given size, and a
+// disk cache if a directory is given.
+func newCacheBackend(inner Backend, memorySize int64, dir string, diskSize int64) (Backend, error) {
+	cache := &cacheBackend{
+		inner:  inner,
+		memory: newLRUCache(memorySize, nil),
+		fills:  map[Key]*cacheFill{},
+	}
+	if dir != "" && diskSize > 0 {
+		if err := os.RemoveAll(dir); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		cache.dir = dir
+		cache.disk = newLRUCache(diskSize, func(key Key) {
+			os.Remove(cache.diskPath(key))
+		})
+	}
+	return cache, nil
+}
+
+func newLRUCache(capacity int64, evict func(key Key)) *lruCache {
+	return &lruCache{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[Key]*list.Element),
+		evict:    evict,
+	}
+}
+
+// report whether content of the given size may be cached.
+func (lru *lruCache) fits(size int64) bool {
+	return lru != nil && size <= lru.capacity/4
+}
+
+// look up an entry, marking it recently used.
+func (lru *lruCache) get(key Key) *cacheEntry {
+	if lru == nil {
+		return nil
+	}
+	elem, ok := lru.entries[key]
+	if !ok {
+		return nil
+	}
+	lru.order.MoveToFront(elem)
+	return elem.Value.(*cacheEntry)
+}
+
+// add an entry, evicting the least recently used to make room.
+func (lru *lruCache) add(entry *cacheEntry) {
+	lru.remove(entry.key)
+	for lru.used+entry.size > lru.capacity && lru.order.Len() > 0 {
+		lru.remove(lru.order.Back().Value.(*cacheEntry).key)
+	}
+	lru.entries[entry.key] = lru.order.PushFront(entry)
+	lru.used += entry.size
+}
+
+// drop an entry, if present.
+func (lru *lruCache) remove(key Key) {
+	if lru == nil {
+		return
+	}
+	elem, ok := lru.entries[key]
+	if !ok {
+		return
+	}
+	entry := lru.order.Remove(elem).(*cacheEntry)
+	delete(lru.entries, key)
+	lru.used -= entry.size
+	if lru.evict != nil {
+		lru.evict(key)
+	}
+}
+
+// return the file holding a disk entry.
+func (cache *cacheBackend) diskPath(key Key) string {
+	return filepath.Join(cache.dir, encodeKey(key))
+}
+
+// return a reader over the cached content of a key, or nil on a
+// miss. Hits are counted if asked, and misses too.
+func (cache *cacheBackend) cached(key Key, offset, length int64, count bool) (io.ReadCloser, error) {
+	cache.mu.Lock()
+	if entry := cache.memory.get(key); entry != nil {
+		if count {
+			cache.stats.MemoryHits++
+		}
+		cache.mu.Unlock()
+		return sliceReader(entry.content, offset, length)
+	}
+	entry := cache.disk.get(key)
+	writes := cache.writes
+	if entry == nil {
+		if count {
+			cache.stats.Misses++
+		}
+		cache.mu.Unlock()
+		return nil, nil
+	}
+	cache.mu.Unlock()
+
+	// open outside the lock, then check nothing changed. An open
+	// file stays readable if the entry is evicted after.
+	var content []byte
+	file, err := os.Open(cache.diskPath(key))
+	if err == nil {
+		var info os.FileInfo
+		if info, err = file.Stat(); err == nil && info.Size() != entry.size {
+			err = ErrCorrupt
+		} else if err == nil && cache.memory.fits(entry.size) {
+			content, err = io.ReadAll(file)
+		}
+		if err != nil || content != nil {
+			file.Close()
+		}
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if err != nil || cache.writes != writes || cache.disk.get(key) != entry {
+		if err == nil && content == nil {
+			file.Close()
+		} else if err != nil && cache.disk.get(key) == entry {
+			log.Printf("Dropping unreadable cache entry for %s", key)
+			cache.disk.remove(key)
+		}
+		if count {
+			cache.stats.Misses++
+		}
+		return nil, nil
+	}
+	if count {
+		cache.stats.DiskHits++
+	}
+	if content != nil {
+		cache.memory.add(&cacheEntry{key: key, size: entry.size, content: content})
+		return sliceReader(content, offset, length)
+	}
+	if offset > entry.size {
+		file.Close()
+		return nil, ErrRange
+	} else if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return limitReader(file, length), nil
+}
+
+// return a reader over a range of content held in memory.
+func sliceReader(content []byte, offset, length int64) (io.ReadCloser, error) {
+	if offset > int64(len(content)) {
+		return nil, ErrRange
+	}
+	reader := io.NopCloser(bytes.NewReader(content[offset:]))
+	return limitReader(reader, length), nil
+}
+
+// start filling the cache with a key in the background, or join
+// the fill already under way.
+func (cache *cacheBackend) startFill(key Key) *cacheFill {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if fill, ok := cache.fills[key]; ok {
+		return fill
+	}
+	fill := &cacheFill{done: make(chan struct{})}
+	cache.fills[key] = fill
+	writes := cache.writes
+	go func() {
+		fill.err = cache.fill(key, writes)
+		cache.mu.Lock()
+		if cache.fills[key] == fill {
+			delete(cache.fills, key)
+		}
+		cache.mu.Unlock()
+		close(fill.done)
+	}()
+	return fill
+}
+
+// stream a key from the backend into whichever tiers it fits,
+// caching it unless anything was written since the given count.
+// Content is only held in memory if it fits the memory tier.
+func (cache *cacheBackend) fill(key Key, writes uint64) error {
+	attrs, err := cache.inner.Stat(key)
+	if err != nil {
+		return err
+	}
+	var content *bytes.Buffer
+	if cache.memory.fits(attrs.Size) {
+		content = bytes.NewBuffer(make([]byte, 0, attrs.Size))
+	}
+	var file *os.File
+	if cache.disk.fits(attrs.Size) {
+		if file, err = os.CreateTemp(cache.dir, ".fill.*"); err != nil {
+			log.Printf("Unable to fill disk cache, %v", err)
+			file = nil
+		}
+	}
+	if content == nil && file == nil {
+		return nil // too large to cache
+	}
+	dropFile := func() {
+		if file != nil {
+			file.Close()
+			os.Remove(file.Name())
+			file = nil
+		}
+	}
+	defer dropFile()
+
+	reader, err := cache.inner.Reader(key, 0, 0)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	// read one byte past the size, to spot content that changed
+	source := io.LimitReader(reader, attrs.Size+1)
+	buffer := make([]byte, 256*1024)
+	var size int64
+	for {
+		n, err := source.Read(buffer)
+		size += int64(n)
+		if content != nil {
+			content.Write(buffer[:n])
+		}
+		if file != nil && n > 0 {
+			if _, err := file.Write(buffer[:n]); err != nil {
+				log.Printf("Unable to fill disk cache, %v", err)
+				dropFile()
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	if file != nil {
+		if err = file.Close(); err != nil {
+			os.Remove(file.Name())
+			file = nil
+		}
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if cache.writes != writes || size != attrs.Size {
+		return nil // written since the fill began, so may be stale
+	}
+	if content != nil {
+		cache.memory.add(&cacheEntry{key: key, size: size, content: content.Bytes()})
+	}
+	if file != nil {
+		cache.disk.remove(key) // so its eviction can't take the new file
+		if err = os.Rename(file.Name(), cache.diskPath(key)); err == nil {
+			cache.disk.add(&cacheEntry{key: key, size: size})
+			file = nil
+		}
+	}
+	return nil
+}
+
+// drop a key from every tier, and let later reads start a new fill
+// rather than wait on one that may be stale.
+func (cache *cacheBackend) invalidate(key Key) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.writes++
+	cache.memory.remove(key)
+	cache.disk.remove(key)
+	delete(cache.fills, key)
+}
+
+// return a reader over cached content. On a miss, whole reads wait
+// on a fill shared by every reader of the key, and ranged reads go
+// to the backend while the fill runs.
+func (cache *cacheBackend) Reader(key Key, offset, length int64) (io.ReadCloser, error) {
+	if reader, err := cache.cached(key, offset, length, true); reader != nil || err != nil {
+		return reader, err
+	}
+	fill := cache.startFill(key)
+	if offset > 0 || length > 0 {
+		return cache.inner.Reader(key, offset, length)
+	}
+	<-fill.done
+	if fill.err != nil {
+		return nil, fill.err
+	}
+	if reader, err := cache.cached(key, offset, length, false); reader != nil || err != nil {
+		return reader, err
+	}
+	// too large to cache, or written during the fill
+	return cache.inner.Reader(key, offset, length)
+}
+
+// return the backend's quiet view, bypassing the cache so passes
+// over the whole store don't flush it.
+func (cache *cacheBackend) quiet() Backend {
+	return quiet(cache.inner)
+}
+
+// return a writer that invalidates the key once committed.
+func (cache *cacheBackend) Writer(key Key) (Writer, error) {
+	writer, err := cache.inner.Writer(key)
+	if err != nil {
+		return nil, err
+	}
+	return &cacheWriter{Writer: writer, cache: cache, key: key}, nil
+}
+
+func (writer *cacheWriter) Commit() error {
+	err := writer.Writer.Commit()
+	writer.cache.invalidate(writer.key)
+	return err
+}
+
+// delete a key and drop it from the cache.
+func (cache *cacheBackend) Delete(key Key) error {
+	err := cache.inner.Delete(key)
+	cache.invalidate(key)
+	return err
+}
+
+// clone a key in the backend and drop the destination from the cache.
+func (cache *cacheBackend) Clone(from, to Key) error {
+	err := cloneContent(cache.inner, from, to)
+	cache.invalidate(to)
+	return err
+}
+
+func (cache *cacheBackend) Stat(key Key) (Attrs, error) {
+	return cache.inner.Stat(key)
+}
+
+func (cache *cacheBackend) List(major string, after Key, limit int) ([]Key, error) {
+	return cache.inner.List(major, after, limit)
+}
+
+// return the read cache counters, or ErrNotSupp if there's no cache.
+func ReadCacheStats() (CacheStats, error) {
+	if blobCache == nil {
+		return CacheStats{}, ErrNotSupp
+	}
+	blobCache.mu.Lock()
+	defer blobCache.mu.Unlock()
+	return blobCache.stats, nil
+}
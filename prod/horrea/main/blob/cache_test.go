@@ -0,0 +1,244 @@
+/*
+ * Tests for the read cache layer.
+ */
+
+package blob
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// configure the memory backend behind a cache with the given sizes
+func configureCache(t *testing.T, memorySize, diskSize int64) {
+	cfg := testConfig(t)
+	cfg.CacheSize = memorySize
+	cfg.DiskCacheDir = filepath.Join(t.TempDir(), "cache")
+	cfg.DiskCacheSize = diskSize
+	if err := ConfigureBackend(MemoryBackend, cfg); err != nil {
+		t.Fatalf("could not configure cached backend: %s", err)
+	}
+}
+
+// read a key through the cache and check its content
+func checkCachedRead(t *testing.T, key Key, expect string) {
+	content, err := blobReadInternal(blobio, key)
+	if err != nil {
+		t.Fatalf("could not read %s: %s", key, err)
+	} else if string(content) != expect {
+		t.Fatalf("expected %q for %s, found %q", expect, key, content)
+	}
+}
+
+// check the cache counters
+func checkCacheStats(t *testing.T, expect CacheStats) {
+	stats, err := ReadCacheStats()
+	if err != nil {
+		t.Fatalf("could not read cache stats: %s", err)
+	} else if stats != expect {
+		t.Fatalf("expected cache stats %+v, found %+v", expect, stats)
+	}
+}
+
+// test that repeated reads hit memory and writes invalidate
+func TestCacheHitAndInvalidate(t *testing.T) {
+	configureCache(t, 1024, 0)
+	key := Key{Major: "major", Minor: "minor", BlobType: "Raw"}
+	if err := blobWriteInternal(blobio, key, []byte("first")); err != nil {
+		t.Fatalf("could not write content: %s", err)
+	}
+	checkCachedRead(t, key, "first")
+	checkCachedRead(t, key, "first")
+	checkCacheStats(t, CacheStats{MemoryHits: 1, Misses: 1})
+
+	// ranged reads are served from the cached copy
+	reader, err := blobio.Reader(key, 1, 3)
+	if err != nil {
+		t.Fatalf("could not open ranged reader: %s", err)
+	}
+	buffer := make([]byte, 10)
+	if n, _ := reader.Read(buffer); string(buffer[:n]) != "irs" {
+		t.Fatalf("expected cached range \"irs\", found %q", buffer[:n])
+	}
+	checkCacheStats(t, CacheStats{MemoryHits: 2, Misses: 1})
+
+	// overwrites and deletes are never served stale
+	if err = blobWriteInternal(blobio, key, []byte("second")); err != nil {
+		t.Fatalf("could not overwrite content: %s", err)
+	}
+	checkCachedRead(t, key, "second")
+	if err = blobio.Delete(key); err != nil {
+		t.Fatalf("could not delete content: %s", err)
+	}
+	if _, err = blobReadInternal(blobio, key); err == nil {
+		t.Fatalf("read deleted content from cache")
+	}
+}
+
+// test least recently used eviction and the size limit
+func TestCacheEviction(t *testing.T) {
+	configureCache(t, 400, 0)
+	keys := []Key{}
+	for _, minor := range []string{"a", "b", "c", "d", "e", "large"} {
+		key := Key{Major: "major", Minor: minor, BlobType: "Raw"}
+		size := 100
+		if minor == "large" {
+			size = 101 // over a quarter of the cache
+		}
+		if err := blobWriteInternal(blobio, key, make([]byte, size)); err != nil {
+			t.Fatalf("could not write %s: %s", key, err)
+		}
+		keys = append(keys, key)
+	}
+	read := func(i int) {
+		if _, err := blobReadInternal(blobio, keys[i]); err != nil {
+			t.Fatalf("could not read %s: %s", keys[i], err)
+		}
+	}
+
+	// a to d fill the cache, touching a makes b the oldest
+	for i := 0; i < 4; i++ {
+		read(i)
+	}
+	read(0)
+	checkCacheStats(t, CacheStats{MemoryHits: 1, Misses: 4})
+	read(4)
+	read(0)
+	read(1)
+	checkCacheStats(t, CacheStats{MemoryHits: 2, Misses: 6})
+
+	// too large to cache, so every read misses
+	read(5)
+	read(5)
+	checkCacheStats(t, CacheStats{MemoryHits: 2, Misses: 8})
+}
+
+// test that the disk tier serves reads evicted from memory
+func TestCacheDiskTier(t *testing.T) {
+	configureCache(t, 0, 1024)
+	key := Key{Major: "major", Minor: "minor", BlobType: "Raw"}
+	if err := blobWriteInternal(blobio, key, []byte("on disk")); err != nil {
+		t.Fatalf("could not write content: %s", err)
+	}
+	checkCachedRead(t, key, "on disk")
+	checkCachedRead(t, key, "on disk")
+	checkCacheStats(t, CacheStats{DiskHits: 1, Misses: 1})
+	if err := blobWriteInternal(blobio, key, []byte("rewritten")); err != nil {
+		t.Fatalf("could not overwrite content: %s", err)
+	}
+	checkCachedRead(t, key, "rewritten")
+	checkCacheStats(t, CacheStats{DiskHits: 1, Misses: 2})
+}
+
+// backend counting the readers opened on it, each held until the
+// gate is closed
+type gatedBackend struct {
+	Backend
+	gate    chan struct{}
+	mu      sync.Mutex
+	readers int
+}
+
+func (gated *gatedBackend) Reader(key Key, offset, length int64) (io.ReadCloser, error) {
+	gated.mu.Lock()
+	gated.readers++
+	gated.mu.Unlock()
+	<-gated.gate
+	return gated.Backend.Reader(key, offset, length)
+}
+
+// wait for the fills under way in a cache to end
+func waitFills(cache *cacheBackend) {
+	for {
+		cache.mu.Lock()
+		fills := make([]*cacheFill, 0, len(cache.fills))
+		for _, fill := range cache.fills {
+			fills = append(fills, fill)
+		}
+		cache.mu.Unlock()
+		if len(fills) == 0 {
+			return
+		}
+		for _, fill := range fills {
+			<-fill.done
+		}
+	}
+}
+
+// test concurrent misses on a key share one backend read
+func TestCacheSharedFill(t *testing.T) {
+	inner, _ := newMemoryBackend(testConfig(t))
+	key := Key{Major: "major", Minor: "minor", BlobType: "Raw"}
+	content := bytes.Repeat([]byte("shared "), 1000)
+	if err := blobWriteInternal(inner, key, content); err != nil {
+		t.Fatalf("could not write content: %s", err)
+	}
+	gated := &gatedBackend{Backend: inner, gate: make(chan struct{})}
+	cache, err := newCacheBackend(gated, 0, filepath.Join(t.TempDir(), "cache"), 1<<20)
+	if err != nil {
+		t.Fatalf("could not create cache: %s", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			read, err := blobReadInternal(cache, key)
+			if err == nil && !bytes.Equal(read, content) {
+				err = fmt.Errorf("read %d bytes, expected %d", len(read), len(content))
+			}
+			errs <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond) // let every reader miss
+	close(gated.gate)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("concurrent read failed: %s", err)
+		}
+	}
+	if gated.readers != 1 {
+		t.Fatalf("expected one backend read, found %d", gated.readers)
+	}
+}
+
+// test ranged misses are served by the backend while the blob
+// fills in the background
+func TestCacheRangedMiss(t *testing.T) {
+	configureCache(t, 0, 1<<20)
+	key := Key{Major: "major", Minor: "minor", BlobType: "Raw"}
+	if err := blobWriteInternal(blobio, key, []byte("ranged content")); err != nil {
+		t.Fatalf("could not write content: %s", err)
+	}
+	reader, err := blobio.Reader(key, 7, 3)
+	if err != nil {
+		t.Fatalf("could not open ranged reader: %s", err)
+	}
+	if read, _ := io.ReadAll(reader); string(read) != "con" {
+		t.Fatalf("expected range \"con\", found %q", read)
+	}
+	reader.Close()
+	waitFills(blobio.(*cacheBackend))
+	reader, err = blobio.Reader(key, 7, 0)
+	if err != nil {
+		t.Fatalf("could not open ranged reader: %s", err)
+	}
+	if read, _ := io.ReadAll(reader); string(read) != "content" {
+		t.Fatalf("expected cached range \"content\", found %q", read)
+	}
+	reader.Close()
+	checkCacheStats(t, CacheStats{DiskHits: 1, Misses: 1})
+	if _, err = blobio.Reader(key, 15, 0); !errors.Is(err, ErrRange) {
+		t.Fatalf("expected ErrRange past the end, got %v", err)
+	}
+}
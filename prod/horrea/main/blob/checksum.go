@@ -0,0 +1,421 @@
+/*
+ * End-to-end integrity checks for persisted blobs.
+ */
+
+/*
+ * Every blob is stored with a metadata sidecar holding the SHA-256
+ * digest of its content and a CRC32C for each fixed-size block. The
+ * digest is compared against the client's digest on PUT, and block
+ * CRCs are checked on every read before any byte of the block is
+ * returned, so ranged reads are verified without reading the whole
+ * blob.
+ *
+ * The sidecar is committed before the content. A crash in between
+ * leaves a sidecar that doesn't match the content, which reads
+ * report as corruption rather than returning unverified data. A
+ * blob with no sidecar at all predates checksums and is served
+ * unverified.
+ *
+ * Content may be compressed at rest, in which case checksums still
+ * cover the uncompressed content and the sidecar names the codec.
+ * Compressed streams can't be entered mid-way, so ranged reads of a
+ * compressed blob decompress from the start and skip ahead.
+ */
+
+package blob
+
+import (
+	"github.com/pleb/prod/horrea/main/codec"
+
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log"
+	"time"
+)
+
+// bytes covered by each block checksum.
+const checksumBlockSize = 64 * 1024
+
+// suffix on the blob type of metadata sidecar keys.
+const metadataSuffix = ".meta"
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Integrity data persisted alongside each blob.
+type Metadata struct {
+	Size        int64     `json:"size"`                  // content size in bytes.
+	Digest      []byte    `json:"digest"`                // SHA-256 of the content.
+	BlockSize   int64     `json:"blockSize"`             // bytes per checksum block.
+	Blocks      []uint32  `json:"blocks"`                // CRC32C of each block.
+	Compression string    `json:"compression,omitempty"` // at-rest codec, if any.
+	Version     string    `json:"version,omitempty"`     // version ID of the content.
+	Encryption  *Envelope `json:"encryption,omitempty"`  // data key, if encrypted.
+	Deltas      []Delta   `json:"deltas,omitempty"`      // patches over the content.
+}
+
+type checksumWriter struct {
+	backend Backend        // backend holding the blob.
+	key     Key            // destination key.
+	sidecar Key            // key the metadata is persisted at.
+	writer  Writer         // pending content write.
+	encoder io.WriteCloser // compressor in front of the write.
+	sealer  *sealWriter    // encryption after compression, if any.
+	keys    *keyring       // master keys wrapping the data key.
+	expect  []byte         // client-supplied digest, if any.
+	digest  hash.Hash      // running SHA-256 of the content.
+	block   hash.Hash      // running CRC32C of the current block.
+	filled  int64          // bytes in the current block.
+	meta    Metadata       // metadata accumulated so far.
+}
+
+type checksumReader struct {
+	source io.ReadCloser // content reader, from a block boundary.
+	meta   *Metadata     // checksums for the blob.
+	next   int           // index of the next block to read.
+	buffer []byte        // block storage, plus one probe byte.
+	ready  []byte        // verified bytes not yet returned.
+	skip   int64         // bytes to drop from the first block.
+	remain int64         // bytes left to return.
+}
+
+// return the key of the metadata sidecar for a blob.
+func metadataKey(key Key) Key {
+	key.BlobType += metadataSuffix
+	return key
+}
+
+// read the metadata sidecar for a blob.
+func readMetadata(backend Backend, key Key) (*Metadata, error) {
+	content, err := blobReadInternal(backend, metadataKey(key))
+	if err != nil {
+		return nil, err
+	}
+	return parseMetadata(content)
+}
+
+// decode a stored sidecar.
+func parseMetadata(content []byte) (*Metadata, error) {
+	meta := new(Metadata)
+	if err := json.Unmarshal(content, meta); err != nil || meta.BlockSize <= 0 {
+		return nil, ErrCorrupt
+	}
+	return meta, nil
+}
+
+// persist the metadata sidecar for a blob.
+func writeMetadata(backend Backend, key Key, meta *Metadata) error {
+	return writeSidecar(backend, metadataKey(key), storedMetadata(meta))
+}
+
+// persist a JSON record at a sidecar key.
+func writeSidecar(backend Backend, sidecar Key, record any) error {
+	content, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return blobWriteInternal(backend, sidecar, content)
+}
+
+// wrap a backend write so checksums are computed as content
+// passes through, checking the digest if one is expected. Content
+// is compressed with the named codec, then encrypted if master
+// keys are loaded, before it is stored.
+func newChecksumWriter(backend Backend, key Key, expect []byte, compression string) (Writer, error) {
+	writer, err := newSidecarWriter(backend, key, metadataKey(key), expect, compression, blobKeys)
+	if err != nil {
+		return nil, err
+	}
+	return lockedWriter{writer}, nil
+}
+
+// checksummed write that commits under the lock of its sidecar,
+// unless the content it replaces is held. Deltas of the content
+// replaced are dropped.
+type lockedWriter struct {
+	*checksumWriter
+}
+
+func (writer lockedWriter) Commit() error {
+	defer lockSidecar(writer.key)()
+	if err := checkHold(writer.key, time.Now()); err != nil {
+		writer.Abort()
+		return err
+	}
+	replaced, _ := readMetadata(writer.backend, writer.key)
+	if err := writer.checksumWriter.Commit(); err != nil {
+		return err
+	}
+	dropDeltas(writer.backend, writer.key, replaced, nil)
+	return nil
+}
+
+// as newChecksumWriter, persisting the metadata at the given key
+// and encrypting only if given keys.
+func newSidecarWriter(backend Backend, key, sidecar Key, expect []byte, compression string,
+	keys *keyring) (*checksumWriter, error) {
+	writer, err := backend.Writer(key)
+	if err != nil {
+		return nil, err
+	}
+	if compression == codec.None {
+		compression = ""
+	}
+	var stored io.Writer = writer
+	var sealer *sealWriter
+	if keys != nil {
+		if sealer, err = newSealWriter(writer, checksumBlockSize); err != nil {
+			writer.Abort()
+			return nil, err
+		}
+		stored = sealer
+	}
+	encoder, err := codec.NewWriter(compression, stored)
+	if err != nil {
+		writer.Abort()
+		return nil, err
+	}
+	return &checksumWriter{
+		backend: backend,
+		key:     key,
+		sidecar: sidecar,
+		writer:  writer,
+		encoder: encoder,
+		sealer:  sealer,
+		keys:    keys,
+		expect:  expect,
+		digest:  sha256.New(),
+		block:   crc32.New(crcTable),
+		meta:    Metadata{BlockSize: checksumBlockSize, Compression: compression},
+	}, nil
+}
+
+func (writer *checksumWriter) Write(data []byte) (int, error) {
+	n, err := writer.encoder.Write(data)
+	data = data[:n]
+	writer.digest.Write(data)
+	writer.meta.Size += int64(n)
+	for len(data) > 0 {
+		space := min(writer.meta.BlockSize-writer.filled, int64(len(data)))
+		writer.block.Write(data[:space])
+		writer.filled += space
+		data = data[space:]
+		if writer.filled == writer.meta.BlockSize {
+			writer.finishBlock()
+		}
+	}
+	return n, err
+}
+
+// record the checksum of the current block and start another.
+func (writer *checksumWriter) finishBlock() {
+	sum := writer.block.(hash.Hash32).Sum32()
+	writer.meta.Blocks = append(writer.meta.Blocks, sum)
+	writer.block.Reset()
+	writer.filled = 0
+}
+
+// verify the digest, then persist the sidecar and the content.
+func (writer *checksumWriter) Commit() error {
+	if writer.filled > 0 {
+		writer.finishBlock()
+	}
+	writer.meta.Digest = writer.digest.Sum(nil)
+	if writer.meta.Version == "" {
+		writer.meta.Version = newVersionID(time.Now())
+	}
+	if len(writer.expect) > 0 && !bytes.Equal(writer.expect, writer.meta.Digest) {
+		writer.writer.Abort()
+		return ErrDigest
+	}
+	if err := writer.encoder.Close(); err != nil {
+		writer.writer.Abort()
+		return err
+	}
+	if writer.sealer != nil {
+		if err := writer.seal(); err != nil {
+			writer.writer.Abort()
+			return err
+		}
+	}
+	if err := writeSidecar(writer.backend, writer.sidecar, storedMetadata(&writer.meta)); err != nil {
+		writer.writer.Abort()
+		return err
+	}
+	return writer.writer.Commit()
+}
+
+// seal the last of the content and its checksums, and wrap its
+// data key into the metadata.
+func (writer *checksumWriter) seal() error {
+	envelope, err := writer.sealer.finish()
+	if err != nil {
+		return err
+	}
+	writer.meta.Encryption = envelope
+	if err = sealSums(&writer.meta, writer.sealer.dataKey); err != nil {
+		return err
+	}
+	return writer.keys.wrap(writer.key, &writer.meta, writer.sealer.dataKey)
+}
+
+func (writer *checksumWriter) Abort() error {
+	return writer.writer.Abort()
+}
+
+// open a reader that verifies each block of the requested range
+// against the blob's checksums before returning it.
+func newChecksumReader(backend Backend, key Key, offset, length int64) (io.ReadCloser, error) {
+	meta, err := readMetadata(backend, key)
+	if errors.Is(err, ErrNoExist) {
+		// blobs written before checksums existed
+		log.Printf("No checksums for %s, reading unverified", key)
+		return backend.Reader(key, offset, length)
+	} else if err != nil {
+		return nil, err
+	} else if len(meta.Deltas) > 0 {
+		return openPatched(backend, key, meta, offset, length)
+	}
+	return openVerified(backend, key, meta, offset, length)
+}
+
+// open a reader over a range of content, verified against the
+// given checksums.
+func openVerified(backend Backend, key Key, meta *Metadata, offset, length int64) (io.ReadCloser, error) {
+	if offset > meta.Size {
+		return nil, ErrRange
+	} else if err := openSums(key, meta); err != nil {
+		return nil, err
+	}
+
+	// read whole blocks covering the range
+	remain := meta.Size - offset
+	if length > 0 && length < remain {
+		remain = length
+	}
+	first := offset / meta.BlockSize
+	last := (offset + remain + meta.BlockSize - 1) / meta.BlockSize
+	if int(last) > len(meta.Blocks) {
+		return nil, ErrCorrupt
+	}
+	// reads through the final block run to the end of the
+	// content, so trailing garbage is caught as well
+	span := (last - first) * meta.BlockSize
+	if int(last) == len(meta.Blocks) {
+		span = 0
+	}
+	var source io.ReadCloser
+	var err error
+	if meta.Compression == "" {
+		source, err = openStored(backend, key, meta, first*meta.BlockSize, span)
+	} else {
+		source, err = openCompressed(backend, key, meta, first*meta.BlockSize)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &checksumReader{
+		source: source,
+		meta:   meta,
+		next:   int(first),
+		buffer: make([]byte, meta.BlockSize+1),
+		skip:   offset - first*meta.BlockSize,
+		remain: remain,
+	}, nil
+}
+
+func (reader *checksumReader) Read(data []byte) (int, error) {
+	if reader.remain == 0 {
+		return 0, io.EOF
+	}
+	if len(reader.ready) == 0 {
+		if err := reader.readBlock(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(data, reader.ready[:min(int64(len(reader.ready)), reader.remain)])
+	reader.ready = reader.ready[n:]
+	reader.remain -= int64(n)
+	return n, nil
+}
+
+// read and verify the next block from the backend.
+func (reader *checksumReader) readBlock() error {
+	meta := reader.meta
+	start := int64(reader.next) * meta.BlockSize
+	size := min(meta.BlockSize, meta.Size-start)
+	block := reader.buffer[:size]
+	if _, err := io.ReadFull(reader.source, block); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrCorrupt // content shorter than recorded
+		}
+		return err
+	}
+	if crc32.Checksum(block, crcTable) != meta.Blocks[reader.next] {
+		log.Printf("Checksum mismatch in block %d", reader.next)
+		return ErrCorrupt
+	}
+	reader.next++
+	if reader.next == len(meta.Blocks) {
+		n, err := reader.source.Read(reader.buffer[size:][:1])
+		if n > 0 || (err != nil && err != io.EOF) {
+			return ErrCorrupt // content longer than recorded
+		}
+	}
+	reader.ready = block[reader.skip:]
+	reader.skip = 0
+	return nil
+}
+
+func (reader *checksumReader) Close() error {
+	return reader.source.Close()
+}
+
+// reader over decompressed content, which reports any
+// decoding failure as corruption.
+type decodeReader struct {
+	decoder io.ReadCloser // decompressor over the stored content.
+	source  io.ReadCloser // backend reader.
+}
+
+// open a compressed blob, decompressing from the start and
+// discarding content up to offset.
+func openCompressed(backend Backend, key Key, meta *Metadata, offset int64) (io.ReadCloser, error) {
+	compression := meta.Compression
+	source, err := openStored(backend, key, meta, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	decoder, err := codec.NewReader(compression, source)
+	if errors.Is(err, codec.ErrUnknown) {
+		source.Close()
+		return nil, fmt.Errorf("%w: stored with codec %q", ErrNotSupp, compression)
+	} else if err != nil {
+		source.Close()
+		return nil, ErrCorrupt
+	}
+	reader := &decodeReader{decoder: decoder, source: source}
+	if _, err = io.CopyN(io.Discard, reader, offset); err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return reader, nil
+}
+
+func (reader *decodeReader) Read(data []byte) (int, error) {
+	n, err := reader.decoder.Read(data)
+	if err != nil && err != io.EOF {
+		return n, ErrCorrupt
+	}
+	return n, err
+}
+
+func (reader *decodeReader) Close() error {
+	reader.decoder.Close()
+	return reader.source.Close()
+}
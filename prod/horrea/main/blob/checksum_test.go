@@ -0,0 +1,229 @@
+/*
+ * Tests for blob checksums and read verification.
+ */
+
+package blob
+
+import (
+	"github.com/pleb/prod/horrea/main/codec"
+	pb "github.com/pleb/prod/horrea/pb"
+
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// write random test content through the checksummed writer
+func writeChecksummedBlob(t *testing.T, size int) (*pb.BlobInfo, []byte) {
+	testdata := make([]byte, size)
+	for b := range testdata {
+		testdata[b] = byte(rand.Intn(256))
+	}
+	digest := sha256.Sum256(testdata)
+	info := &pb.BlobInfo{
+		Size:     int64(size),
+		Major:    fmt.Sprintf("%d", rand.Int()),
+		Minor:    fmt.Sprintf("%d", rand.Int()),
+		BlobType: pb.BlobType_Raw,
+		Digest:   digest[:],
+	}
+	writeblob := CreateBlob(info)
+	writeblob.AppendChunk(testdata)
+	if err := writeblob.WriteContent(); err != nil {
+		t.Fatalf("WriteContent returned error: %s", err)
+	}
+	return info, testdata
+}
+
+// read a range through the verifying reader
+func readRange(info *pb.BlobInfo, offset, length int64) ([]byte, error) {
+	reader, err := CreateBlobReader(info, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// test digest checks on write against every backend
+func TestChecksumDigest(t *testing.T) {
+	for _, name := range Backends() {
+		t.Run(name, func(t *testing.T) {
+			if err := ConfigureBackend(name, testConfig(t)); err != nil {
+				t.Fatalf("could not configure %s backend: %s", name, err)
+			}
+
+			// matching digest is accepted and recorded
+			info, _ := writeChecksummedBlob(t, 100*1024)
+			meta, err := readMetadata(blobio, keyFromInfo(info))
+			if err != nil {
+				t.Fatalf("could not read metadata: %s", err)
+			}
+			if err = checkBytesEqual(meta.Digest, info.Digest); err != nil {
+				t.Fatalf("recorded digest mismatch: %s", err)
+			} else if len(meta.Blocks) != 2 {
+				t.Fatalf("expected 2 checksum blocks, found %d", len(meta.Blocks))
+			}
+
+			// mismatched digest is rejected and nothing is persisted
+			info.Minor = fmt.Sprintf("%d", rand.Int())
+			info.Digest[0] ^= 0xff
+			writeblob := CreateBlob(info)
+			writeblob.AppendChunk(make([]byte, info.Size))
+			if err = writeblob.WriteContent(); !errors.Is(err, ErrDigest) {
+				t.Fatalf("expected ErrDigest, got %v", err)
+			}
+			if _, err = readRange(info, 0, 0); !errors.Is(err, ErrNoExist) {
+				t.Fatalf("expected ErrNoExist after rejected write, got %v", err)
+			}
+		})
+	}
+}
+
+// test that stored corruption is detected on read, against every
+// backend
+func TestChecksumCorruption(t *testing.T) {
+	for _, name := range Backends() {
+		t.Run(name, func(t *testing.T) {
+			if err := ConfigureBackend(name, testConfig(t)); err != nil {
+				t.Fatalf("could not configure %s backend: %s", name, err)
+			}
+			testChecksumCorruption(t)
+		})
+	}
+}
+
+// damage stored content behind the checksum layer, then read it
+func testChecksumCorruption(t *testing.T) {
+	size := 3*checksumBlockSize + 100
+	info, testdata := writeChecksummedBlob(t, size)
+	key := keyFromInfo(info)
+
+	// flip a byte in the second block
+	corrupt := append([]byte{}, testdata...)
+	corrupt[checksumBlockSize+10] ^= 0x01
+	if err := blobWriteInternal(blobio, key, corrupt); err != nil {
+		t.Fatalf("could not overwrite content: %s", err)
+	}
+	if _, err := readRange(info, 0, 0); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expected ErrCorrupt on full read, got %v", err)
+	}
+	if _, err := readRange(info, checksumBlockSize, 4096); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expected ErrCorrupt on damaged range, got %v", err)
+	}
+
+	// ranges in undamaged blocks still read
+	readback, err := readRange(info, 2*checksumBlockSize+5, 4096)
+	if err != nil {
+		t.Fatalf("undamaged range returned error: %s", err)
+	}
+	start := 2*checksumBlockSize + 5
+	if err = checkBytesEqual(readback, testdata[start:start+4096]); err != nil {
+		t.Fatalf("undamaged range content mismatch: %s", err)
+	}
+
+	// truncated and extended content are both detected
+	damaged := [][]byte{testdata[:size-1], append(testdata, 0)}
+	for _, content := range damaged {
+		if err = blobWriteInternal(blobio, key, content); err != nil {
+			t.Fatalf("could not overwrite content: %s", err)
+		}
+		if _, err = readRange(info, 0, 0); !errors.Is(err, ErrCorrupt) {
+			t.Fatalf("expected ErrCorrupt for %d byte content, got %v",
+				len(content), err)
+		}
+	}
+}
+
+// test that blobs with no sidecar are read unverified
+func TestChecksumLegacyBlob(t *testing.T) {
+	ConfigureBackend(MemoryBackend, testConfig(t))
+	info := &pb.BlobInfo{Major: "legacy", Minor: "blob"}
+	testdata := []byte("written before checksums")
+	if err := blobWriteInternal(blobio, keyFromInfo(info), testdata); err != nil {
+		t.Fatalf("could not write content: %s", err)
+	}
+	readback, err := readRange(info, 0, 0)
+	if err != nil {
+		t.Fatalf("legacy read returned error: %s", err)
+	}
+	if err = checkBytesEqual(readback, testdata); err != nil {
+		t.Fatalf("legacy content mismatch: %s", err)
+	}
+}
+
+// test that content compressed at rest reads back verified,
+// including ranges, against every backend
+func TestChecksumCompression(t *testing.T) {
+	for _, name := range Backends() {
+		t.Run(name, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.Compression = codec.Gzip
+			if err := ConfigureBackend(name, cfg); err != nil {
+				t.Fatalf("could not configure %s backend: %s", name, err)
+			}
+
+			// highly compressible content spanning several blocks
+			size := 3*checksumBlockSize + 100
+			testdata := bytes.Repeat([]byte("horrea "), size/7+1)[:size]
+			info := &pb.BlobInfo{
+				Size:  int64(size),
+				Major: fmt.Sprintf("%d", rand.Int()),
+				Minor: fmt.Sprintf("%d", rand.Int()),
+			}
+			writeblob := CreateBlob(info)
+			writeblob.AppendChunk(testdata)
+			if err := writeblob.WriteContent(); err != nil {
+				t.Fatalf("WriteContent returned error: %s", err)
+			}
+
+			// stored compressed, but described by content size
+			key := keyFromInfo(info)
+			attrs, err := blobio.Stat(key)
+			if err != nil {
+				t.Fatalf("could not stat stored content: %s", err)
+			} else if attrs.Size >= int64(size)/10 {
+				t.Fatalf("expected compressed content, stored %d bytes", attrs.Size)
+			}
+			stat, err := StatBlob(info)
+			if err != nil {
+				t.Fatalf("could not stat blob: %s", err)
+			} else if stat.Size != int64(size) {
+				t.Fatalf("expected size %d, found %d", size, stat.Size)
+			}
+
+			// full and ranged reads return the original content
+			ranges := [][2]int64{{0, 0}, {checksumBlockSize + 3, 4096}, {int64(size) - 10, 0}}
+			for _, r := range ranges {
+				readback, err := readRange(info, r[0], r[1])
+				if err != nil {
+					t.Fatalf("read [%d, +%d] returned error: %s", r[0], r[1], err)
+				}
+				end := int64(size)
+				if r[1] > 0 {
+					end = r[0] + r[1]
+				}
+				if err = checkBytesEqual(readback, testdata[r[0]:end]); err != nil {
+					t.Fatalf("read [%d, +%d] mismatch: %s", r[0], r[1], err)
+				}
+			}
+
+			// damaged compressed content is reported as corruption
+			stored, err := blobReadInternal(blobio, key)
+			if err != nil {
+				t.Fatalf("could not read stored content: %s", err)
+			}
+			stored[len(stored)/2] ^= 0xff
+			if err = blobWriteInternal(blobio, key, stored); err != nil {
+				t.Fatalf("could not overwrite content: %s", err)
+			}
+			if _, err = readRange(info, 0, 0); !errors.Is(err, ErrCorrupt) {
+				t.Fatalf("expected ErrCorrupt, got %v", err)
+			}
+		})
+	}
+}
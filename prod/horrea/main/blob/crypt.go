@@ -0,0 +1,536 @@
+/*
+ * Envelope encryption of blob content at rest.
+ */
+
+/*
+ * Each blob is encrypted under its own random AES-256 data key, and
+ * the data key is stored in the blob's sidecar wrapped by a master
+ * key. Content is sealed with AES-GCM in segments the size of a
+ * checksum block, after any compression, so ranged reads only
+ * decrypt the segments they cover. Segment nonces count up from
+ * zero, which is safe since a data key only ever seals one blob,
+ * and each segment is bound to its position and to whether it is
+ * the last, so segments can't be reordered or the content cut
+ * short. A clone shares its source's content, and so its data key,
+ * re-wrapped for the clone's key; rewriting either one draws a new
+ * data key, so no key ever seals two different contents.
+ *
+ * The wrapped data key is bound to the blob's key and the rest of
+ * its sidecar, so a sidecar that is edited or moved to another blob
+ * fails to unwrap and reads report corruption.
+ *
+ * A plaintext digest and block checksums would let anyone holding
+ * the sidecar confirm guesses at the content, so they are sealed
+ * into the envelope too, under a key derived from the data key, and
+ * only opened when content is read or described. Sidecars written
+ * before that hold them in the clear, bound with the rest.
+ *
+ * Master keys are identified by a fingerprint, so several can be
+ * loaded at once. New blobs use the last one loaded, and RotateKeys
+ * re-wraps the data keys of older blobs under it, rewriting only
+ * sidecars. Commits and rotation take a per-key lock, so rotation
+ * never writes back a sidecar that a commit has just replaced.
+ */
+
+package blob
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// bytes in a master or data key.
+const keySize = 32
+
+var ErrNoKey = errors.New("master key for blob not loaded")
+
+// Encryption details persisted in a blob's sidecar.
+type Envelope struct {
+	KeyID      string `json:"keyId"`          // fingerprint of the master key.
+	WrappedKey []byte `json:"wrappedKey"`     // data key sealed by the master key.
+	Segment    int64  `json:"segment"`        // plaintext bytes per sealed segment.
+	Segments   int64  `json:"segments"`       // sealed segments stored.
+	Sums       []byte `json:"sums,omitempty"` // digest and block checksums, sealed.
+}
+
+// Checksums of encrypted content, as sealed in its envelope.
+type sealedSums struct {
+	Digest []byte   `json:"digest"` // SHA-256 of the content.
+	Blocks []uint32 `json:"blocks"` // CRC32C of each block.
+}
+
+// Loaded master keys.
+type keyring struct {
+	current string                 // fingerprint of the key for new blobs.
+	keys    map[string]cipher.AEAD // cipher of each key, by fingerprint.
+}
+
+// keys used for content at rest, nil if not encrypting.
+var blobKeys *keyring
+
+// locks serializing sidecar updates, striped by key.
+var sidecarLocks [64]sync.Mutex
+
+// lock the sidecars of keys, returning the unlock function.
+func lockSidecar(keys ...Key) func() {
+	return lockStripes(sidecarLocks[:], keys...)
+}
+
+// read master keys from a file holding one base64 key per line,
+// oldest first. Blank lines and lines starting with # are skipped.
+func LoadKeyFile(path string) ([][]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	keys := [][]byte{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		key, err := ParseKey(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, scanner.Err()
+}
+
+// decode a base64 master key.
+func ParseKey(text string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(text))
+	if err != nil {
+		return nil, fmt.Errorf("master key is not base64: %w", err)
+	} else if len(key) != keySize {
+		return nil, fmt.Errorf("master key is %d bytes, expected %d", len(key), keySize)
+	}
+	return key, nil
+}
+
+// return the fingerprint identifying a master key.
+func keyID(key []byte) string {
+	sum := sha256.Sum256(append([]byte("horrea-master-key\x00"), key...))
+	return hex.EncodeToString(sum[:8])
+}
+
+// return an AES-GCM cipher for a key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// load master keys, the last of which wraps new data keys.
+// Returns nil if there are none.
+func newKeyring(keys [][]byte) (*keyring, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	ring := &keyring{keys: map[string]cipher.AEAD{}}
+	for _, key := range keys {
+		if len(key) != keySize {
+			return nil, fmt.Errorf("master key is %d bytes, expected %d", len(key), keySize)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		ring.current = keyID(key)
+		ring.keys[ring.current] = aead
+	}
+	return ring, nil
+}
+
+// return the key a wrapped data key is bound to: the blob's key,
+// without any version, or that of the blob's delta.
+func boundKey(key Key) Key {
+	if base, id, ok := parseDeltaKey(key); ok {
+		return deltaKey(boundKey(base), id)
+	} else if base, _, ok := parseVersionKey(key); ok {
+		return base // old versions keep their blob's binding
+	}
+	return key
+}
+
+// return the data bound to a wrapped data key: the bound key and
+// the sidecar less the wrapped key.
+func envelopeData(key Key, meta *Metadata) ([]byte, error) {
+	key = boundKey(key)
+	bound := *storedMetadata(meta)
+	envelope := *meta.Encryption
+	envelope.KeyID, envelope.WrappedKey = "", nil
+	bound.Encryption = &envelope
+	content, err := json.Marshal(&bound)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("horrea-envelope\x00"+encodeKey(key)+"\x00"), content...), nil
+}
+
+// seal a data key under the current master key, recording it in
+// the sidecar. The rest of the sidecar must be final.
+func (ring *keyring) wrap(key Key, meta *Metadata, dataKey []byte) error {
+	meta.Encryption.KeyID = ring.current
+	bound, err := envelopeData(key, meta)
+	if err != nil {
+		return err
+	}
+	aead := ring.keys[ring.current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return err
+	}
+	meta.Encryption.WrappedKey = aead.Seal(nonce, nonce, dataKey, bound)
+	return nil
+}
+
+// recover the data key recorded in a sidecar.
+func (ring *keyring) unwrap(key Key, meta *Metadata) ([]byte, error) {
+	if ring == nil {
+		return nil, ErrNoKey
+	}
+	aead, ok := ring.keys[meta.Encryption.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNoKey, meta.Encryption.KeyID)
+	}
+	bound, err := envelopeData(key, meta)
+	if err != nil {
+		return nil, err
+	}
+	wrapped := meta.Encryption.WrappedKey
+	if len(wrapped) < aead.NonceSize() {
+		return nil, ErrCorrupt
+	}
+	dataKey, err := aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], bound)
+	if err != nil {
+		log.Printf("Could not unwrap data key of %s", key)
+		return nil, ErrCorrupt
+	}
+	return dataKey, nil
+}
+
+// return a cipher for the checksums sealed under a data key, kept
+// apart from the content's so their nonces can't collide.
+func sumsAEAD(dataKey []byte) (cipher.AEAD, error) {
+	key := sha256.Sum256(append([]byte("horrea-sums\x00"), dataKey...))
+	return newAEAD(key[:])
+}
+
+// seal the digest and block checksums of a sidecar into its
+// envelope, under the data key.
+func sealSums(meta *Metadata, dataKey []byte) error {
+	aead, err := sumsAEAD(dataKey)
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(&sealedSums{Digest: meta.Digest, Blocks: meta.Blocks})
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return err
+	}
+	meta.Encryption.Sums = aead.Seal(nonce, nonce, content, nil)
+	return nil
+}
+
+// recover the digest and block checksums sealed in a sidecar read
+// back, if they aren't already in the clear.
+func openSums(key Key, meta *Metadata) error {
+	if meta.Encryption == nil || meta.Encryption.Sums == nil || meta.Digest != nil {
+		return nil
+	}
+	dataKey, err := blobKeys.unwrap(key, meta)
+	if err != nil {
+		return err
+	}
+	aead, err := sumsAEAD(dataKey)
+	if err != nil {
+		return err
+	}
+	sealed := meta.Encryption.Sums
+	if len(sealed) < aead.NonceSize() {
+		return ErrCorrupt
+	}
+	content, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		log.Printf("Could not open checksums of %s", key)
+		return ErrCorrupt
+	}
+	sums := new(sealedSums)
+	if err = json.Unmarshal(content, sums); err != nil || sums.Digest == nil {
+		return ErrCorrupt
+	}
+	meta.Digest, meta.Blocks = sums.Digest, sums.Blocks
+	return nil
+}
+
+// return a sidecar as it is stored, without checksums that are
+// sealed in its envelope.
+func storedMetadata(meta *Metadata) *Metadata {
+	if meta.Encryption == nil || meta.Encryption.Sums == nil {
+		return meta
+	}
+	stored := *meta
+	stored.Digest, stored.Blocks = nil, nil
+	return &stored
+}
+
+// return the nonce of a segment.
+func segmentNonce(aead cipher.AEAD, index int64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce, uint64(index))
+	return nonce
+}
+
+// return the data bound to a segment: its position, and whether
+// it is the last.
+func segmentData(index int64, final bool) []byte {
+	data := binary.BigEndian.AppendUint64([]byte("horrea-segment\x00"), uint64(index))
+	if final {
+		return append(data, 1)
+	}
+	return append(data, 0)
+}
+
+// Encrypts content as it is written, a segment at a time.
+type sealWriter struct {
+	dst     io.Writer   // stored content.
+	aead    cipher.AEAD // data key cipher.
+	buffer  []byte      // plaintext of the current segment.
+	index   int64       // index of the current segment.
+	dataKey []byte      // data key, to be wrapped on commit.
+}
+
+// start encrypting content under a fresh data key.
+func newSealWriter(dst io.Writer, segment int64) (*sealWriter, error) {
+	dataKey := make([]byte, keySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &sealWriter{
+		dst:     dst,
+		aead:    aead,
+		buffer:  make([]byte, 0, segment),
+		dataKey: dataKey,
+	}, nil
+}
+
+func (writer *sealWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		// a full segment is only sealed once more follows, since
+		// the last one is sealed differently
+		if len(writer.buffer) == cap(writer.buffer) {
+			if err := writer.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(writer.buffer[len(writer.buffer):cap(writer.buffer)], data)
+		writer.buffer = writer.buffer[:len(writer.buffer)+n]
+		data = data[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// seal and store the current segment.
+func (writer *sealWriter) seal(final bool) error {
+	nonce := segmentNonce(writer.aead, writer.index)
+	sealed := writer.aead.Seal(nil, nonce, writer.buffer, segmentData(writer.index, final))
+	if _, err := writer.dst.Write(sealed); err != nil {
+		return err
+	}
+	writer.index++
+	writer.buffer = writer.buffer[:0]
+	return nil
+}
+
+// seal the last segment, returning the envelope to record.
+func (writer *sealWriter) finish() (*Envelope, error) {
+	if err := writer.seal(true); err != nil {
+		return nil, err
+	}
+	return &Envelope{Segment: int64(cap(writer.buffer)), Segments: writer.index}, nil
+}
+
+// Decrypts stored content, starting at a segment boundary.
+type openReader struct {
+	source io.ReadCloser // stored content.
+	aead   cipher.AEAD   // data key cipher.
+	index  int64         // index of the next segment.
+	count  int64         // segments in the blob.
+	buffer []byte        // sealed segment storage.
+	ready  []byte        // plaintext not yet returned.
+}
+
+// open the stored content of a blob from the given plaintext
+// offset, decrypting it if the blob is encrypted. The offset must
+// fall on a segment boundary, and span counts plaintext bytes.
+func openStored(backend Backend, key Key, meta *Metadata, offset, span int64) (io.ReadCloser, error) {
+	envelope := meta.Encryption
+	if envelope == nil {
+		return backend.Reader(key, offset, span)
+	} else if envelope.Segment <= 0 || offset%envelope.Segment != 0 {
+		return nil, ErrCorrupt
+	}
+	dataKey, err := blobKeys.unwrap(key, meta)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	sealed := envelope.Segment + int64(aead.Overhead())
+	first := offset / envelope.Segment
+	storedSpan := int64(0)
+	if span > 0 {
+		storedSpan = (span + envelope.Segment - 1) / envelope.Segment * sealed
+	}
+	source, err := backend.Reader(key, first*sealed, storedSpan)
+	if err != nil {
+		return nil, err
+	}
+	return &openReader{
+		source: source,
+		aead:   aead,
+		index:  first,
+		count:  envelope.Segments,
+		buffer: make([]byte, sealed+1),
+	}, nil
+}
+
+func (reader *openReader) Read(data []byte) (int, error) {
+	if len(reader.ready) == 0 {
+		if reader.index >= reader.count {
+			return 0, io.EOF
+		} else if err := reader.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(data, reader.ready)
+	reader.ready = reader.ready[n:]
+	return n, nil
+}
+
+// read and decrypt the next segment. Only the last may be short,
+// and nothing may follow it.
+func (reader *openReader) open() error {
+	final := reader.index == reader.count-1
+	sealed := reader.buffer[:len(reader.buffer)-1]
+	n, err := io.ReadFull(reader.source, sealed)
+	if err == io.ErrUnexpectedEOF && final {
+		sealed = sealed[:n]
+	} else if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrCorrupt // content shorter than recorded
+	} else if err != nil {
+		return err
+	}
+	if final && len(sealed) == len(reader.buffer)-1 {
+		probe, err := reader.source.Read(reader.buffer[len(sealed):])
+		if probe > 0 || (err != nil && err != io.EOF) {
+			return ErrCorrupt // content longer than recorded
+		}
+	}
+	nonce := segmentNonce(reader.aead, reader.index)
+	plain, err := reader.aead.Open(sealed[:0], nonce, sealed, segmentData(reader.index, final))
+	if err != nil {
+		log.Printf("Could not decrypt segment %d", reader.index)
+		return ErrCorrupt
+	}
+	reader.index++
+	reader.ready = plain
+	return nil
+}
+
+func (reader *openReader) Close() error {
+	return reader.source.Close()
+}
+
+// re-wrap the data keys of every blob not wrapped by the current
+// master key, returning how many were re-wrapped.
+func RotateKeys() (int, error) {
+	if blobio == nil {
+		return 0, ErrNotSupp
+	} else if blobKeys == nil {
+		return 0, fmt.Errorf("%w: no master keys loaded", ErrNotSupp)
+	}
+	sidecars := []Key{}
+	after := Key{}
+	for {
+		keys, err := blobio.List("", after, DefaultPageSize)
+		if err != nil {
+			return 0, err
+		}
+		for _, key := range keys {
+			if blobType, ok := strings.CutSuffix(key.BlobType, metadataSuffix); ok {
+				key.BlobType = blobType
+				sidecars = append(sidecars, key)
+			}
+		}
+		if len(keys) < DefaultPageSize {
+			break
+		}
+		after = keys[len(keys)-1]
+	}
+	rotated := 0
+	for _, key := range sidecars {
+		done, err := rotateKey(key)
+		if err != nil {
+			log.Printf("Could not re-wrap data key of %s: %v", key, err)
+		} else if done {
+			rotated++
+		}
+	}
+	if rotated > 0 {
+		log.Printf("Re-wrapped %d data keys under master key %s", rotated, blobKeys.current)
+	}
+	return rotated, nil
+}
+
+// re-wrap one blob's data key if it isn't under the current key.
+func rotateKey(key Key) (bool, error) {
+	defer lockSidecar(key)()
+	meta, err := readMetadata(blobio, key)
+	if errors.Is(err, ErrNoExist) {
+		return false, nil // deleted since listing
+	} else if err != nil {
+		return false, err
+	} else if meta.Encryption == nil || meta.Encryption.KeyID == blobKeys.current {
+		return false, nil
+	}
+	dataKey, err := blobKeys.unwrap(key, meta)
+	if err != nil {
+		return false, err
+	}
+	if err = blobKeys.wrap(key, meta, dataKey); err != nil {
+		return false, err
+	}
+	return true, writeMetadata(blobio, key, meta)
+}
@@ -0,0 +1,285 @@
+/*
+ * Tests for encryption at rest.
+ */
+
+package blob
+
+import (
+	"github.com/pleb/prod/horrea/main/codec"
+	pb "github.com/pleb/prod/horrea/pb"
+
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// return a random master key
+func testMasterKey(t *testing.T) []byte {
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf("could not generate key: %s", err)
+	}
+	return key
+}
+
+// configure a backend encrypting under the given master keys
+func configureKeys(t *testing.T, name string, cfg *Config, keys ...[]byte) {
+	cfg.MasterKeys = keys
+	if err := ConfigureBackend(name, cfg); err != nil {
+		t.Fatalf("could not configure %s backend: %s", name, err)
+	}
+}
+
+// test encrypted content reads back, whole and in ranges, with and
+// without compression, against every backend
+func TestCryptRoundTrip(t *testing.T) {
+	for _, name := range Backends() {
+		for _, compression := range []string{"", codec.Gzip} {
+			t.Run(name+"/"+compression, func(t *testing.T) {
+				cfg := testConfig(t)
+				cfg.Compression = compression
+				configureKeys(t, name, cfg, testMasterKey(t))
+				size := 3*checksumBlockSize + 100
+				info, testdata := writeChecksummedBlob(t, size)
+
+				// nothing of the content is stored in the clear
+				key := keyFromInfo(info)
+				stored, err := blobReadInternal(blobio, key)
+				if err != nil {
+					t.Fatalf("could not read stored content: %s", err)
+				} else if bytes.Contains(stored, testdata[:64]) {
+					t.Fatalf("content stored in the clear")
+				}
+				meta, err := readMetadata(blobio, key)
+				if err != nil || meta.Encryption == nil {
+					t.Fatalf("expected an envelope in the sidecar, got %v", err)
+				} else if meta.Digest != nil || meta.Blocks != nil {
+					t.Fatalf("checksums stored in the clear")
+				}
+				digest := sha256.Sum256(testdata)
+				if stat, err := StatBlob(info); err != nil || !bytes.Equal(stat.Digest, digest[:]) {
+					t.Fatalf("expected the sealed digest in stats, got %+v, %v", stat, err)
+				}
+
+				ranges := [][2]int64{{0, 0}, {checksumBlockSize + 3, 4096}, {int64(size) - 10, 0}}
+				for _, r := range ranges {
+					readback, err := readRange(info, r[0], r[1])
+					if err != nil {
+						t.Fatalf("range %v returned error: %s", r, err)
+					}
+					end := int64(size)
+					if r[1] > 0 {
+						end = r[0] + r[1]
+					}
+					if err = checkBytesEqual(readback, testdata[r[0]:end]); err != nil {
+						t.Fatalf("range %v content mismatch: %s", r, err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// test sidecars written with checksums in the clear, before they
+// were sealed, still read back and verify
+func TestCryptClearSums(t *testing.T) {
+	configureKeys(t, MemoryBackend, testConfig(t), testMasterKey(t))
+	info, testdata := writeChecksummedBlob(t, 2*checksumBlockSize+10)
+	key := keyFromInfo(info)
+	meta, err := readMetadata(blobio, key)
+	if err != nil {
+		t.Fatalf("could not read sidecar: %s", err)
+	}
+	dataKey, err := blobKeys.unwrap(key, meta)
+	if err != nil {
+		t.Fatalf("could not unwrap data key: %s", err)
+	} else if err = openSums(key, meta); err != nil {
+		t.Fatalf("could not open checksums: %s", err)
+	}
+	meta.Encryption.Sums = nil
+	if err = blobKeys.wrap(key, meta, dataKey); err != nil {
+		t.Fatalf("could not wrap data key: %s", err)
+	} else if err = writeMetadata(blobio, key, meta); err != nil {
+		t.Fatalf("could not write sidecar: %s", err)
+	}
+
+	content, err := readRange(info, 0, 0)
+	if err != nil {
+		t.Fatalf("could not read blob with clear checksums: %s", err)
+	} else if err = checkBytesEqual(content, testdata); err != nil {
+		t.Fatalf("content mismatch: %s", err)
+	}
+	meta.Blocks[0] ^= 1
+	if err = blobKeys.wrap(key, meta, dataKey); err != nil {
+		t.Fatalf("could not wrap data key: %s", err)
+	}
+	meta.Blocks[0] ^= 1 // edited after binding
+	if err = writeMetadata(blobio, key, meta); err != nil {
+		t.Fatalf("could not write sidecar: %s", err)
+	}
+	if _, err = readRange(info, 0, 0); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expected ErrCorrupt with edited clear checksums, got %v", err)
+	}
+}
+
+// test copies of encrypted blobs read back under their own key
+func TestCryptCopy(t *testing.T) {
+	configureKeys(t, LocalBackend, testConfig(t), testMasterKey(t))
+	source, testdata := writeChecksummedBlob(t, 2*checksumBlockSize)
+	dest := &pb.BlobInfo{Major: "major", Minor: "copy", BlobType: pb.BlobType_Raw}
+	if err := CopyBlob(source, dest, ""); err != nil {
+		t.Fatalf("CopyBlob returned error: %s", err)
+	}
+	if content, err := readRange(dest, 10, 0); err != nil {
+		t.Fatalf("could not read copy: %s", err)
+	} else if err = checkBytesEqual(content, testdata[10:]); err != nil {
+		t.Fatalf("copy mismatch: %s", err)
+	}
+	sourceMeta, _ := readMetadata(blobio, keyFromInfo(source))
+	destMeta, err := readMetadata(blobio, keyFromInfo(dest))
+	if err != nil {
+		t.Fatalf("could not read sidecar: %s", err)
+	} else if bytes.Equal(sourceMeta.Encryption.WrappedKey, destMeta.Encryption.WrappedKey) {
+		t.Fatalf("copy reuses its source's wrapped key")
+	}
+}
+
+// test damaged content, an edited sidecar, or a sidecar moved to
+// another blob are all reported as corruption
+func TestCryptTamper(t *testing.T) {
+	configureKeys(t, MemoryBackend, testConfig(t), testMasterKey(t))
+	info, _ := writeChecksummedBlob(t, 2*checksumBlockSize)
+	key := keyFromInfo(info)
+	stored, err := blobReadInternal(blobio, key)
+	if err != nil {
+		t.Fatalf("could not read stored content: %s", err)
+	}
+	meta, err := readMetadata(blobio, key)
+	if err != nil {
+		t.Fatalf("could not read sidecar: %s", err)
+	}
+
+	// a flipped byte in a segment
+	damaged := append([]byte{}, stored...)
+	damaged[10] ^= 0x01
+	if err = blobWriteInternal(blobio, key, damaged); err != nil {
+		t.Fatalf("could not overwrite content: %s", err)
+	}
+	if _, err = readRange(info, 0, 0); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expected ErrCorrupt for damaged segment, got %v", err)
+	}
+	// the last segment dropped
+	segments := len(stored) / int(meta.Encryption.Segments)
+	if err = blobWriteInternal(blobio, key, stored[:len(stored)-segments]); err != nil {
+		t.Fatalf("could not overwrite content: %s", err)
+	}
+	if _, err = readRange(info, 0, 0); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expected ErrCorrupt for truncated content, got %v", err)
+	}
+	if err = blobWriteInternal(blobio, key, stored); err != nil {
+		t.Fatalf("could not restore content: %s", err)
+	}
+
+	// an edited sidecar
+	edited := *meta
+	edited.Version = "edited"
+	if err = writeMetadata(blobio, key, &edited); err != nil {
+		t.Fatalf("could not edit sidecar: %s", err)
+	}
+	if _, err = readRange(info, 0, 0); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expected ErrCorrupt for edited sidecar, got %v", err)
+	}
+
+	// content and sidecar copied to another key
+	other := &pb.BlobInfo{Major: info.Major, Minor: info.Minor + "-moved", BlobType: info.BlobType}
+	if err = blobWriteInternal(blobio, keyFromInfo(other), stored); err != nil {
+		t.Fatalf("could not copy content: %s", err)
+	}
+	if err = writeMetadata(blobio, keyFromInfo(other), meta); err != nil {
+		t.Fatalf("could not copy sidecar: %s", err)
+	}
+	if _, err = readRange(other, 0, 0); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expected ErrCorrupt for moved sidecar, got %v", err)
+	}
+}
+
+// test rotation re-wraps data keys under the newest master key
+// without rewriting content, after which the old key can go
+func TestCryptRotation(t *testing.T) {
+	cfg := testConfig(t)
+	oldKey, newKey := testMasterKey(t), testMasterKey(t)
+	configureKeys(t, LocalBackend, cfg, oldKey)
+	info, testdata := writeChecksummedBlob(t, checksumBlockSize+100)
+	key := keyFromInfo(info)
+	stored, err := blobReadInternal(blobio, key)
+	if err != nil {
+		t.Fatalf("could not read stored content: %s", err)
+	}
+
+	configureKeys(t, LocalBackend, cfg, oldKey, newKey)
+	if rotated, err := RotateKeys(); err != nil || rotated != 1 {
+		t.Fatalf("expected 1 key re-wrapped, got %d, %v", rotated, err)
+	}
+	if rotated, err := RotateKeys(); err != nil || rotated != 0 {
+		t.Fatalf("expected nothing left to re-wrap, got %d, %v", rotated, err)
+	}
+	meta, err := readMetadata(blobio, key)
+	if err != nil {
+		t.Fatalf("could not read sidecar: %s", err)
+	} else if meta.Encryption.KeyID != keyID(newKey) {
+		t.Fatalf("expected key %s, found %s", keyID(newKey), meta.Encryption.KeyID)
+	}
+	rewrapped, err := blobReadInternal(blobio, key)
+	if err != nil {
+		t.Fatalf("could not read stored content: %s", err)
+	} else if !bytes.Equal(rewrapped, stored) {
+		t.Fatalf("content rewritten by rotation")
+	}
+
+	configureKeys(t, LocalBackend, cfg, newKey)
+	readback, err := readRange(info, 0, 0)
+	if err != nil {
+		t.Fatalf("could not read under new key: %s", err)
+	} else if err = checkBytesEqual(readback, testdata); err != nil {
+		t.Fatalf("content mismatch under new key: %s", err)
+	}
+
+	// without its master key a blob can't be read
+	configureKeys(t, LocalBackend, cfg, oldKey)
+	if _, err = readRange(info, 0, 0); !errors.Is(err, ErrNoKey) {
+		t.Fatalf("expected ErrNoKey, got %v", err)
+	}
+	configureKeys(t, LocalBackend, cfg)
+	if _, err = readRange(info, 0, 0); !errors.Is(err, ErrNoKey) {
+		t.Fatalf("expected ErrNoKey with no keys, got %v", err)
+	}
+}
+
+// test key files are read oldest first, skipping comments
+func TestCryptKeyFile(t *testing.T) {
+	first, second := testMasterKey(t), testMasterKey(t)
+	path := filepath.Join(t.TempDir(), "keys")
+	content := "# retired\n" + base64.StdEncoding.EncodeToString(first) +
+		"\n\n" + base64.StdEncoding.EncodeToString(second) + "\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("could not write key file: %s", err)
+	}
+	keys, err := LoadKeyFile(path)
+	if err != nil {
+		t.Fatalf("could not load key file: %s", err)
+	} else if len(keys) != 2 || !bytes.Equal(keys[0], first) || !bytes.Equal(keys[1], second) {
+		t.Fatalf("unexpected keys loaded %v", keys)
+	}
+
+	if err = os.WriteFile(path, []byte("c2hvcnQ=\n"), 0600); err != nil {
+		t.Fatalf("could not write key file: %s", err)
+	}
+	if _, err = LoadKeyFile(path); err == nil {
+		t.Fatalf("expected an error for a short key")
+	}
+}
@@ -0,0 +1,541 @@
+/*
+ * Content-addressed deduplication layer over a storage backend.
+ */
+
+/*
+ * Blob content is split into fixed-size chunks stored once under
+ * their SHA-256, and a manifest listing its chunks is stored next to
+ * the blob's key, under a ".manifest" type suffix. Each chunk has a
+ * reference count, persisted next to it, so identical content
+ * uploaded under many keys is stored once.
+ *
+ * Updates are ordered so a crash can only leak a chunk, never drop
+ * one that's still referenced: chunks are written before their
+ * count is raised, counts are raised before the manifest is
+ * committed, and an old manifest is replaced or deleted before its
+ * counts are lowered. A count is removed before its chunk, so an
+ * orphaned chunk is simply rewritten by the next upload needing it.
+ *
+ * A clone copies the manifest, raising the counts of its chunks
+ * first, so cloned blobs share every chunk.
+ *
+ * Blobs written before deduplication was enabled have no manifest
+ * and are read as-is; a manifest replaces such content once the
+ * blob is rewritten. Whether content is deduplicated is told by the
+ * manifest key alone, never by what the content holds. Checksum
+ * sidecars are small and unique, so they bypass the layer.
+ *
+ * Encryption at rest seals each blob under its own data key above
+ * this layer, so encrypted content never matches other content and
+ * deduplication stores nothing once. Clones still share chunks.
+ */
+
+package blob
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// bytes of content per deduplicated chunk.
+const dedupChunkSize = 1024 * 1024
+
+// major key of chunks and their reference counts.
+const dedupMajor = ".chunks"
+
+// blob types of chunks and their reference counts.
+const (
+	chunkType = "chunk"
+	refsType  = "refs"
+)
+
+// blob type suffix of the key holding a blob's manifest.
+const manifestSuffix = ".manifest"
+
+type dedupBackend struct {
+	inner Backend    // backend holding manifests and chunks.
+	mu    sync.Mutex // serializes reference count updates.
+}
+
+// Chunk list persisted at a deduplicated blob's key.
+type manifest struct {
+	Size   int64      `json:"size"`   // content size in bytes.
+	Chunks []chunkRef `json:"chunks"` // chunks in content order.
+}
+
+// Reference from a manifest to a stored chunk.
+type chunkRef struct {
+	Hash string `json:"hash"` // hex SHA-256 of the chunk.
+	Size int64  `json:"size"` // chunk size in bytes.
+}
+
+type dedupWriter struct {
+	backend  *dedupBackend // owning layer.
+	key      Key           // destination key.
+	buffer   []byte        // content of the current chunk.
+	manifest manifest      // chunks stored so far.
+}
+
+type dedupReader struct {
+	inner  Backend    // backend holding the chunks.
+	chunks []chunkRef // chunks left to read.
+	ready  []byte     // bytes of the current chunk to return.
+	skip   int64      // bytes to drop from the first chunk.
+	remain int64      // bytes left to return.
+}
+
+// View of a dedup layer reading quietly from its backend.
+type quietDedup struct {
+	*dedupBackend
+}
+
+// wrap a backend so blob content is stored deduplicated.
+func newDedupBackend(inner Backend) Backend {
+	return &dedupBackend{inner: inner}
+}
+
+// report whether content at the key goes through the layer.
+func dedupable(key Key) bool {
+	return key.Major != dedupMajor && !strings.HasSuffix(key.BlobType, metadataSuffix)
+}
+
+// return the key of a chunk, or of its reference count.
+func chunkKey(hash, blobType string) Key {
+	return Key{Major: dedupMajor, Minor: hash, BlobType: blobType}
+}
+
+// return the key holding a blob's manifest.
+func manifestKey(key Key) Key {
+	key.BlobType += manifestSuffix
+	return key
+}
+
+// return the blob key a manifest key belongs to, if it is one.
+func parseManifestKey(key Key) (Key, bool) {
+	if key.Major == dedupMajor {
+		return Key{}, false
+	}
+	blobType, ok := strings.CutSuffix(key.BlobType, manifestSuffix)
+	key.BlobType = blobType
+	return key, ok
+}
+
+// read the manifest of a blob, or nil if it isn't deduplicated.
+func (dedup *dedupBackend) readManifest(key Key) (*manifest, error) {
+	return readManifest(dedup.inner, key)
+}
+
+// read the manifest of a blob from the given backend, or nil if it
+// isn't deduplicated.
+func readManifest(inner Backend, key Key) (*manifest, error) {
+	content, err := blobReadInternal(inner, manifestKey(key))
+	if errors.Is(err, ErrNoExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	m := new(manifest)
+	if err = json.Unmarshal(content, m); err != nil {
+		return nil, ErrCorrupt
+	}
+	return m, nil
+}
+
+// remove content stored at a blob's key before it was
+// deduplicated, if there is any.
+func (dedup *dedupBackend) dropPlain(key Key) error {
+	if err := dedup.inner.Delete(key); err != nil && !errors.Is(err, ErrNoExist) {
+		return err
+	}
+	return nil
+}
+
+// read the reference count of a chunk, 0 if it isn't stored.
+func (dedup *dedupBackend) readRefs(hash string) (int, error) {
+	content, err := blobReadInternal(dedup.inner, chunkKey(hash, refsType))
+	if errors.Is(err, ErrNoExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	refs, err := strconv.Atoi(string(content))
+	if err != nil {
+		return 0, ErrCorrupt
+	}
+	return refs, nil
+}
+
+// store a chunk if it's new, and take a reference to it.
+func (dedup *dedupBackend) acquire(data []byte) (chunkRef, error) {
+	sum := sha256.Sum256(data)
+	ref := chunkRef{Hash: hex.EncodeToString(sum[:]), Size: int64(len(data))}
+	dedup.mu.Lock()
+	defer dedup.mu.Unlock()
+	refs, err := dedup.readRefs(ref.Hash)
+	if err != nil {
+		return ref, err
+	}
+	if refs == 0 {
+		if err = blobWriteInternal(dedup.inner, chunkKey(ref.Hash, chunkType), data); err != nil {
+			return ref, err
+		}
+	}
+	count := []byte(strconv.Itoa(refs + 1))
+	return ref, blobWriteInternal(dedup.inner, chunkKey(ref.Hash, refsType), count)
+}
+
+// drop references to chunks, removing any no longer used.
+// Called with the lock held.
+func (dedup *dedupBackend) release(chunks []chunkRef) error {
+	for _, ref := range chunks {
+		refs, err := dedup.readRefs(ref.Hash)
+		if err != nil {
+			return err
+		}
+		if refs > 1 {
+			count := []byte(strconv.Itoa(refs - 1))
+			err = blobWriteInternal(dedup.inner, chunkKey(ref.Hash, refsType), count)
+		} else if refs == 1 {
+			// the count goes first, so a crash leaves only an orphan
+			err = dedup.inner.Delete(chunkKey(ref.Hash, refsType))
+			if err == nil {
+				err = dedup.inner.Delete(chunkKey(ref.Hash, chunkType))
+			}
+		}
+		if err != nil && !errors.Is(err, ErrNoExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// take further references to chunks already stored. Called with
+// the lock held.
+func (dedup *dedupBackend) retain(chunks []chunkRef) error {
+	for i, ref := range chunks {
+		refs, err := dedup.readRefs(ref.Hash)
+		if err == nil && refs == 0 {
+			err = ErrCorrupt // manifest names a missing chunk
+		}
+		if err == nil {
+			count := []byte(strconv.Itoa(refs + 1))
+			err = blobWriteInternal(dedup.inner, chunkKey(ref.Hash, refsType), count)
+		}
+		if err != nil {
+			dedup.release(chunks[:i])
+			return err
+		}
+	}
+	return nil
+}
+
+// return a reader over the content of a blob, assembled from
+// its chunks if it was stored deduplicated.
+func (dedup *dedupBackend) Reader(key Key, offset, length int64) (io.ReadCloser, error) {
+	return readDeduped(dedup.inner, key, offset, length)
+}
+
+// return the view of the layer reading quietly from its backend.
+func (dedup *dedupBackend) quiet() Backend {
+	return quietDedup{dedup}
+}
+
+func (view quietDedup) Reader(key Key, offset, length int64) (io.ReadCloser, error) {
+	return readDeduped(quiet(view.inner), key, offset, length)
+}
+
+func (view quietDedup) Stat(key Key) (Attrs, error) {
+	return statDeduped(quiet(view.inner), key)
+}
+
+// return a reader over the content of a blob stored in the given
+// backend, assembled from its chunks if it was stored deduplicated.
+func readDeduped(inner Backend, key Key, offset, length int64) (io.ReadCloser, error) {
+	if !dedupable(key) {
+		return inner.Reader(key, offset, length)
+	}
+	m, err := readManifest(inner, key)
+	if err != nil {
+		return nil, err
+	} else if m == nil {
+		return inner.Reader(key, offset, length)
+	} else if offset > m.Size {
+		return nil, ErrRange
+	}
+	remain := m.Size - offset
+	if length > 0 && length < remain {
+		remain = length
+	}
+	// skip whole chunks before the offset
+	chunks := m.Chunks
+	for len(chunks) > 0 && offset >= chunks[0].Size {
+		offset -= chunks[0].Size
+		chunks = chunks[1:]
+	}
+	return &dedupReader{inner: inner, chunks: chunks, skip: offset, remain: remain}, nil
+}
+
+func (reader *dedupReader) Read(data []byte) (int, error) {
+	if reader.remain == 0 {
+		return 0, io.EOF
+	}
+	if len(reader.ready) == 0 {
+		if err := reader.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(data, reader.ready[:min(int64(len(reader.ready)), reader.remain)])
+	reader.ready = reader.ready[n:]
+	reader.remain -= int64(n)
+	return n, nil
+}
+
+// load and verify the next chunk.
+func (reader *dedupReader) readChunk() error {
+	if len(reader.chunks) == 0 {
+		return ErrCorrupt // manifest shorter than its size
+	}
+	ref := reader.chunks[0]
+	reader.chunks = reader.chunks[1:]
+	content, err := blobReadInternal(reader.inner, chunkKey(ref.Hash, chunkType))
+	if errors.Is(err, ErrNoExist) {
+		return ErrCorrupt
+	} else if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(content)
+	if hex.EncodeToString(sum[:]) != ref.Hash || int64(len(content)) != ref.Size {
+		return ErrCorrupt
+	}
+	reader.ready = content[min(reader.skip, ref.Size):]
+	reader.skip = 0
+	return nil
+}
+
+func (reader *dedupReader) Close() error {
+	return nil
+}
+
+// return a writer storing content as chunks as it arrives.
+func (dedup *dedupBackend) Writer(key Key) (Writer, error) {
+	if !dedupable(key) {
+		return dedup.inner.Writer(key)
+	}
+	return &dedupWriter{
+		backend:  dedup,
+		key:      key,
+		buffer:   make([]byte, 0, dedupChunkSize),
+		manifest: manifest{Chunks: []chunkRef{}},
+	}, nil
+}
+
+func (writer *dedupWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		n := copy(writer.buffer[len(writer.buffer):cap(writer.buffer)], data)
+		writer.buffer = writer.buffer[:len(writer.buffer)+n]
+		data = data[n:]
+		written += n
+		if len(writer.buffer) == cap(writer.buffer) {
+			if err := writer.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// store the current chunk, if any.
+func (writer *dedupWriter) flush() error {
+	if len(writer.buffer) == 0 {
+		return nil
+	}
+	ref, err := writer.backend.acquire(writer.buffer)
+	if err != nil {
+		return err
+	}
+	writer.manifest.Chunks = append(writer.manifest.Chunks, ref)
+	writer.manifest.Size += ref.Size
+	writer.buffer = writer.buffer[:0]
+	return nil
+}
+
+// commit the manifest, then release the chunks it replaced.
+func (writer *dedupWriter) Commit() error {
+	if err := writer.flush(); err != nil {
+		writer.Abort()
+		return err
+	}
+	content, err := json.Marshal(&writer.manifest)
+	if err != nil {
+		writer.Abort()
+		return err
+	}
+	dedup := writer.backend
+	dedup.mu.Lock()
+	defer dedup.mu.Unlock()
+	// a damaged old manifest can only leak its chunks
+	old, err := dedup.readManifest(writer.key)
+	if err != nil && !errors.Is(err, ErrCorrupt) {
+		dedup.release(writer.manifest.Chunks)
+		return err
+	}
+	if err = blobWriteInternal(dedup.inner, manifestKey(writer.key), content); err != nil {
+		dedup.release(writer.manifest.Chunks)
+		return err
+	}
+	if err = dedup.dropPlain(writer.key); err != nil {
+		return err
+	}
+	if old != nil {
+		return dedup.release(old.Chunks)
+	}
+	return nil
+}
+
+// release the chunks stored so far.
+func (writer *dedupWriter) Abort() error {
+	dedup := writer.backend
+	dedup.mu.Lock()
+	defer dedup.mu.Unlock()
+	err := dedup.release(writer.manifest.Chunks)
+	writer.manifest = manifest{}
+	return err
+}
+
+// copy a blob's manifest to another key, sharing its chunks, then
+// release the chunks the destination held.
+func (dedup *dedupBackend) Clone(from, to Key) error {
+	if !dedupable(from) || !dedupable(to) {
+		return cloneContent(dedup.inner, from, to)
+	}
+	dedup.mu.Lock()
+	defer dedup.mu.Unlock()
+	m, err := dedup.readManifest(from)
+	if err != nil {
+		return err
+	}
+	old, err := dedup.readManifest(to)
+	if err != nil && !errors.Is(err, ErrCorrupt) {
+		return err
+	}
+	if m == nil {
+		// plain content is copied as stored, replacing any manifest
+		if err = cloneContent(dedup.inner, from, to); err != nil {
+			return err
+		} else if old == nil {
+			return nil
+		}
+		err = dedup.inner.Delete(manifestKey(to))
+		if err != nil && !errors.Is(err, ErrNoExist) {
+			return err
+		}
+		return dedup.release(old.Chunks)
+	}
+	if err = dedup.retain(m.Chunks); err != nil {
+		return err
+	}
+	if err = cloneContent(dedup.inner, manifestKey(from), manifestKey(to)); err != nil {
+		dedup.release(m.Chunks)
+		return err
+	}
+	if err = dedup.dropPlain(to); err != nil {
+		return err
+	}
+	if old != nil {
+		return dedup.release(old.Chunks)
+	}
+	return nil
+}
+
+// delete a blob, then release its chunks.
+func (dedup *dedupBackend) Delete(key Key) error {
+	if !dedupable(key) {
+		return dedup.inner.Delete(key)
+	}
+	dedup.mu.Lock()
+	defer dedup.mu.Unlock()
+	m, err := dedup.readManifest(key)
+	if errors.Is(err, ErrCorrupt) {
+		m = &manifest{} // a damaged manifest can only leak its chunks
+	} else if err != nil {
+		return err
+	}
+	if m == nil {
+		return dedup.inner.Delete(key)
+	}
+	if err = dedup.inner.Delete(manifestKey(key)); err != nil {
+		return err
+	}
+	if err = dedup.dropPlain(key); err != nil {
+		return err
+	}
+	return dedup.release(m.Chunks)
+}
+
+// describe a blob, by its content size if deduplicated.
+func (dedup *dedupBackend) Stat(key Key) (Attrs, error) {
+	return statDeduped(dedup.inner, key)
+}
+
+// describe a blob stored in the given backend, by its content size
+// if deduplicated.
+func statDeduped(inner Backend, key Key) (Attrs, error) {
+	if !dedupable(key) {
+		return inner.Stat(key)
+	}
+	attrs, err := inner.Stat(manifestKey(key))
+	if errors.Is(err, ErrNoExist) {
+		return inner.Stat(key)
+	} else if err != nil {
+		return attrs, err
+	}
+	m, err := readManifest(inner, key)
+	if err != nil {
+		return Attrs{}, err
+	} else if m == nil {
+		return Attrs{}, ErrNoExist // deleted since
+	}
+	attrs.Size = m.Size
+	return attrs, nil
+}
+
+// list blob keys, listing manifests as the blobs they belong to
+// and hiding chunks and reference counts. A manifest key sorts
+// just after its blob's key, so listing after a blob also skips
+// its manifest.
+func (dedup *dedupBackend) List(major string, after Key, limit int) ([]Key, error) {
+	if after != (Key{}) && dedupable(after) {
+		after = manifestKey(after)
+	}
+	keys := []Key{}
+	for len(keys) < limit {
+		want := limit - len(keys)
+		page, err := dedup.inner.List(major, after, want)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range page {
+			if blobKey, ok := parseManifestKey(key); ok {
+				key = blobKey
+			}
+			if key.Major == dedupMajor {
+				continue
+			} else if len(keys) > 0 && keys[len(keys)-1] == key {
+				continue // plain content left behind a manifest
+			}
+			keys = append(keys, key)
+		}
+		if len(page) < want {
+			break // nothing more to list
+		}
+		after = page[len(page)-1]
+	}
+	return keys, nil
+}
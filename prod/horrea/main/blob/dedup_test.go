@@ -0,0 +1,228 @@
+/*
+ * Tests for the content-addressed deduplication layer.
+ */
+
+package blob
+
+import (
+	pb "github.com/pleb/prod/horrea/pb"
+
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+// configure the named backend with deduplication enabled
+func configureDedup(t *testing.T, name string) *dedupBackend {
+	cfg := testConfig(t)
+	cfg.Dedup = true
+	if err := ConfigureBackend(name, cfg); err != nil {
+		t.Fatalf("could not configure %s backend: %s", name, err)
+	}
+	return blobio.(*dedupBackend)
+}
+
+// count the chunks held by the underlying backend
+func countChunks(t *testing.T, dedup *dedupBackend) int {
+	keys, err := dedup.inner.List(dedupMajor, Key{}, 1000)
+	if err != nil {
+		t.Fatalf("could not list chunks: %s", err)
+	}
+	chunks := 0
+	for _, key := range keys {
+		if key.BlobType == chunkType {
+			chunks++
+		}
+	}
+	return chunks
+}
+
+// test copies share chunks, which outlive the source
+func TestDedupCopy(t *testing.T) {
+	dedup := configureDedup(t, MemoryBackend)
+	source, testdata := writeChecksummedBlob(t, dedupChunkSize+100)
+	dest := &pb.BlobInfo{Major: "major", Minor: "copy", BlobType: pb.BlobType_Raw}
+	if err := CopyBlob(source, dest, ""); err != nil {
+		t.Fatalf("CopyBlob returned error: %s", err)
+	}
+	if chunks := countChunks(t, dedup); chunks != 2 {
+		t.Fatalf("expected 2 shared chunks, found %d", chunks)
+	}
+	m, err := dedup.readManifest(keyFromInfo(dest))
+	if err != nil || m == nil {
+		t.Fatalf("expected a manifest for the copy, got %v", err)
+	}
+	for _, ref := range m.Chunks {
+		if refs, _ := dedup.readRefs(ref.Hash); refs != 2 {
+			t.Fatalf("expected 2 references to %s, found %d", ref.Hash, refs)
+		}
+	}
+	if err = DeleteBlob(source); err != nil {
+		t.Fatalf("DeleteBlob returned error: %s", err)
+	}
+	if content, err := readRange(dest, 0, 0); err != nil {
+		t.Fatalf("could not read copy: %s", err)
+	} else if err = checkBytesEqual(content, testdata); err != nil {
+		t.Fatalf("copy mismatch: %s", err)
+	}
+	if err = DeleteBlob(dest); err != nil {
+		t.Fatalf("DeleteBlob returned error: %s", err)
+	}
+	if chunks := countChunks(t, dedup); chunks != 0 {
+		t.Fatalf("expected chunks released, found %d", chunks)
+	}
+}
+
+// test that identical content is stored once and released with
+// its last reference, against every backend
+func TestDedupSharedContent(t *testing.T) {
+	for _, name := range Backends() {
+		t.Run(name, func(t *testing.T) {
+			dedup := configureDedup(t, name)
+
+			// two and a half chunks, the first two identical
+			chunk := make([]byte, dedupChunkSize)
+			rand.Read(chunk)
+			testdata := append(append(append([]byte{}, chunk...), chunk...),
+				chunk[:dedupChunkSize/2]...)
+			first := Key{Major: "major", Minor: "first", BlobType: "Raw"}
+			second := Key{Major: "major", Minor: "second", BlobType: "Raw"}
+			for _, key := range []Key{first, second} {
+				if err := blobWriteInternal(blobio, key, testdata); err != nil {
+					t.Fatalf("could not write %s: %s", key, err)
+				}
+			}
+			if chunks := countChunks(t, dedup); chunks != 2 {
+				t.Fatalf("expected 2 stored chunks, found %d", chunks)
+			}
+
+			// content and sizes are unchanged by deduplication
+			attrs, err := blobio.Stat(second)
+			if err != nil {
+				t.Fatalf("could not stat blob: %s", err)
+			} else if attrs.Size != int64(len(testdata)) {
+				t.Fatalf("expected size %d, found %d", len(testdata), attrs.Size)
+			}
+			reader, err := blobio.Reader(second, dedupChunkSize-10, 20)
+			if err != nil {
+				t.Fatalf("could not open ranged reader: %s", err)
+			}
+			readback := make([]byte, 20)
+			if _, err = reader.Read(readback[:10]); err != nil {
+				t.Fatalf("could not read range: %s", err)
+			}
+			if _, err = reader.Read(readback[10:]); err != nil {
+				t.Fatalf("could not read range: %s", err)
+			}
+			reader.Close()
+			if err = checkBytesEqual(readback, testdata[dedupChunkSize-10:dedupChunkSize+10]); err != nil {
+				t.Fatalf("range across chunks mismatch: %s", err)
+			}
+
+			// chunks are hidden from listings
+			keys, err := blobio.List("", Key{}, 100)
+			if err != nil {
+				t.Fatalf("could not list blobs: %s", err)
+			} else if len(keys) != 2 {
+				t.Fatalf("expected 2 listed blobs, found %v", keys)
+			}
+
+			// chunks survive until their last reference goes
+			if err = blobio.Delete(first); err != nil {
+				t.Fatalf("could not delete blob: %s", err)
+			}
+			content, err := blobReadInternal(blobio, second)
+			if err != nil {
+				t.Fatalf("could not read remaining blob: %s", err)
+			} else if err = checkBytesEqual(content, testdata); err != nil {
+				t.Fatalf("remaining blob mismatch: %s", err)
+			}
+			if err = blobWriteInternal(blobio, second, []byte("replaced")); err != nil {
+				t.Fatalf("could not overwrite blob: %s", err)
+			}
+			if chunks := countChunks(t, dedup); chunks != 1 {
+				t.Fatalf("expected 1 chunk after overwrite, found %d", chunks)
+			}
+			if err = blobio.Delete(second); err != nil {
+				t.Fatalf("could not delete blob: %s", err)
+			}
+			if chunks := countChunks(t, dedup); chunks != 0 {
+				t.Fatalf("expected no chunks after delete, found %d", chunks)
+			}
+		})
+	}
+}
+
+// test that aborted writes release their chunks
+func TestDedupAbort(t *testing.T) {
+	dedup := configureDedup(t, MemoryBackend)
+	writer, err := blobio.Writer(Key{Major: "major", Minor: "minor", BlobType: "Raw"})
+	if err != nil {
+		t.Fatalf("could not open writer: %s", err)
+	}
+	if _, err = writer.Write(make([]byte, 3*dedupChunkSize)); err != nil {
+		t.Fatalf("could not write content: %s", err)
+	}
+	if err = writer.Abort(); err != nil {
+		t.Fatalf("could not abort write: %s", err)
+	}
+	if chunks := countChunks(t, dedup); chunks != 0 {
+		t.Fatalf("expected no chunks after abort, found %d", chunks)
+	}
+}
+
+// test that content stored before deduplication still reads, and
+// that damaged chunks are reported as corruption
+func TestDedupLegacyAndCorrupt(t *testing.T) {
+	dedup := configureDedup(t, MemoryBackend)
+	// plain content is never taken for a manifest, whatever it holds
+	legacy := Key{Major: "major", Minor: "legacy", BlobType: "Raw"}
+	plain := `horrea-manifest
+{"size": 5, "chunks": []}`
+	if err := blobWriteInternal(dedup.inner, legacy, []byte(plain)); err != nil {
+		t.Fatalf("could not write content: %s", err)
+	}
+	content, err := blobReadInternal(blobio, legacy)
+	if err != nil {
+		t.Fatalf("could not read legacy blob: %s", err)
+	} else if string(content) != plain {
+		t.Fatalf("expected legacy content, found %q", content)
+	}
+	if attrs, err := blobio.Stat(legacy); err != nil || attrs.Size != int64(len(plain)) {
+		t.Fatalf("unexpected legacy stat %+v, %v", attrs, err)
+	}
+
+	// rewriting a legacy blob replaces its plain content
+	if err = blobWriteInternal(blobio, legacy, []byte("rewritten")); err != nil {
+		t.Fatalf("could not rewrite content: %s", err)
+	}
+	if _, err = dedup.inner.Stat(legacy); !errors.Is(err, ErrNoExist) {
+		t.Fatalf("expected plain content removed, got %v", err)
+	}
+	if content, err = blobReadInternal(blobio, legacy); err != nil || string(content) != "rewritten" {
+		t.Fatalf("expected rewritten content, found %q, %v", content, err)
+	}
+	listed, err := blobio.List("major", Key{}, 10)
+	if err != nil || len(listed) != 1 || listed[0] != legacy {
+		t.Fatalf("expected the blob listed once, got %v, %v", listed, err)
+	}
+	if listed, err = blobio.List("major", legacy, 10); err != nil || len(listed) != 0 {
+		t.Fatalf("expected nothing listed after the blob, got %v, %v", listed, err)
+	}
+
+	key := Key{Major: "major", Minor: "deduped", BlobType: "Raw"}
+	if err = blobWriteInternal(blobio, key, []byte("deduplicated")); err != nil {
+		t.Fatalf("could not write content: %s", err)
+	}
+	m, err := dedup.readManifest(key)
+	if err != nil || m == nil {
+		t.Fatalf("could not read manifest: %v", err)
+	}
+	damaged := chunkKey(m.Chunks[0].Hash, chunkType)
+	if err = blobWriteInternal(dedup.inner, damaged, []byte("damaged")); err != nil {
+		t.Fatalf("could not overwrite chunk: %s", err)
+	}
+	if _, err = blobReadInternal(blobio, key); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expected ErrCorrupt for damaged chunk, got %v", err)
+	}
+}
@@ -0,0 +1,480 @@
+/*
+ * Byte-range patches stored as deltas over a blob.
+ */
+
+/*
+ * A patch writes a byte range into an existing blob without
+ * rewriting the rest of it. The range is stored as a delta, a
+ * checksummed blob of its own at a key next to the patched one,
+ * and the patched blob's sidecar lists its deltas, oldest first.
+ * Reads merge the stored content with its deltas, later deltas
+ * overlaying earlier ones, so only the deltas a range covers are
+ * read. A patch may start anywhere up to the end of the blob, and
+ * grows the blob if it runs past the end.
+ *
+ * The sidecar's size, digest and checksums still describe the
+ * stored content alone, so the digest of a patched blob isn't
+ * known until compaction folds its deltas back in. Compaction
+ * rewrites the merged content under the same version, since it
+ * reads the same, and gives up if the blob is written meanwhile.
+ * Blobs reaching a limit of deltas are compacted straight away.
+ *
+ * Deltas are written before the sidecar lists them, and removed
+ * after it stops listing them, so a crash leaves only orphans,
+ * which compaction sweeps once they're old enough not to be part
+ * of a patch still being written. Copies and old versions of a
+ * patched blob get clones of its deltas, so keeping the version a
+ * patch replaces costs a sidecar, not a copy of the blob.
+ */
+
+package blob
+
+import (
+	pb "github.com/pleb/prod/horrea/pb"
+
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// separates the blob type from the delta ID in delta keys.
+const deltaSep = "~"
+
+// deltas a blob may have before it is compacted.
+const maxDeltas = 64
+
+// age after which a delta no sidecar lists is removed.
+const deltaGrace = time.Hour
+
+// Delta layered over a blob's stored content.
+type Delta struct {
+	ID     string `json:"id"`     // version ID the delta was written under.
+	Offset int64  `json:"offset"` // offset of the delta in the blob.
+	Size   int64  `json:"size"`   // bytes in the delta.
+}
+
+// stretch of merged content, and where it is stored.
+type extent struct {
+	start int64  // offset in the merged content.
+	end   int64  // offset past the stretch.
+	delta string // delta holding it, empty for the stored content.
+	from  int64  // offset of start within its source.
+}
+
+// pending write of a delta.
+type patchWriter struct {
+	*checksumWriter
+	base   Key    // blob being patched.
+	offset int64  // offset of the delta in the blob.
+	id     string // delta ID.
+}
+
+// reader over the merged content of a patched blob.
+type patchedReader struct {
+	backend Backend
+	key     Key
+	meta    *Metadata
+	extents []extent
+	offset  int64         // offset of the next byte returned.
+	remain  int64         // bytes left to return.
+	source  io.ReadCloser // reader over the current extent.
+	left    int64         // bytes left in the current extent.
+}
+
+// return the key holding a delta of a blob.
+func deltaKey(key Key, id string) Key {
+	key.BlobType += deltaSep + id
+	return key
+}
+
+// split a delta key into its blob key and delta ID.
+func parseDeltaKey(key Key) (Key, string, bool) {
+	if strings.HasSuffix(key.BlobType, metadataSuffix) {
+		return Key{}, "", false
+	}
+	blobType, id, ok := strings.Cut(key.BlobType, deltaSep)
+	if !ok || id == "" {
+		return Key{}, "", false
+	}
+	key.BlobType = blobType
+	return key, id, true
+}
+
+// return the size of a blob with its deltas applied.
+func (meta *Metadata) contentSize() int64 {
+	size := meta.Size
+	for _, delta := range meta.Deltas {
+		size = max(size, delta.Offset+delta.Size)
+	}
+	return size
+}
+
+// return the stretches making up the merged content, in order.
+func (meta *Metadata) extents() []extent {
+	extents := []extent{{start: 0, end: meta.Size}}
+	for _, delta := range meta.Deltas {
+		start, end := delta.Offset, delta.Offset+delta.Size
+		if start == end {
+			continue
+		}
+		next := []extent{{start: start, end: end, delta: delta.ID}}
+		for _, under := range extents {
+			if under.start < start {
+				next = append(next, extent{under.start, min(under.end, start), under.delta, under.from})
+			}
+			if under.end > end {
+				skip := max(end-under.start, 0)
+				next = append(next, extent{max(under.start, end), under.end, under.delta, under.from + skip})
+			}
+		}
+		sort.Slice(next, func(i, j int) bool { return next[i].start < next[j].start })
+		extents = next
+	}
+	return extents
+}
+
+// start a patch writing content into a blob from the given offset,
+// which may be at most the blob's size. The blob must exist, with
+// checksums, and not be held.
+func CreatePatchWriter(info *pb.BlobInfo, offset int64) (Writer, error) {
+	if blobio == nil {
+		return nil, ErrNotSupp
+	} else if offset < 0 {
+		return nil, ErrRange
+	}
+	key := keyFromInfo(info)
+	if !validKey(key) {
+		return nil, ErrKey
+	}
+	if err := checkHold(key, time.Now()); err != nil {
+		return nil, err
+	}
+	if _, err := patchBase(key, offset); err != nil {
+		return nil, err
+	}
+	id := newVersionID(time.Now())
+	dkey := deltaKey(key, id)
+	writer, err := newSidecarWriter(blobio, dkey, metadataKey(dkey), nil, storeCodec, blobKeys)
+	if err != nil {
+		return nil, err
+	}
+	return &patchWriter{checksumWriter: writer, base: key, offset: offset, id: id}, nil
+}
+
+// return the sidecar of a blob a patch at offset may apply to.
+func patchBase(key Key, offset int64) (*Metadata, error) {
+	meta, err := readMetadata(blobio, key)
+	if errors.Is(err, ErrNoExist) {
+		if _, err = blobio.Stat(key); err == nil {
+			return nil, fmt.Errorf("%w: %s has no checksums to patch", ErrNotSupp, key)
+		}
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+	if offset > meta.contentSize() {
+		return nil, ErrRange
+	}
+	return meta, nil
+}
+
+// persist the delta, then list it in the blob's sidecar. With
+// versioning, the content patched is kept as an old version.
+func (writer *patchWriter) Commit() error {
+	if err := writer.checksumWriter.Commit(); err != nil {
+		return err
+	}
+	if versioning.enabled {
+		if err := preserveVersion(writer.base); err != nil {
+			dropDelta(blobio, writer.base, writer.id)
+			return err
+		}
+	}
+	delta := Delta{ID: writer.id, Offset: writer.offset, Size: writer.meta.Size}
+	count, err := attachDelta(writer.base, delta)
+	if err != nil {
+		dropDelta(blobio, writer.base, writer.id)
+		return err
+	}
+	if count >= maxDeltas {
+		if _, err = compactKey(writer.base); err != nil {
+			log.Printf("Could not compact %s: %v", writer.base, err)
+		}
+	}
+	if versioning.enabled {
+		return pruneVersions(writer.base, time.Now())
+	}
+	return nil
+}
+
+// add a stored delta to a blob's sidecar under a new version,
+// returning how many deltas the blob has.
+func attachDelta(key Key, delta Delta) (int, error) {
+	defer lockSidecar(key)()
+	if err := checkHold(key, time.Now()); err != nil {
+		return 0, err
+	}
+	meta, err := patchBase(key, delta.Offset)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = readMetadata(blobio, deltaKey(key, delta.ID)); err != nil {
+		// swept as an orphan while it was written
+		return 0, fmt.Errorf("%w: delta %s", ErrNoExist, delta.ID)
+	}
+	var dataKey []byte
+	if meta.Encryption != nil {
+		if dataKey, err = blobKeys.unwrap(key, meta); err != nil {
+			return 0, err
+		}
+	}
+	meta.Deltas = append(meta.Deltas, delta)
+	meta.Version = newVersionID(time.Now())
+	if dataKey != nil {
+		if err = blobKeys.wrap(key, meta, dataKey); err != nil {
+			return 0, err
+		}
+	}
+	return len(meta.Deltas), writeMetadata(blobio, key, meta)
+}
+
+// open a reader over a range of a blob's content merged with its
+// deltas, each part verified against its own checksums.
+func openPatched(backend Backend, key Key, meta *Metadata, offset, length int64) (io.ReadCloser, error) {
+	size := meta.contentSize()
+	if offset > size {
+		return nil, ErrRange
+	}
+	remain := size - offset
+	if length > 0 && length < remain {
+		remain = length
+	}
+	return &patchedReader{
+		backend: backend,
+		key:     key,
+		meta:    meta,
+		extents: meta.extents(),
+		offset:  offset,
+		remain:  remain,
+	}, nil
+}
+
+func (reader *patchedReader) Read(data []byte) (int, error) {
+	if reader.remain == 0 {
+		return 0, io.EOF
+	}
+	if reader.source == nil {
+		if err := reader.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := reader.source.Read(data[:min(int64(len(data)), reader.left)])
+	reader.offset += int64(n)
+	reader.remain -= int64(n)
+	reader.left -= int64(n)
+	if reader.left == 0 {
+		reader.source.Close()
+		reader.source = nil
+		return n, nil
+	} else if err == io.EOF {
+		return n, ErrCorrupt // shorter than its sidecar says
+	}
+	return n, err
+}
+
+// open the source of the extent holding the next byte.
+func (reader *patchedReader) open() error {
+	i := sort.Search(len(reader.extents), func(i int) bool {
+		return reader.extents[i].end > reader.offset
+	})
+	if i == len(reader.extents) || reader.extents[i].start > reader.offset {
+		return ErrCorrupt
+	}
+	at := reader.extents[i]
+	span := min(at.end-reader.offset, reader.remain)
+	from := at.from + reader.offset - at.start
+	key, meta := reader.key, reader.meta
+	if at.delta != "" {
+		key = deltaKey(reader.key, at.delta)
+		var err error
+		if meta, err = readMetadata(reader.backend, key); errors.Is(err, ErrNoExist) {
+			return fmt.Errorf("%w: delta %s missing", ErrCorrupt, at.delta)
+		} else if err != nil {
+			return err
+		}
+	}
+	source, err := openVerified(reader.backend, key, meta, from, span)
+	if err != nil {
+		return err
+	}
+	reader.source, reader.left = source, span
+	return nil
+}
+
+func (reader *patchedReader) Close() error {
+	if reader.source != nil {
+		return reader.source.Close()
+	}
+	return nil
+}
+
+// copy a delta of one blob to another, re-wrapping its data key
+// if the copy is bound to a different blob.
+func cloneDelta(src, dst Key, id string) error {
+	from, to := deltaKey(src, id), deltaKey(dst, id)
+	meta, err := readMetadata(blobio, from)
+	if err != nil {
+		return err
+	}
+	if meta.Encryption != nil && boundKey(from) != boundKey(to) {
+		dataKey, err := blobKeys.unwrap(from, meta)
+		if err != nil {
+			return err
+		}
+		if err = blobKeys.wrap(to, meta, dataKey); err != nil {
+			return err
+		}
+	}
+	if err = writeMetadata(blobio, to, meta); err != nil {
+		return err
+	}
+	return cloneContent(blobio, from, to)
+}
+
+// remove the deltas listed by a replaced sidecar that its
+// replacement doesn't list.
+func dropDeltas(backend Backend, key Key, replaced, kept *Metadata) {
+	if replaced == nil {
+		return
+	}
+	keep := map[string]bool{}
+	if kept != nil {
+		for _, delta := range kept.Deltas {
+			keep[delta.ID] = true
+		}
+	}
+	for _, delta := range replaced.Deltas {
+		if !keep[delta.ID] {
+			dropDelta(backend, key, delta.ID)
+		}
+	}
+}
+
+// remove a delta and its sidecar. Failures only leave an orphan
+// for compaction to sweep.
+func dropDelta(backend Backend, key Key, id string) {
+	dkey := deltaKey(key, id)
+	for _, stored := range []Key{dkey, metadataKey(dkey)} {
+		if err := backend.Delete(stored); err != nil && !errors.Is(err, ErrNoExist) {
+			log.Printf("Could not remove delta %s: %v", stored, err)
+		}
+	}
+}
+
+// fold a blob's deltas into its content, unless it is written
+// meanwhile. Reports whether it was compacted.
+func compactKey(key Key) (bool, error) {
+	meta, err := readMetadata(blobio, key)
+	if errors.Is(err, ErrNoExist) {
+		return false, nil
+	} else if err != nil || len(meta.Deltas) == 0 {
+		return false, err
+	}
+	reader, err := openPatched(blobio, key, meta, 0, 0)
+	if err != nil {
+		return false, err
+	}
+	defer reader.Close()
+	writer, err := newSidecarWriter(blobio, key, metadataKey(key), nil, storeCodec, blobKeys)
+	if err != nil {
+		return false, err
+	}
+	// the merged content reads the same, so keeps its version
+	writer.meta.Version = meta.Version
+	if _, err = io.Copy(writer, reader); err != nil {
+		writer.Abort()
+		return false, err
+	}
+
+	defer lockSidecar(key)()
+	current, err := readMetadata(blobio, key)
+	if err != nil || current.Version != meta.Version {
+		writer.Abort()
+		if errors.Is(err, ErrNoExist) {
+			err = nil
+		}
+		return false, err
+	}
+	if err = writer.Commit(); err != nil {
+		return false, err
+	}
+	dropDeltas(blobio, key, meta, nil)
+	return true, nil
+}
+
+// remove deltas of a blob its sidecar doesn't list, if they are
+// older than the grace period at the given time.
+func sweepDeltas(key Key, ids []string, now time.Time) {
+	defer lockSidecar(key)()
+	listed := map[string]bool{}
+	if meta, err := readMetadata(blobio, key); err == nil {
+		for _, delta := range meta.Deltas {
+			listed[delta.ID] = true
+		}
+	} else if !errors.Is(err, ErrNoExist) {
+		return // unreadable, so its deltas may yet be needed
+	}
+	for _, id := range ids {
+		if !listed[id] && now.Sub(versionTime(id)) > deltaGrace {
+			log.Printf("Removing orphan delta %s of %s", id, key)
+			dropDelta(blobio, key, id)
+		}
+	}
+}
+
+// fold the deltas of every patched blob into its content, and
+// remove orphan deltas, returning how many blobs were compacted.
+func CompactDeltas(now time.Time) (int, error) {
+	if blobio == nil {
+		return 0, ErrNotSupp
+	}
+	patched := map[Key][]string{}
+	after := Key{}
+	for {
+		keys, err := blobio.List("", after, DefaultPageSize)
+		if err != nil {
+			return 0, err
+		}
+		for _, key := range keys {
+			// orphans may be a sidecar alone
+			key.BlobType = strings.TrimSuffix(key.BlobType, metadataSuffix)
+			base, id, ok := parseDeltaKey(key)
+			if ok && !slices.Contains(patched[base], id) {
+				patched[base] = append(patched[base], id)
+			}
+		}
+		if len(keys) < DefaultPageSize {
+			break
+		}
+		after = keys[len(keys)-1]
+	}
+	compacted := 0
+	for key, ids := range patched {
+		done, err := compactKey(key)
+		if err != nil {
+			log.Printf("Could not compact %s: %v", key, err)
+		} else if done {
+			compacted++
+		}
+		sweepDeltas(key, ids, now)
+	}
+	if compacted > 0 {
+		log.Printf("Compacted deltas of %d blobs", compacted)
+	}
+	return compacted, nil
+}
@@ -0,0 +1,265 @@
+/*
+ * Tests for byte-range patches stored as deltas.
+ */
+
+package blob
+
+import (
+	pb "github.com/pleb/prod/horrea/pb"
+
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+// patch a blob with random content, returning the content expected
+// of the blob after it
+func patchBlob(t *testing.T, info *pb.BlobInfo, offset int64, size int, expect []byte) []byte {
+	patch := make([]byte, size)
+	rand.Read(patch)
+	writer, err := CreatePatchWriter(info, offset)
+	if err != nil {
+		t.Fatalf("CreatePatchWriter returned error: %s", err)
+	}
+	if _, err = writer.Write(patch); err != nil {
+		t.Fatalf("could not write patch: %s", err)
+	} else if err = writer.Commit(); err != nil {
+		t.Fatalf("could not commit patch: %s", err)
+	}
+	if end := int(offset) + size; end > len(expect) {
+		expect = append(expect, make([]byte, end-len(expect))...)
+	}
+	copy(expect[offset:], patch)
+	return expect
+}
+
+// count the deltas stored for every blob
+func countDeltas(t *testing.T) int {
+	count := 0
+	after := Key{}
+	for {
+		keys, err := blobio.List("", after, DefaultPageSize)
+		if err != nil {
+			t.Fatalf("could not list keys: %s", err)
+		}
+		for _, key := range keys {
+			if _, _, ok := parseDeltaKey(key); ok {
+				count++
+			}
+		}
+		if len(keys) < DefaultPageSize {
+			return count
+		}
+		after = keys[len(keys)-1]
+	}
+}
+
+// check a blob reads back as expected, whole and in ranges
+func checkPatched(t *testing.T, info *pb.BlobInfo, expect []byte) {
+	size := int64(len(expect))
+	ranges := [][2]int64{{0, 0}, {999, 2}, {checksumBlockSize - 60, 120}, {size - 20, 0}}
+	for _, r := range ranges {
+		content, err := readRange(info, r[0], r[1])
+		if err != nil {
+			t.Fatalf("range %v returned error: %s", r, err)
+		}
+		end := size
+		if r[1] > 0 {
+			end = r[0] + r[1]
+		}
+		if err = checkBytesEqual(content, expect[r[0]:end]); err != nil {
+			t.Fatalf("range %v mismatch: %s", r, err)
+		}
+	}
+}
+
+// test patches against every backend
+func TestDeltaPatch(t *testing.T) {
+	for _, name := range Backends() {
+		t.Run(name, func(t *testing.T) {
+			if err := ConfigureBackend(name, testConfig(t)); err != nil {
+				t.Fatalf("could not configure %s backend: %s", name, err)
+			}
+			testDeltaPatch(t)
+		})
+	}
+}
+
+// patch a blob with overlapping and growing deltas, then check it
+// reads the same once compacted
+func testDeltaPatch(t *testing.T) {
+	info, testdata := writeChecksummedBlob(t, 3*checksumBlockSize+100)
+	expect := slices.Clone(testdata)
+	expect = patchBlob(t, info, 1000, 1, expect)
+	expect = patchBlob(t, info, checksumBlockSize-50, 100, expect)
+	expect = patchBlob(t, info, checksumBlockSize-10, 20, expect)
+	expect = patchBlob(t, info, int64(len(expect))-10, 50, expect)
+	checkPatched(t, info, expect)
+
+	stat, err := StatBlob(info)
+	if err != nil {
+		t.Fatalf("StatBlob returned error: %s", err)
+	} else if stat.Size != int64(len(expect)) || stat.Digest != nil {
+		t.Fatalf("unexpected patched stat %+v", stat)
+	}
+	if _, err = CreatePatchWriter(info, stat.Size+1); !errors.Is(err, ErrRange) {
+		t.Fatalf("expected ErrRange patching past the end, got %v", err)
+	}
+	missing := &pb.BlobInfo{Major: "major", Minor: "missing"}
+	if _, err = CreatePatchWriter(missing, 0); !errors.Is(err, ErrNoExist) {
+		t.Fatalf("expected ErrNoExist patching a missing blob, got %v", err)
+	}
+
+	if count := countDeltas(t); count != 4 {
+		t.Fatalf("expected 4 deltas stored, got %d", count)
+	}
+	if compacted, err := CompactDeltas(time.Now()); err != nil || compacted != 1 {
+		t.Fatalf("expected one blob compacted, got %d, %v", compacted, err)
+	}
+	if count := countDeltas(t); count != 0 {
+		t.Fatalf("expected deltas removed, got %d", count)
+	}
+	checkPatched(t, info, expect)
+	digest := sha256.Sum256(expect)
+	compacted, err := StatBlob(info)
+	if err != nil {
+		t.Fatalf("StatBlob returned error: %s", err)
+	} else if !bytes.Equal(compacted.Digest, digest[:]) || compacted.Version != stat.Version {
+		t.Fatalf("unexpected compacted stat %+v", compacted)
+	}
+}
+
+// read the whole of one version of a blob
+func readAllVersion(t *testing.T, info *pb.BlobInfo, version string) string {
+	reader, err := CreateVersionReader(info, version, 0, 0)
+	if err != nil {
+		t.Fatalf("could not open version %q: %s", version, err)
+	}
+	defer reader.Close()
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("could not read version %q: %s", version, err)
+	}
+	return string(content)
+}
+
+// test patches keep the content they replace as an old version,
+// and overwrites drop the deltas of the content they replace
+func TestDeltaVersions(t *testing.T) {
+	configureVersioning(t, MemoryBackend, 0, 0)
+	info := &pb.BlobInfo{Major: "major", Minor: "minor"}
+	writeVersion(t, info, "first")
+	original := readAllVersion(t, info, "")
+	expect := patchBlob(t, info, 5, 3, []byte(original))
+	versions, err := ListVersions(info)
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("expected two versions, got %v, %v", versions, err)
+	} else if content := readAllVersion(t, info, versions[1].Version); content != original {
+		t.Fatalf("expected original content %q, got %q", original, content)
+	}
+	patched := versions[0].Version
+	writeVersion(t, info, "second")
+	if content := readAllVersion(t, info, patched); content != string(expect) {
+		t.Fatalf("expected patched version %q, got %q", expect, content)
+	}
+	// the old version holds the only delta left
+	if count := countDeltas(t); count != 1 {
+		t.Fatalf("expected one delta stored, got %d", count)
+	}
+}
+
+// test copies of encrypted patched blobs read back under their own
+// key, apart from their source
+func TestDeltaCopy(t *testing.T) {
+	configureKeys(t, LocalBackend, testConfig(t), testMasterKey(t))
+	source, testdata := writeChecksummedBlob(t, 2*checksumBlockSize)
+	expect := patchBlob(t, source, checksumBlockSize-2, 4, slices.Clone(testdata))
+	dest := &pb.BlobInfo{Major: "major", Minor: "copy", BlobType: pb.BlobType_Raw}
+	if err := CopyBlob(source, dest, ""); err != nil {
+		t.Fatalf("CopyBlob returned error: %s", err)
+	}
+	if err := DeleteBlob(source); err != nil {
+		t.Fatalf("DeleteBlob returned error: %s", err)
+	}
+	checkPatched(t, dest, expect)
+	if count := countDeltas(t); count != 1 {
+		t.Fatalf("expected the copy's delta alone, got %d", count)
+	}
+	if _, err := CompactDeltas(time.Now()); err != nil {
+		t.Fatalf("could not compact: %s", err)
+	}
+	checkPatched(t, dest, expect)
+}
+
+// test deltas no sidecar lists are swept once old enough
+func TestDeltaOrphans(t *testing.T) {
+	if err := ConfigureBackend(MemoryBackend, testConfig(t)); err != nil {
+		t.Fatalf("could not configure memory backend: %s", err)
+	}
+	info, testdata := writeChecksummedBlob(t, 1000)
+	writer, err := CreatePatchWriter(info, 0)
+	if err != nil {
+		t.Fatalf("CreatePatchWriter returned error: %s", err)
+	}
+	writer.Write([]byte("orphan"))
+	// stored, but never listed by the blob
+	if err = writer.(*patchWriter).checksumWriter.Commit(); err != nil {
+		t.Fatalf("could not store delta: %s", err)
+	}
+	if _, err = CompactDeltas(time.Now()); err != nil || countDeltas(t) != 1 {
+		t.Fatalf("expected a recent orphan kept, got %d, %v", countDeltas(t), err)
+	}
+	if _, err = CompactDeltas(time.Now().Add(2 * deltaGrace)); err != nil || countDeltas(t) != 0 {
+		t.Fatalf("expected an old orphan removed, got %d, %v", countDeltas(t), err)
+	}
+	if content, err := readRange(info, 0, 0); err != nil {
+		t.Fatalf("could not read blob: %s", err)
+	} else if err = checkBytesEqual(content, testdata); err != nil {
+		t.Fatalf("orphan changed content: %s", err)
+	}
+}
+
+// test versions kept by patches share the base content and deltas
+// with the blob on backends able to clone, rather than copying
+func TestDeltaVersionClones(t *testing.T) {
+	configureVersioning(t, LocalBackend, 0, 0)
+	local := blobio.(*localBackend)
+	info := &pb.BlobInfo{Major: "major", Minor: "minor"}
+	key := keyFromInfo(info)
+	writeVersion(t, info, "first content")
+	expect := patchBlob(t, info, 0, 3, []byte(readAllVersion(t, info, "")))
+	expect = patchBlob(t, info, 6, 3, expect)
+	versions, err := ListVersions(info)
+	if err != nil || len(versions) != 3 {
+		t.Fatalf("expected three versions, got %v, %v", versions, err)
+	}
+
+	// the version after the first patch holds its delta too
+	sameFile := func(a, b Key) bool {
+		pathA, _ := local.constructFilePath(a)
+		pathB, _ := local.constructFilePath(b)
+		statA, errA := os.Stat(pathA)
+		statB, errB := os.Stat(pathB)
+		return errA == nil && errB == nil && os.SameFile(statA, statB)
+	}
+	vkey := versionKey(key, versions[1].Version)
+	meta, err := readMetadata(blobio, vkey)
+	if err != nil || len(meta.Deltas) != 1 {
+		t.Fatalf("expected one delta in the version, got %v", err)
+	}
+	id := meta.Deltas[0].ID
+	if !sameFile(key, vkey) || !sameFile(key, versionKey(key, versions[2].Version)) {
+		t.Fatalf("expected versions to share the base content")
+	} else if !sameFile(deltaKey(key, id), deltaKey(vkey, id)) {
+		t.Fatalf("expected the version to share its delta")
+	}
+	if content := readAllVersion(t, info, ""); content != string(expect) {
+		t.Fatalf("expected patched content %q, got %q", expect, content)
+	}
+}
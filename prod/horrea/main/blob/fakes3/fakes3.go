@@ -0,0 +1,351 @@
+/*
+ * In-process fake of the S3 HTTP protocol for tests. Supports
+ * path-style addressing and the subset of object, copy and
+ * multipart upload operations used by the blob package. Buckets exist
+ * implicitly and requests are not authenticated.
+ */
+
+package fakes3
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Server struct {
+	*httptest.Server
+	mu       sync.Mutex           // guards all state below.
+	objects  map[string][]byte    // object content by bucket/key.
+	modTimes map[string]time.Time // object write times by bucket/key.
+	uploads  map[string]*upload   // in-progress multipart uploads.
+	nextID   int                  // next multipart upload ID.
+}
+
+type upload struct {
+	object string         // destination bucket/key.
+	parts  map[int][]byte // uploaded parts by part number.
+}
+
+type initiateResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadId string   `xml:"UploadId"`
+}
+
+type completeRequest struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type completeResult struct {
+	XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+	Bucket  string   `xml:"Bucket"`
+	Key     string   `xml:"Key"`
+}
+
+type copyResult struct {
+	XMLName      xml.Name `xml:"CopyObjectResult"`
+	ETag         string   `xml:"ETag"`
+	LastModified string   `xml:"LastModified"`
+}
+
+type listResult struct {
+	XMLName     xml.Name    `xml:"ListBucketResult"`
+	Name        string      `xml:"Name"`
+	Prefix      string      `xml:"Prefix"`
+	KeyCount    int         `xml:"KeyCount"`
+	MaxKeys     int         `xml:"MaxKeys"`
+	IsTruncated bool        `xml:"IsTruncated"`
+	Contents    []listEntry `xml:"Contents"`
+}
+
+type listEntry struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	Size         int    `xml:"Size"`
+}
+
+type errorResult struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+// start a fake object store. Close the server when done.
+func NewServer() *Server {
+	fake := &Server{
+		objects:  make(map[string][]byte),
+		modTimes: make(map[string]time.Time),
+		uploads:  make(map[string]*upload),
+	}
+	fake.Server = httptest.NewServer(http.HandlerFunc(fake.serve))
+	return fake
+}
+
+// return the stored content of an object, if present.
+func (fake *Server) Object(bucket, key string) ([]byte, bool) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	content, ok := fake.objects[bucket+"/"+key]
+	return content, ok
+}
+
+// return the keys of all objects in a bucket, in sorted order.
+func (fake *Server) Keys(bucket string) []string {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return fake.keys(bucket)
+}
+
+func (fake *Server) keys(bucket string) []string {
+	keys := []string{}
+	for name := range fake.objects {
+		if key, ok := strings.CutPrefix(name, bucket+"/"); ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// return the number of multipart uploads not yet completed.
+func (fake *Server) PendingUploads() int {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return len(fake.uploads)
+}
+
+// dispatch a request by method, path and query.
+func (fake *Server) serve(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	switch {
+	case key == "" && r.Method == http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	case key == "" && r.Method == http.MethodGet && query.Get("list-type") == "2":
+		fake.listObjects(w, bucket, query)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		fake.createUpload(w, bucket, key)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		fake.completeUpload(w, r, bucket, key, query.Get("uploadId"))
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		fake.putPart(w, r, query.Get("uploadId"), query.Get("partNumber"))
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(fake.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		fake.copyObject(w, r, bucket+"/"+key)
+	case r.Method == http.MethodPut:
+		fake.putObject(w, r, bucket+"/"+key)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		fake.getObject(w, r, bucket+"/"+key)
+	case r.Method == http.MethodDelete:
+		delete(fake.objects, bucket+"/"+key)
+		delete(fake.modTimes, bucket+"/"+key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented",
+			r.Method+" "+r.URL.String())
+	}
+}
+
+func (fake *Server) putObject(w http.ResponseWriter, r *http.Request, name string) {
+	content, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	fake.objects[name] = content
+	fake.modTimes[name] = time.Now()
+	w.Header().Set("ETag", etag(name))
+	w.WriteHeader(http.StatusOK)
+}
+
+// copy the object named by the copy source header.
+func (fake *Server) copyObject(w http.ResponseWriter, r *http.Request, name string) {
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", err.Error())
+		return
+	}
+	content, ok := fake.objects[strings.TrimPrefix(source, "/")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchKey", source)
+		return
+	}
+	fake.objects[name] = content
+	fake.modTimes[name] = time.Now()
+	writeXML(w, copyResult{
+		ETag:         etag(name),
+		LastModified: fake.modTimes[name].UTC().Format(time.RFC3339),
+	})
+}
+
+func (fake *Server) getObject(w http.ResponseWriter, r *http.Request, name string) {
+	content, ok := fake.objects[name]
+	if !ok && r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchKey", name)
+		return
+	}
+	status := http.StatusOK
+	if header := r.Header.Get("Range"); header != "" && r.Method == http.MethodGet {
+		start, end, ok := parseRange(header, len(content))
+		if !ok {
+			writeError(w, http.StatusRequestedRangeNotSatisfiable,
+				"InvalidRange", header)
+			return
+		}
+		w.Header().Set("Content-Range",
+			fmt.Sprintf("bytes %d-%d/%d", start, end-1, len(content)))
+		content, status = content[start:end], http.StatusPartialContent
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	w.Header().Set("Last-Modified", fake.modTimes[name].UTC().Format(http.TimeFormat))
+	w.WriteHeader(status)
+	if r.Method == http.MethodGet {
+		w.Write(content)
+	}
+}
+
+// parse a "bytes=start-[end]" header into a half-open range.
+// Like S3, ranges must start before the end of the object.
+func parseRange(header string, size int) (int, int, bool) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return 0, 0, false
+	}
+	first, last, _ := strings.Cut(spec, "-")
+	start, err := strconv.Atoi(first)
+	if err != nil || start >= size {
+		return 0, 0, false
+	}
+	end := size
+	if last != "" {
+		if end, err = strconv.Atoi(last); err != nil || end < start {
+			return 0, 0, false
+		}
+		end = min(end+1, size)
+	}
+	return start, end, true
+}
+
+// list objects in key order, honoring prefix, start-after and
+// max-keys. Continuation tokens are not supported.
+func (fake *Server) listObjects(w http.ResponseWriter, bucket string, query url.Values) {
+	prefix, startAfter := query.Get("prefix"), query.Get("start-after")
+	maxKeys := 1000
+	if value := query.Get("max-keys"); value != "" {
+		maxKeys, _ = strconv.Atoi(value)
+	}
+	result := &listResult{Name: bucket, Prefix: prefix, MaxKeys: maxKeys}
+	for _, key := range fake.keys(bucket) {
+		if !strings.HasPrefix(key, prefix) || key <= startAfter {
+			continue
+		} else if result.KeyCount == maxKeys {
+			result.IsTruncated = true
+			break
+		}
+		name := bucket + "/" + key
+		result.Contents = append(result.Contents, listEntry{
+			Key:          key,
+			LastModified: fake.modTimes[name].UTC().Format(time.RFC3339),
+			Size:         len(fake.objects[name]),
+		})
+		result.KeyCount++
+	}
+	writeXML(w, result)
+}
+
+func (fake *Server) createUpload(w http.ResponseWriter, bucket, key string) {
+	fake.nextID++
+	id := strconv.Itoa(fake.nextID)
+	fake.uploads[id] = &upload{
+		object: bucket + "/" + key,
+		parts:  make(map[int][]byte),
+	}
+	writeXML(w, &initiateResult{Bucket: bucket, Key: key, UploadId: id})
+}
+
+func (fake *Server) putPart(w http.ResponseWriter, r *http.Request, id, number string) {
+	pending, ok := fake.uploads[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", id)
+		return
+	}
+	partNumber, err := strconv.Atoi(number)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", number)
+		return
+	}
+	content, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	pending.parts[partNumber] = content
+	w.Header().Set("ETag", etag(fmt.Sprintf("%s-%d", id, partNumber)))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (fake *Server) completeUpload(w http.ResponseWriter, r *http.Request, bucket, key, id string) {
+	pending, ok := fake.uploads[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", id)
+		return
+	}
+	request := completeRequest{}
+	if err := xml.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+	// concatenate the listed parts, which must be in order
+	content := []byte{}
+	for i, part := range request.Parts {
+		data, ok := pending.parts[part.PartNumber]
+		if !ok || (i > 0 && part.PartNumber <= request.Parts[i-1].PartNumber) {
+			writeError(w, http.StatusBadRequest, "InvalidPart",
+				strconv.Itoa(part.PartNumber))
+			return
+		}
+		content = append(content, data...)
+	}
+	fake.objects[pending.object] = content
+	fake.modTimes[pending.object] = time.Now()
+	delete(fake.uploads, id)
+	writeXML(w, &completeResult{Bucket: bucket, Key: key})
+}
+
+// quoted entity tag for the given name.
+func etag(name string) string {
+	return strconv.Quote(name)
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	xml.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(&errorResult{Code: code, Message: message})
+}
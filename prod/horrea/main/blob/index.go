@@ -0,0 +1,136 @@
+/*
+ * Sorted in-memory index of flat names.
+ */
+
+/*
+ * Names are kept sorted in blocks of bounded size, found by binary
+ * search over the blocks' last names. Adding or removing a name
+ * moves at most one block's worth of entries plus the block list,
+ * and listing a page seeks straight to its start, so neither grows
+ * with the whole index the way re-sorting every name would.
+ */
+
+package blob
+
+import (
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// most names held by one block of an index.
+const indexBlockSize = 512
+
+type nameIndex struct {
+	mu     sync.RWMutex
+	blocks [][]string // non-empty sorted blocks, in order.
+	count  int        // names held.
+}
+
+// create an index holding the given names, which may be unsorted.
+func newNameIndex(names []string) *nameIndex {
+	sorted := slices.Clone(names)
+	sort.Strings(sorted)
+	sorted = slices.Compact(sorted)
+	index := &nameIndex{count: len(sorted)}
+	for len(sorted) > 0 {
+		n := min(len(sorted), indexBlockSize/2)
+		index.blocks = append(index.blocks, slices.Clip(sorted[:n]))
+		sorted = sorted[n:]
+	}
+	return index
+}
+
+// return the block a name belongs in: the first whose last name
+// isn't before it, or the last block. The lock must be held.
+func (index *nameIndex) block(name string) int {
+	i := sort.Search(len(index.blocks), func(i int) bool {
+		block := index.blocks[i]
+		return block[len(block)-1] >= name
+	})
+	return min(i, len(index.blocks)-1)
+}
+
+// add a name, if it isn't already held.
+func (index *nameIndex) add(name string) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	if len(index.blocks) == 0 {
+		index.blocks = [][]string{{name}}
+		index.count = 1
+		return
+	}
+	b := index.block(name)
+	block := index.blocks[b]
+	i, found := slices.BinarySearch(block, name)
+	if found {
+		return
+	}
+	block = slices.Insert(block, i, name)
+	index.count++
+	if len(block) <= indexBlockSize {
+		index.blocks[b] = block
+		return
+	}
+	half := len(block) / 2
+	upper := slices.Clone(block[half:])
+	index.blocks[b] = slices.Clip(block[:half])
+	index.blocks = slices.Insert(index.blocks, b+1, upper)
+}
+
+// remove a name, if held.
+func (index *nameIndex) remove(name string) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	if len(index.blocks) == 0 {
+		return
+	}
+	b := index.block(name)
+	block := index.blocks[b]
+	i, found := slices.BinarySearch(block, name)
+	if !found {
+		return
+	}
+	index.count--
+	if len(block) == 1 {
+		index.blocks = slices.Delete(index.blocks, b, b+1)
+		return
+	}
+	index.blocks[b] = slices.Delete(block, i, i+1)
+}
+
+// return up to limit names after start, or from the beginning if
+// start is empty, that have the given prefix.
+func (index *nameIndex) after(start, prefix string, limit int) []string {
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+	names := []string{}
+	if len(index.blocks) == 0 || limit <= 0 {
+		return names
+	}
+	seek := max(start, prefix)
+	b := index.block(seek)
+	i, _ := slices.BinarySearch(index.blocks[b], seek)
+	for ; b < len(index.blocks); b, i = b+1, 0 {
+		for _, name := range index.blocks[b][i:] {
+			if name <= start {
+				continue
+			} else if !strings.HasPrefix(name, prefix) {
+				return names // past every name with the prefix
+			}
+			names = append(names, name)
+			if len(names) == limit {
+				return names
+			}
+		}
+	}
+	return names
+}
+
+// return the number of names held.
+func (index *nameIndex) len() int {
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+	return index.count
+}
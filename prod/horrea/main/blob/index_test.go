@@ -0,0 +1,66 @@
+/*
+ * Tests for the sorted name index.
+ */
+
+package blob
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// test an index holds names sorted across block splits and
+// removals, and pages through them by start and prefix
+func TestNameIndex(t *testing.T) {
+	names := []string{}
+	for i := 0; i < 3*indexBlockSize; i++ {
+		names = append(names, fmt.Sprintf("m%d.%05d.Raw", i%3, i))
+	}
+	shuffled := slices.Clone(names)
+	rand.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	index := newNameIndex(shuffled[:len(shuffled)/2])
+	for _, name := range shuffled[len(shuffled)/2:] {
+		index.add(name)
+	}
+	index.add(names[0]) // duplicates are ignored
+	slices.Sort(names)
+	if index.len() != len(names) {
+		t.Fatalf("expected %d names, got %d", len(names), index.len())
+	}
+	if got := index.after("", "", len(names)+1); !slices.Equal(got, names) {
+		t.Fatalf("index lost sort order")
+	}
+
+	// page through one prefix a few names at a time
+	want := []string{}
+	for _, name := range names {
+		if strings.HasPrefix(name, "m1.") {
+			want = append(want, name)
+		}
+	}
+	got, start := []string{}, ""
+	for {
+		page := index.after(start, "m1.", 7)
+		got = append(got, page...)
+		if len(page) < 7 {
+			break
+		}
+		start = page[len(page)-1]
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("paging by prefix returned %d of %d names", len(got), len(want))
+	}
+
+	for _, name := range shuffled {
+		index.remove(name)
+	}
+	index.remove("m0.missing.Raw")
+	if index.len() != 0 || len(index.after("", "", 10)) != 0 {
+		t.Fatalf("expected an empty index, got %d names", index.len())
+	}
+}
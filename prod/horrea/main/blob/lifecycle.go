@@ -0,0 +1,207 @@
+/*
+ * Lifecycle rules: expiry and retention holds.
+ */
+
+/*
+ * Rules apply to blobs by major key and minor key prefix. A rule may
+ * expire blobs a number of days after they were written, and may
+ * hold them write-once-read-many, for a number of days after they
+ * were written or until a fixed date. Where several rules match a
+ * blob, the shortest expiry and the longest hold apply.
+ *
+ * A held blob can be read and copied, but not overwritten, deleted
+ * or copied over, and expiry waits for its hold to end. Holds are
+ * checked again under the sidecar lock as a write or delete
+ * commits, so two first writes of a key can't both succeed. Keys
+ * with no content aren't held, so writing a key the first time is
+ * always allowed.
+ *
+ * A blob's age is taken from its version ID, the time its content
+ * was committed, and the expiry sweep reads it quietly so cold
+ * blobs stay cold. Rules come from configuration, so they guard
+ * blobs against clients rather than against whoever runs the
+ * server. Internal keys never match a rule.
+ */
+
+package blob
+
+import (
+	pb "github.com/pleb/prod/horrea/pb"
+
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+var ErrHeld = errors.New("blob is under a retention hold")
+
+// Lifecycle policy for blobs under a key prefix.
+type LifecycleRule struct {
+	Major       string    `json:"major"`                 // major key, empty for any.
+	Prefix      string    `json:"prefix"`                // minor key prefix, empty for any.
+	ExpireDays  int       `json:"expireDays,omitempty"`  // days kept after writing, 0 for ever.
+	RetainDays  int       `json:"retainDays,omitempty"`  // days held after writing.
+	RetainUntil time.Time `json:"retainUntil,omitempty"` // date held until.
+}
+
+// rules in force.
+var lifecycle []LifecycleRule
+
+// return a span of whole days.
+func days(n int) time.Duration {
+	return time.Duration(n) * 24 * time.Hour
+}
+
+// read lifecycle rules from a file holding a JSON array of them.
+func LoadLifecycleFile(path string) ([]LifecycleRule, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rules := []LifecycleRule{}
+	if err = json.Unmarshal(content, &rules); err != nil {
+		return nil, fmt.Errorf("lifecycle file %s: %w", path, err)
+	}
+	for i, rule := range rules {
+		if rule.ExpireDays < 0 || rule.RetainDays < 0 {
+			return nil, fmt.Errorf("lifecycle file %s: rule %d has negative days", path, i)
+		}
+	}
+	return rules, nil
+}
+
+// report whether a rule covers a key.
+func (rule *LifecycleRule) matches(key Key) bool {
+	if _, known := pb.BlobType_value[key.BlobType]; !known {
+		return false // sidecars, versions and internal keys
+	}
+	return (rule.Major == "" || rule.Major == key.Major) && strings.HasPrefix(key.Minor, rule.Prefix)
+}
+
+// report whether any rule holds blobs at a key.
+func holdsKey(key Key) bool {
+	for i := range lifecycle {
+		rule := &lifecycle[i]
+		if rule.matches(key) && (rule.RetainDays > 0 || !rule.RetainUntil.IsZero()) {
+			return true
+		}
+	}
+	return false
+}
+
+// return the time a blob written at the given time is held until,
+// zero if it isn't held.
+func heldUntil(key Key, written time.Time) time.Time {
+	var until time.Time
+	for i := range lifecycle {
+		rule := &lifecycle[i]
+		if !rule.matches(key) {
+			continue
+		}
+		if rule.RetainUntil.After(until) {
+			until = rule.RetainUntil
+		}
+		if rule.RetainDays > 0 {
+			if end := written.Add(days(rule.RetainDays)); end.After(until) {
+				until = end
+			}
+		}
+	}
+	return until
+}
+
+// return the time a blob written at the given time expires, zero
+// if it never does.
+func expiresAt(key Key, written time.Time) time.Time {
+	var expiry time.Time
+	for i := range lifecycle {
+		rule := &lifecycle[i]
+		if !rule.matches(key) || rule.ExpireDays == 0 {
+			continue
+		}
+		end := written.Add(days(rule.ExpireDays))
+		if expiry.IsZero() || end.Before(expiry) {
+			expiry = end
+		}
+	}
+	return expiry
+}
+
+// report whether any rule expires blobs at a key.
+func expiresKey(key Key) bool {
+	for i := range lifecycle {
+		if lifecycle[i].ExpireDays > 0 && lifecycle[i].matches(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// fail with ErrHeld if the content at a key is held at the given
+// time.
+func checkHold(key Key, now time.Time) error {
+	if !holdsKey(key) {
+		return nil
+	}
+	stat, err := statKey(key)
+	if errors.Is(err, ErrNoExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if until := heldUntil(key, versionTime(stat.Version)); now.Before(until) {
+		return fmt.Errorf("%w until %s", ErrHeld, until.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// delete every blob past its expiry and not held, returning how
+// many were deleted.
+func ApplyLifecycle(now time.Time) (int, error) {
+	if blobio == nil {
+		return 0, ErrNotSupp
+	}
+	expired := map[Key]string{}
+	after := Key{}
+	for {
+		keys, err := blobio.List("", after, DefaultPageSize)
+		if err != nil {
+			return 0, err
+		}
+		for _, key := range keys {
+			if !expiresKey(key) {
+				continue
+			}
+			stat, err := statStored(quiet(blobio), key)
+			if err != nil {
+				continue // removed since listing, or unreadable
+			}
+			written := versionTime(stat.Version)
+			if !now.Before(expiresAt(key, written)) && !now.Before(heldUntil(key, written)) {
+				expired[key] = stat.Version
+			}
+		}
+		if len(keys) < DefaultPageSize {
+			break
+		}
+		after = keys[len(keys)-1]
+	}
+	deleted := 0
+	for key, version := range expired {
+		// content rewritten since it was listed is left alone
+		err := deleteBlob(key, version, now)
+		if err != nil && !errors.Is(err, ErrNoExist) {
+			log.Printf("Could not expire %s: %v", key, err)
+		} else if err == nil {
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		log.Printf("Expired %d blobs", deleted)
+	}
+	return deleted, nil
+}
@@ -0,0 +1,166 @@
+/*
+ * Tests for lifecycle rules.
+ */
+
+package blob
+
+import (
+	pb "github.com/pleb/prod/horrea/pb"
+
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// configure the memory backend under the given rules
+func configureLifecycle(t *testing.T, rules ...LifecycleRule) {
+	cfg := testConfig(t)
+	cfg.Versioning = true
+	cfg.Lifecycle = rules
+	if err := ConfigureBackend(MemoryBackend, cfg); err != nil {
+		t.Fatalf("could not configure memory backend: %s", err)
+	}
+}
+
+// write a small blob
+func writeLifecycleBlob(major, minor, content string) error {
+	writeblob := CreateBlob(&pb.BlobInfo{Size: int64(len(content)), Major: major, Minor: minor})
+	writeblob.AppendChunk([]byte(content))
+	return writeblob.WriteContent()
+}
+
+// test held blobs can be written once and read, but not replaced
+// or removed
+func TestLifecycleHold(t *testing.T) {
+	configureLifecycle(t,
+		LifecycleRule{Major: "logs", Prefix: "audit-", RetainDays: 1},
+		LifecycleRule{Major: "logs", Prefix: "old-", RetainUntil: time.Now().Add(-time.Hour)},
+	)
+	held := &pb.BlobInfo{Major: "logs", Minor: "audit-1"}
+	if err := writeLifecycleBlob("logs", "audit-1", "first"); err != nil {
+		t.Fatalf("could not write held blob the first time: %s", err)
+	}
+	if err := writeLifecycleBlob("logs", "audit-1", "second"); !errors.Is(err, ErrHeld) {
+		t.Fatalf("expected ErrHeld overwriting, got %v", err)
+	}
+	if err := DeleteBlob(held); !errors.Is(err, ErrHeld) {
+		t.Fatalf("expected ErrHeld deleting, got %v", err)
+	}
+	if _, err := CreatePatchWriter(held, 0); !errors.Is(err, ErrHeld) {
+		t.Fatalf("expected ErrHeld patching, got %v", err)
+	}
+	other := &pb.BlobInfo{Major: "logs", Minor: "other"}
+	if err := writeLifecycleBlob("logs", "other", "other"); err != nil {
+		t.Fatalf("could not write unheld blob: %s", err)
+	}
+	if err := CopyBlob(other, held, ""); !errors.Is(err, ErrHeld) {
+		t.Fatalf("expected ErrHeld copying over, got %v", err)
+	}
+	if err := CopyBlob(held, other, ""); err != nil {
+		t.Fatalf("could not copy held blob: %s", err)
+	}
+	if content, err := readRange(held, 0, 0); err != nil || string(content) != "first" {
+		t.Fatalf("expected held content intact, got %q, %v", content, err)
+	}
+	stat, err := StatBlob(held)
+	if err != nil {
+		t.Fatalf("StatBlob returned error: %s", err)
+	} else if hold := time.Until(stat.HeldUntil); hold < 23*time.Hour || hold > 24*time.Hour {
+		t.Fatalf("expected a one day hold, got %s", stat.HeldUntil)
+	}
+
+	// holds that have ended don't apply
+	if err = writeLifecycleBlob("logs", "old-1", "first"); err != nil {
+		t.Fatalf("could not write blob: %s", err)
+	}
+	if err = writeLifecycleBlob("logs", "old-1", "second"); err != nil {
+		t.Fatalf("could not overwrite blob past its hold: %s", err)
+	}
+	if err = DeleteBlob(&pb.BlobInfo{Major: "logs", Minor: "old-1"}); err != nil {
+		t.Fatalf("could not delete blob past its hold: %s", err)
+	}
+}
+
+// test expiry deletes blobs once old enough, waiting for holds
+func TestLifecycleExpiry(t *testing.T) {
+	configureLifecycle(t,
+		LifecycleRule{Major: "tmp", ExpireDays: 1},
+		LifecycleRule{Major: "tmp", Prefix: "keep", RetainDays: 3},
+	)
+	for _, minor := range []string{"a", "b", "keep"} {
+		if err := writeLifecycleBlob("tmp", minor, minor); err != nil {
+			t.Fatalf("could not write blob: %s", err)
+		}
+	}
+	if err := writeLifecycleBlob("other", "a", "a"); err != nil {
+		t.Fatalf("could not write blob: %s", err)
+	}
+	now := time.Now()
+	if deleted, err := ApplyLifecycle(now); err != nil || deleted != 0 {
+		t.Fatalf("expected nothing expired yet, got %d, %v", deleted, err)
+	}
+	if deleted, err := ApplyLifecycle(now.Add(2 * 24 * time.Hour)); err != nil || deleted != 2 {
+		t.Fatalf("expected 2 blobs expired, got %d, %v", deleted, err)
+	}
+	if _, err := StatBlob(&pb.BlobInfo{Major: "tmp", Minor: "keep"}); err != nil {
+		t.Fatalf("held blob expired: %v", err)
+	}
+	if _, err := StatBlob(&pb.BlobInfo{Major: "tmp", Minor: "a"}); !errors.Is(err, ErrNoExist) {
+		t.Fatalf("expected expired blob gone, got %v", err)
+	}
+	if deleted, err := ApplyLifecycle(now.Add(4 * 24 * time.Hour)); err != nil || deleted != 1 {
+		t.Fatalf("expected the held blob expired after its hold, got %d, %v", deleted, err)
+	}
+	if _, err := StatBlob(&pb.BlobInfo{Major: "other", Minor: "a"}); err != nil {
+		t.Fatalf("blob without rules expired: %v", err)
+	}
+}
+
+// test rules load from a file, and bad ones are refused
+func TestLifecycleFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lifecycle.json")
+	content := `[{"major": "logs", "prefix": "audit-", "retainUntil": "2030-01-01T00:00:00Z"},
+		{"major": "tmp", "expireDays": 7}]`
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("could not write rules: %s", err)
+	}
+	rules, err := LoadLifecycleFile(path)
+	if err != nil {
+		t.Fatalf("could not load rules: %s", err)
+	} else if len(rules) != 2 || rules[0].RetainUntil.Year() != 2030 || rules[1].ExpireDays != 7 {
+		t.Fatalf("unexpected rules %+v", rules)
+	}
+	for _, bad := range []string{`{"major": "tmp"}`, `[{"expireDays": -1}]`} {
+		if err = os.WriteFile(path, []byte(bad), 0600); err != nil {
+			t.Fatalf("could not write rules: %s", err)
+		}
+		if _, err = LoadLifecycleFile(path); err == nil {
+			t.Fatalf("expected an error loading %s", bad)
+		}
+	}
+}
+
+// test expiry sweeps leave cold blobs cold
+func TestLifecycleLeavesTiers(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.ColdAfter = time.Hour
+	cfg.Lifecycle = []LifecycleRule{{Major: "tmp", ExpireDays: 1}}
+	if err := ConfigureBackend(TieredBackend, cfg); err != nil {
+		t.Fatalf("could not configure tiered backend: %s", err)
+	}
+	if err := writeLifecycleBlob("tmp", "a", "a"); err != nil {
+		t.Fatalf("could not write blob: %s", err)
+	}
+	if _, err := DemoteCold(time.Now().Add(2 * time.Hour)); err != nil {
+		t.Fatalf("could not demote: %s", err)
+	}
+	if deleted, err := ApplyLifecycle(time.Now()); err != nil || deleted != 0 {
+		t.Fatalf("expected nothing expired yet, got %d, %v", deleted, err)
+	}
+	waitPromotions(blobTiers)
+	key := Key{Major: "tmp", Minor: "a", BlobType: "Raw"}
+	checkTier(t, blobTiers, key, false)
+	checkTier(t, blobTiers, metadataKey(key), false)
+}
@@ -0,0 +1,547 @@
+/*
+ * Local directory storage backend.
+ */
+
+/*
+ * Writes are crash-safe: content goes to a temp file, which is
+ * fsynced and then renamed over the final path, and the directory
+ * is fsynced so the rename itself is durable. Readers only ever
+ * see complete old or complete new content. Temp files left by a
+ * crash are removed when the backend is next constructed.
+ *
+ * Clones are hard links. Files are only ever replaced by rename or
+ * removed, never changed in place, so linked keys share a file
+ * until one of them is rewritten or deleted.
+ *
+ * Blob files are fanned out over two levels of directories named
+ * by a hash prefix of their flat name, so no directory grows too
+ * large. Stores created before this keep their flat layout until
+ * converted with MigrateLocal, and a layout file records which one
+ * a directory uses.
+ *
+ * Since hash prefixes scatter names, listing in name order is served
+ * from an in-memory sorted index of every file name, built by one
+ * walk of the store on startup and kept up to date by each commit,
+ * clone and delete. The backend assumes it is the store's only user.
+ *
+ * Stores written before key parts were escaped in file names hold
+ * blobs whose keys contain "." or "%" under their raw names. Those
+ * are found by the raw name when the escaped one doesn't exist, and
+ * the raw file is removed once the blob is rewritten or deleted.
+ * They aren't listed under their own keys until rewritten, since
+ * raw names can't be split back into keys reliably.
+ */
+
+package blob
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// subdirectory holding in-progress writes.
+const localTempDir = ".tmp"
+
+// file recording the layout of a local store.
+const localLayoutFile = ".layout"
+
+// contents of the layout file.
+const (
+	layoutSharded   = "sharded"
+	layoutMigrating = "migrating"
+)
+
+var ErrMigrating = errors.New("local store migration incomplete, rerun it")
+
+type localBackend struct {
+	directory string     // which directory to use for storage
+	sharded   bool       // fan files out over hash prefix directories?
+	index     *nameIndex // names of all blob files, sorted.
+}
+
+type localWriter struct {
+	local  *localBackend // owning backend.
+	file   *os.File      // temp file receiving content.
+	path   string        // final path of the blob.
+	legacy string        // unescaped path of the blob, removed on commit.
+}
+
+// test hook, called at each step of a commit to simulate crashes.
+var crashPoint = func(step string) {}
+
+func init() {
+	RegisterBackend(LocalBackend, newLocalBackend)
+}
+
+// create a backend storing blobs as files in a local directory.
+func newLocalBackend(cfg *Config) (Backend, error) {
+	// if local directory does not exist, create it
+	log.Printf("Creating local file directory %s", cfg.LocalDirectory)
+	err := os.MkdirAll(cfg.LocalDirectory, 0755)
+	if err != nil {
+		return nil, err
+	}
+	local := &localBackend{directory: cfg.LocalDirectory}
+	if err = local.recover(); err != nil {
+		return nil, err
+	}
+	if local.sharded, err = detectLayout(cfg.LocalDirectory); err != nil {
+		return nil, err
+	}
+	names, err := local.names()
+	if err != nil {
+		return nil, err
+	}
+	local.index = newNameIndex(names)
+	return local, nil
+}
+
+// work out whether a store is sharded. Empty stores are made
+// sharded, and stores holding flat blob files stay flat.
+func detectLayout(directory string) (bool, error) {
+	layout, err := os.ReadFile(filepath.Join(directory, localLayoutFile))
+	if err == nil {
+		switch strings.TrimSpace(string(layout)) {
+		case layoutSharded:
+			return true, nil
+		case layoutMigrating:
+			return false, ErrMigrating
+		}
+		return false, fmt.Errorf("unknown local layout %q", layout)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+	names, err := flatNames(directory)
+	if err != nil {
+		return false, err
+	} else if len(names) > 0 {
+		log.Printf("Local store %s has a flat layout, consider migrating it", directory)
+		return false, nil
+	}
+	return true, writeLayout(directory, layoutSharded)
+}
+
+// durably record the layout of a store.
+func writeLayout(directory, layout string) error {
+	temp := filepath.Join(directory, localTempDir, localLayoutFile)
+	if err := os.WriteFile(temp, []byte(layout+"\n"), 0644); err != nil {
+		return err
+	}
+	if err := syncFile(temp); err != nil {
+		return err
+	}
+	if err := os.Rename(temp, filepath.Join(directory, localLayoutFile)); err != nil {
+		return err
+	}
+	return syncDirectory(directory)
+}
+
+// convert a flat local store to the sharded layout in place,
+// returning the number of files moved. The server must not be
+// running. An interrupted migration is finished by running it
+// again, and the server refuses to start until it is.
+func MigrateLocal(directory string) (int, error) {
+	local := &localBackend{directory: directory}
+	if err := local.recover(); err != nil {
+		return 0, err
+	}
+	sharded, err := detectLayout(directory)
+	if err != nil && !errors.Is(err, ErrMigrating) {
+		return 0, err
+	} else if sharded {
+		return 0, nil // already done, or empty
+	}
+	if err = writeLayout(directory, layoutMigrating); err != nil {
+		return 0, err
+	}
+	names, err := flatNames(directory)
+	if err != nil {
+		return 0, err
+	}
+	local.sharded = true
+	for _, name := range names {
+		target := local.shardPath(name)
+		if err = makeShardDir(filepath.Dir(target)); err != nil {
+			return 0, err
+		}
+		if err = os.Rename(filepath.Join(directory, name), target); err != nil {
+			return 0, err
+		}
+		if err = syncDirectory(filepath.Dir(target)); err != nil {
+			return 0, err
+		}
+	}
+	if err = syncDirectory(directory); err != nil {
+		return 0, err
+	}
+	return len(names), writeLayout(directory, layoutSharded)
+}
+
+// return the flat names of blob files at the top of a store,
+// including unescaped names that don't decode.
+func flatNames(directory string) ([]string, error) {
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), ".") && entry.Type().IsRegular() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// return the names of all blob files in a store, by walking it.
+func (local *localBackend) names() ([]string, error) {
+	if !local.sharded {
+		return flatNames(local.directory)
+	}
+	names := []string{}
+	outer, err := filepath.Glob(filepath.Join(local.directory, "[0-9a-f][0-9a-f]", "[0-9a-f][0-9a-f]"))
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range outer {
+		inner, err := flatNames(dir)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, inner...)
+	}
+	return names, nil
+}
+
+// remove temp files left behind by interrupted writes. Nothing
+// else is touched, since completed writes were renamed into place.
+func (local *localBackend) recover() error {
+	tempdir := filepath.Join(local.directory, localTempDir)
+	if err := os.MkdirAll(tempdir, 0755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(tempdir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		log.Printf("Removing interrupted write %s", entry.Name())
+		if err = os.RemoveAll(filepath.Join(tempdir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// construct filepath from identifiers + blob. Keys that could
+// escape the directory are rejected rather than escaped.
+func (local *localBackend) constructFilePath(key Key) (string, error) {
+	if !validKey(key) {
+		return "", ErrKey
+	}
+	return local.shardPath(encodeKey(key)), nil
+}
+
+// return the path the blob had before key parts were escaped,
+// if that differs from its path now.
+func (local *localBackend) legacyPath(key Key) (string, bool) {
+	name := key.String()
+	if name == encodeKey(key) {
+		return "", false
+	}
+	return local.shardPath(name), true
+}
+
+// return the path of the file holding the blob, which is its
+// legacy path if only that exists.
+func (local *localBackend) existingPath(key Key) (string, error) {
+	path, err := local.constructFilePath(key)
+	if err != nil {
+		return "", err
+	}
+	if _, err = os.Lstat(path); errors.Is(err, fs.ErrNotExist) {
+		if legacy, ok := local.legacyPath(key); ok {
+			if _, err = os.Lstat(legacy); err == nil {
+				return legacy, nil
+			}
+		}
+	}
+	return path, nil
+}
+
+// remove the legacy file of a blob that has been replaced, if any.
+func (local *localBackend) removeLegacy(key Key) error {
+	legacy, ok := local.legacyPath(key)
+	if !ok {
+		return nil
+	}
+	local.index.remove(key.String())
+	if err := os.Remove(legacy); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	log.Printf("Removed unescaped local file %s", legacy)
+	return syncDirectory(filepath.Dir(legacy))
+}
+
+// return the path of the file with the given flat name.
+func (local *localBackend) shardPath(name string) string {
+	if !local.sharded {
+		return filepath.Join(local.directory, name)
+	}
+	sum := sha256.Sum256([]byte(name))
+	prefix := hex.EncodeToString(sum[:2])
+	return filepath.Join(local.directory, prefix[:2], prefix[2:], name)
+}
+
+// create a shard directory, making new directory entries durable.
+func makeShardDir(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return err
+	}
+	if err := syncDirectory(filepath.Dir(path)); err != nil {
+		return err
+	}
+	return syncDirectory(filepath.Dir(filepath.Dir(path)))
+}
+
+// open the local file holding the blob, seeking to the offset.
+func (local *localBackend) Reader(key Key, offset, length int64) (io.ReadCloser, error) {
+	readpath, err := local.existingPath(key)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Reading local file content from %s", readpath)
+	file, err := os.Open(readpath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNoExist
+	} else if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	} else if offset > info.Size() {
+		file.Close()
+		return nil, ErrRange
+	}
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return limitReader(file, length), nil
+}
+
+// create a temp file that will be renamed into place on commit.
+func (local *localBackend) Writer(key Key) (Writer, error) {
+	writepath, err := local.constructFilePath(key)
+	if err != nil {
+		return nil, err
+	}
+	if err = makeShardDir(filepath.Dir(writepath)); err != nil {
+		return nil, err
+	}
+	log.Printf("Writing local file content to %s", writepath)
+	tempdir := filepath.Join(local.directory, localTempDir)
+	file, err := os.CreateTemp(tempdir, encodeKey(key)+".*")
+	if err != nil {
+		return nil, err
+	}
+	legacy, _ := local.legacyPath(key)
+	return &localWriter{local: local, file: file, path: writepath, legacy: legacy}, nil
+}
+
+func (writer *localWriter) Write(data []byte) (int, error) {
+	return writer.file.Write(data)
+}
+
+// flush the temp file to disk, then atomically replace the blob.
+func (writer *localWriter) Commit() error {
+	crashPoint("written")
+	if err := writer.file.Sync(); err != nil {
+		writer.Abort()
+		return err
+	}
+	crashPoint("synced")
+	if err := writer.file.Close(); err != nil {
+		os.Remove(writer.file.Name())
+		return err
+	}
+	if err := os.Chmod(writer.file.Name(), 0644); err != nil {
+		os.Remove(writer.file.Name())
+		return err
+	}
+	if err := os.Rename(writer.file.Name(), writer.path); err != nil {
+		os.Remove(writer.file.Name())
+		return err
+	}
+	crashPoint("renamed")
+	writer.local.index.add(filepath.Base(writer.path))
+	if err := syncDirectory(filepath.Dir(writer.path)); err != nil {
+		return err
+	}
+	if writer.legacy == "" {
+		return nil
+	}
+	writer.local.index.remove(filepath.Base(writer.legacy))
+	if err := os.Remove(writer.legacy); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return syncDirectory(filepath.Dir(writer.legacy))
+}
+
+// close and remove the temp file, leaving any old blob in place.
+func (writer *localWriter) Abort() error {
+	writer.file.Close()
+	return os.Remove(writer.file.Name())
+}
+
+// remove the local file holding the blob, and any legacy file
+// behind it.
+func (local *localBackend) Delete(key Key) error {
+	deletepath, err := local.constructFilePath(key)
+	if err != nil {
+		return err
+	}
+	log.Printf("Deleting local file %s", deletepath)
+	err = os.Remove(deletepath)
+	local.index.remove(encodeKey(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		legacy, ok := local.legacyPath(key)
+		if !ok {
+			return ErrNoExist
+		}
+		local.index.remove(key.String())
+		if err = os.Remove(legacy); errors.Is(err, fs.ErrNotExist) {
+			return ErrNoExist
+		} else if err != nil {
+			return err
+		}
+		return syncDirectory(filepath.Dir(legacy))
+	} else if err != nil {
+		return err
+	}
+	if err = syncDirectory(filepath.Dir(deletepath)); err != nil {
+		return err
+	}
+	return local.removeLegacy(key)
+}
+
+// link the file holding one blob in place of another's, by way
+// of a temp name so the destination is replaced atomically.
+func (local *localBackend) Clone(from, to Key) error {
+	frompath, err := local.existingPath(from)
+	if err != nil {
+		return err
+	}
+	topath, err := local.constructFilePath(to)
+	if err != nil {
+		return err
+	}
+	if err = makeShardDir(filepath.Dir(topath)); err != nil {
+		return err
+	}
+	log.Printf("Linking local file %s to %s", frompath, topath)
+	tempdir := filepath.Join(local.directory, localTempDir)
+	file, err := os.CreateTemp(tempdir, encodeKey(to)+".*")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	temp := file.Name()
+	if err = os.Remove(temp); err != nil {
+		return err
+	}
+	err = os.Link(frompath, temp)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNoExist
+	} else if err != nil {
+		return err
+	}
+	if err = os.Rename(temp, topath); err != nil {
+		os.Remove(temp)
+		return err
+	}
+	local.index.add(encodeKey(to))
+	if err = syncDirectory(filepath.Dir(topath)); err != nil {
+		return err
+	}
+	return local.removeLegacy(to)
+}
+
+// describe the local file holding the blob.
+func (local *localBackend) Stat(key Key) (Attrs, error) {
+	statpath, err := local.existingPath(key)
+	if err != nil {
+		return Attrs{}, err
+	}
+	info, err := os.Stat(statpath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return Attrs{}, ErrNoExist
+	} else if err != nil {
+		return Attrs{}, err
+	}
+	return Attrs{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// list blob files in name order from the index, skipping names
+// that don't decode, such as unescaped legacy names.
+func (local *localBackend) List(major string, after Key, limit int) ([]Key, error) {
+	start, prefix := "", ""
+	if after != (Key{}) {
+		start = encodeKey(after)
+	}
+	if major != "" {
+		prefix = escapeKeyPart(major) + "."
+	}
+	keys := []Key{}
+	for len(keys) < limit {
+		want := limit - len(keys)
+		names := local.index.after(start, prefix, want)
+		for _, name := range names {
+			if key, ok := decodeKey(name); ok {
+				keys = append(keys, key)
+			}
+		}
+		if len(names) < want {
+			break // index exhausted
+		}
+		start = names[len(names)-1]
+	}
+	return keys, nil
+}
+
+// fsync a file's content to disk.
+func syncFile(path string) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// fsync a directory so renames into it are durable.
+func syncDirectory(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -0,0 +1,351 @@
+/*
+ * Tests for the local directory backend, including crash recovery.
+ */
+
+package blob
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// sentinel panic value used to simulate a crash
+var errCrash = errors.New("simulated crash")
+
+// write content and commit, simulating a crash at the given step.
+// Returns true if the crash happened before the commit finished.
+func commitWithCrash(t *testing.T, backend Backend, key Key, content []byte, step string) (crashed bool) {
+	crashPoint = func(at string) {
+		if at == step {
+			panic(errCrash)
+		}
+	}
+	defer func() {
+		crashPoint = func(string) {}
+		if r := recover(); r == errCrash {
+			crashed = true
+		} else if r != nil {
+			panic(r)
+		}
+	}()
+
+	writer, err := backend.Writer(key)
+	if err != nil {
+		t.Fatalf("could not open writer: %s", err)
+	}
+	if _, err = writer.Write(content); err != nil {
+		t.Fatalf("could not write content: %s", err)
+	}
+	if step == "streaming" {
+		return true // abandoned mid-stream, never committed
+	}
+	if err = writer.Commit(); err != nil {
+		t.Fatalf("could not commit content: %s", err)
+	}
+	return false
+}
+
+// test that a crash at any step leaves old or new content, never
+// partial content, and that restart cleans up temp files
+func TestLocalCrashRecovery(t *testing.T) {
+	// expected content after restart, for a crash at each step
+	steps := map[string]string{
+		"streaming": "old",
+		"written":   "old",
+		"synced":    "old",
+		"renamed":   "new",
+	}
+	for step, expect := range steps {
+		t.Run(step, func(t *testing.T) {
+			cfg := &Config{LocalDirectory: t.TempDir()}
+			backend, err := newLocalBackend(cfg)
+			if err != nil {
+				t.Fatalf("could not create backend: %s", err)
+			}
+			key := Key{Major: "major", Minor: "minor", BlobType: "Raw"}
+			if err = blobWriteInternal(backend, key, []byte("old")); err != nil {
+				t.Fatalf("could not write old content: %s", err)
+			}
+
+			if !commitWithCrash(t, backend, key, []byte("new"), step) {
+				t.Fatalf("crash at step %s was not simulated", step)
+			}
+
+			// restart the backend, which runs recovery
+			backend, err = newLocalBackend(cfg)
+			if err != nil {
+				t.Fatalf("could not restart backend: %s", err)
+			}
+			content, err := blobReadInternal(backend, key)
+			if err != nil {
+				t.Fatalf("could not read content after restart: %s", err)
+			}
+			if string(content) != expect {
+				t.Fatalf("expected %q after crash at %s, found %q",
+					expect, step, content)
+			}
+			temps, err := os.ReadDir(filepath.Join(cfg.LocalDirectory, localTempDir))
+			if err != nil {
+				t.Fatalf("could not list temp directory: %s", err)
+			} else if len(temps) != 0 {
+				t.Fatalf("%d temp files left after recovery", len(temps))
+			}
+		})
+	}
+}
+
+// test that an aborted write leaves the previous content in place
+func TestLocalAbortKeepsOldContent(t *testing.T) {
+	backend, err := newLocalBackend(&Config{LocalDirectory: t.TempDir()})
+	if err != nil {
+		t.Fatalf("could not create backend: %s", err)
+	}
+	key := Key{Major: "major", Minor: "minor", BlobType: "Raw"}
+	if err = blobWriteInternal(backend, key, []byte("old")); err != nil {
+		t.Fatalf("could not write old content: %s", err)
+	}
+	writer, err := backend.Writer(key)
+	if err != nil {
+		t.Fatalf("could not open writer: %s", err)
+	}
+	writer.Write([]byte("partial"))
+	if err = writer.Abort(); err != nil {
+		t.Fatalf("could not abort write: %s", err)
+	}
+	content, err := blobReadInternal(backend, key)
+	if err != nil {
+		t.Fatalf("could not read content: %s", err)
+	} else if string(content) != "old" {
+		t.Fatalf("expected old content after abort, found %q", content)
+	}
+}
+
+// test that new stores fan files out under hash prefix directories
+func TestLocalShardedLayout(t *testing.T) {
+	dir := t.TempDir()
+	backend, err := newLocalBackend(&Config{LocalDirectory: dir})
+	if err != nil {
+		t.Fatalf("could not create backend: %s", err)
+	}
+	key := Key{Major: "major", Minor: "minor", BlobType: "Raw"}
+	if err = blobWriteInternal(backend, key, []byte("content")); err != nil {
+		t.Fatalf("could not write content: %s", err)
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, "*", "*", encodeKey(key)))
+	if len(matches) != 1 {
+		t.Fatalf("expected one sharded file, found %v", matches)
+	}
+	rel, _ := filepath.Rel(dir, matches[0])
+	if parts := strings.Split(rel, string(filepath.Separator)); len(parts[0]) != 2 || len(parts[1]) != 2 {
+		t.Fatalf("expected two-character shard directories, found %s", rel)
+	}
+	if _, err = os.Stat(filepath.Join(dir, encodeKey(key))); err == nil {
+		t.Fatalf("blob file written at top of sharded store")
+	}
+	if _, err = backend.Reader(Key{Major: "..", Minor: "x", BlobType: "Raw"}, 0, 0); !errors.Is(err, ErrKey) {
+		t.Fatalf("expected ErrKey for unsafe key, got %v", err)
+	}
+}
+
+// test clones link the same file, and part from it when rewritten
+func TestLocalClone(t *testing.T) {
+	dir := t.TempDir()
+	backend, err := newLocalBackend(&Config{LocalDirectory: dir})
+	if err != nil {
+		t.Fatalf("could not create backend: %s", err)
+	}
+	local := backend.(*localBackend)
+	from := Key{Major: "major", Minor: "from", BlobType: "Raw"}
+	to := Key{Major: "major", Minor: "to", BlobType: "Raw"}
+	if err = blobWriteInternal(backend, from, []byte("content")); err != nil {
+		t.Fatalf("could not write content: %s", err)
+	}
+	if err = blobWriteInternal(backend, to, []byte("replaced")); err != nil {
+		t.Fatalf("could not write content: %s", err)
+	}
+	if err = local.Clone(from, to); err != nil {
+		t.Fatalf("could not clone: %s", err)
+	}
+	fromPath, _ := local.constructFilePath(from)
+	toPath, _ := local.constructFilePath(to)
+	fromInfo, _ := os.Stat(fromPath)
+	toInfo, err := os.Stat(toPath)
+	if err != nil || !os.SameFile(fromInfo, toInfo) {
+		t.Fatalf("expected clone to link the same file, got %v", err)
+	}
+	if err = blobWriteInternal(backend, from, []byte("rewritten")); err != nil {
+		t.Fatalf("could not rewrite content: %s", err)
+	}
+	if content, err := blobReadInternal(backend, to); err != nil || string(content) != "content" {
+		t.Fatalf("expected clone unchanged, got %q, %v", content, err)
+	}
+	missing := Key{Major: "major", Minor: "missing", BlobType: "Raw"}
+	if err = local.Clone(missing, to); !errors.Is(err, ErrNoExist) {
+		t.Fatalf("expected ErrNoExist cloning a missing blob, got %v", err)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(dir, localTempDir)); len(entries) != 0 {
+		t.Fatalf("clone left %d temp files", len(entries))
+	}
+}
+
+// test converting a flat store to the sharded layout
+func TestLocalMigrate(t *testing.T) {
+	dir := t.TempDir()
+	keys := []Key{
+		{Major: "a", Minor: "1", BlobType: "Raw"},
+		{Major: "a", Minor: "2", BlobType: "Raw.meta"},
+		{Major: "b", Minor: "1", BlobType: "Raw"},
+	}
+	for _, key := range keys {
+		content := []byte(key.String())
+		if err := os.WriteFile(filepath.Join(dir, encodeKey(key)), content, 0644); err != nil {
+			t.Fatalf("could not create flat file: %s", err)
+		}
+	}
+
+	// an existing flat store is left flat until migrated
+	backend, err := newLocalBackend(&Config{LocalDirectory: dir})
+	if err != nil {
+		t.Fatalf("could not open flat store: %s", err)
+	} else if backend.(*localBackend).sharded {
+		t.Fatalf("flat store opened as sharded")
+	}
+
+	// a store left mid-migration refuses to open
+	if err = writeLayout(dir, layoutMigrating); err != nil {
+		t.Fatalf("could not write layout: %s", err)
+	}
+	if _, err = newLocalBackend(&Config{LocalDirectory: dir}); !errors.Is(err, ErrMigrating) {
+		t.Fatalf("expected ErrMigrating, got %v", err)
+	}
+
+	moved, err := MigrateLocal(dir)
+	if err != nil {
+		t.Fatalf("migration failed: %s", err)
+	} else if moved != len(keys) {
+		t.Fatalf("expected %d files moved, found %d", len(keys), moved)
+	}
+	if moved, err = MigrateLocal(dir); err != nil || moved != 0 {
+		t.Fatalf("expected repeat migration to do nothing, moved %d, %v", moved, err)
+	}
+
+	backend, err = newLocalBackend(&Config{LocalDirectory: dir})
+	if err != nil {
+		t.Fatalf("could not open migrated store: %s", err)
+	} else if !backend.(*localBackend).sharded {
+		t.Fatalf("migrated store opened as flat")
+	}
+	for _, key := range keys {
+		content, err := blobReadInternal(backend, key)
+		if err != nil {
+			t.Fatalf("could not read %s after migration: %s", key, err)
+		} else if string(content) != key.String() {
+			t.Fatalf("expected %q for %s, found %q", key.String(), key, content)
+		}
+	}
+	listed, err := backend.List("a", Key{}, 10)
+	if err != nil || len(listed) != 2 || listed[0] != keys[0] || listed[1] != keys[1] {
+		t.Fatalf("unexpected listing after migration %v, %v", listed, err)
+	}
+}
+
+// test blobs stored under unescaped names before key escaping are
+// still found, and their old files go once they are replaced
+func TestLocalLegacyNames(t *testing.T) {
+	dir := t.TempDir()
+	keys := []Key{
+		{Major: "a.b", Minor: "c", BlobType: "Raw"},
+		{Major: "50%", Minor: "x.y", BlobType: "Raw.meta"},
+		{Major: "plain", Minor: "key", BlobType: "Raw"},
+	}
+	for _, key := range keys {
+		if err := os.WriteFile(filepath.Join(dir, key.String()), []byte(key.String()), 0644); err != nil {
+			t.Fatalf("could not create legacy file: %s", err)
+		}
+	}
+	if _, err := MigrateLocal(dir); err != nil {
+		t.Fatalf("migration failed: %s", err)
+	}
+	backend, err := newLocalBackend(&Config{LocalDirectory: dir})
+	if err != nil {
+		t.Fatalf("could not open migrated store: %s", err)
+	}
+	for _, key := range keys {
+		content, err := blobReadInternal(backend, key)
+		if err != nil || string(content) != key.String() {
+			t.Fatalf("expected legacy content for %s, got %q, %v", key, content, err)
+		}
+		if attrs, err := backend.Stat(key); err != nil || attrs.Size != int64(len(key.String())) {
+			t.Fatalf("unexpected legacy stat for %s, %+v, %v", key, attrs, err)
+		}
+	}
+
+	// a rewrite replaces the legacy file, and a delete removes it
+	if err = blobWriteInternal(backend, keys[0], []byte("new")); err != nil {
+		t.Fatalf("could not rewrite content: %s", err)
+	}
+	legacy, _ := backend.(*localBackend).legacyPath(keys[0])
+	if _, err = os.Stat(legacy); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected legacy file removed on rewrite, got %v", err)
+	}
+	if err = backend.Delete(keys[0]); err != nil {
+		t.Fatalf("could not delete: %s", err)
+	}
+	if err = backend.Delete(keys[1]); err != nil {
+		t.Fatalf("could not delete legacy blob: %s", err)
+	}
+	for _, key := range keys[:2] {
+		if _, err = backend.Stat(key); !errors.Is(err, ErrNoExist) {
+			t.Fatalf("expected %s deleted, got %v", key, err)
+		}
+	}
+}
+
+// test listing pages follow writes, clones and deletes made after
+// the store was opened, and files present when it was opened
+func TestLocalListIndex(t *testing.T) {
+	dir := t.TempDir()
+	backend, err := newLocalBackend(&Config{LocalDirectory: dir})
+	if err != nil {
+		t.Fatalf("could not open store: %s", err)
+	}
+	for i := 0; i < 20; i++ {
+		key := Key{Major: "m", Minor: fmt.Sprintf("%02d", i), BlobType: "Raw"}
+		if err = blobWriteInternal(backend, key, []byte("x")); err != nil {
+			t.Fatalf("could not write: %s", err)
+		}
+	}
+	local := backend.(*localBackend)
+	if err = local.Clone(Key{"m", "00", "Raw"}, Key{"m", "20", "Raw"}); err != nil {
+		t.Fatalf("could not clone: %s", err)
+	}
+	if err = backend.Delete(Key{"m", "05", "Raw"}); err != nil {
+		t.Fatalf("could not delete: %s", err)
+	}
+	// the reopened store indexes what the first one left behind
+	reopened, err := newLocalBackend(&Config{LocalDirectory: dir})
+	if err != nil {
+		t.Fatalf("could not reopen store: %s", err)
+	}
+	for _, backend := range []Backend{backend, reopened} {
+		keys, after := []Key{}, Key{}
+		for {
+			page, err := backend.List("m", after, 6)
+			if err != nil {
+				t.Fatalf("List returned error: %s", err)
+			}
+			keys = append(keys, page...)
+			if len(page) < 6 {
+				break
+			}
+			after = page[len(page)-1]
+		}
+		if len(keys) != 20 || keys[5].Minor != "06" || keys[19].Minor != "20" {
+			t.Fatalf("unexpected listing %v", keys)
+		}
+	}
+}
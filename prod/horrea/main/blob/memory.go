@@ -0,0 +1,137 @@
+/*
+ * In-memory storage backend. Content is lost on restart.
+ */
+
+package blob
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+type memoryBackend struct {
+	mu    sync.RWMutex        // guards content.
+	blobs map[Key]*memoryBlob // committed blobs.
+}
+
+type memoryBlob struct {
+	content []byte    // committed content.
+	modTime time.Time // time of commit.
+}
+
+type memoryWriter struct {
+	backend *memoryBackend // owning backend.
+	key     Key            // destination key.
+	buffer  bytes.Buffer   // uncommitted content.
+}
+
+func init() {
+	RegisterBackend(MemoryBackend, newMemoryBackend)
+}
+
+// create a backend holding all blobs in process memory.
+func newMemoryBackend(cfg *Config) (Backend, error) {
+	return &memoryBackend{blobs: make(map[Key]*memoryBlob)}, nil
+}
+
+// return a reader over the stored content.
+func (mem *memoryBackend) Reader(key Key, offset, length int64) (io.ReadCloser, error) {
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+	blob, ok := mem.blobs[key]
+	if !ok {
+		return nil, ErrNoExist
+	} else if offset > int64(len(blob.content)) {
+		return nil, ErrRange
+	}
+	reader := io.NopCloser(bytes.NewReader(blob.content[offset:]))
+	return limitReader(reader, length), nil
+}
+
+// return a writer buffering content until commit.
+func (mem *memoryBackend) Writer(key Key) (Writer, error) {
+	return &memoryWriter{backend: mem, key: key}, nil
+}
+
+func (writer *memoryWriter) Write(data []byte) (int, error) {
+	return writer.buffer.Write(data)
+}
+
+// store the buffered content, replacing any previous content.
+func (writer *memoryWriter) Commit() error {
+	mem := writer.backend
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	mem.blobs[writer.key] = &memoryBlob{
+		content: writer.buffer.Bytes(),
+		modTime: time.Now(),
+	}
+	return nil
+}
+
+// drop the buffered content.
+func (writer *memoryWriter) Abort() error {
+	writer.buffer.Reset()
+	return nil
+}
+
+// store a key's content at another, sharing it, since committed
+// content is never changed.
+func (mem *memoryBackend) Clone(from, to Key) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	blob, ok := mem.blobs[from]
+	if !ok {
+		return ErrNoExist
+	}
+	mem.blobs[to] = &memoryBlob{content: blob.content, modTime: blob.modTime}
+	return nil
+}
+
+// drop the stored content.
+func (mem *memoryBackend) Delete(key Key) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	if _, ok := mem.blobs[key]; !ok {
+		return ErrNoExist
+	}
+	delete(mem.blobs, key)
+	return nil
+}
+
+// describe the stored content.
+func (mem *memoryBackend) Stat(key Key) (Attrs, error) {
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+	blob, ok := mem.blobs[key]
+	if !ok {
+		return Attrs{}, ErrNoExist
+	}
+	return Attrs{Size: int64(len(blob.content)), ModTime: blob.modTime}, nil
+}
+
+// list stored keys in the same order as the local backend.
+func (mem *memoryBackend) List(major string, after Key, limit int) ([]Key, error) {
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+	start := ""
+	if after != (Key{}) {
+		start = encodeKey(after)
+	}
+	keys := []Key{}
+	for key := range mem.blobs {
+		if (major == "" || key.Major == major) && encodeKey(key) > start {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return encodeKey(keys[i]) < encodeKey(keys[j])
+	})
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys, nil
+}
@@ -0,0 +1,683 @@
+/*
+ * Packing of small blobs into larger pack files.
+ */
+
+/*
+ * Blobs no larger than a threshold are appended to pack files, each
+ * holding the content of many blobs followed by an index of where
+ * each one lies, so small blobs don't each cost a file or an object.
+ * Larger blobs pass through to the backend as before.
+ *
+ * New entries go to a small open pack, rewritten whole on every
+ * commit since backends can't append, and sealed once it fills.
+ * Indexes are only ever added to, so offsets already handed to
+ * readers stay valid across rewrites. Deleting a blob held by a
+ * sealed pack records a tombstone in the open pack. Packs are
+ * numbered in order of age and replayed in that order on startup,
+ * so later entries and tombstones win over earlier ones.
+ *
+ * Compaction merges small or mostly dead packs into full-size ones,
+ * written once each, copying only the entries still current and the
+ * tombstones still hiding older entries, then deletes the originals.
+ * The merged packs are numbered after everything before them, and a
+ * new open pack is started after them, so replay order still
+ * matches write order.
+ *
+ * The keys of current entries are also kept in a sorted index of
+ * their flat names, so a listing page seeks straight to where it
+ * starts rather than sorting every packed key.
+ *
+ * Packed blobs are small, so cloning one copies its bytes into the
+ * open pack, while clones of larger blobs are left to the backend.
+ * Reading pack indexes and compacting read packs quietly, so those
+ * passes don't disturb how the backend places them.
+ *
+ * A blob packed over content the backend still holds at its own key
+ * leaves that content shadowed until the key is deleted. A blob
+ * grown past the threshold is tombstoned before its new content is
+ * committed, so a crash in between loses the key rather than serving
+ * stale content. Packed blobs need the layer to be read, so leave it
+ * on once enabled.
+ */
+
+package blob
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// major key of pack files.
+const packMajor = ".packs"
+
+// blob type of pack files.
+const packType = "pack"
+
+// bytes of content after which the open pack is sealed.
+const packOpenSize = 64 * 1024
+
+// bytes of content per pack when none is configured.
+const defaultPackSize = 4 * 1024 * 1024
+
+// Location of a blob's content within a pack.
+type packEntry struct {
+	Key     Key       `json:"key"`     // blob key.
+	Offset  int64     `json:"offset"`  // first byte in the pack.
+	Size    int64     `json:"size"`    // content size in bytes.
+	ModTime time.Time `json:"modTime"` // time content was committed.
+}
+
+// Index persisted at the end of each pack.
+type packIndex struct {
+	Entries []packEntry `json:"entries"` // content held, by offset.
+	Deleted []Key       `json:"deleted"` // keys removed from older packs.
+}
+
+// In-memory state of one pack.
+type pack struct {
+	id      string            // pack number, as fixed-width hex.
+	size    int64             // bytes of content held.
+	live    int64             // bytes of content still current.
+	entries map[Key]packEntry // content held, by key.
+	deleted map[Key]bool      // tombstones held.
+}
+
+type packBackend struct {
+	inner     Backend          // backend holding packs and large blobs.
+	threshold int64            // largest blob packed.
+	packSize  int64            // bytes of content per merged pack.
+	mu        sync.RWMutex     // guards everything below.
+	packs     map[string]*pack // stored packs, by ID.
+	current   map[Key]*pack    // pack holding each packed key.
+	names     *nameIndex       // flat names of packed keys, sorted.
+	open      *pack            // pack taking new entries.
+	data      []byte           // content of the open pack.
+	next      uint64           // number of the next new pack.
+}
+
+// View of a pack layer reading quietly from its backend.
+type quietPacks struct {
+	*packBackend
+}
+
+// Pending write, held in memory while it's small enough to pack.
+type packWriter struct {
+	backend *packBackend // layer being written.
+	key     Key          // destination key.
+	buffer  []byte       // content while it may still be packed.
+	inner   Writer       // backend write, once past the threshold.
+}
+
+// packing layer in use, nil if disabled.
+var blobPacks *packBackend
+
+// wrap a backend so blobs up to threshold bytes are packed, and
+// load the indexes of the packs it already holds.
+func newPackBackend(inner Backend, threshold, packSize int64) (*packBackend, error) {
+	if packSize <= 0 {
+		packSize = defaultPackSize
+	}
+	packs := &packBackend{inner: inner, threshold: threshold, packSize: packSize}
+	if err := packs.load(); err != nil {
+		return nil, err
+	}
+	return packs, nil
+}
+
+// report whether content at the key goes through the layer.
+func packable(key Key) bool {
+	return key.Major != packMajor
+}
+
+// return the key of a pack file.
+func packKey(id string) Key {
+	return Key{Major: packMajor, Minor: id, BlobType: packType}
+}
+
+// return a new, empty pack.
+func newPack(number uint64) *pack {
+	return &pack{
+		id:      fmt.Sprintf("%016x", number),
+		entries: map[Key]packEntry{},
+		deleted: map[Key]bool{},
+	}
+}
+
+// rebuild the index from the stored packs, oldest first, and start
+// a new open pack after them.
+func (packs *packBackend) load() error {
+	packs.packs = map[string]*pack{}
+	packs.current = map[Key]*pack{}
+	packs.names = newNameIndex(nil)
+	packs.next = 0
+	after := Key{}
+	for {
+		keys, err := packs.inner.List(packMajor, after, DefaultPageSize)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			number, err := strconv.ParseUint(key.Minor, 16, 64)
+			if err != nil || key.BlobType != packType {
+				continue
+			}
+			stored, err := packs.readIndex(key.Minor)
+			if err != nil {
+				return fmt.Errorf("pack %s: %w", key.Minor, err)
+			}
+			packs.replay(stored)
+			packs.next = number + 1
+		}
+		if len(keys) < DefaultPageSize {
+			break
+		}
+		after = keys[len(keys)-1]
+	}
+	packs.roll()
+	return nil
+}
+
+// read the index at the end of a stored pack.
+func (packs *packBackend) readIndex(id string) (*pack, error) {
+	key := packKey(id)
+	attrs, err := packs.inner.Stat(key)
+	if err != nil {
+		return nil, err
+	} else if attrs.Size < 8 {
+		return nil, ErrCorrupt
+	}
+	trailer, err := readStoredRange(quiet(packs.inner), key, attrs.Size-8, 8)
+	if err != nil {
+		return nil, err
+	}
+	length := int64(binary.BigEndian.Uint64(trailer))
+	if length > attrs.Size-8 {
+		return nil, ErrCorrupt
+	}
+	content, err := readStoredRange(quiet(packs.inner), key, attrs.Size-8-length, length)
+	if err != nil {
+		return nil, err
+	}
+	index := new(packIndex)
+	if err = json.Unmarshal(content, index); err != nil {
+		return nil, ErrCorrupt
+	}
+	stored := newPack(0)
+	stored.id = id
+	stored.size = attrs.Size - 8 - length
+	for _, entry := range index.Entries {
+		if entry.Offset < 0 || entry.Size < 0 || entry.Offset+entry.Size > stored.size {
+			return nil, ErrCorrupt
+		}
+		stored.entries[entry.Key] = entry
+	}
+	for _, key := range index.Deleted {
+		stored.deleted[key] = true
+	}
+	return stored, nil
+}
+
+// read a range of stored content in full.
+func readStoredRange(backend Backend, key Key, offset, length int64) ([]byte, error) {
+	if length == 0 {
+		return []byte{}, nil
+	}
+	reader, err := backend.Reader(key, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	content := make([]byte, length)
+	if _, err = io.ReadFull(reader, content); err != nil {
+		return nil, ErrCorrupt
+	}
+	return content, nil
+}
+
+// apply a stored pack's tombstones and entries over older packs.
+func (packs *packBackend) replay(stored *pack) {
+	for key := range stored.deleted {
+		packs.retire(key)
+	}
+	for key, entry := range stored.entries {
+		packs.retire(key)
+		packs.hold(key, stored)
+		stored.live += entry.Size
+	}
+	packs.packs[stored.id] = stored
+}
+
+// record a pack as holding a key's current entry.
+func (packs *packBackend) hold(key Key, holder *pack) {
+	packs.current[key] = holder
+	packs.names.add(encodeKey(key))
+}
+
+// stop counting a key's current entry, if it has one.
+func (packs *packBackend) retire(key Key) {
+	if holder := packs.current[key]; holder != nil {
+		holder.live -= holder.entries[key].Size
+		delete(packs.current, key)
+		packs.names.remove(encodeKey(key))
+	}
+}
+
+// seal the open pack and start a new, empty one.
+func (packs *packBackend) roll() {
+	packs.open = newPack(packs.next)
+	packs.data = nil
+	packs.next++
+}
+
+// report whether a pack other than the given ones holds an entry
+// for the key, which a tombstone must keep hidden.
+func (packs *packBackend) heldElsewhere(key Key, except ...*pack) bool {
+	for _, stored := range packs.packs {
+		if _, ok := stored.entries[key]; ok && !containsPack(except, stored) {
+			return true
+		}
+	}
+	return false
+}
+
+// report whether a pack is in a list.
+func containsPack(list []*pack, target *pack) bool {
+	for _, item := range list {
+		if item == target {
+			return true
+		}
+	}
+	return false
+}
+
+// return the stored form of a pack: its content, its index, and
+// the length of its index.
+func encodePack(stored *pack, data []byte) ([]byte, error) {
+	index := packIndex{Entries: []packEntry{}, Deleted: []Key{}}
+	for _, entry := range stored.entries {
+		index.Entries = append(index.Entries, entry)
+	}
+	sort.Slice(index.Entries, func(a, b int) bool {
+		return index.Entries[a].Offset < index.Entries[b].Offset
+	})
+	for key := range stored.deleted {
+		index.Deleted = append(index.Deleted, key)
+	}
+	footer, err := json.Marshal(&index)
+	if err != nil {
+		return nil, err
+	}
+	content := make([]byte, 0, len(data)+len(footer)+8)
+	content = append(append(content, data...), footer...)
+	return binary.BigEndian.AppendUint64(content, uint64(len(footer))), nil
+}
+
+// persist the open pack. On failure the index is reloaded, so it
+// matches what storage still holds.
+func (packs *packBackend) flush() error {
+	content, err := encodePack(packs.open, packs.data)
+	if err == nil {
+		err = blobWriteInternal(packs.inner, packKey(packs.open.id), content)
+	}
+	if err != nil {
+		if reloadErr := packs.load(); reloadErr != nil {
+			log.Printf("Could not reload pack index: %v", reloadErr)
+		}
+		return err
+	}
+	packs.packs[packs.open.id] = packs.open
+	return nil
+}
+
+// add content to the open pack, sealing it first if it's full.
+func (packs *packBackend) add(key Key, data []byte, modTime time.Time) {
+	open := packs.open
+	if open.size > 0 && open.size+int64(len(data)) > packOpenSize {
+		packs.roll()
+		open = packs.open
+	}
+	entry := packEntry{Key: key, Offset: open.size, Size: int64(len(data)), ModTime: modTime}
+	packs.data = append(packs.data, data...)
+	open.size += entry.Size
+	packs.retire(key)
+	open.entries[key] = entry
+	delete(open.deleted, key)
+	packs.hold(key, open)
+	open.live += entry.Size
+}
+
+// persist a packed blob.
+func (packs *packBackend) put(key Key, data []byte) error {
+	packs.mu.Lock()
+	defer packs.mu.Unlock()
+	// a full open pack is already stored, so it can be sealed freely
+	packs.add(key, data, time.Now())
+	return packs.flush()
+}
+
+// remove a key's packed entry, if it has one, reporting whether
+// it did.
+func (packs *packBackend) drop(key Key) (bool, error) {
+	packs.mu.Lock()
+	defer packs.mu.Unlock()
+	holder := packs.current[key]
+	if holder == nil {
+		return false, nil
+	}
+	packs.retire(key)
+	open := packs.open
+	if holder == open {
+		delete(open.entries, key)
+	}
+	if packs.heldElsewhere(key, open) {
+		open.deleted[key] = true
+	}
+	return true, packs.flush()
+}
+
+// return a reader over a blob, packed or not.
+func (packs *packBackend) Reader(key Key, offset, length int64) (io.ReadCloser, error) {
+	return packs.read(packs.inner, key, offset, length)
+}
+
+// return the view of the layer reading quietly from its backend.
+func (packs *packBackend) quiet() Backend {
+	return quietPacks{packs}
+}
+
+func (view quietPacks) Reader(key Key, offset, length int64) (io.ReadCloser, error) {
+	return view.read(quiet(view.inner), key, offset, length)
+}
+
+// return a reader over a blob, read through the given view of the
+// backend.
+func (packs *packBackend) read(inner Backend, key Key, offset, length int64) (io.ReadCloser, error) {
+	packs.mu.RLock()
+	defer packs.mu.RUnlock()
+	holder := packs.current[key]
+	if holder == nil {
+		return inner.Reader(key, offset, length)
+	}
+	entry := holder.entries[key]
+	if offset > entry.Size {
+		return nil, ErrRange
+	}
+	span := entry.Size - offset
+	if length > 0 && length < span {
+		span = length
+	}
+	if span == 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	// packs are only deleted under the write lock, and an open
+	// reader keeps its content
+	return inner.Reader(packKey(holder.id), entry.Offset+offset, span)
+}
+
+// return a writer that packs the content if it stays small.
+func (packs *packBackend) Writer(key Key) (Writer, error) {
+	if !packable(key) {
+		return packs.inner.Writer(key)
+	}
+	return &packWriter{backend: packs, key: key}, nil
+}
+
+func (writer *packWriter) Write(data []byte) (int, error) {
+	if writer.inner == nil && int64(len(writer.buffer)+len(data)) <= writer.backend.threshold {
+		writer.buffer = append(writer.buffer, data...)
+		return len(data), nil
+	}
+	if writer.inner == nil {
+		inner, err := writer.backend.inner.Writer(writer.key)
+		if err != nil {
+			return 0, err
+		}
+		writer.inner = inner
+		if _, err = inner.Write(writer.buffer); err != nil {
+			return 0, err
+		}
+		writer.buffer = nil
+	}
+	return writer.inner.Write(data)
+}
+
+// pack the content, or commit it to the backend once any packed
+// copy is dropped.
+func (writer *packWriter) Commit() error {
+	if writer.inner == nil {
+		return writer.backend.put(writer.key, writer.buffer)
+	}
+	if _, err := writer.backend.drop(writer.key); err != nil {
+		writer.inner.Abort()
+		return err
+	}
+	return writer.inner.Commit()
+}
+
+func (writer *packWriter) Abort() error {
+	writer.buffer = nil
+	if writer.inner != nil {
+		return writer.inner.Abort()
+	}
+	return nil
+}
+
+// delete a blob from its pack and from the backend.
+func (packs *packBackend) Delete(key Key) error {
+	if !packable(key) {
+		return packs.inner.Delete(key)
+	}
+	packed, err := packs.drop(key)
+	if err != nil {
+		return err
+	}
+	err = packs.inner.Delete(key)
+	if packed && errors.Is(err, ErrNoExist) {
+		return nil
+	}
+	return err
+}
+
+// clone a blob, into the open pack if it's packed, or in the
+// backend once any packed copy at the destination is dropped.
+func (packs *packBackend) Clone(from, to Key) error {
+	if !packable(from) || !packable(to) {
+		return cloneContent(packs.inner, from, to)
+	}
+	packs.mu.Lock()
+	if holder := packs.current[from]; holder != nil {
+		defer packs.mu.Unlock()
+		entry := holder.entries[from]
+		data, err := readStoredRange(packs.inner, packKey(holder.id), entry.Offset, entry.Size)
+		if err != nil {
+			return err
+		}
+		packs.add(to, data, entry.ModTime)
+		return packs.flush()
+	}
+	packs.mu.Unlock()
+	if _, err := packs.inner.Stat(from); err != nil {
+		return err
+	}
+	if _, err := packs.drop(to); err != nil {
+		return err
+	}
+	return cloneContent(packs.inner, from, to)
+}
+
+// describe a blob, packed or not.
+func (packs *packBackend) Stat(key Key) (Attrs, error) {
+	packs.mu.RLock()
+	defer packs.mu.RUnlock()
+	if holder := packs.current[key]; holder != nil {
+		entry := holder.entries[key]
+		return Attrs{Size: entry.Size, ModTime: entry.ModTime}, nil
+	}
+	return packs.inner.Stat(key)
+}
+
+// list packed and unpacked keys together, hiding pack files.
+func (packs *packBackend) List(major string, after Key, limit int) ([]Key, error) {
+	keys := []Key{}
+	from := after
+	for len(keys) < limit {
+		want := limit - len(keys)
+		page, err := packs.inner.List(major, from, want)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range page {
+			if packable(key) {
+				keys = append(keys, key)
+			}
+		}
+		if len(page) < want {
+			break
+		}
+		from = page[len(page)-1]
+	}
+
+	// both lists hold the first keys of their kind, so the first
+	// of the two together are the first overall
+	start, prefix := "", ""
+	if after != (Key{}) {
+		start = encodeKey(after)
+	}
+	if major != "" {
+		prefix = escapeKeyPart(major) + "."
+	}
+	packed := []Key{}
+	packs.mu.RLock()
+	names := packs.names.after(start, prefix, limit)
+	packs.mu.RUnlock()
+	for _, name := range names {
+		if key, ok := decodeKey(name); ok {
+			packed = append(packed, key)
+		}
+	}
+	return mergeKeys([][]Key{keys, packed}, limit), nil
+}
+
+// merge small and mostly dead packs into full-size ones, returning
+// the bytes of storage reclaimed.
+func CompactPacks() (int64, error) {
+	if blobPacks == nil {
+		return 0, ErrNotSupp
+	}
+	return blobPacks.compact()
+}
+
+func (packs *packBackend) compact() (int64, error) {
+	packs.mu.Lock()
+	defer packs.mu.Unlock()
+	candidates := []*pack{}
+	for _, stored := range packs.packs {
+		if stored != packs.open && (stored.size < packs.packSize/2 || stored.live*2 < stored.size) {
+			candidates = append(candidates, stored)
+		}
+	}
+	if len(candidates) == 0 || (len(candidates) == 1 && candidates[0].live == candidates[0].size) {
+		return 0, nil // nothing to gain
+	}
+	sort.Slice(candidates, func(a, b int) bool { return candidates[a].id < candidates[b].id })
+	reclaimed, err := packs.merge(candidates)
+	if err != nil {
+		// merged packs already stored only repeat current entries
+		if reloadErr := packs.load(); reloadErr != nil {
+			log.Printf("Could not reload pack index: %v", reloadErr)
+		}
+		return 0, err
+	}
+	log.Printf("Compacted %d packs, reclaiming %d bytes", len(candidates), reclaimed)
+	return reclaimed, nil
+}
+
+// copy the current entries and needed tombstones of packs into
+// new ones, then delete them, returning the bytes reclaimed.
+func (packs *packBackend) merge(candidates []*pack) (int64, error) {
+	// merged packs are written whole, and numbered after every
+	// pack they replace
+	merged := []*pack{}
+	var target *pack
+	var data []byte
+	var reclaimed int64
+	for _, stored := range candidates {
+		content, err := readStoredRange(quiet(packs.inner), packKey(stored.id), 0, stored.size)
+		if err != nil {
+			return 0, fmt.Errorf("pack %s: %w", stored.id, err)
+		}
+		for key, entry := range stored.entries {
+			if packs.current[key] != stored {
+				continue
+			}
+			if target == nil || (target.size > 0 && target.size+entry.Size > packs.packSize) {
+				if target != nil {
+					if err = packs.store(target, data); err != nil {
+						return 0, err
+					}
+				}
+				target, data = newPack(packs.next), nil
+				packs.next++
+				merged = append(merged, target)
+			}
+			moved := packEntry{Key: key, Offset: target.size, Size: entry.Size, ModTime: entry.ModTime}
+			data = append(data, content[entry.Offset:entry.Offset+entry.Size]...)
+			target.size += moved.Size
+			target.entries[key] = moved
+		}
+		reclaimed += stored.size - stored.live
+	}
+	if target == nil {
+		target = newPack(packs.next)
+		packs.next++
+		merged = append(merged, target)
+	}
+	for _, stored := range candidates {
+		for key := range stored.deleted {
+			if packs.current[key] == nil && packs.heldElsewhere(key, candidates...) {
+				target.deleted[key] = true
+			}
+		}
+	}
+	if err := packs.store(target, data); err != nil {
+		return 0, err
+	}
+
+	// the merged entries are now current, and new entries must
+	// follow them
+	for _, stored := range merged {
+		for key, entry := range stored.entries {
+			packs.retire(key)
+			packs.hold(key, stored)
+			stored.live += entry.Size
+		}
+		packs.packs[stored.id] = stored
+	}
+	packs.roll()
+	for _, stored := range candidates {
+		err := packs.inner.Delete(packKey(stored.id))
+		if err != nil && !errors.Is(err, ErrNoExist) {
+			return 0, err
+		}
+		delete(packs.packs, stored.id)
+	}
+	return reclaimed, nil
+}
+
+// persist a merged pack.
+func (packs *packBackend) store(target *pack, data []byte) error {
+	content, err := encodePack(target, data)
+	if err != nil {
+		return err
+	}
+	return blobWriteInternal(packs.inner, packKey(target.id), content)
+}
@@ -0,0 +1,260 @@
+/*
+ * Tests for small-blob packing.
+ */
+
+package blob
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// configure the named backend with packing enabled
+func configurePacks(t *testing.T, name string, cfg *Config) *packBackend {
+	cfg.PackThreshold = 8 * 1024
+	cfg.PackSize = 256 * 1024
+	if err := ConfigureBackend(name, cfg); err != nil {
+		t.Fatalf("could not configure %s backend: %s", name, err)
+	}
+	return blobPacks
+}
+
+// list the keys held by the backend under the packing layer
+func innerKeys(t *testing.T, packs *packBackend) []Key {
+	keys, err := packs.inner.List("", Key{}, 10000)
+	if err != nil {
+		t.Fatalf("could not list inner backend: %s", err)
+	}
+	return keys
+}
+
+// sum the bytes of stored packs
+func packBytes(t *testing.T, packs *packBackend) int64 {
+	var total int64
+	for _, key := range innerKeys(t, packs) {
+		if key.Major != packMajor {
+			continue
+		}
+		attrs, err := packs.inner.Stat(key)
+		if err != nil {
+			t.Fatalf("could not stat pack: %s", err)
+		}
+		total += attrs.Size
+	}
+	return total
+}
+
+// write small blobs, returning their keys and content
+func writeSmallBlobs(t *testing.T, count, size int) ([]Key, [][]byte) {
+	keys, contents := []Key{}, [][]byte{}
+	for i := 0; i < count; i++ {
+		key := Key{Major: "small", Minor: fmt.Sprintf("%04d", i), BlobType: "Raw"}
+		content := make([]byte, size)
+		rand.Read(content)
+		if err := blobWriteInternal(blobio, key, content); err != nil {
+			t.Fatalf("could not write %s: %s", key, err)
+		}
+		keys, contents = append(keys, key), append(contents, content)
+	}
+	return keys, contents
+}
+
+// check blobs read back as written
+func checkBlobs(t *testing.T, keys []Key, contents [][]byte) {
+	for i, key := range keys {
+		content, err := blobReadInternal(blobio, key)
+		if err != nil {
+			t.Fatalf("could not read %s: %s", key, err)
+		} else if err = checkBytesEqual(content, contents[i]); err != nil {
+			t.Fatalf("%s mismatch: %s", key, err)
+		}
+	}
+}
+
+// test the usual blob operations with packing on, against every
+// backend
+func TestPackBackends(t *testing.T) {
+	tests := []func(t *testing.T){
+		testBlobReadWrite, testBlobRangeRead, testBlobManagement, testChecksumCorruption,
+		testBlobCopy, testDeltaPatch,
+	}
+	for _, name := range Backends() {
+		t.Run(name, func(t *testing.T) {
+			for _, test := range tests {
+				configurePacks(t, name, testConfig(t))
+				test(t)
+			}
+		})
+	}
+}
+
+// test small blobs share pack files, which are found again on
+// restart
+func TestPackFiles(t *testing.T) {
+	cfg := testConfig(t)
+	packs := configurePacks(t, LocalBackend, cfg)
+	keys, contents := writeSmallBlobs(t, 100, 1000)
+	large := Key{Major: "large", Minor: "blob", BlobType: "Raw"}
+	largeContent := make([]byte, 100*1024)
+	rand.Read(largeContent)
+	if err := blobWriteInternal(blobio, large, largeContent); err != nil {
+		t.Fatalf("could not write large blob: %s", err)
+	}
+	stored := innerKeys(t, packs)
+	if len(stored) != 3 || stored[0].Major != packMajor || stored[2] != large {
+		t.Fatalf("expected two packs and the large blob, found %v", stored)
+	}
+	listed, err := blobio.List("small", Key{}, 1000)
+	if err != nil {
+		t.Fatalf("could not list: %s", err)
+	} else if len(listed) != len(keys) || listed[0] != keys[0] {
+		t.Fatalf("listed %d keys, expected %d", len(listed), len(keys))
+	}
+
+	configurePacks(t, LocalBackend, cfg)
+	checkBlobs(t, append(keys, large), append(contents, largeContent))
+	reader, err := blobio.Reader(keys[5], 100, 10)
+	if err != nil {
+		t.Fatalf("could not open range: %s", err)
+	}
+	defer reader.Close()
+	readback := make([]byte, 20)
+	if n, _ := reader.Read(readback); !bytes.Equal(readback[:n], contents[5][100:110]) {
+		t.Fatalf("range mismatch")
+	}
+}
+
+// test blobs move in and out of packs as they change size, and
+// packed blobs clone into the open pack
+func TestPackResize(t *testing.T) {
+	packs := configurePacks(t, MemoryBackend, testConfig(t))
+	key := Key{Major: "major", Minor: "minor", BlobType: "Raw"}
+	sizes := []int{100, 20 * 1024, 200}
+	for _, size := range sizes {
+		content := make([]byte, size)
+		rand.Read(content)
+		if err := blobWriteInternal(blobio, key, content); err != nil {
+			t.Fatalf("could not write %d bytes: %s", size, err)
+		}
+		checkBlobs(t, []Key{key}, [][]byte{content})
+		if attrs, err := blobio.Stat(key); err != nil || attrs.Size != int64(size) {
+			t.Fatalf("expected size %d, got %+v, %v", size, attrs, err)
+		}
+		_, packed := packs.current[key]
+		if packed != (int64(size) <= packs.threshold) {
+			t.Fatalf("%d byte blob packed %v", size, packed)
+		}
+	}
+	clone := Key{Major: "major", Minor: "clone", BlobType: "Raw"}
+	if err := packs.Clone(key, clone); err != nil {
+		t.Fatalf("could not clone: %s", err)
+	} else if packs.current[clone] != packs.current[key] {
+		t.Fatalf("expected packed clone in the open pack")
+	}
+	if err := blobio.Delete(key); err != nil {
+		t.Fatalf("could not delete: %s", err)
+	}
+	if _, err := blobio.Stat(key); !errors.Is(err, ErrNoExist) {
+		t.Fatalf("expected ErrNoExist after delete, got %v", err)
+	}
+	if err := blobio.Delete(key); !errors.Is(err, ErrNoExist) {
+		t.Fatalf("expected ErrNoExist on second delete, got %v", err)
+	}
+	if attrs, err := blobio.Stat(clone); err != nil || attrs.Size != 200 {
+		t.Fatalf("expected 200 byte clone, got %+v, %v", attrs, err)
+	}
+}
+
+// test compaction reclaims the space of deleted blobs, keeping
+// the rest, and deletes stay deleted on restart
+func TestPackCompaction(t *testing.T) {
+	cfg := testConfig(t)
+	packs := configurePacks(t, LocalBackend, cfg)
+	keys, contents := writeSmallBlobs(t, 200, 2000)
+	for i, key := range keys {
+		if i%4 != 0 {
+			if err := blobio.Delete(key); err != nil {
+				t.Fatalf("could not delete %s: %s", key, err)
+			}
+		}
+	}
+	before := packBytes(t, packs)
+	reclaimed, err := CompactPacks()
+	if err != nil {
+		t.Fatalf("could not compact: %s", err)
+	} else if reclaimed < 250*1000 {
+		t.Fatalf("expected at least 250KB reclaimed, got %d", reclaimed)
+	}
+	if after := packBytes(t, packs); after > before/2 {
+		t.Fatalf("packs hold %d bytes after compaction, %d before", after, before)
+	}
+
+	// compacted entries are overwritten and deleted as usual
+	kept, keptContents := []Key{}, [][]byte{}
+	for i := 0; i < len(keys); i += 4 {
+		kept, keptContents = append(kept, keys[i]), append(keptContents, contents[i])
+	}
+	keptContents[0] = []byte("rewritten")
+	if err = blobWriteInternal(blobio, kept[0], keptContents[0]); err != nil {
+		t.Fatalf("could not rewrite: %s", err)
+	}
+	if err = blobio.Delete(kept[1]); err != nil {
+		t.Fatalf("could not delete: %s", err)
+	}
+	kept, keptContents = append(kept[:1], kept[2:]...), append(keptContents[:1], keptContents[2:]...)
+
+	configurePacks(t, LocalBackend, cfg)
+	checkBlobs(t, kept, keptContents)
+	listed, err := blobio.List("small", Key{}, 1000)
+	if err != nil {
+		t.Fatalf("could not list: %s", err)
+	} else if len(listed) != len(kept) {
+		t.Fatalf("listed %d keys after restart, expected %d", len(listed), len(kept))
+	}
+	if _, err = blobio.Stat(keys[1]); !errors.Is(err, ErrNoExist) {
+		t.Fatalf("expected deleted blob to stay deleted, got %v", err)
+	}
+}
+
+// test listing pages through packed keys in order under one major
+// key, following deletes and compaction
+func TestPackList(t *testing.T) {
+	packs := configurePacks(t, MemoryBackend, testConfig(t))
+	keys, _ := writeSmallBlobs(t, 50, 100)
+	other := Key{Major: "smaller", Minor: "0000", BlobType: "Raw"}
+	if err := blobWriteInternal(blobio, other, []byte("other")); err != nil {
+		t.Fatalf("could not write %s: %s", other, err)
+	}
+	for i := 0; i < len(keys); i += 3 {
+		if err := blobio.Delete(keys[i]); err != nil {
+			t.Fatalf("could not delete %s: %s", keys[i], err)
+		}
+	}
+	if _, err := CompactPacks(); err != nil {
+		t.Fatalf("could not compact: %s", err)
+	}
+	expect := []Key{}
+	for i, key := range keys {
+		if i%3 != 0 {
+			expect = append(expect, key)
+		}
+	}
+	listed, after := []Key{}, Key{}
+	for {
+		page, err := packs.List("small", after, 7)
+		if err != nil {
+			t.Fatalf("could not list: %s", err)
+		}
+		listed = append(listed, page...)
+		if len(page) < 7 {
+			break
+		}
+		after = page[len(page)-1]
+	}
+	if fmt.Sprint(listed) != fmt.Sprint(expect) {
+		t.Fatalf("listed %v, expected %v", listed, expect)
+	}
+}
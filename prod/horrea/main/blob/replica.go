@@ -0,0 +1,531 @@
+/*
+ * Replicated storage over several local roots.
+ */
+
+/*
+ * Every key is written to each configured root, and a write
+ * succeeds once a quorum of roots commit it. Each root keeps its
+ * own checksum record next to every copy, covering the bytes as
+ * stored, so a read verifies the copy it's served from and moves
+ * on to another copy when one is missing, damaged or unreadable.
+ * Records carry a version, and only copies matching the newest
+ * record are read, so a root that missed a write can't serve stale
+ * content. Deletes leave a versioned tombstone record for the same
+ * reason.
+ *
+ * A root that misses a write, or whose copy is lost or damaged, is
+ * left under-replicated until RepairReplicas re-copies it from a
+ * good copy. Repair also drops tombstones once every root has one.
+ * It reads every copy to verify it, so its reads are paced to a
+ * byte rate the way scrubs are, leaving the roots to clients.
+ *
+ * Peer Horrea instances can't serve as replicas, since records,
+ * sidecars and other internal keys aren't reachable through the
+ * public API.
+ */
+
+package blob
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// suffix on the blob type of replica record keys.
+const replicaSuffix = ".rsum"
+
+var ErrQuorum = errors.New("too few replicas available")
+
+type replicatedBackend struct {
+	rootSet // roots holding a copy of every key.
+}
+
+// Checksums of one root's copy of a key, or a tombstone.
+type replicaRecord struct {
+	Metadata
+	Deleted bool `json:"deleted,omitempty"` // key was deleted.
+}
+
+type replicatedWriter struct {
+	backend *replicatedBackend // owning backend.
+	key     Key                // destination key.
+	writers []*checksumWriter  // per-root writes, nil once failed.
+}
+
+type replicatedReader struct {
+	backend *replicatedBackend // owning backend.
+	key     Key                // key being read.
+	roots   []int              // roots holding good copies, in order.
+	records []*replicaRecord   // records of each root.
+	offset  int64              // first byte of the range.
+	length  int64              // bytes in the range, 0 to the end.
+	read    int64              // bytes returned so far.
+	source  io.ReadCloser      // reader of the current copy.
+	failure error              // why the last copy was abandoned.
+}
+
+// the active replicated backend, for repair.
+var blobReplicas *replicatedBackend
+
+func init() {
+	RegisterBackend(ReplicatedBackend, newReplicatedBackend)
+}
+
+// create a backend copying every key to each replica directory.
+func newReplicatedBackend(cfg *Config) (Backend, error) {
+	if len(cfg.ReplicaDirs) == 0 {
+		return nil, fmt.Errorf("%w: no replica directories", ErrNotSupp)
+	}
+	quorum := cfg.WriteQuorum
+	if quorum == 0 {
+		quorum = len(cfg.ReplicaDirs)/2 + 1
+	} else if quorum < 0 || quorum > len(cfg.ReplicaDirs) {
+		return nil, fmt.Errorf("write quorum %d out of range for %d replicas",
+			quorum, len(cfg.ReplicaDirs))
+	}
+	roots, err := openRoots(cfg.ReplicaDirs, quorum, replicaSuffix)
+	if err != nil {
+		return nil, err
+	}
+	replicated := &replicatedBackend{roots}
+	log.Printf("Replicating to %d roots, write quorum %d", len(replicated.roots), quorum)
+	return replicated, nil
+}
+
+// return the key of a root's record for a key.
+func replicaKey(key Key) Key {
+	key.BlobType += replicaSuffix
+	return key
+}
+
+// read one root's record for a key.
+func readReplicaRecord(root Backend, key Key) (*replicaRecord, error) {
+	content, err := blobReadInternal(root, replicaKey(key))
+	if err != nil {
+		return nil, err
+	}
+	record := new(replicaRecord)
+	if err = json.Unmarshal(content, record); err != nil ||
+		(!record.Deleted && record.BlockSize <= 0) {
+		return nil, ErrCorrupt
+	}
+	return record, nil
+}
+
+// read every root's record for a key, nil where a root has none
+// or it can't be read, and return the newest.
+func (replicated *replicatedBackend) records(key Key) ([]*replicaRecord, *replicaRecord) {
+	records := make([]*replicaRecord, len(replicated.roots))
+	var newest *replicaRecord
+	for i, root := range replicated.roots {
+		record, err := readReplicaRecord(root, key)
+		if err != nil {
+			if !errors.Is(err, ErrNoExist) {
+				log.Printf("Unreadable replica record for %s in %s: %v",
+					key, replicated.dirs[i], err)
+			}
+			continue
+		}
+		records[i] = record
+		if newest == nil || record.Version > newest.Version {
+			newest = record
+		}
+	}
+	return records, newest
+}
+
+// report whether a record describes the same content as another.
+func sameContent(record, other *replicaRecord) bool {
+	return record != nil && other != nil && !record.Deleted && !other.Deleted &&
+		record.Size == other.Size && string(record.Digest) == string(other.Digest)
+}
+
+// return the roots that may hold current content for a key, in
+// the order to try them. Keys with no records at all predate
+// replication, and are read from any root holding them.
+func (replicated *replicatedBackend) candidates(key Key) ([]int, []*replicaRecord, error) {
+	records, newest := replicated.records(key)
+	roots := []int{}
+	if newest == nil {
+		for i := range replicated.roots {
+			roots = append(roots, i)
+		}
+		return roots, records, nil
+	} else if newest.Deleted {
+		return nil, nil, ErrNoExist
+	}
+	for i, record := range records {
+		if sameContent(record, newest) {
+			roots = append(roots, i)
+		}
+	}
+	return roots, records, nil
+}
+
+// open one root's copy of a range, verified against its record
+// when it has one.
+func (replicated *replicatedBackend) openCopy(i int, record *replicaRecord, key Key,
+	offset, length int64) (io.ReadCloser, error) {
+	root := replicated.roots[i]
+	if record == nil {
+		return root.Reader(key, offset, length)
+	}
+	return openVerified(root, key, &record.Metadata, offset, length)
+}
+
+// return a reader over the first good copy of a key, which moves
+// to the next copy if reading one fails.
+func (replicated *replicatedBackend) Reader(key Key, offset, length int64) (io.ReadCloser, error) {
+	roots, records, err := replicated.candidates(key)
+	if err != nil {
+		return nil, err
+	}
+	reader := &replicatedReader{
+		backend: replicated,
+		key:     key,
+		roots:   roots,
+		records: records,
+		offset:  offset,
+		length:  length,
+	}
+	// open a copy now, so a missing key is reported here
+	if err = reader.next(); err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+// open the next copy at the current position.
+func (reader *replicatedReader) next() error {
+	err := ErrNoExist
+	for len(reader.roots) > 0 {
+		i := reader.roots[0]
+		reader.roots = reader.roots[1:]
+		length := reader.length
+		if length > 0 {
+			length -= reader.read
+		}
+		reader.source, err = reader.backend.openCopy(i, reader.records[i], reader.key,
+			reader.offset+reader.read, length)
+		if err == nil {
+			return nil
+		} else if errors.Is(err, ErrRange) {
+			return err
+		} else if !errors.Is(err, ErrNoExist) {
+			log.Printf("Failing over from copy of %s in %s: %v",
+				reader.key, reader.backend.dirs[i], err)
+		}
+	}
+	return err
+}
+
+// read from the current copy, failing over on errors. Copies are
+// verified block by block, so bytes already returned are good and
+// the next copy carries on from the same position.
+func (reader *replicatedReader) Read(data []byte) (int, error) {
+	for {
+		if reader.source == nil {
+			if err := reader.next(); errors.Is(err, ErrNoExist) && reader.failure != nil {
+				return 0, reader.failure // no copies left
+			} else if err != nil {
+				return 0, err
+			}
+		}
+		n, err := reader.source.Read(data)
+		reader.read += int64(n)
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		log.Printf("Failing over while reading %s: %v", reader.key, err)
+		reader.failure = err
+		reader.source.Close()
+		reader.source = nil
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (reader *replicatedReader) Close() error {
+	if reader.source == nil {
+		return nil
+	}
+	return reader.source.Close()
+}
+
+// return a writer copying content to every root.
+func (replicated *replicatedBackend) Writer(key Key) (Writer, error) {
+	writer := &replicatedWriter{backend: replicated, key: key}
+	live := 0
+	for i, root := range replicated.roots {
+		rootWriter, err := newSidecarWriter(root, key, replicaKey(key), nil, "", nil)
+		if err != nil {
+			log.Printf("Could not write %s to %s: %v", key, replicated.dirs[i], err)
+		} else {
+			live++
+		}
+		writer.writers = append(writer.writers, rootWriter)
+	}
+	if live < replicated.quorum {
+		writer.Abort()
+		return nil, fmt.Errorf("%w: %d of %d writable", ErrQuorum, live, replicated.quorum)
+	}
+	return writer, nil
+}
+
+// write to every root still accepting content. Roots that fail
+// drop out, and the write fails once too few are left.
+func (writer *replicatedWriter) Write(data []byte) (int, error) {
+	live := 0
+	for i, rootWriter := range writer.writers {
+		if rootWriter == nil {
+			continue
+		}
+		if _, err := rootWriter.Write(data); err != nil {
+			log.Printf("Could not write %s to %s: %v",
+				writer.key, writer.backend.dirs[i], err)
+			rootWriter.Abort()
+			writer.writers[i] = nil
+			continue
+		}
+		live++
+	}
+	if live < writer.backend.quorum {
+		return 0, fmt.Errorf("%w: %d of %d writable", ErrQuorum, live, writer.backend.quorum)
+	}
+	return len(data), nil
+}
+
+// commit on every root, succeeding if a quorum commits. Roots that
+// did commit keep the content even if the quorum is missed.
+func (writer *replicatedWriter) Commit() error {
+	version := newVersionID(time.Now())
+	committed := 0
+	for i, rootWriter := range writer.writers {
+		if rootWriter == nil {
+			continue
+		}
+		// one version on every copy, so they read as the same write
+		rootWriter.meta.Version = version
+		if err := rootWriter.Commit(); err != nil {
+			log.Printf("Could not commit %s to %s: %v",
+				writer.key, writer.backend.dirs[i], err)
+			continue
+		}
+		committed++
+	}
+	if committed < writer.backend.quorum {
+		return fmt.Errorf("%w: %d of %d committed", ErrQuorum, committed, writer.backend.quorum)
+	}
+	return nil
+}
+
+func (writer *replicatedWriter) Abort() error {
+	for _, rootWriter := range writer.writers {
+		if rootWriter != nil {
+			rootWriter.Abort()
+		}
+	}
+	return nil
+}
+
+// write a tombstone to every root, then remove its copy.
+func (replicated *replicatedBackend) Delete(key Key) error {
+	roots, _, err := replicated.candidates(key)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, i := range roots {
+		if _, err = replicated.roots[i].Stat(key); err == nil {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return ErrNoExist
+	}
+	tombstone := &replicaRecord{Deleted: true}
+	tombstone.Version = newVersionID(time.Now())
+	deleted := 0
+	for i := range replicated.roots {
+		if err = replicated.deleteCopy(i, key, tombstone); err != nil {
+			log.Printf("Could not delete %s from %s: %v", key, replicated.dirs[i], err)
+			continue
+		}
+		deleted++
+	}
+	if deleted < replicated.quorum {
+		return fmt.Errorf("%w: %d of %d deleted", ErrQuorum, deleted, replicated.quorum)
+	}
+	return nil
+}
+
+// mark one root's copy of a key deleted, then remove it.
+func (replicated *replicatedBackend) deleteCopy(i int, key Key, tombstone *replicaRecord) error {
+	root := replicated.roots[i]
+	if err := writeSidecar(root, replicaKey(key), tombstone); err != nil {
+		return err
+	}
+	err := root.Delete(key)
+	if errors.Is(err, ErrNoExist) {
+		return nil
+	}
+	return err
+}
+
+// describe the first good copy of a key.
+func (replicated *replicatedBackend) Stat(key Key) (Attrs, error) {
+	roots, _, err := replicated.candidates(key)
+	if err != nil {
+		return Attrs{}, err
+	}
+	err = ErrNoExist
+	for _, i := range roots {
+		var attrs Attrs
+		if attrs, err = replicated.roots[i].Stat(key); err == nil {
+			return attrs, nil
+		}
+	}
+	return Attrs{}, err
+}
+
+// bring every root up to date, reading at most rate bytes per
+// second (0 for no limit), and return the number of copies
+// re-copied or removed.
+func RepairReplicas(rate int64) (int, error) {
+	if blobReplicas == nil {
+		return 0, ErrNotSupp
+	}
+	return blobReplicas.repair(rate)
+}
+
+// repair every key held by any root, records included.
+func (replicated *replicatedBackend) repair(rate int64) (int, error) {
+	keys, err := replicated.allKeys()
+	if err != nil {
+		return 0, err
+	}
+	pace := &pacedReader{rate: rate, start: time.Now()}
+	repaired := 0
+	for key := range keys {
+		n, err := replicated.repairKey(key, pace)
+		if err != nil {
+			return repaired, err
+		}
+		repaired += n
+	}
+	if repaired > 0 {
+		log.Printf("Repaired %d replica copies", repaired)
+	}
+	return repaired, nil
+}
+
+// bring every root's copy of a key in line with the newest record.
+func (replicated *replicatedBackend) repairKey(key Key, pace *pacedReader) (int, error) {
+	records, newest := replicated.records(key)
+	if newest != nil && newest.Deleted {
+		return replicated.repairDeleted(key, records, newest)
+	}
+
+	// sort roots into good copies and ones needing a fresh copy
+	good, bad := []int{}, []int{}
+	for i := range replicated.roots {
+		if replicated.verifyCopy(i, records[i], newest, key, pace) {
+			good = append(good, i)
+		} else {
+			bad = append(bad, i)
+		}
+	}
+	if len(bad) == 0 {
+		return 0, nil
+	} else if len(good) == 0 {
+		log.Printf("No good copy of %s left to repair from", key)
+		return 0, nil
+	}
+	repaired := 0
+	for _, i := range bad {
+		if err := replicated.copyTo(i, good[0], records[good[0]], key, pace); err != nil {
+			log.Printf("Could not repair %s in %s: %v", key, replicated.dirs[i], err)
+			continue
+		}
+		repaired++
+	}
+	return repaired, nil
+}
+
+// report whether a root's copy of a key is current and intact.
+// Keys with no records are only checked for presence.
+func (replicated *replicatedBackend) verifyCopy(i int, record, newest *replicaRecord, key Key,
+	pace *pacedReader) bool {
+	if newest == nil {
+		_, err := replicated.roots[i].Stat(key)
+		return err == nil
+	} else if !sameContent(record, newest) {
+		return false
+	}
+	reader, err := replicated.openCopy(i, record, key, 0, 0)
+	if err != nil {
+		return false
+	}
+	defer reader.Close()
+	pace.source = reader
+	_, err = io.Copy(io.Discard, pace)
+	return err == nil
+}
+
+// replace a root's copy of a key with the copy held by another.
+func (replicated *replicatedBackend) copyTo(target, source int, record *replicaRecord, key Key,
+	pace *pacedReader) error {
+	reader, err := replicated.openCopy(source, record, key, 0, 0)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	writer, err := newSidecarWriter(replicated.roots[target], key, replicaKey(key), nil, "", nil)
+	if err != nil {
+		return err
+	}
+	pace.source = reader
+	if _, err = io.Copy(writer, pace); err != nil {
+		writer.Abort()
+		return err
+	}
+	if record != nil {
+		writer.meta.Version = record.Version
+	}
+	return writer.Commit()
+}
+
+// remove copies of a deleted key, then drop its tombstones once
+// every root has one.
+func (replicated *replicatedBackend) repairDeleted(key Key, records []*replicaRecord,
+	tombstone *replicaRecord) (int, error) {
+	repaired, settled := 0, true
+	for i, root := range replicated.roots {
+		_, err := root.Stat(key)
+		if records[i] != nil && records[i].Version == tombstone.Version && errors.Is(err, ErrNoExist) {
+			continue
+		}
+		if err = replicated.deleteCopy(i, key, tombstone); err != nil {
+			log.Printf("Could not delete %s from %s: %v", key, replicated.dirs[i], err)
+			settled = false
+			continue
+		}
+		repaired++
+	}
+	if !settled {
+		return repaired, nil
+	}
+	for _, root := range replicated.roots {
+		err := root.Delete(replicaKey(key))
+		if err != nil && !errors.Is(err, ErrNoExist) {
+			return repaired, err
+		}
+	}
+	return repaired, nil
+}
@@ -0,0 +1,198 @@
+/*
+ * Tests for replicated storage.
+ */
+
+package blob
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// configure the replicated backend over three fresh roots
+func configureReplicas(t *testing.T) *replicatedBackend {
+	if err := ConfigureBackend(ReplicatedBackend, testConfig(t)); err != nil {
+		t.Fatalf("could not configure replicated backend: %s", err)
+	}
+	return blobReplicas
+}
+
+// return the file holding a root's copy or shard of a key
+func rootPath(t *testing.T, set *rootSet, i int, key Key) string {
+	path, err := set.roots[i].(*localBackend).constructFilePath(key)
+	if err != nil {
+		t.Fatalf("no path for %s: %s", key, err)
+	}
+	return path
+}
+
+// flip a byte in a root's copy or shard of a key
+func corruptRoot(t *testing.T, set *rootSet, i int, key Key) {
+	path := rootPath(t, set, i, key)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("could not read copy: %s", err)
+	}
+	content[len(content)/2] ^= 0xff
+	if err = os.WriteFile(path, content, 0644); err != nil {
+		t.Fatalf("could not corrupt copy: %s", err)
+	}
+}
+
+// report which roots hold a good copy of a key
+func goodCopies(replicated *replicatedBackend, key Key) []bool {
+	records, newest := replicated.records(key)
+	good := []bool{}
+	for i := range replicated.roots {
+		good = append(good, replicated.verifyCopy(i, records[i], newest, key, &pacedReader{}))
+	}
+	return good
+}
+
+// test reads fail over from damaged and missing copies, and
+// writes succeed while a quorum of roots is left
+func TestReplicaFailover(t *testing.T) {
+	replicated := configureReplicas(t)
+	info, testdata := writeChecksummedBlob(t, 200*1024)
+	key := keyFromInfo(info)
+
+	corruptRoot(t, &replicated.rootSet, 0, key)
+	if err := os.RemoveAll(replicated.dirs[1]); err != nil {
+		t.Fatalf("could not remove root: %s", err)
+	}
+	content, err := readRange(info, 0, 0)
+	if err != nil {
+		t.Fatalf("could not read with two copies lost: %s", err)
+	} else if err = checkBytesEqual(content, testdata); err != nil {
+		t.Fatalf("failover read mismatch: %s", err)
+	}
+	content, err = readRange(info, 100*1024, 1000)
+	if err != nil {
+		t.Fatalf("could not read range with two copies lost: %s", err)
+	} else if err = checkBytesEqual(content, testdata[100*1024:100*1024+1000]); err != nil {
+		t.Fatalf("failover range mismatch: %s", err)
+	}
+
+	// two of three roots still take writes
+	info, testdata = writeChecksummedBlob(t, 1000)
+	if content, err = readRange(info, 0, 0); err != nil {
+		t.Fatalf("could not read back quorum write: %s", err)
+	} else if err = checkBytesEqual(content, testdata); err != nil {
+		t.Fatalf("quorum write mismatch: %s", err)
+	}
+
+	// one isn't enough
+	if err = os.RemoveAll(replicated.dirs[2]); err != nil {
+		t.Fatalf("could not remove root: %s", err)
+	}
+	if _, err = blobio.Writer(Key{Major: "a", Minor: "b", BlobType: "Raw"}); !errors.Is(err, ErrQuorum) {
+		t.Fatalf("expected ErrQuorum with one root left, got %v", err)
+	}
+}
+
+// test repair re-copies lost and damaged copies, and settles deletes
+func TestReplicaRepair(t *testing.T) {
+	replicated := configureReplicas(t)
+	info, testdata := writeChecksummedBlob(t, 100*1024)
+	key := keyFromInfo(info)
+	if repaired, err := RepairReplicas(0); err != nil || repaired != 0 {
+		t.Fatalf("expected nothing to repair, got %d, %v", repaired, err)
+	}
+
+	if err := os.Remove(rootPath(t, &replicated.rootSet, 0, key)); err != nil {
+		t.Fatalf("could not remove copy: %s", err)
+	}
+	corruptRoot(t, &replicated.rootSet, 1, key)
+	if good := goodCopies(replicated, key); good[0] || good[1] || !good[2] {
+		t.Fatalf("unexpected good copies before repair %v", good)
+	}
+	repaired, err := RepairReplicas(0)
+	if err != nil {
+		t.Fatalf("could not repair: %s", err)
+	} else if repaired != 2 {
+		t.Fatalf("expected 2 copies repaired, got %d", repaired)
+	}
+	if good := goodCopies(replicated, key); !good[0] || !good[1] || !good[2] {
+		t.Fatalf("unexpected good copies after repair %v", good)
+	}
+
+	// the repaired roots serve the blob on their own
+	if err = os.RemoveAll(replicated.dirs[2]); err != nil {
+		t.Fatalf("could not remove root: %s", err)
+	}
+	corruptRoot(t, &replicated.rootSet, 0, key)
+	content, err := readRange(info, 0, 0)
+	if err != nil {
+		t.Fatalf("could not read repaired copy: %s", err)
+	} else if err = checkBytesEqual(content, testdata); err != nil {
+		t.Fatalf("repaired copy mismatch: %s", err)
+	}
+}
+
+// test deleted keys stay deleted, and repair drops tombstones
+func TestReplicaDelete(t *testing.T) {
+	replicated := configureReplicas(t)
+	key := Key{Major: "major", Minor: "minor", BlobType: "Raw"}
+	if err := blobWriteInternal(blobio, key, []byte("content")); err != nil {
+		t.Fatalf("could not write: %s", err)
+	}
+
+	// a root that misses the delete can't bring the key back
+	stale, err := os.ReadFile(rootPath(t, &replicated.rootSet, 0, key))
+	if err != nil {
+		t.Fatalf("could not read copy: %s", err)
+	}
+	if err = blobio.Delete(key); err != nil {
+		t.Fatalf("could not delete: %s", err)
+	}
+	if err = os.WriteFile(rootPath(t, &replicated.rootSet, 0, key), stale, 0644); err != nil {
+		t.Fatalf("could not restore stale copy: %s", err)
+	}
+	if _, err = blobio.Stat(key); !errors.Is(err, ErrNoExist) {
+		t.Fatalf("expected ErrNoExist after delete, got %v", err)
+	}
+	if err = blobio.Delete(key); !errors.Is(err, ErrNoExist) {
+		t.Fatalf("expected ErrNoExist on second delete, got %v", err)
+	}
+
+	if _, err = RepairReplicas(0); err != nil {
+		t.Fatalf("could not repair: %s", err)
+	}
+	for i, root := range replicated.roots {
+		keys, err := root.List("", Key{}, DefaultPageSize)
+		if err != nil {
+			t.Fatalf("could not list root %d: %s", i, err)
+		} else if len(keys) != 0 {
+			t.Fatalf("root %d still holds %v", i, keys)
+		}
+	}
+}
+
+// test the write quorum must fit the replicas
+func TestReplicaQuorum(t *testing.T) {
+	config := testConfig(t)
+	config.WriteQuorum = 4
+	if err := ConfigureBackend(ReplicatedBackend, config); err == nil {
+		t.Fatalf("expected an error for a quorum above the replica count")
+	}
+	config.ReplicaDirs = nil
+	if err := ConfigureBackend(ReplicatedBackend, config); !errors.Is(err, ErrNotSupp) {
+		t.Fatalf("expected ErrNotSupp with no replicas, got %v", err)
+	}
+}
+
+// test repair paces its reads of every copy to the given rate
+func TestReplicaRepairPaced(t *testing.T) {
+	configureReplicas(t)
+	writeChecksummedBlob(t, 64*1024)
+	start := time.Now()
+	if _, err := RepairReplicas(1 << 20); err != nil {
+		t.Fatalf("could not repair: %s", err)
+	}
+	// three copies of 64KiB at 1MiB/s take at least 3/16s
+	if elapsed := time.Since(start); elapsed < 3*time.Second/16 {
+		t.Fatalf("expected paced repair, took %s", elapsed)
+	}
+}
@@ -0,0 +1,121 @@
+/*
+ * Sets of local storage roots, shared by backends that spread
+ * each key over several roots.
+ */
+
+package blob
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// Local roots, each holding a per-root record next to its copy
+// or part of every key.
+type rootSet struct {
+	roots  []Backend // local backend of each root.
+	dirs   []string  // directories of the roots, for logging.
+	quorum int       // roots that must commit a write.
+	suffix string    // blob type suffix of record keys.
+}
+
+// open a local backend in each directory.
+func openRoots(dirs []string, quorum int, suffix string) (rootSet, error) {
+	set := rootSet{dirs: dirs, quorum: quorum, suffix: suffix}
+	for _, dir := range dirs {
+		root, err := newLocalBackend(&Config{LocalDirectory: dir})
+		if err != nil {
+			return rootSet{}, err
+		}
+		set.roots = append(set.roots, root)
+	}
+	return set, nil
+}
+
+// list keys held by any root, hiding records. Every root lists in
+// flat name order, so merging the first page of each gives the
+// first page of the union. Deleted keys a root still holds are
+// listed until repaired.
+func (set *rootSet) List(major string, after Key, limit int) ([]Key, error) {
+	lists := [][]Key{}
+	for i, root := range set.roots {
+		keys, err := set.listRoot(root, major, after, limit)
+		if err != nil {
+			log.Printf("Could not list %s: %v", set.dirs[i], err)
+			continue
+		}
+		lists = append(lists, keys)
+	}
+	if len(lists) < set.quorum {
+		return nil, fmt.Errorf("%w: %d of %d listable", ErrQuorum, len(lists), set.quorum)
+	}
+	return mergeKeys(lists, limit), nil
+}
+
+// merge listings into the first limit distinct keys in name order.
+func mergeKeys(lists [][]Key, limit int) []Key {
+	seen := map[Key]bool{}
+	for _, list := range lists {
+		for _, key := range list {
+			seen[key] = true
+		}
+	}
+	keys := make([]Key, 0, len(seen))
+	for key := range seen {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(a, b int) bool {
+		return encodeKey(keys[a]) < encodeKey(keys[b])
+	})
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys
+}
+
+// list up to limit keys of one root, skipping records.
+func (set *rootSet) listRoot(root Backend, major string, after Key, limit int) ([]Key, error) {
+	keys := []Key{}
+	for len(keys) < limit {
+		want := limit - len(keys)
+		page, err := root.List(major, after, want)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range page {
+			if !strings.HasSuffix(key.BlobType, set.suffix) {
+				keys = append(keys, key)
+			}
+		}
+		if len(page) < want {
+			break
+		}
+		after = page[len(page)-1]
+	}
+	return keys, nil
+}
+
+// return every key any root holds content or a record for.
+func (set *rootSet) allKeys() (map[Key]bool, error) {
+	keys := map[Key]bool{}
+	for _, root := range set.roots {
+		after := Key{}
+		for {
+			page, err := root.List("", after, DefaultPageSize)
+			if err != nil {
+				return nil, err
+			}
+			for _, key := range page {
+				key.BlobType = strings.TrimSuffix(key.BlobType, set.suffix)
+				keys[key] = true
+			}
+			if len(page) < DefaultPageSize {
+				break
+			}
+			after = page[len(page)-1]
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,446 @@
+/*
+ * S3-compatible object store backend.
+ */
+
+/*
+ * Buckets written before key parts were escaped for flat names
+ * hold objects named with URL path escaping, which leaves "." in
+ * place. Where a key's old and new object keys differ, the old one
+ * is read when the new one doesn't exist, and removed once the blob
+ * is rewritten or deleted.
+ */
+
+package blob
+
+import (
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"strings"
+)
+
+// default size of each part of a multipart upload.
+const defaultS3PartSize = 8 * 1024 * 1024
+
+// largest object copied in a single request.
+const s3CopyLimit = 5 * 1024 * 1024 * 1024
+
+type s3Backend struct {
+	client   *s3.Client // object store client.
+	bucket   string     // bucket holding all blobs.
+	prefix   string     // object key prefix for all blobs.
+	partSize int        // bytes per multipart upload part.
+}
+
+type s3Writer struct {
+	backend  *s3Backend            // owning backend.
+	object   string                // destination object key.
+	legacy   string                // old object key, removed on commit.
+	buffer   []byte                // content not yet uploaded.
+	uploadID *string               // multipart upload, once started.
+	parts    []types.CompletedPart // parts uploaded so far.
+}
+
+func init() {
+	RegisterBackend(S3Backend, newS3Backend)
+}
+
+// create a backend storing blobs as objects in an S3 bucket.
+func newS3Backend(cfg *Config) (Backend, error) {
+	if cfg.S3Bucket == "" {
+		return nil, fmt.Errorf("s3 backend requires a bucket")
+	}
+	opts := s3.Options{
+		Region:       cfg.S3Region,
+		UsePathStyle: cfg.S3PathStyle,
+		Credentials:  aws.AnonymousCredentials{},
+	}
+	if opts.Region == "" {
+		opts.Region = "us-east-1"
+	}
+	if cfg.S3Endpoint != "" {
+		opts.BaseEndpoint = aws.String(cfg.S3Endpoint)
+	}
+	if cfg.S3AccessKey != "" {
+		creds := aws.Credentials{
+			AccessKeyID:     cfg.S3AccessKey,
+			SecretAccessKey: cfg.S3SecretKey,
+		}
+		opts.Credentials = aws.CredentialsProviderFunc(
+			func(context.Context) (aws.Credentials, error) {
+				return creds, nil
+			})
+	}
+	backend := &s3Backend{
+		client:   s3.New(opts),
+		bucket:   cfg.S3Bucket,
+		prefix:   cfg.S3Prefix,
+		partSize: cfg.S3PartSize,
+	}
+	if backend.partSize <= 0 {
+		backend.partSize = defaultS3PartSize
+	}
+
+	// fail fast if the bucket is unreachable
+	log.Printf("Checking object store bucket %s", backend.bucket)
+	_, err := backend.client.HeadBucket(context.Background(),
+		&s3.HeadBucketInput{Bucket: aws.String(backend.bucket)})
+	if err != nil {
+		return nil, fmt.Errorf("could not reach bucket %s: %w",
+			backend.bucket, err)
+	}
+	return backend, nil
+}
+
+// map a blob key to an object key. The major key becomes a
+// "directory" so all blobs under a major key share a prefix.
+func (backend *s3Backend) objectKey(key Key) string {
+	return backend.majorPrefix(key.Major) +
+		escapeKeyPart(key.Minor) + "." + key.BlobType
+}
+
+// map a blob key to the object key it had before key parts were
+// escaped for flat names, if that differs from its object key now.
+func (backend *s3Backend) legacyObjectKey(key Key) (string, bool) {
+	object := backend.majorPrefix("") + url.PathEscape(key.Major) + "/" +
+		url.PathEscape(key.Minor) + "." + key.BlobType
+	return object, object != backend.objectKey(key)
+}
+
+// return the object key holding a blob, which is its legacy one
+// if only that exists.
+func (backend *s3Backend) existingObject(key Key) (string, error) {
+	object := backend.objectKey(key)
+	_, err := backend.head(object)
+	if legacy, ok := backend.legacyObjectKey(key); ok && errors.Is(err, ErrNoExist) {
+		if _, err = backend.head(legacy); err == nil {
+			return legacy, nil
+		}
+	}
+	return object, err
+}
+
+// remove the legacy object of a blob that has been replaced.
+// Deletes of missing objects succeed.
+func (backend *s3Backend) removeLegacy(legacy string) error {
+	_, err := backend.client.DeleteObject(context.Background(),
+		&s3.DeleteObjectInput{
+			Bucket: aws.String(backend.bucket),
+			Key:    aws.String(legacy),
+		})
+	return s3Error(err)
+}
+
+// return the object key prefix shared by a major key, or by
+// all blobs if major is empty.
+func (backend *s3Backend) majorPrefix(major string) string {
+	prefix := ""
+	if backend.prefix != "" {
+		prefix = strings.TrimSuffix(backend.prefix, "/") + "/"
+	}
+	if major != "" {
+		prefix += escapeKeyPart(major) + "/"
+	}
+	return prefix
+}
+
+// parse an object key produced by objectKey.
+func (backend *s3Backend) parseObjectKey(object string) (Key, bool) {
+	object, ok := strings.CutPrefix(object, backend.majorPrefix(""))
+	if !ok {
+		return Key{}, false
+	}
+	major, name, ok := strings.Cut(object, "/")
+	if !ok {
+		return Key{}, false
+	}
+	return decodeKey(major + "." + name)
+}
+
+// open the object holding the blob, fetching only the range.
+func (backend *s3Backend) Reader(key Key, offset, length int64) (io.ReadCloser, error) {
+	object := backend.objectKey(key)
+	log.Printf("Reading object content from %s/%s", backend.bucket, object)
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(backend.bucket),
+		Key:    aws.String(object),
+	}
+	if length > 0 {
+		input.Range = aws.String(
+			fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	} else if offset > 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-", offset))
+	}
+	out, err := backend.client.GetObject(context.Background(), input)
+	if legacy, ok := backend.legacyObjectKey(key); ok && errors.Is(s3Error(err), ErrNoExist) {
+		object, input.Key = legacy, aws.String(legacy)
+		out, err = backend.client.GetObject(context.Background(), input)
+	}
+	if errors.Is(s3Error(err), ErrRange) {
+		// S3 rejects ranges starting at the end of the object,
+		// which other backends treat as an empty read
+		return backend.emptyAtEnd(object, offset)
+	} else if err != nil {
+		return nil, s3Error(err)
+	}
+	return out.Body, nil
+}
+
+// return an empty reader if offset is exactly the object size.
+func (backend *s3Backend) emptyAtEnd(object string, offset int64) (io.ReadCloser, error) {
+	out, err := backend.client.HeadObject(context.Background(),
+		&s3.HeadObjectInput{
+			Bucket: aws.String(backend.bucket),
+			Key:    aws.String(object),
+		})
+	if err != nil {
+		return nil, s3Error(err)
+	} else if aws.ToInt64(out.ContentLength) != offset {
+		return nil, ErrRange
+	}
+	return io.NopCloser(bytes.NewReader(nil)), nil
+}
+
+// start an upload of the blob. Content is buffered one part
+// at a time, switching to a multipart upload once it exceeds
+// a single part.
+func (backend *s3Backend) Writer(key Key) (Writer, error) {
+	object := backend.objectKey(key)
+	log.Printf("Writing object content to %s/%s", backend.bucket, object)
+	legacy, ok := backend.legacyObjectKey(key)
+	if !ok {
+		legacy = ""
+	}
+	return &s3Writer{
+		backend: backend,
+		object:  object,
+		legacy:  legacy,
+		buffer:  make([]byte, 0, backend.partSize),
+	}, nil
+}
+
+// buffer data, uploading a part each time the buffer fills.
+func (writer *s3Writer) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		space := cap(writer.buffer) - len(writer.buffer)
+		if space > len(data) {
+			space = len(data)
+		}
+		writer.buffer = append(writer.buffer, data[:space]...)
+		data = data[space:]
+		written += space
+		if len(writer.buffer) == cap(writer.buffer) {
+			if err := writer.uploadPart(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// upload the buffered content as the next multipart part.
+func (writer *s3Writer) uploadPart() error {
+	backend, ctx := writer.backend, context.Background()
+	if writer.uploadID == nil {
+		out, err := backend.client.CreateMultipartUpload(ctx,
+			&s3.CreateMultipartUploadInput{
+				Bucket: aws.String(backend.bucket),
+				Key:    aws.String(writer.object),
+			})
+		if err != nil {
+			return s3Error(err)
+		}
+		writer.uploadID = out.UploadId
+	}
+	number := int32(len(writer.parts) + 1)
+	out, err := backend.client.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:     aws.String(backend.bucket),
+		Key:        aws.String(writer.object),
+		UploadId:   writer.uploadID,
+		PartNumber: aws.Int32(number),
+		Body:       bytes.NewReader(writer.buffer),
+	})
+	if err != nil {
+		return s3Error(err)
+	}
+	writer.parts = append(writer.parts, types.CompletedPart{
+		ETag:       out.ETag,
+		PartNumber: aws.Int32(number),
+	})
+	writer.buffer = writer.buffer[:0]
+	return nil
+}
+
+// upload any remaining content and finalize the object, then
+// remove any legacy object it replaces.
+func (writer *s3Writer) Commit() error {
+	if err := writer.complete(); err != nil {
+		return err
+	} else if writer.legacy != "" {
+		return writer.backend.removeLegacy(writer.legacy)
+	}
+	return nil
+}
+
+// upload any remaining content and finalize the object.
+func (writer *s3Writer) complete() error {
+	backend, ctx := writer.backend, context.Background()
+	// small objects never start a multipart upload
+	if writer.uploadID == nil {
+		_, err := backend.client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(backend.bucket),
+			Key:    aws.String(writer.object),
+			Body:   bytes.NewReader(writer.buffer),
+		})
+		return s3Error(err)
+	}
+	if len(writer.buffer) > 0 {
+		if err := writer.uploadPart(); err != nil {
+			return err
+		}
+	}
+	_, err := backend.client.CompleteMultipartUpload(ctx,
+		&s3.CompleteMultipartUploadInput{
+			Bucket:   aws.String(backend.bucket),
+			Key:      aws.String(writer.object),
+			UploadId: writer.uploadID,
+			MultipartUpload: &types.CompletedMultipartUpload{
+				Parts: writer.parts,
+			},
+		})
+	return s3Error(err)
+}
+
+// discard buffered content and any uploaded parts.
+func (writer *s3Writer) Abort() error {
+	backend := writer.backend
+	writer.buffer = writer.buffer[:0]
+	if writer.uploadID == nil {
+		return nil
+	}
+	_, err := backend.client.AbortMultipartUpload(context.Background(),
+		&s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(backend.bucket),
+			Key:      aws.String(writer.object),
+			UploadId: writer.uploadID,
+		})
+	return s3Error(err)
+}
+
+// delete the object holding the blob, and any legacy object
+// behind it. S3 deletes succeed even for missing objects, so check
+// for existence first.
+func (backend *s3Backend) Delete(key Key) error {
+	object, err := backend.existingObject(key)
+	if err != nil {
+		return err
+	}
+	log.Printf("Deleting object %s/%s", backend.bucket, object)
+	_, err = backend.client.DeleteObject(context.Background(),
+		&s3.DeleteObjectInput{
+			Bucket: aws.String(backend.bucket),
+			Key:    aws.String(object),
+		})
+	if legacy, ok := backend.legacyObjectKey(key); ok && err == nil && legacy != object {
+		return backend.removeLegacy(legacy)
+	}
+	return s3Error(err)
+}
+
+// copy the object holding a blob within the store, so its content
+// doesn't pass through the server. Objects too large to copy in
+// one request are streamed instead.
+func (backend *s3Backend) Clone(from, to Key) error {
+	source, err := backend.existingObject(from)
+	if err != nil {
+		return err
+	}
+	attrs, err := backend.head(source)
+	if err != nil {
+		return err
+	} else if attrs.Size > s3CopyLimit {
+		return streamContent(backend, from, to)
+	}
+	object := backend.objectKey(to)
+	log.Printf("Copying object %s/%s to %s", backend.bucket, source, object)
+	_, err = backend.client.CopyObject(context.Background(), &s3.CopyObjectInput{
+		Bucket:     aws.String(backend.bucket),
+		Key:        aws.String(object),
+		CopySource: aws.String(url.PathEscape(backend.bucket + "/" + source)),
+	})
+	if legacy, ok := backend.legacyObjectKey(to); ok && err == nil {
+		return backend.removeLegacy(legacy)
+	}
+	return s3Error(err)
+}
+
+// describe the object holding the blob.
+func (backend *s3Backend) Stat(key Key) (Attrs, error) {
+	attrs, err := backend.head(backend.objectKey(key))
+	if legacy, ok := backend.legacyObjectKey(key); ok && errors.Is(err, ErrNoExist) {
+		return backend.head(legacy)
+	}
+	return attrs, err
+}
+
+// describe an object.
+func (backend *s3Backend) head(object string) (Attrs, error) {
+	out, err := backend.client.HeadObject(context.Background(),
+		&s3.HeadObjectInput{
+			Bucket: aws.String(backend.bucket),
+			Key:    aws.String(object),
+		})
+	if err != nil {
+		return Attrs{}, s3Error(err)
+	}
+	return Attrs{
+		Size:    aws.ToInt64(out.ContentLength),
+		ModTime: aws.ToTime(out.LastModified),
+	}, nil
+}
+
+// list objects in object key order, a page at a time.
+func (backend *s3Backend) List(major string, after Key, limit int) ([]Key, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(backend.bucket),
+		Prefix:  aws.String(backend.majorPrefix(major)),
+		MaxKeys: aws.Int32(int32(limit)),
+	}
+	if after != (Key{}) {
+		input.StartAfter = aws.String(backend.objectKey(after))
+	}
+	out, err := backend.client.ListObjectsV2(context.Background(), input)
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	keys := []Key{}
+	for _, object := range out.Contents {
+		if key, ok := backend.parseObjectKey(aws.ToString(object.Key)); ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// translate object store errors into blob errors.
+func s3Error(err error) error {
+	var noSuchKey *types.NoSuchKey
+	var notFound *types.NotFound
+	var apiErr smithy.APIError
+	if errors.As(err, &noSuchKey) || errors.As(err, &notFound) {
+		return ErrNoExist
+	} else if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidRange" {
+		return ErrRange
+	}
+	return err
+}
@@ -0,0 +1,169 @@
+/*
+ * Tests for the object store backend, against a fake S3 server.
+ */
+
+package blob
+
+import (
+	"github.com/pleb/prod/horrea/main/blob/fakes3"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+// create an object store backend against a fresh fake server
+func createTestS3Backend(t *testing.T, partSize int) (*s3Backend, *fakes3.Server) {
+	fake := fakes3.NewServer()
+	t.Cleanup(fake.Close)
+	backend, err := newS3Backend(&Config{
+		S3Endpoint:  fake.URL,
+		S3Bucket:    "horrea-test",
+		S3Prefix:    "blobs/",
+		S3PathStyle: true,
+		S3PartSize:  partSize,
+	})
+	if err != nil {
+		t.Fatalf("could not create s3 backend: %s", err)
+	}
+	return backend.(*s3Backend), fake
+}
+
+// test that blob keys map onto per-major object key prefixes
+func TestS3ObjectKeys(t *testing.T) {
+	backend, fake := createTestS3Backend(t, 0)
+	keys := []Key{
+		{Major: "1234", Minor: "5678", BlobType: "Raw"},
+		{Major: "a/b", Minor: "..", BlobType: "Raw"},
+	}
+	for _, key := range keys {
+		if err := blobWriteInternal(backend, key, []byte("data")); err != nil {
+			t.Fatalf("could not write %s: %s", key, err)
+		}
+	}
+	objects := fake.Keys("horrea-test")
+	expected := []string{"blobs/1234/5678.Raw", "blobs/a%2Fb/%2E%2E.Raw"}
+	if len(objects) != len(expected) {
+		t.Fatalf("expected objects %v, found %v", expected, objects)
+	}
+	for i := range expected {
+		if objects[i] != expected[i] {
+			t.Fatalf("expected object %s, found %s", expected[i], objects[i])
+		}
+	}
+}
+
+// test objects written under the old object key escaping are
+// still found, and go once their blob is replaced or deleted
+func TestS3LegacyObjectKeys(t *testing.T) {
+	backend, fake := createTestS3Backend(t, 0)
+	keys := []Key{
+		{Major: "v1.2", Minor: "file.txt", BlobType: "Raw"},
+		{Major: "v1.2", Minor: "other.txt", BlobType: "Raw"},
+	}
+	for _, key := range keys {
+		legacy, ok := backend.legacyObjectKey(key)
+		if !ok {
+			t.Fatalf("expected %s to have a legacy object key", key)
+		}
+		_, err := backend.client.PutObject(context.Background(), &s3.PutObjectInput{
+			Bucket: aws.String(backend.bucket),
+			Key:    aws.String(legacy),
+			Body:   bytes.NewReader([]byte("legacy")),
+		})
+		if err != nil {
+			t.Fatalf("could not put legacy object: %s", err)
+		}
+		content, err := blobReadInternal(backend, key)
+		if err != nil || string(content) != "legacy" {
+			t.Fatalf("expected legacy content for %s, got %q, %v", key, content, err)
+		}
+		if attrs, err := backend.Stat(key); err != nil || attrs.Size != 6 {
+			t.Fatalf("unexpected legacy stat %+v, %v", attrs, err)
+		}
+	}
+
+	if err := blobWriteInternal(backend, keys[0], []byte("new")); err != nil {
+		t.Fatalf("could not rewrite %s: %s", keys[0], err)
+	}
+	if err := backend.Delete(keys[1]); err != nil {
+		t.Fatalf("could not delete legacy blob: %s", err)
+	}
+	objects := fake.Keys("horrea-test")
+	if len(objects) != 1 || objects[0] != backend.objectKey(keys[0]) {
+		t.Fatalf("expected only the rewritten object, found %v", objects)
+	}
+	if _, err := backend.Stat(keys[1]); !errors.Is(err, ErrNoExist) {
+		t.Fatalf("expected deleted legacy blob gone, got %v", err)
+	}
+}
+
+// test that large blobs are uploaded in multiple parts
+func TestS3MultipartUpload(t *testing.T) {
+	partSize := 64 * 1024
+	backend, fake := createTestS3Backend(t, partSize)
+	key := Key{Major: "major", Minor: "minor", BlobType: "Raw"}
+
+	// several full parts plus a short final part
+	testdata := make([]byte, 5*partSize+123)
+	for b := range testdata {
+		testdata[b] = byte(rand.Intn(256))
+	}
+	writer, err := backend.Writer(key)
+	if err != nil {
+		t.Fatalf("could not open writer: %s", err)
+	}
+	for start := 0; start < len(testdata); start += 1000 {
+		end := min(start+1000, len(testdata))
+		if _, err = writer.Write(testdata[start:end]); err != nil {
+			t.Fatalf("could not write data: %s", err)
+		}
+	}
+	if parts := len(writer.(*s3Writer).parts); parts != 5 {
+		t.Fatalf("expected 5 parts uploaded before commit, found %d", parts)
+	}
+	if err = writer.Commit(); err != nil {
+		t.Fatalf("could not commit upload: %s", err)
+	}
+	if fake.PendingUploads() != 0 {
+		t.Fatalf("multipart upload was not completed")
+	}
+
+	// content should match what was written
+	content, err := blobReadInternal(backend, key)
+	if err != nil {
+		t.Fatalf("could not read back blob: %s", err)
+	}
+	if err = checkBytesEqual(content, testdata); err != nil {
+		t.Fatalf("read content != test data, %s", err)
+	}
+}
+
+// test that aborted uploads leave nothing behind
+func TestS3AbortUpload(t *testing.T) {
+	partSize := 64 * 1024
+	backend, fake := createTestS3Backend(t, partSize)
+	key := Key{Major: "major", Minor: "minor", BlobType: "Raw"}
+
+	writer, err := backend.Writer(key)
+	if err != nil {
+		t.Fatalf("could not open writer: %s", err)
+	}
+	if _, err = writer.Write(make([]byte, 3*partSize)); err != nil {
+		t.Fatalf("could not write data: %s", err)
+	}
+	if err = writer.Abort(); err != nil {
+		t.Fatalf("could not abort upload: %s", err)
+	}
+	if fake.PendingUploads() != 0 {
+		t.Fatalf("multipart upload was not aborted")
+	}
+	if _, err = backend.Reader(key, 0, 0); !errors.Is(err, ErrNoExist) {
+		t.Fatalf("expected ErrNoExist after abort, got %v", err)
+	}
+}
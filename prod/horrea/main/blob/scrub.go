@@ -0,0 +1,244 @@
+/*
+ * Background scrubbing of stored content.
+ */
+
+/*
+ * A scrub walks every sidecar in the backend and reads the content
+ * it describes back through the verifying reader, checking each
+ * block's checksum and the digest of the whole. Reads are paced to
+ * a byte rate so a scrub doesn't starve clients of the backend.
+ * They are quiet reads, going below any read cache and leaving
+ * blobs in the tier they are stored in, so it's the stored copy that
+ * is verified, and a pass doesn't evict what clients are reading or
+ * move cold blobs back hot.
+ *
+ * Corrupt blobs are quarantined: their content and sidecar are
+ * copied as stored under a reserved major key, then removed from
+ * their own key, so clients stop being served them and they can
+ * still be inspected or restored by hand. The sidecar is re-read
+ * under its lock before anything moves, so content rewritten since
+ * it was verified is left alone.
+ *
+ * Each scrub's report is persisted, so the last one survives
+ * restarts. Blobs without sidecars predate checksums and can't be
+ * verified, and sidecars without content are left by interrupted
+ * deletes, so both are passed over.
+ */
+
+package blob
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// major key of quarantined content.
+const quarantineMajor = ".quarantine"
+
+// blob types of quarantined content and sidecars.
+const (
+	quarantineContent = "content"
+	quarantineSidecar = "sidecar"
+)
+
+// key of the last scrub report.
+var scrubReportKey = Key{Major: ".scrub", Minor: "last", BlobType: "report"}
+
+// Problem found with a stored blob.
+type ScrubFinding struct {
+	Key         Key    `json:"key"`                  // blob key.
+	Version     string `json:"version,omitempty"`    // old version, if not current.
+	Error       string `json:"error"`                // what was wrong.
+	Quarantined bool   `json:"quarantined"`          // moved out of the way?
+	Quarantine  string `json:"quarantine,omitempty"` // minor key in quarantine.
+}
+
+// Results of one pass over the backend.
+type ScrubReport struct {
+	Started  time.Time      `json:"started"`  // time the scrub began.
+	Finished time.Time      `json:"finished"` // time the scrub ended.
+	Blobs    int64          `json:"blobs"`    // blobs verified.
+	Bytes    int64          `json:"bytes"`    // content bytes verified.
+	Findings []ScrubFinding `json:"findings"` // blobs that failed.
+}
+
+// reader limited to an average byte rate.
+type pacedReader struct {
+	source io.Reader // content being read.
+	rate   int64     // bytes per second, 0 for no limit.
+	start  time.Time // time pacing began.
+	read   int64     // bytes read since then.
+}
+
+func (reader *pacedReader) Read(data []byte) (int, error) {
+	n, err := reader.source.Read(data)
+	reader.charge(int64(n))
+	return n, err
+}
+
+// count bytes read by other means against the rate, waiting until
+// they are due.
+func (reader *pacedReader) charge(n int64) {
+	reader.read += n
+	if reader.rate > 0 {
+		due := reader.start.Add(time.Duration(reader.read * int64(time.Second) / reader.rate))
+		if wait := time.Until(due); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+}
+
+// verify every stored blob, reading at most rate bytes per second
+// (0 for no limit), and quarantine those that are corrupt. The
+// report is persisted as well as returned.
+func Scrub(rate int64) (*ScrubReport, error) {
+	if blobio == nil {
+		return nil, ErrNotSupp
+	}
+	report := &ScrubReport{Started: time.Now(), Findings: []ScrubFinding{}}
+	pace := &pacedReader{rate: rate, start: report.Started}
+	after := Key{}
+	for {
+		keys, err := blobio.List("", after, DefaultPageSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			blobType, ok := strings.CutSuffix(key.BlobType, metadataSuffix)
+			if !ok {
+				continue
+			}
+			key.BlobType = blobType
+			scrubKey(report, key, pace)
+		}
+		if len(keys) < DefaultPageSize {
+			break
+		}
+		after = keys[len(keys)-1]
+	}
+	report.Finished = time.Now()
+	report.Bytes = pace.read
+	log.Printf("Scrubbed %d blobs, %d bytes, found %d bad",
+		report.Blobs, report.Bytes, len(report.Findings))
+	return report, writeSidecar(blobio, scrubReportKey, report)
+}
+
+// return the report of the last scrub.
+func LastScrub() (*ScrubReport, error) {
+	if blobio == nil {
+		return nil, ErrNotSupp
+	}
+	content, err := blobReadInternal(blobio, scrubReportKey)
+	if err != nil {
+		return nil, err
+	}
+	report := new(ScrubReport)
+	if err = json.Unmarshal(content, report); err != nil {
+		return nil, ErrCorrupt
+	}
+	return report, nil
+}
+
+// verify one blob, quarantining it if corrupt, and add the result
+// to the report.
+func scrubKey(report *ScrubReport, key Key, pace *pacedReader) {
+	sidecar, err := verifyStored(key, pace)
+	if errors.Is(err, ErrNoExist) {
+		return
+	}
+	report.Blobs++
+	if err == nil {
+		return
+	}
+	finding := ScrubFinding{Key: key, Error: err.Error()}
+	if base, version, ok := parseVersionKey(key); ok {
+		finding.Key, finding.Version = base, version
+	}
+	// blobs that can't be read for other reasons, such as a
+	// missing master key, aren't known to be bad
+	if errors.Is(err, ErrCorrupt) || errors.Is(err, ErrDigest) {
+		log.Printf("Scrub found %s corrupt: %v", key, err)
+		finding.Quarantine, err = quarantine(key, sidecar)
+		if err != nil {
+			log.Printf("Could not quarantine %s: %v", key, err)
+			finding.Error += "; not quarantined: " + err.Error()
+		}
+		finding.Quarantined = finding.Quarantine != ""
+	}
+	report.Findings = append(report.Findings, finding)
+}
+
+// return the quiet view of the backend, reading stored content
+// below any cache and from whichever tier holds it.
+func storedBackend() Backend {
+	return quiet(blobio)
+}
+
+// read a blob's content back against its sidecar, returning the
+// sidecar as stored.
+func verifyStored(key Key, pace *pacedReader) ([]byte, error) {
+	stored := storedBackend()
+	sidecar, err := blobReadInternal(stored, metadataKey(key))
+	if err != nil {
+		return nil, err
+	}
+	meta, err := parseMetadata(sidecar)
+	if err != nil {
+		return sidecar, err
+	}
+	reader, err := openVerified(stored, key, meta, 0, 0)
+	if err != nil {
+		return sidecar, err
+	}
+	defer reader.Close()
+	digest := sha256.New()
+	pace.source = reader
+	if _, err = io.Copy(digest, pace); err != nil {
+		return sidecar, err
+	}
+	if len(meta.Digest) > 0 && !bytes.Equal(digest.Sum(nil), meta.Digest) {
+		return sidecar, ErrDigest
+	}
+	return sidecar, nil
+}
+
+// move a corrupt blob's content and sidecar into quarantine,
+// unless its sidecar no longer matches the one verified. Returns
+// the minor key it was moved to, empty if it wasn't moved.
+func quarantine(key Key, sidecar []byte) (string, error) {
+	defer lockSidecar(key)()
+	current, err := blobReadInternal(storedBackend(), metadataKey(key))
+	if errors.Is(err, ErrNoExist) {
+		return "", nil // deleted since verified
+	} else if err != nil {
+		return "", err
+	} else if !bytes.Equal(current, sidecar) {
+		return "", nil // rewritten since verified
+	}
+
+	minor := hex.EncodeToString([]byte(encodeKey(key)))
+	held := Key{Major: quarantineMajor, Minor: minor, BlobType: quarantineContent}
+	if err = cloneContent(blobio, key, held); err != nil && !errors.Is(err, ErrNoExist) {
+		return "", err
+	}
+	held.BlobType = quarantineSidecar
+	if err = blobWriteInternal(blobio, held, sidecar); err != nil {
+		return "", err
+	}
+	// content goes first, so a crash leaves only an orphan sidecar
+	if err = blobio.Delete(key); err != nil && !errors.Is(err, ErrNoExist) {
+		return "", err
+	}
+	err = blobio.Delete(metadataKey(key))
+	if err != nil && !errors.Is(err, ErrNoExist) {
+		return "", err
+	}
+	return minor, nil
+}
@@ -0,0 +1,164 @@
+/*
+ * Tests for background scrubbing.
+ */
+
+package blob
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+)
+
+// test scrubs find and quarantine damaged content and sidecars,
+// against every backend
+func TestScrubQuarantine(t *testing.T) {
+	for _, name := range Backends() {
+		t.Run(name, func(t *testing.T) {
+			if err := ConfigureBackend(name, testConfig(t)); err != nil {
+				t.Fatalf("could not configure %s backend: %s", name, err)
+			}
+			testScrubQuarantine(t)
+		})
+	}
+}
+
+// damage one blob's content and another's digest, then scrub
+func testScrubQuarantine(t *testing.T) {
+	sound, testdata := writeChecksummedBlob(t, 2*checksumBlockSize)
+	damaged, _ := writeChecksummedBlob(t, 2*checksumBlockSize)
+	edited, _ := writeChecksummedBlob(t, 1000)
+	if report, err := Scrub(0); err != nil {
+		t.Fatalf("could not scrub: %s", err)
+	} else if report.Blobs != 3 || len(report.Findings) != 0 {
+		t.Fatalf("expected 3 sound blobs, got %+v", report)
+	}
+
+	corrupt := append([]byte{}, testdata...)
+	corrupt[checksumBlockSize+10] ^= 0x01
+	if err := blobWriteInternal(blobio, keyFromInfo(damaged), corrupt); err != nil {
+		t.Fatalf("could not overwrite content: %s", err)
+	}
+	meta, err := readMetadata(blobio, keyFromInfo(edited))
+	if err != nil {
+		t.Fatalf("could not read sidecar: %s", err)
+	}
+	meta.Digest[0] ^= 0x01
+	if err = writeMetadata(blobio, keyFromInfo(edited), meta); err != nil {
+		t.Fatalf("could not edit sidecar: %s", err)
+	}
+
+	report, err := Scrub(0)
+	if err != nil {
+		t.Fatalf("could not scrub: %s", err)
+	} else if report.Blobs != 3 || len(report.Findings) != 2 {
+		t.Fatalf("expected 2 of 3 blobs bad, got %+v", report)
+	}
+	for _, finding := range report.Findings {
+		if !finding.Quarantined {
+			t.Fatalf("%s not quarantined: %s", finding.Key, finding.Error)
+		}
+		held := Key{Major: quarantineMajor, Minor: finding.Quarantine, BlobType: quarantineSidecar}
+		if _, err = blobio.Stat(held); err != nil {
+			t.Fatalf("no quarantined sidecar for %s: %s", finding.Key, err)
+		}
+	}
+	if _, err = readRange(damaged, 0, 0); !errors.Is(err, ErrNoExist) {
+		t.Fatalf("expected quarantined blob gone, got %v", err)
+	}
+	if _, err = readRange(edited, 0, 0); !errors.Is(err, ErrNoExist) {
+		t.Fatalf("expected quarantined blob gone, got %v", err)
+	}
+	held := Key{
+		Major:    quarantineMajor,
+		Minor:    hex.EncodeToString([]byte(encodeKey(keyFromInfo(damaged)))),
+		BlobType: quarantineContent,
+	}
+	content, err := blobReadInternal(blobio, held)
+	if err != nil {
+		t.Fatalf("could not read quarantined content: %s", err)
+	} else if err = checkBytesEqual(content, corrupt); err != nil {
+		t.Fatalf("quarantined content mismatch: %s", err)
+	}
+	if content, err = readRange(sound, 0, 0); err != nil {
+		t.Fatalf("could not read sound blob: %s", err)
+	} else if err = checkBytesEqual(content, testdata); err != nil {
+		t.Fatalf("sound blob mismatch: %s", err)
+	}
+
+	// the report is kept, and the next scrub finds nothing
+	last, err := LastScrub()
+	if err != nil {
+		t.Fatalf("could not read last scrub: %s", err)
+	} else if len(last.Findings) != 2 || !last.Finished.Equal(report.Finished) {
+		t.Fatalf("unexpected last scrub %+v", last)
+	}
+	if report, err = Scrub(0); err != nil || report.Blobs != 1 || len(report.Findings) != 0 {
+		t.Fatalf("expected 1 sound blob left, got %+v, %v", report, err)
+	}
+}
+
+// test scrubs read no faster than the given rate
+func TestScrubRate(t *testing.T) {
+	ConfigureBackend(MemoryBackend, testConfig(t))
+	if _, err := LastScrub(); !errors.Is(err, ErrNoExist) {
+		t.Fatalf("expected ErrNoExist before any scrub, got %v", err)
+	}
+	writeChecksummedBlob(t, 256*1024)
+	start := time.Now()
+	report, err := Scrub(1024 * 1024)
+	if err != nil {
+		t.Fatalf("could not scrub: %s", err)
+	} else if report.Bytes != 256*1024 {
+		t.Fatalf("expected 256KiB scrubbed, got %d", report.Bytes)
+	} else if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Fatalf("scrubbed 256KiB at 1MiB/s in %s", elapsed)
+	}
+}
+
+// test scrubs verify stored content rather than cached copies, and
+// leave the cache alone
+func TestScrubBelowCache(t *testing.T) {
+	configureCache(t, 1<<20, 0)
+	info, testdata := writeChecksummedBlob(t, 2*checksumBlockSize)
+	if _, err := readRange(info, 0, 0); err != nil {
+		t.Fatalf("could not read blob: %s", err)
+	}
+	stats, _ := ReadCacheStats()
+
+	// damage the stored copy without the cache seeing the write
+	corrupt := append([]byte{}, testdata...)
+	corrupt[10] ^= 0x01
+	if err := blobWriteInternal(blobCache.inner, keyFromInfo(info), corrupt); err != nil {
+		t.Fatalf("could not overwrite content: %s", err)
+	}
+	report, err := Scrub(0)
+	if err != nil {
+		t.Fatalf("could not scrub: %s", err)
+	} else if len(report.Findings) != 1 || report.Findings[0].Key != keyFromInfo(info) {
+		t.Fatalf("expected the stored copy found bad, got %+v", report)
+	}
+	if after, _ := ReadCacheStats(); after != stats {
+		t.Fatalf("scrub went through the cache: %+v before, %+v after", stats, after)
+	}
+}
+
+// test scrubs verify cold blobs in the cold tier and leave them there
+func TestScrubLeavesTiers(t *testing.T) {
+	tiers := configureTiers(t, time.Hour, 0)
+	info, _ := writeChecksummedBlob(t, 2*checksumBlockSize)
+	key := keyFromInfo(info)
+	if _, err := DemoteCold(time.Now().Add(2 * time.Hour)); err != nil {
+		t.Fatalf("could not demote: %s", err)
+	}
+	report, err := Scrub(0)
+	if err != nil {
+		t.Fatalf("could not scrub: %s", err)
+	} else if report.Blobs != 1 || len(report.Findings) != 0 {
+		t.Fatalf("expected one sound blob scrubbed, got %+v", report)
+	}
+	waitPromotions(tiers)
+	checkTier(t, tiers, key, false)
+	checkTier(t, tiers, metadataKey(key), false)
+}
@@ -0,0 +1,326 @@
+/*
+ * Resumable upload sessions.
+ */
+
+/*
+ * A session records the attributes of the blob being uploaded, and
+ * collects numbered parts that clients may send in any order, in
+ * parallel, and more than once. Committing streams parts 1 to N
+ * through the usual checksummed writer, so the blob only appears
+ * once the whole of it has arrived.
+ *
+ * Session records live under one reserved major key so they can be
+ * listed for expiry, and each session's parts under a major key of
+ * their own. All of it is kept in the backend, so sessions survive
+ * restarts. A session's record goes last when it's removed, so a
+ * crash part-way leaves it to be expired again.
+ */
+
+package blob
+
+import (
+	pb "github.com/pleb/prod/horrea/pb"
+
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// major key of all session records.
+const sessionMajor = ".uploads"
+
+// prefix of the major key holding each session's parts.
+const partMajorPrefix = ".upload-"
+
+// blob types of session records and parts.
+const (
+	sessionType = "session"
+	partType    = "part"
+)
+
+// Largest part number in a session.
+const MaxPartNumber = 10000
+
+var ErrNoUpload = errors.New("no such upload session")
+var ErrPartNumber = errors.New("part number out of range")
+var ErrIncomplete = errors.New("upload parts don't make up the blob")
+
+// Part received by an upload session.
+type PartStat struct {
+	Number int32 // part number.
+	Size   int64 // part size in bytes.
+}
+
+// Upload session record.
+type session struct {
+	BlobType string    `json:"blobType"` // blob type name.
+	Major    string    `json:"major"`    // major key string.
+	Minor    string    `json:"minor"`    // minor key string.
+	Size     int64     `json:"size"`     // declared blob size.
+	Digest   []byte    `json:"digest"`   // expected digest, if any.
+	Expires  time.Time `json:"expires"`  // time the session expires.
+}
+
+// return the blob attributes given when the session began.
+func (sess *session) info() *pb.BlobInfo {
+	return &pb.BlobInfo{
+		BlobType: pb.BlobType(pb.BlobType_value[sess.BlobType]),
+		Size:     sess.Size,
+		Major:    sess.Major,
+		Minor:    sess.Minor,
+		Digest:   sess.Digest,
+	}
+}
+
+// return the key of a session record.
+func sessionKey(id string) Key {
+	return Key{Major: sessionMajor, Minor: id, BlobType: sessionType}
+}
+
+// return the key of a numbered part.
+func partKey(id string, number int32) Key {
+	// zero padding keeps parts listed in order
+	minor := fmt.Sprintf("%05d", number)
+	return Key{Major: partMajorPrefix + id, Minor: minor, BlobType: partType}
+}
+
+// check an ID has the form of one from BeginUpload, so it's
+// safe to use in keys.
+func validUploadID(id string) bool {
+	raw, err := hex.DecodeString(id)
+	return err == nil && len(raw) == 16
+}
+
+// read a session record.
+func readSession(id string) (*session, error) {
+	if blobio == nil {
+		return nil, ErrNotSupp
+	} else if !validUploadID(id) {
+		return nil, ErrNoUpload
+	}
+	content, err := blobReadInternal(blobio, sessionKey(id))
+	if errors.Is(err, ErrNoExist) {
+		return nil, ErrNoUpload
+	} else if err != nil {
+		return nil, err
+	}
+	sess := new(session)
+	if err = json.Unmarshal(content, sess); err != nil {
+		return nil, ErrCorrupt
+	}
+	return sess, nil
+}
+
+// start an upload session for a blob, expiring after ttl.
+// Returns the session ID and expiry time.
+func BeginUpload(info *pb.BlobInfo, ttl time.Duration) (string, time.Time, error) {
+	if blobio == nil {
+		return "", time.Time{}, ErrNotSupp
+	} else if !validKey(keyFromInfo(info)) {
+		return "", time.Time{}, ErrKey
+	}
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", time.Time{}, err
+	}
+	id := hex.EncodeToString(raw)
+	sess := &session{
+		BlobType: info.GetBlobType().String(),
+		Major:    info.GetMajor(),
+		Minor:    info.GetMinor(),
+		Size:     info.GetSize(),
+		Digest:   info.GetDigest(),
+		Expires:  time.Now().Add(ttl),
+	}
+	content, err := json.Marshal(sess)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if err = blobWriteInternal(blobio, sessionKey(id), content); err != nil {
+		return "", time.Time{}, err
+	}
+	return id, sess.Expires, nil
+}
+
+// start a write of one part of a session, replacing any earlier
+// copy of the part once committed.
+func CreatePartWriter(id string, number int32) (Writer, error) {
+	if number < 1 || number > MaxPartNumber {
+		return nil, ErrPartNumber
+	} else if _, err := readSession(id); err != nil {
+		return nil, err
+	}
+	// parts are checksummed, and encrypted like any blob at rest
+	return newChecksumWriter(blobio, partKey(id, number), nil, "")
+}
+
+// list the parts a session has received, in order, along with
+// the blob attributes it began with.
+func ListParts(id string) (*pb.BlobInfo, []PartStat, error) {
+	sess, err := readSession(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	parts, err := listParts(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sess.info(), parts, nil
+}
+
+// list the stored parts of a session, in order.
+func listParts(id string) ([]PartStat, error) {
+	parts := []PartStat{}
+	after := Key{}
+	for {
+		keys, err := blobio.List(partMajorPrefix+id, after, DefaultPageSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			number, err := strconv.Atoi(key.Minor)
+			if err != nil || key.BlobType != partType {
+				continue
+			}
+			size, err := partSize(key)
+			if errors.Is(err, ErrNoExist) {
+				continue // removed since listing
+			} else if err != nil {
+				return nil, err
+			}
+			parts = append(parts, PartStat{Number: int32(number), Size: size})
+		}
+		if len(keys) < DefaultPageSize {
+			return parts, nil
+		}
+		after = keys[len(keys)-1]
+	}
+}
+
+// return the content size of a stored part.
+func partSize(key Key) (int64, error) {
+	meta, err := readMetadata(blobio, key)
+	if err == nil {
+		return meta.Size, nil
+	} else if !errors.Is(err, ErrNoExist) {
+		return 0, err
+	}
+	// parts written before they had sidecars
+	attrs, err := blobio.Stat(key)
+	if err != nil {
+		return 0, err
+	}
+	return attrs.Size, nil
+}
+
+// assemble a session's parts into its blob, then remove the
+// session. Parts must run from 1 with no gaps and add up to the
+// declared size.
+func CommitUpload(id string) error {
+	info, parts, err := ListParts(id)
+	if err != nil {
+		return err
+	}
+	var total int64
+	for i, part := range parts {
+		if part.Number != int32(i+1) {
+			return fmt.Errorf("%w: part %d missing", ErrIncomplete, i+1)
+		}
+		total += part.Size
+	}
+	if total != info.Size {
+		return fmt.Errorf("%w: parts total %d bytes, expected %d",
+			ErrIncomplete, total, info.Size)
+	}
+
+	writer, err := CreateBlobWriter(info)
+	if err != nil {
+		return err
+	}
+	for _, part := range parts {
+		if err = copyPart(writer, id, part.Number); err != nil {
+			writer.Abort()
+			return err
+		}
+	}
+	if err = writer.Commit(); err != nil {
+		return err
+	}
+	return removeSession(id)
+}
+
+// append a stored part to a pending write.
+func copyPart(writer io.Writer, id string, number int32) error {
+	reader, err := newChecksumReader(blobio, partKey(id, number), 0, 0)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	_, err = io.Copy(writer, reader)
+	return err
+}
+
+// discard a session and any parts it received.
+func AbortUpload(id string) error {
+	if _, err := readSession(id); err != nil {
+		return err
+	}
+	return removeSession(id)
+}
+
+// delete a session's parts, then its record.
+func removeSession(id string) error {
+	parts, err := listParts(id)
+	if err != nil {
+		return err
+	}
+	for _, part := range parts {
+		err := deleteContent(partKey(id, part.Number), "", time.Now())
+		if err != nil && !errors.Is(err, ErrNoExist) {
+			return err
+		}
+	}
+	err = blobio.Delete(sessionKey(id))
+	if errors.Is(err, ErrNoExist) {
+		return nil
+	}
+	return err
+}
+
+// discard sessions that expired before the given time, returning
+// how many were removed.
+func ExpireUploads(now time.Time) (int, error) {
+	if blobio == nil {
+		return 0, ErrNotSupp
+	}
+	expired := []string{}
+	after := Key{}
+	for {
+		keys, err := blobio.List(sessionMajor, after, DefaultPageSize)
+		if err != nil {
+			return 0, err
+		}
+		for _, key := range keys {
+			// unreadable records are dropped along with expired ones
+			sess, err := readSession(key.Minor)
+			if errors.Is(err, ErrCorrupt) || (err == nil && sess.Expires.Before(now)) {
+				expired = append(expired, key.Minor)
+			}
+		}
+		if len(keys) < DefaultPageSize {
+			break
+		}
+		after = keys[len(keys)-1]
+	}
+	for _, id := range expired {
+		if err := removeSession(id); err != nil {
+			return 0, err
+		}
+	}
+	return len(expired), nil
+}
@@ -0,0 +1,122 @@
+/*
+ * Tests for resumable upload sessions.
+ */
+
+package blob
+
+import (
+	pb "github.com/pleb/prod/horrea/pb"
+
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// write one part of a session
+func writePart(t *testing.T, id string, number int32, content []byte) {
+	writer, err := CreatePartWriter(id, number)
+	if err != nil {
+		t.Fatalf("could not open part %d: %s", number, err)
+	}
+	if _, err = writer.Write(content); err != nil {
+		t.Fatalf("could not write part %d: %s", number, err)
+	}
+	if err = writer.Commit(); err != nil {
+		t.Fatalf("could not commit part %d: %s", number, err)
+	}
+}
+
+// test assembling a blob from parts sent out of order, against
+// every backend
+func TestSessionCommit(t *testing.T) {
+	for _, name := range Backends() {
+		t.Run(name, func(t *testing.T) {
+			if err := ConfigureBackend(name, testConfig(t)); err != nil {
+				t.Fatalf("could not configure %s backend: %s", name, err)
+			}
+			testdata := make([]byte, 3000)
+			rand.Read(testdata)
+			info := &pb.BlobInfo{Size: 3000, Major: "major", Minor: "minor"}
+			id, _, err := BeginUpload(info, time.Hour)
+			if err != nil {
+				t.Fatalf("could not begin upload: %s", err)
+			}
+
+			// parts arrive out of order, one of them twice
+			writePart(t, id, 3, testdata[2000:])
+			writePart(t, id, 1, make([]byte, 500))
+			if err = CommitUpload(id); !errors.Is(err, ErrIncomplete) {
+				t.Fatalf("expected ErrIncomplete with a part missing, got %v", err)
+			}
+			writePart(t, id, 2, testdata[1000:2000])
+			if err = CommitUpload(id); !errors.Is(err, ErrIncomplete) {
+				t.Fatalf("expected ErrIncomplete with a short part, got %v", err)
+			}
+			writePart(t, id, 1, testdata[:1000])
+
+			_, parts, err := ListParts(id)
+			if err != nil {
+				t.Fatalf("could not list parts: %s", err)
+			} else if len(parts) != 3 || parts[0].Number != 1 || parts[0].Size != 1000 {
+				t.Fatalf("unexpected parts %v", parts)
+			}
+			if err = CommitUpload(id); err != nil {
+				t.Fatalf("could not commit upload: %s", err)
+			}
+			content, err := readRange(info, 0, 0)
+			if err != nil {
+				t.Fatalf("could not read assembled blob: %s", err)
+			} else if err = checkBytesEqual(content, testdata); err != nil {
+				t.Fatalf("assembled blob mismatch: %s", err)
+			}
+
+			// the session and its parts are gone
+			if _, _, err = ListParts(id); !errors.Is(err, ErrNoUpload) {
+				t.Fatalf("expected ErrNoUpload after commit, got %v", err)
+			}
+			if parts, _ = listParts(id); len(parts) != 0 {
+				t.Fatalf("expected no parts after commit, found %v", parts)
+			}
+		})
+	}
+}
+
+// test that abandoned sessions expire, and aborted ones go at once
+func TestSessionExpiry(t *testing.T) {
+	ConfigureBackend(MemoryBackend, testConfig(t))
+	info := &pb.BlobInfo{Size: 10, Major: "major", Minor: "minor"}
+	short, _, err := BeginUpload(info, time.Minute)
+	if err != nil {
+		t.Fatalf("could not begin upload: %s", err)
+	}
+	long, _, err := BeginUpload(info, time.Hour)
+	if err != nil {
+		t.Fatalf("could not begin upload: %s", err)
+	}
+	writePart(t, short, 1, make([]byte, 10))
+	writePart(t, long, 1, make([]byte, 10))
+
+	expired, err := ExpireUploads(time.Now().Add(2 * time.Minute))
+	if err != nil {
+		t.Fatalf("could not expire uploads: %s", err)
+	} else if expired != 1 {
+		t.Fatalf("expected 1 expired upload, found %d", expired)
+	}
+	if _, err = CreatePartWriter(short, 2); !errors.Is(err, ErrNoUpload) {
+		t.Fatalf("expected ErrNoUpload for expired session, got %v", err)
+	}
+	if parts, _ := listParts(short); len(parts) != 0 {
+		t.Fatalf("expected expired parts removed, found %v", parts)
+	}
+
+	if err = AbortUpload(long); err != nil {
+		t.Fatalf("could not abort upload: %s", err)
+	}
+	if parts, _ := listParts(long); len(parts) != 0 {
+		t.Fatalf("expected aborted parts removed, found %v", parts)
+	}
+	if _, err = CreatePartWriter("not-an-id", 1); !errors.Is(err, ErrNoUpload) {
+		t.Fatalf("expected ErrNoUpload for malformed ID, got %v", err)
+	}
+}
@@ -0,0 +1,699 @@
+/*
+ * Erasure-coded storage over several local roots.
+ */
+
+/*
+ * Content is cut into stripes, each split into one block per data
+ * shard, and Reed-Solomon parity blocks are computed over them.
+ * Shard N of every stripe goes to root N, so a key costs its size
+ * times (data + parity) / data rather than a full copy per root,
+ * and reads survive losing up to the parity count of roots. The
+ * final stripe is cut into smaller blocks to keep padding small.
+ *
+ * As with replication, each root keeps a record next to its shard
+ * with block checksums, so damaged shards are caught on read and
+ * rebuilt from the others. Records carry the version of the write,
+ * the shard counts it used and the content size, so only shards of
+ * the newest write are combined, and changing the counts later
+ * leaves old keys readable. Deletes leave tombstone records.
+ *
+ * RepairShards re-encodes shards that are missing or damaged from
+ * the rest, and drops tombstones once every root has one. It reads
+ * every shard to verify it, so like scrubs its reads are paced to a
+ * byte rate.
+ */
+
+package blob
+
+import (
+	"github.com/pleb/prod/horrea/main/erasure"
+
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log"
+	"time"
+)
+
+// suffix on the blob type of shard record keys.
+const shardSuffix = ".shard"
+
+// bytes of each shard in a full stripe. Matches the checksum
+// block size, so each block of a shard is checked on its own.
+const shardBlockSize = checksumBlockSize
+
+type shardBackend struct {
+	rootSet                // roots holding one shard of every key each.
+	coder   *erasure.Coder // coder for new writes.
+}
+
+// Checksums of one root's shard of a key, or a tombstone.
+type shardRecord struct {
+	Metadata
+	Shard        int   `json:"shard"`             // index of the shard.
+	DataShards   int   `json:"dataShards"`        // data shards written.
+	ParityShards int   `json:"parityShards"`      // parity shards written.
+	ContentSize  int64 `json:"contentSize"`       // size of the whole content.
+	Deleted      bool  `json:"deleted,omitempty"` // key was deleted.
+}
+
+// Pending write of one shard, checksummed as blocks arrive.
+type shardWriter struct {
+	writer Writer    // pending root write.
+	digest hash.Hash // running SHA-256 of the shard.
+	meta   Metadata  // checksums so far.
+}
+
+type shardedWriter struct {
+	backend *shardBackend  // owning backend.
+	key     Key            // destination key.
+	writers []*shardWriter // per-shard writes, nil once failed.
+	stripe  []byte         // content of the current stripe.
+	size    int64          // content written so far.
+}
+
+// Reads the shards of one write of a key a stripe at a time,
+// rebuilding blocks of shards that can't be read.
+type stripeReader struct {
+	backend *shardBackend   // owning backend.
+	key     Key             // key being read.
+	coder   *erasure.Coder  // coder the write used.
+	records []*shardRecord  // records of usable shards, by index.
+	sources []io.ReadCloser // open shard readers, by index.
+	size    int64           // content size.
+	next    int64           // index of the next stripe.
+}
+
+type shardedReader struct {
+	stripes *stripeReader // shards being read.
+	ready   []byte        // content not yet returned.
+	skip    int64         // bytes to drop from the first stripe.
+	remain  int64         // bytes left to return.
+}
+
+// the active erasure-coded backend, for repair.
+var blobShards *shardBackend
+
+func init() {
+	RegisterBackend(ErasureBackend, newShardBackend)
+}
+
+// create a backend spreading data and parity shards over the
+// shard directories, one shard per directory.
+func newShardBackend(cfg *Config) (Backend, error) {
+	data := len(cfg.ShardDirs) - cfg.ParityShards
+	coder, err := erasure.New(data, cfg.ParityShards)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %d shard directories, %d parity",
+			err, len(cfg.ShardDirs), cfg.ParityShards)
+	}
+	// writes need the data shards and half the parity
+	roots, err := openRoots(cfg.ShardDirs, data+cfg.ParityShards/2, shardSuffix)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Erasure coding over %d data and %d parity shards", data, cfg.ParityShards)
+	return &shardBackend{rootSet: roots, coder: coder}, nil
+}
+
+// return the key of a root's record for a key.
+func shardKey(key Key) Key {
+	key.BlobType += shardSuffix
+	return key
+}
+
+// read one root's record for a key.
+func readShardRecord(root Backend, key Key) (*shardRecord, error) {
+	content, err := blobReadInternal(root, shardKey(key))
+	if err != nil {
+		return nil, err
+	}
+	record := new(shardRecord)
+	if err = json.Unmarshal(content, record); err != nil ||
+		(!record.Deleted && record.BlockSize != shardBlockSize) {
+		return nil, ErrCorrupt
+	}
+	return record, nil
+}
+
+// read every root's record for a key, nil where a root has none
+// or it can't be read, and return the newest.
+func (sharded *shardBackend) records(key Key) ([]*shardRecord, *shardRecord) {
+	records := make([]*shardRecord, len(sharded.roots))
+	var newest *shardRecord
+	for i, root := range sharded.roots {
+		record, err := readShardRecord(root, key)
+		if err != nil {
+			if !errors.Is(err, ErrNoExist) {
+				log.Printf("Unreadable shard record for %s in %s: %v",
+					key, sharded.dirs[i], err)
+			}
+			continue
+		}
+		records[i] = record
+		if newest == nil || record.Version > newest.Version {
+			newest = record
+		}
+	}
+	return records, newest
+}
+
+// return the records of shards of the newest write of a key.
+func (sharded *shardBackend) current(key Key) ([]*shardRecord, *shardRecord, error) {
+	records, newest := sharded.records(key)
+	if newest == nil || newest.Deleted {
+		return nil, nil, ErrNoExist
+	}
+	return currentShards(records, newest), newest, nil
+}
+
+// drop records that aren't of the same write as the newest.
+func currentShards(records []*shardRecord, newest *shardRecord) []*shardRecord {
+	for i, record := range records {
+		if record != nil && (record.Version != newest.Version || record.Shard != i) {
+			records[i] = nil
+		}
+	}
+	return records
+}
+
+// return the size of each block of a stripe.
+func stripeBlockSize(stripe, size int64, data int) int64 {
+	width := shardBlockSize * int64(data)
+	remain := size - stripe*width
+	if remain >= width {
+		return shardBlockSize
+	}
+	return (remain + int64(data) - 1) / int64(data)
+}
+
+// open a reader over the shards of the newest write of a key,
+// starting at the given stripe.
+func (sharded *shardBackend) openStripes(key Key, records []*shardRecord,
+	newest *shardRecord, stripe int64) (*stripeReader, error) {
+	coder, err := erasure.New(newest.DataShards, newest.ParityShards)
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	total := newest.DataShards + newest.ParityShards
+	if total > len(sharded.roots) {
+		return nil, fmt.Errorf("%w: written over %d roots, %d configured",
+			ErrNotSupp, total, len(sharded.roots))
+	}
+	return &stripeReader{
+		backend: sharded,
+		key:     key,
+		coder:   coder,
+		records: records[:total],
+		sources: make([]io.ReadCloser, total),
+		size:    newest.ContentSize,
+		next:    stripe,
+	}, nil
+}
+
+// read one block of a shard, opening it at the current stripe
+// if need be.
+func (reader *stripeReader) readBlock(i int, block []byte) error {
+	if reader.sources[i] == nil {
+		root := reader.backend.roots[i]
+		source, err := openVerified(root, reader.key, &reader.records[i].Metadata,
+			reader.next*shardBlockSize, 0)
+		if err != nil {
+			return err
+		}
+		reader.sources[i] = source
+	}
+	_, err := io.ReadFull(reader.sources[i], block)
+	return err
+}
+
+// drop a shard that couldn't be read.
+func (reader *stripeReader) fail(i int, err error) {
+	log.Printf("Dropping shard %d of %s in %s: %v",
+		i, reader.key, reader.backend.dirs[i], err)
+	if reader.sources[i] != nil {
+		reader.sources[i].Close()
+		reader.sources[i] = nil
+	}
+	reader.records[i] = nil
+}
+
+// read the next stripe, returning a block per shard. Data blocks
+// are always filled in, and parity blocks too if all is set.
+// Shards are read lowest first, so a shard once read is read
+// for every later stripe too, until it fails.
+func (reader *stripeReader) readStripe(all bool) ([][]byte, error) {
+	blockSize := stripeBlockSize(reader.next, reader.size, reader.coder.DataShards())
+	blocks := make([][]byte, len(reader.records))
+	data, found := reader.coder.DataShards(), 0
+	for i := range blocks {
+		if found == data {
+			break
+		} else if reader.records[i] == nil {
+			continue
+		}
+		block := make([]byte, blockSize)
+		if err := reader.readBlock(i, block); err != nil {
+			reader.fail(i, err)
+			continue
+		}
+		blocks[i] = block
+		found++
+	}
+	if found < data {
+		return nil, ErrCorrupt
+	}
+	rebuild := all
+	for _, block := range blocks[:data] {
+		rebuild = rebuild || block == nil
+	}
+	if rebuild {
+		if err := reader.coder.Reconstruct(blocks); err != nil {
+			return nil, err
+		}
+	}
+	reader.next++
+	return blocks, nil
+}
+
+func (reader *stripeReader) Close() error {
+	for _, source := range reader.sources {
+		if source != nil {
+			source.Close()
+		}
+	}
+	return nil
+}
+
+// return a reader over a range of content, rebuilt from parity
+// where data shards can't be read.
+func (sharded *shardBackend) Reader(key Key, offset, length int64) (io.ReadCloser, error) {
+	records, newest, err := sharded.current(key)
+	if err != nil {
+		return nil, err
+	} else if offset > newest.ContentSize {
+		return nil, ErrRange
+	}
+	width := shardBlockSize * int64(newest.DataShards)
+	stripes, err := sharded.openStripes(key, records, newest, offset/width)
+	if err != nil {
+		return nil, err
+	}
+	remain := newest.ContentSize - offset
+	if length > 0 && length < remain {
+		remain = length
+	}
+	return &shardedReader{stripes: stripes, skip: offset % width, remain: remain}, nil
+}
+
+func (reader *shardedReader) Read(data []byte) (int, error) {
+	if reader.remain == 0 {
+		return 0, io.EOF
+	}
+	if len(reader.ready) == 0 {
+		blocks, err := reader.stripes.readStripe(false)
+		if err != nil {
+			return 0, err
+		}
+		for _, block := range blocks[:reader.stripes.coder.DataShards()] {
+			reader.ready = append(reader.ready, block...)
+		}
+		reader.ready = reader.ready[reader.skip:]
+		reader.skip = 0
+	}
+	n := copy(data, reader.ready[:min(int64(len(reader.ready)), reader.remain)])
+	reader.ready = reader.ready[n:]
+	reader.remain -= int64(n)
+	return n, nil
+}
+
+func (reader *shardedReader) Close() error {
+	return reader.stripes.Close()
+}
+
+// start a write of one shard to a root.
+func newShardWriter(root Backend, key Key) (*shardWriter, error) {
+	writer, err := root.Writer(key)
+	if err != nil {
+		return nil, err
+	}
+	return &shardWriter{
+		writer: writer,
+		digest: sha256.New(),
+		meta:   Metadata{BlockSize: shardBlockSize},
+	}, nil
+}
+
+// append one block to the shard.
+func (writer *shardWriter) write(block []byte) error {
+	if _, err := writer.writer.Write(block); err != nil {
+		return err
+	}
+	writer.digest.Write(block)
+	writer.meta.Size += int64(len(block))
+	writer.meta.Blocks = append(writer.meta.Blocks, crc32.Checksum(block, crcTable))
+	return nil
+}
+
+// persist the shard's record, with its checksums filled in,
+// then its content.
+func (writer *shardWriter) commit(root Backend, key Key, record *shardRecord) error {
+	writer.meta.Digest = writer.digest.Sum(nil)
+	writer.meta.Version = record.Version
+	record.Metadata = writer.meta
+	if err := writeSidecar(root, shardKey(key), record); err != nil {
+		writer.writer.Abort()
+		return err
+	}
+	return writer.writer.Commit()
+}
+
+// return a writer encoding content into shards as it arrives.
+func (sharded *shardBackend) Writer(key Key) (Writer, error) {
+	data := sharded.coder.DataShards()
+	writer := &shardedWriter{
+		backend: sharded,
+		key:     key,
+		stripe:  make([]byte, 0, shardBlockSize*data),
+	}
+	live := 0
+	for i, root := range sharded.roots {
+		shard, err := newShardWriter(root, key)
+		if err != nil {
+			log.Printf("Could not write %s to %s: %v", key, sharded.dirs[i], err)
+			shard = nil
+		} else {
+			live++
+		}
+		writer.writers = append(writer.writers, shard)
+	}
+	if live < sharded.quorum {
+		writer.Abort()
+		return nil, fmt.Errorf("%w: %d of %d writable", ErrQuorum, live, sharded.quorum)
+	}
+	return writer, nil
+}
+
+func (writer *shardedWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		n := copy(writer.stripe[len(writer.stripe):cap(writer.stripe)], data)
+		writer.stripe = writer.stripe[:len(writer.stripe)+n]
+		data = data[n:]
+		written += n
+		if len(writer.stripe) == cap(writer.stripe) {
+			if err := writer.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// encode the current stripe and append a block to each shard.
+// Shards that fail drop out, and the write fails once too few
+// are left.
+func (writer *shardedWriter) flush() error {
+	if len(writer.stripe) == 0 {
+		return nil
+	}
+	coder := writer.backend.coder
+	data := coder.DataShards()
+	writer.size += int64(len(writer.stripe))
+	blockSize := (len(writer.stripe) + data - 1) / data
+	padded := writer.stripe[:blockSize*data]
+	clear(padded[len(writer.stripe):])
+	blocks := make([][]byte, data+coder.ParityShards())
+	for i := range blocks {
+		if i < data {
+			blocks[i] = padded[i*blockSize : (i+1)*blockSize]
+		} else {
+			blocks[i] = make([]byte, blockSize)
+		}
+	}
+	if err := coder.Encode(blocks); err != nil {
+		return err
+	}
+	live := 0
+	for i, shard := range writer.writers {
+		if shard == nil {
+			continue
+		}
+		if err := shard.write(blocks[i]); err != nil {
+			log.Printf("Could not write %s to %s: %v",
+				writer.key, writer.backend.dirs[i], err)
+			shard.writer.Abort()
+			writer.writers[i] = nil
+			continue
+		}
+		live++
+	}
+	writer.stripe = writer.stripe[:0]
+	if live < writer.backend.quorum {
+		return fmt.Errorf("%w: %d of %d writable", ErrQuorum, live, writer.backend.quorum)
+	}
+	return nil
+}
+
+// commit every shard, succeeding if a quorum commits.
+func (writer *shardedWriter) Commit() error {
+	if err := writer.flush(); err != nil {
+		writer.Abort()
+		return err
+	}
+	coder := writer.backend.coder
+	version := newVersionID(time.Now())
+	committed := 0
+	for i, shard := range writer.writers {
+		if shard == nil {
+			continue
+		}
+		record := &shardRecord{
+			Shard:        i,
+			DataShards:   coder.DataShards(),
+			ParityShards: coder.ParityShards(),
+			ContentSize:  writer.size,
+		}
+		record.Version = version
+		if err := shard.commit(writer.backend.roots[i], writer.key, record); err != nil {
+			log.Printf("Could not commit %s to %s: %v",
+				writer.key, writer.backend.dirs[i], err)
+			continue
+		}
+		committed++
+	}
+	if committed < writer.backend.quorum {
+		return fmt.Errorf("%w: %d of %d committed", ErrQuorum, committed, writer.backend.quorum)
+	}
+	return nil
+}
+
+func (writer *shardedWriter) Abort() error {
+	for _, shard := range writer.writers {
+		if shard != nil {
+			shard.writer.Abort()
+		}
+	}
+	return nil
+}
+
+// write a tombstone to every root, then remove its shard.
+func (sharded *shardBackend) Delete(key Key) error {
+	if _, _, err := sharded.current(key); err != nil {
+		return err
+	}
+	tombstone := &shardRecord{Deleted: true}
+	tombstone.Version = newVersionID(time.Now())
+	deleted := 0
+	for i := range sharded.roots {
+		if err := sharded.deleteShard(i, key, tombstone); err != nil {
+			log.Printf("Could not delete %s from %s: %v", key, sharded.dirs[i], err)
+			continue
+		}
+		deleted++
+	}
+	if deleted < sharded.quorum {
+		return fmt.Errorf("%w: %d of %d deleted", ErrQuorum, deleted, sharded.quorum)
+	}
+	return nil
+}
+
+// mark one root's shard of a key deleted, then remove it.
+func (sharded *shardBackend) deleteShard(i int, key Key, tombstone *shardRecord) error {
+	root := sharded.roots[i]
+	tombstone.Shard = i
+	if err := writeSidecar(root, shardKey(key), tombstone); err != nil {
+		return err
+	}
+	err := root.Delete(key)
+	if errors.Is(err, ErrNoExist) {
+		return nil
+	}
+	return err
+}
+
+// describe a key from its newest records.
+func (sharded *shardBackend) Stat(key Key) (Attrs, error) {
+	records, newest, err := sharded.current(key)
+	if err != nil {
+		return Attrs{}, err
+	}
+	found := 0
+	for _, record := range records {
+		if record != nil {
+			found++
+		}
+	}
+	if found < newest.DataShards {
+		return Attrs{}, ErrCorrupt
+	}
+	return Attrs{Size: newest.ContentSize, ModTime: versionTime(newest.Version)}, nil
+}
+
+// rebuild missing and damaged shards of every key, reading at most
+// rate bytes per second (0 for no limit), and return the number of
+// shards re-encoded or removed.
+func RepairShards(rate int64) (int, error) {
+	if blobShards == nil {
+		return 0, ErrNotSupp
+	}
+	keys, err := blobShards.allKeys()
+	if err != nil {
+		return 0, err
+	}
+	pace := &pacedReader{rate: rate, start: time.Now()}
+	repaired := 0
+	for key := range keys {
+		n, err := blobShards.repairKey(key, pace)
+		if err != nil {
+			return repaired, err
+		}
+		repaired += n
+	}
+	if repaired > 0 {
+		log.Printf("Repaired %d shards", repaired)
+	}
+	return repaired, nil
+}
+
+// bring every root's shard of a key in line with the newest record.
+func (sharded *shardBackend) repairKey(key Key, pace *pacedReader) (int, error) {
+	records, newest := sharded.records(key)
+	if newest == nil {
+		return 0, nil // content with no records can't be decoded
+	} else if newest.Deleted {
+		return sharded.repairDeleted(key, records, newest)
+	}
+	records = currentShards(records, newest)
+	total := newest.DataShards + newest.ParityShards
+	if total > len(sharded.roots) {
+		return 0, nil
+	}
+	bad := []int{}
+	for i := range records[:total] {
+		if !sharded.verifyShard(i, records[i], key, pace) {
+			records[i] = nil
+			bad = append(bad, i)
+		}
+	}
+	if len(bad) == 0 {
+		return 0, nil
+	}
+	if err := sharded.rebuild(key, records, newest, bad, pace); err != nil {
+		log.Printf("Could not rebuild shards of %s: %v", key, err)
+		return 0, nil
+	}
+	return len(bad), nil
+}
+
+// report whether a root's shard of a key is current and intact.
+func (sharded *shardBackend) verifyShard(i int, record *shardRecord, key Key, pace *pacedReader) bool {
+	if record == nil {
+		return false
+	}
+	reader, err := openVerified(sharded.roots[i], key, &record.Metadata, 0, 0)
+	if err != nil {
+		return false
+	}
+	defer reader.Close()
+	pace.source = reader
+	_, err = io.Copy(io.Discard, pace)
+	return err == nil
+}
+
+// re-encode the given shards of a key from the good ones.
+func (sharded *shardBackend) rebuild(key Key, records []*shardRecord, newest *shardRecord, bad []int,
+	pace *pacedReader) error {
+	stripes, err := sharded.openStripes(key, records, newest, 0)
+	if err != nil {
+		return err
+	}
+	defer stripes.Close()
+	writers := map[int]*shardWriter{}
+	defer func() {
+		for _, writer := range writers {
+			writer.writer.Abort()
+		}
+	}()
+	for _, i := range bad {
+		if writers[i], err = newShardWriter(sharded.roots[i], key); err != nil {
+			return err
+		}
+	}
+	width := shardBlockSize * int64(newest.DataShards)
+	for stripe := int64(0); stripe*width < newest.ContentSize; stripe++ {
+		blocks, err := stripes.readStripe(true)
+		if err != nil {
+			return err
+		}
+		pace.charge(width)
+		for i, writer := range writers {
+			if err = writer.write(blocks[i]); err != nil {
+				return err
+			}
+		}
+	}
+	for i, writer := range writers {
+		record := *newest
+		record.Shard = i
+		err = writer.commit(sharded.roots[i], key, &record)
+		delete(writers, i)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove shards of a deleted key, then drop its tombstones once
+// every root has one.
+func (sharded *shardBackend) repairDeleted(key Key, records []*shardRecord,
+	tombstone *shardRecord) (int, error) {
+	repaired, settled := 0, true
+	for i, root := range sharded.roots {
+		_, err := root.Stat(key)
+		if records[i] != nil && records[i].Version == tombstone.Version && errors.Is(err, ErrNoExist) {
+			continue
+		}
+		if err = sharded.deleteShard(i, key, tombstone); err != nil {
+			log.Printf("Could not delete %s from %s: %v", key, sharded.dirs[i], err)
+			settled = false
+			continue
+		}
+		repaired++
+	}
+	if !settled {
+		return repaired, nil
+	}
+	for _, root := range sharded.roots {
+		err := root.Delete(shardKey(key))
+		if err != nil && !errors.Is(err, ErrNoExist) {
+			return repaired, err
+		}
+	}
+	return repaired, nil
+}
@@ -0,0 +1,160 @@
+/*
+ * Tests for erasure-coded storage.
+ */
+
+package blob
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// configure the erasure backend over three data and two parity
+// shards, in fresh roots
+func configureShards(t *testing.T) *shardBackend {
+	if err := ConfigureBackend(ErasureBackend, testConfig(t)); err != nil {
+		t.Fatalf("could not configure erasure backend: %s", err)
+	}
+	return blobShards
+}
+
+// report which roots hold a good shard of a key
+func goodShards(sharded *shardBackend, key Key) []bool {
+	records, newest := sharded.records(key)
+	records = currentShards(records, newest)
+	good := []bool{}
+	for i := range sharded.roots {
+		good = append(good, sharded.verifyShard(i, records[i], key, &pacedReader{}))
+	}
+	return good
+}
+
+// test shards take less space than full copies
+func TestShardOverhead(t *testing.T) {
+	sharded := configureShards(t)
+	info, _ := writeChecksummedBlob(t, 300*1024)
+	var stored int64
+	for i, root := range sharded.roots {
+		attrs, err := root.Stat(keyFromInfo(info))
+		if err != nil {
+			t.Fatalf("could not stat shard %d: %s", i, err)
+		}
+		stored += attrs.Size
+	}
+	// five shards of a third each, plus a little padding
+	if stored < 500*1024 || stored > 500*1024+8 {
+		t.Fatalf("stored %d bytes for 300KiB of content", stored)
+	}
+}
+
+// test reads rebuild data with up to the parity count of shards
+// lost or damaged, and fail beyond it
+func TestShardDegradedRead(t *testing.T) {
+	sharded := configureShards(t)
+	info, testdata := writeChecksummedBlob(t, 300*1024)
+	key := keyFromInfo(info)
+
+	if err := os.RemoveAll(sharded.dirs[0]); err != nil {
+		t.Fatalf("could not remove root: %s", err)
+	}
+	corruptRoot(t, &sharded.rootSet, 2, key)
+	content, err := readRange(info, 0, 0)
+	if err != nil {
+		t.Fatalf("could not read with two shards lost: %s", err)
+	} else if err = checkBytesEqual(content, testdata); err != nil {
+		t.Fatalf("degraded read mismatch: %s", err)
+	}
+	content, err = readRange(info, 250*1024, 1000)
+	if err != nil {
+		t.Fatalf("could not read range with two shards lost: %s", err)
+	} else if err = checkBytesEqual(content, testdata[250*1024:250*1024+1000]); err != nil {
+		t.Fatalf("degraded range mismatch: %s", err)
+	}
+
+	if err = os.Remove(rootPath(t, &sharded.rootSet, 4, key)); err != nil {
+		t.Fatalf("could not remove shard: %s", err)
+	}
+	if _, err = readRange(info, 0, 0); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expected ErrCorrupt with three shards lost, got %v", err)
+	}
+}
+
+// test repair re-encodes lost and damaged shards, and settles deletes
+func TestShardRepair(t *testing.T) {
+	sharded := configureShards(t)
+	info, testdata := writeChecksummedBlob(t, 300*1024)
+	key := keyFromInfo(info)
+	if repaired, err := RepairShards(0); err != nil || repaired != 0 {
+		t.Fatalf("expected nothing to repair, got %d, %v", repaired, err)
+	}
+
+	if err := os.Remove(rootPath(t, &sharded.rootSet, 1, key)); err != nil {
+		t.Fatalf("could not remove shard: %s", err)
+	}
+	corruptRoot(t, &sharded.rootSet, 4, key)
+	repaired, err := RepairShards(0)
+	if err != nil {
+		t.Fatalf("could not repair: %s", err)
+	} else if repaired != 2 {
+		t.Fatalf("expected 2 shards repaired, got %d", repaired)
+	}
+	for i, good := range goodShards(sharded, key) {
+		if !good {
+			t.Fatalf("shard %d still bad after repair", i)
+		}
+	}
+
+	// the rebuilt shards serve the blob without the others
+	for _, i := range []int{0, 2} {
+		if err = os.Remove(rootPath(t, &sharded.rootSet, i, key)); err != nil {
+			t.Fatalf("could not remove shard: %s", err)
+		}
+	}
+	content, err := readRange(info, 0, 0)
+	if err != nil {
+		t.Fatalf("could not read rebuilt shards: %s", err)
+	} else if err = checkBytesEqual(content, testdata); err != nil {
+		t.Fatalf("rebuilt shard mismatch: %s", err)
+	}
+
+	// deletes leave nothing behind once repaired
+	if err = DeleteBlob(info); err != nil {
+		t.Fatalf("could not delete: %s", err)
+	}
+	if _, err = RepairShards(0); err != nil {
+		t.Fatalf("could not repair: %s", err)
+	}
+	for i, root := range sharded.roots {
+		keys, err := root.List("", Key{}, DefaultPageSize)
+		if err != nil {
+			t.Fatalf("could not list root %d: %s", i, err)
+		} else if len(keys) != 0 {
+			t.Fatalf("root %d still holds %v", i, keys)
+		}
+	}
+}
+
+// test shard counts must fit the shard directories
+func TestShardConfig(t *testing.T) {
+	config := testConfig(t)
+	config.ParityShards = len(config.ShardDirs)
+	if err := ConfigureBackend(ErasureBackend, config); err == nil {
+		t.Fatalf("expected an error with no data shards")
+	}
+}
+
+// test repair paces its reads of every shard to the given rate
+func TestShardRepairPaced(t *testing.T) {
+	configureShards(t)
+	writeChecksummedBlob(t, 192*1024)
+	start := time.Now()
+	if _, err := RepairShards(1 << 20); err != nil {
+		t.Fatalf("could not repair: %s", err)
+	}
+	// five shards of 64KiB at 1MiB/s take at least 5/16s
+	if elapsed := time.Since(start); elapsed < 5*time.Second/16 {
+		t.Fatalf("expected paced repair, took %s", elapsed)
+	}
+}
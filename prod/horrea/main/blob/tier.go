@@ -0,0 +1,410 @@
+/*
+ * Hot and cold storage tiers.
+ */
+
+/*
+ * New content is written to a hot tier on local disk, and a
+ * periodic pass moves blobs to a cold tier, any other registered
+ * backend, once they go unread for long enough. The hot tier may
+ * also be given a capacity: blobs over a quarter of it are always
+ * moved, and when it's over capacity the least recently read blobs
+ * go first. Reading a blob from the cold tier moves it back, unless
+ * it's too large to keep hot.
+ *
+ * Reads of cold blobs are served from the cold tier, while the move
+ * back runs in the background, one per key however many readers
+ * miss, so a read never waits on a whole copy. With no capacity set,
+ * blobs over a fixed size stay cold rather than fill the hot disk.
+ * Quiet reads, made by scrubs, exports and other passes over the
+ * whole store, neither move blobs nor count as accesses.
+ *
+ * Access times are kept in memory. After a restart a blob counts as
+ * last read when it was written, until it's read again.
+ *
+ * Reads prefer the hot tier, so content left in the cold tier when
+ * a key is rewritten is shadowed, and replaced when the key is next
+ * moved. Moves and commits of a key hold a lock, so a move never
+ * removes content committed while it was being copied.
+ */
+
+package blob
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// largest blob moved back to a hot tier with no capacity set.
+const promoteLimit = 64 * 1024 * 1024
+
+type tieredBackend struct {
+	hot       Backend               // local disk holding recent blobs.
+	cold      Backend               // backend holding the rest.
+	coldAfter time.Duration         // time unread before a blob moves.
+	capacity  int64                 // bytes the hot tier may hold, 0 for any.
+	mu        sync.Mutex            // guards access times and promotions.
+	accessed  map[Key]time.Time     // last read of hot blobs.
+	promoting map[Key]chan struct{} // moves back under way, closed when done.
+	locks     [64]sync.Mutex        // serialize moves and commits, by key.
+}
+
+// View of a tiered backend whose reads leave blobs where they are.
+type quietTiers struct {
+	*tieredBackend
+}
+
+// Pending write to the hot tier.
+type tieredWriter struct {
+	Writer                // hot tier write.
+	tiers  *tieredBackend // backend being written.
+	key    Key            // destination key.
+}
+
+// tiered backend in use, nil if another backend is configured.
+var blobTiers *tieredBackend
+
+func init() {
+	RegisterBackend(TieredBackend, newTieredBackend)
+}
+
+// create a backend keeping recent blobs on local disk, and the rest
+// in the named cold backend.
+func newTieredBackend(cfg *Config) (Backend, error) {
+	if cfg.HotDir == "" {
+		return nil, fmt.Errorf("%w: no hot tier directory", ErrNotSupp)
+	} else if cfg.ColdBackend == TieredBackend {
+		return nil, fmt.Errorf("%w: cold tier can't be tiered", ErrNotSupp)
+	}
+	factory, ok := backends[cfg.ColdBackend]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown cold backend %q", ErrNotSupp, cfg.ColdBackend)
+	}
+	hot, err := newLocalBackend(&Config{LocalDirectory: cfg.HotDir})
+	if err != nil {
+		return nil, err
+	}
+	coldCfg := *cfg
+	coldCfg.LocalDirectory = cfg.ColdDir
+	cold, err := factory(&coldCfg)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Tiering blobs to %s after %s unread", cfg.ColdBackend, cfg.ColdAfter)
+	return &tieredBackend{
+		hot:       hot,
+		cold:      cold,
+		coldAfter: cfg.ColdAfter,
+		capacity:  cfg.HotCapacity,
+		accessed:  map[Key]time.Time{},
+		promoting: map[Key]chan struct{}{},
+	}, nil
+}
+
+// lock moves and commits of keys, returning the unlock function.
+func (tiers *tieredBackend) lock(keys ...Key) func() {
+	return lockStripes(tiers.locks[:], keys...)
+}
+
+// record a read or write of a hot blob.
+func (tiers *tieredBackend) touch(key Key, when time.Time) {
+	tiers.mu.Lock()
+	defer tiers.mu.Unlock()
+	tiers.accessed[key] = when
+}
+
+// drop the access time of a blob leaving the hot tier.
+func (tiers *tieredBackend) forget(key Key) {
+	tiers.mu.Lock()
+	defer tiers.mu.Unlock()
+	delete(tiers.accessed, key)
+}
+
+// report whether a blob is too large to keep hot.
+func (tiers *tieredBackend) oversized(size int64) bool {
+	return tiers.capacity > 0 && size > tiers.capacity/4
+}
+
+// report whether a blob is small enough to move back hot.
+func (tiers *tieredBackend) promotable(size int64) bool {
+	if tiers.capacity > 0 {
+		return !tiers.oversized(size)
+	}
+	return size <= promoteLimit
+}
+
+// copy content between tiers as it is, then remove the original.
+func moveTier(from, to Backend, key Key) error {
+	reader, err := from.Reader(key, 0, 0)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	writer, err := to.Writer(key)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(writer, reader); err != nil {
+		writer.Abort()
+		return err
+	}
+	if err = writer.Commit(); err != nil {
+		return err
+	}
+	return from.Delete(key)
+}
+
+// return a reader from whichever tier holds a blob, starting to
+// move it back hot if it's only in the cold tier.
+func (tiers *tieredBackend) Reader(key Key, offset, length int64) (io.ReadCloser, error) {
+	return tiers.read(key, offset, length, true)
+}
+
+// return the view of the backend whose reads leave blobs where
+// they are.
+func (tiers *tieredBackend) quiet() Backend {
+	return quietTiers{tiers}
+}
+
+// return a reader from whichever tier holds a blob.
+func (view quietTiers) Reader(key Key, offset, length int64) (io.ReadCloser, error) {
+	return view.read(key, offset, length, false)
+}
+
+// return a reader from whichever tier holds a blob, counting the
+// read as an access and moving cold blobs back if it's a client's.
+func (tiers *tieredBackend) read(key Key, offset, length int64, client bool) (io.ReadCloser, error) {
+	reader, err := tiers.hot.Reader(key, offset, length)
+	if err == nil {
+		if client {
+			tiers.touch(key, time.Now())
+		}
+		return reader, nil
+	} else if !errors.Is(err, ErrNoExist) {
+		return nil, err
+	}
+	reader, err = tiers.cold.Reader(key, offset, length)
+	if errors.Is(err, ErrNoExist) {
+		// moved back since the hot tier was tried
+		if reader, err = tiers.hot.Reader(key, offset, length); err == nil && client {
+			tiers.touch(key, time.Now())
+		}
+		return reader, err
+	} else if err != nil {
+		return nil, err
+	}
+	if client {
+		tiers.startPromote(key)
+	}
+	return reader, nil
+}
+
+// move a blob back hot in the background, unless a move of it is
+// already under way.
+func (tiers *tieredBackend) startPromote(key Key) {
+	tiers.mu.Lock()
+	defer tiers.mu.Unlock()
+	if tiers.promoting[key] != nil {
+		return
+	}
+	done := make(chan struct{})
+	tiers.promoting[key] = done
+	go func() {
+		if err := tiers.promote(key); err != nil {
+			log.Printf("Could not promote %s: %v", key, err)
+		}
+		tiers.mu.Lock()
+		delete(tiers.promoting, key)
+		tiers.mu.Unlock()
+		close(done)
+	}()
+}
+
+// move a blob from the cold tier to the hot tier, if it's still
+// only in the cold tier and isn't too large.
+func (tiers *tieredBackend) promote(key Key) error {
+	defer tiers.lock(key)()
+	if _, err := tiers.hot.Stat(key); err == nil {
+		return nil // written meanwhile
+	}
+	attrs, err := tiers.cold.Stat(key)
+	if errors.Is(err, ErrNoExist) {
+		return nil
+	} else if err != nil {
+		return err
+	} else if !tiers.promotable(attrs.Size) {
+		return nil
+	}
+	if err = moveTier(tiers.cold, tiers.hot, key); err != nil {
+		return err
+	}
+	tiers.touch(key, time.Now())
+	return nil
+}
+
+// return a writer to the hot tier.
+func (tiers *tieredBackend) Writer(key Key) (Writer, error) {
+	writer, err := tiers.hot.Writer(key)
+	if err != nil {
+		return nil, err
+	}
+	return &tieredWriter{Writer: writer, tiers: tiers, key: key}, nil
+}
+
+// commit to the hot tier, counting the write as an access.
+func (writer *tieredWriter) Commit() error {
+	defer writer.tiers.lock(writer.key)()
+	if err := writer.Writer.Commit(); err != nil {
+		return err
+	}
+	writer.tiers.touch(writer.key, time.Now())
+	return nil
+}
+
+// clone a blob within whichever tier holds it, removing any copy
+// the destination has in the other tier.
+func (tiers *tieredBackend) Clone(from, to Key) error {
+	defer tiers.lock(from, to)()
+	err := cloneContent(tiers.hot, from, to)
+	if err == nil {
+		tiers.touch(to, time.Now())
+		return nil
+	} else if !errors.Is(err, ErrNoExist) {
+		return err
+	}
+	if err = cloneContent(tiers.cold, from, to); err != nil {
+		return err
+	}
+	tiers.forget(to)
+	err = tiers.hot.Delete(to)
+	if err != nil && !errors.Is(err, ErrNoExist) {
+		return err
+	}
+	return nil
+}
+
+// delete a blob from both tiers.
+func (tiers *tieredBackend) Delete(key Key) error {
+	defer tiers.lock(key)()
+	tiers.forget(key)
+	hotErr := tiers.hot.Delete(key)
+	if hotErr != nil && !errors.Is(hotErr, ErrNoExist) {
+		return hotErr
+	}
+	coldErr := tiers.cold.Delete(key)
+	if errors.Is(coldErr, ErrNoExist) && hotErr == nil {
+		return nil
+	}
+	return coldErr
+}
+
+// describe a blob from whichever tier holds it.
+func (tiers *tieredBackend) Stat(key Key) (Attrs, error) {
+	attrs, err := tiers.hot.Stat(key)
+	if errors.Is(err, ErrNoExist) {
+		return tiers.cold.Stat(key)
+	}
+	return attrs, err
+}
+
+// list the keys of both tiers together.
+func (tiers *tieredBackend) List(major string, after Key, limit int) ([]Key, error) {
+	hot, err := tiers.hot.List(major, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	cold, err := tiers.cold.List(major, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	return mergeKeys([][]Key{hot, cold}, limit), nil
+}
+
+// move blobs that have gone unread since coldAfter before now, or
+// that don't fit the hot tier, to the cold tier. Returns how many
+// were moved.
+func DemoteCold(now time.Time) (int, error) {
+	if blobTiers == nil {
+		return 0, ErrNotSupp
+	}
+	return blobTiers.demote(now)
+}
+
+// Hot blob considered for demotion.
+type hotBlob struct {
+	key      Key       // blob key.
+	size     int64     // content size in bytes.
+	accessed time.Time // last read or write.
+}
+
+func (tiers *tieredBackend) demote(now time.Time) (int, error) {
+	blobs := []hotBlob{}
+	var total int64
+	after := Key{}
+	for {
+		keys, err := tiers.hot.List("", after, DefaultPageSize)
+		if err != nil {
+			return 0, err
+		}
+		for _, key := range keys {
+			attrs, err := tiers.hot.Stat(key)
+			if err != nil {
+				continue // removed since listing
+			}
+			tiers.mu.Lock()
+			accessed, ok := tiers.accessed[key]
+			tiers.mu.Unlock()
+			if !ok {
+				accessed = attrs.ModTime
+			}
+			blobs = append(blobs, hotBlob{key: key, size: attrs.Size, accessed: accessed})
+			total += attrs.Size
+		}
+		if len(keys) < DefaultPageSize {
+			break
+		}
+		after = keys[len(keys)-1]
+	}
+
+	// least recently read first, so overflow takes the coldest
+	sort.Slice(blobs, func(a, b int) bool { return blobs[a].accessed.Before(blobs[b].accessed) })
+	moved := 0
+	for _, blob := range blobs {
+		idle := tiers.coldAfter > 0 && now.Sub(blob.accessed) >= tiers.coldAfter
+		over := tiers.capacity > 0 && total > tiers.capacity
+		if !idle && !over && !tiers.oversized(blob.size) {
+			continue
+		}
+		if err := tiers.demoteKey(blob.key, blob.accessed); err != nil {
+			log.Printf("Could not demote %s: %v", blob.key, err)
+			continue
+		}
+		total -= blob.size
+		moved++
+	}
+	if moved > 0 {
+		log.Printf("Moved %d blobs to the cold tier", moved)
+	}
+	return moved, nil
+}
+
+// move one blob to the cold tier, unless it was read since it was
+// considered.
+func (tiers *tieredBackend) demoteKey(key Key, accessed time.Time) error {
+	defer tiers.lock(key)()
+	tiers.mu.Lock()
+	last, ok := tiers.accessed[key]
+	tiers.mu.Unlock()
+	if ok && last.After(accessed) {
+		return nil
+	}
+	if err := moveTier(tiers.hot, tiers.cold, key); err != nil {
+		return err
+	}
+	tiers.forget(key)
+	return nil
+}
@@ -0,0 +1,206 @@
+/*
+ * Tests for hot and cold storage tiers.
+ */
+
+package blob
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// configure the tiered backend over two local directories
+func configureTiers(t *testing.T, coldAfter time.Duration, capacity int64) *tieredBackend {
+	cfg := testConfig(t)
+	cfg.ColdAfter = coldAfter
+	cfg.HotCapacity = capacity
+	if err := ConfigureBackend(TieredBackend, cfg); err != nil {
+		t.Fatalf("could not configure tiered backend: %s", err)
+	}
+	return blobTiers
+}
+
+// write raw blobs of the given sizes, returning their keys and content
+func writeTierBlobs(t *testing.T, sizes ...int) ([]Key, [][]byte) {
+	keys, contents := []Key{}, [][]byte{}
+	for i, size := range sizes {
+		key := Key{Major: "tier", Minor: fmt.Sprintf("%04d", i), BlobType: "Raw"}
+		content := make([]byte, size)
+		rand.Read(content)
+		if err := blobWriteInternal(blobio, key, content); err != nil {
+			t.Fatalf("could not write %s: %s", key, err)
+		}
+		keys, contents = append(keys, key), append(contents, content)
+	}
+	return keys, contents
+}
+
+// check which tier holds a blob
+func checkTier(t *testing.T, tiers *tieredBackend, key Key, hot bool) {
+	_, hotErr := tiers.hot.Stat(key)
+	_, coldErr := tiers.cold.Stat(key)
+	if hot && (hotErr != nil || !errors.Is(coldErr, ErrNoExist)) {
+		t.Fatalf("expected %s hot only, got %v, %v", key, hotErr, coldErr)
+	} else if !hot && (coldErr != nil || !errors.Is(hotErr, ErrNoExist)) {
+		t.Fatalf("expected %s cold only, got %v, %v", key, hotErr, coldErr)
+	}
+}
+
+// wait for the moves back hot under way to end
+func waitPromotions(tiers *tieredBackend) {
+	for {
+		tiers.mu.Lock()
+		moves := make([]chan struct{}, 0, len(tiers.promoting))
+		for _, done := range tiers.promoting {
+			moves = append(moves, done)
+		}
+		tiers.mu.Unlock()
+		if len(moves) == 0 {
+			return
+		}
+		for _, done := range moves {
+			<-done
+		}
+	}
+}
+
+// test blobs left unread move cold, and move back when read
+func TestTierDemotion(t *testing.T) {
+	tiers := configureTiers(t, time.Hour, 0)
+	keys, contents := writeTierBlobs(t, 1000, 100*1024, 10)
+	if moved, err := DemoteCold(time.Now()); err != nil || moved != 0 {
+		t.Fatalf("expected nothing demoted yet, got %d, %v", moved, err)
+	}
+	moved, err := DemoteCold(time.Now().Add(2 * time.Hour))
+	if err != nil {
+		t.Fatalf("could not demote: %s", err)
+	} else if moved != len(keys) {
+		t.Fatalf("expected %d demoted, got %d", len(keys), moved)
+	}
+	for _, key := range keys {
+		checkTier(t, tiers, key, false)
+	}
+	listed, err := blobio.List("tier", Key{}, 100)
+	if err != nil || len(listed) != len(keys) {
+		t.Fatalf("expected %d keys listed, got %v, %v", len(keys), listed, err)
+	}
+	if attrs, err := blobio.Stat(keys[1]); err != nil || attrs.Size != 100*1024 {
+		t.Fatalf("unexpected cold attrs %+v, %v", attrs, err)
+	}
+
+	checkBlobs(t, keys[:2], contents[:2])
+	waitPromotions(tiers)
+	checkTier(t, tiers, keys[0], true)
+	checkTier(t, tiers, keys[1], true)
+	checkTier(t, tiers, keys[2], false)
+
+	// deletes reach either tier
+	for _, key := range keys {
+		if err = blobio.Delete(key); err != nil {
+			t.Fatalf("could not delete %s: %s", key, err)
+		}
+	}
+	if err = blobio.Delete(keys[2]); !errors.Is(err, ErrNoExist) {
+		t.Fatalf("expected ErrNoExist on second delete, got %v", err)
+	}
+}
+
+// test an over-capacity hot tier sheds its least recently read
+// blobs, and blobs too large for it are only read from cold
+func TestTierCapacity(t *testing.T) {
+	tiers := configureTiers(t, 0, 512*1024)
+	keys, contents := writeTierBlobs(t, 100*1024, 100*1024, 100*1024, 100*1024, 100*1024, 100*1024)
+	checkBlobs(t, keys[:1], contents[:1])
+	moved, err := DemoteCold(time.Now())
+	if err != nil {
+		t.Fatalf("could not demote: %s", err)
+	} else if moved != 1 {
+		t.Fatalf("expected one blob demoted, got %d", moved)
+	}
+	checkTier(t, tiers, keys[0], true)
+	checkTier(t, tiers, keys[1], false)
+	for _, key := range keys[2:] {
+		checkTier(t, tiers, key, true)
+	}
+
+	large, largeContents := []Key{{Major: "tier", Minor: "large", BlobType: "Raw"}}, [][]byte{make([]byte, 200*1024)}
+	rand.Read(largeContents[0])
+	if err = blobWriteInternal(blobio, large[0], largeContents[0]); err != nil {
+		t.Fatalf("could not write large blob: %s", err)
+	}
+	if _, err = DemoteCold(time.Now()); err != nil {
+		t.Fatalf("could not demote: %s", err)
+	}
+	checkTier(t, tiers, large[0], false)
+	checkBlobs(t, large, largeContents)
+	waitPromotions(tiers)
+	checkTier(t, tiers, large[0], false)
+}
+
+// test cold reads are served from the cold tier while the blob
+// moves back, and that with no capacity set large blobs stay cold
+func TestTierPromotion(t *testing.T) {
+	tiers := configureTiers(t, time.Hour, 0)
+	keys, contents := writeTierBlobs(t, 1000)
+	if _, err := DemoteCold(time.Now().Add(2 * time.Hour)); err != nil {
+		t.Fatalf("could not demote: %s", err)
+	}
+	// hold the key's lock so the move back can't finish
+	unlock := tiers.lock(keys[0])
+	checkBlobs(t, keys, contents)
+	checkBlobs(t, keys, contents)
+	tiers.mu.Lock()
+	moves := len(tiers.promoting)
+	tiers.mu.Unlock()
+	if moves != 1 {
+		t.Fatalf("expected one move back under way, got %d", moves)
+	}
+	checkTier(t, tiers, keys[0], false)
+	unlock()
+	waitPromotions(tiers)
+	checkTier(t, tiers, keys[0], true)
+
+	if !tiers.promotable(promoteLimit) || tiers.promotable(promoteLimit+1) {
+		t.Fatalf("expected blobs over %d bytes to stay cold", promoteLimit)
+	}
+}
+
+// test quiet reads leave cold blobs cold and don't count as
+// accesses of hot ones
+func TestTierQuietReads(t *testing.T) {
+	tiers := configureTiers(t, time.Hour, 0)
+	keys, contents := writeTierBlobs(t, 1000, 10)
+	if _, err := DemoteCold(time.Now().Add(2 * time.Hour)); err != nil {
+		t.Fatalf("could not demote: %s", err)
+	}
+	hot := []Key{{Major: "tier", Minor: "hot", BlobType: "Raw"}}
+	if err := blobWriteInternal(blobio, hot[0], []byte("hot")); err != nil {
+		t.Fatalf("could not write %s: %s", hot[0], err)
+	}
+	tiers.mu.Lock()
+	written := tiers.accessed[hot[0]]
+	tiers.mu.Unlock()
+
+	for i, key := range append(keys, hot...) {
+		content, err := blobReadInternal(quiet(blobio), key)
+		if err != nil {
+			t.Fatalf("could not read %s quietly: %s", key, err)
+		} else if i < len(keys) && !bytes.Equal(content, contents[i]) {
+			t.Fatalf("quiet read of %s returned the wrong content", key)
+		}
+	}
+	waitPromotions(tiers)
+	for _, key := range keys {
+		checkTier(t, tiers, key, false)
+	}
+	tiers.mu.Lock()
+	accessed := tiers.accessed[hot[0]]
+	tiers.mu.Unlock()
+	if !accessed.Equal(written) {
+		t.Fatalf("expected a quiet read to leave the access time alone")
+	}
+}
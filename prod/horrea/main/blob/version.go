@@ -0,0 +1,312 @@
+/*
+ * Blob versioning and retention.
+ */
+
+/*
+ * Every commit stamps the blob's sidecar with a version ID, the
+ * commit time in zero-padded nanoseconds so IDs sort by age. With
+ * versioning enabled, content about to be overwritten, patched or
+ * deleted is first cloned, with its sidecar and deltas, to a version
+ * key next to the blob, so the main key always holds the latest
+ * content and readers of it are unaffected. Backends that can clone
+ * share the bytes, so a version costs a sidecar rather than a copy;
+ * the rest fall back to copying. Versions keep their blob's binding
+ * for wrapped data keys, so encrypted content clones as it is.
+ * Version keys carry the version in their blob type, which keeps them
+ * out of blob listings.
+ *
+ * Retention keeps at most a set number of old versions per key,
+ * and drops versions older than a set age. Counts are enforced as
+ * each key is written, ages by a periodic sweep as well.
+ */
+
+package blob
+
+import (
+	pb "github.com/pleb/prod/horrea/pb"
+
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// separates the blob type from the version in version keys.
+const versionSep = "@"
+
+// Versioning settings.
+type retention struct {
+	enabled bool          // preserve replaced content?
+	keep    int           // old versions kept per key, 0 for all.
+	keepFor time.Duration // age old versions are kept, 0 for ever.
+}
+
+var versioning retention
+
+// Stored version of a blob.
+type VersionStat struct {
+	Version string    // version ID.
+	Size    int64     // content size in bytes.
+	ModTime time.Time // time the version was written.
+	Current bool      // held at the blob's own key?
+}
+
+// return the ID of a version committed at the given time.
+func newVersionID(at time.Time) string {
+	return fmt.Sprintf("%020d", at.UnixNano())
+}
+
+// return the time a version ID was issued.
+func versionTime(version string) time.Time {
+	nanos, err := strconv.ParseInt(version, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// return the key holding an old version of a blob.
+func versionKey(key Key, version string) Key {
+	key.BlobType += versionSep + version
+	return key
+}
+
+// split a version key into its blob key and version.
+func parseVersionKey(key Key) (Key, string, bool) {
+	if strings.HasSuffix(key.BlobType, metadataSuffix) || strings.Contains(key.BlobType, deltaSep) {
+		return Key{}, "", false
+	}
+	blobType, version, ok := strings.Cut(key.BlobType, versionSep)
+	if !ok || version == "" {
+		return Key{}, "", false
+	}
+	key.BlobType = blobType
+	return key, version, true
+}
+
+// writer that preserves the content it replaces.
+type versionWriter struct {
+	Writer     // pending checksummed write.
+	key    Key // destination key.
+}
+
+// preserve the current content, then commit and apply retention.
+func (writer *versionWriter) Commit() error {
+	if err := preserveVersion(writer.key); err != nil {
+		writer.Writer.Abort()
+		return err
+	}
+	if err := writer.Writer.Commit(); err != nil {
+		return err
+	}
+	return pruneVersions(writer.key, time.Now())
+}
+
+// return the version ID of the current content of a key, and
+// its sidecar if it has one.
+func currentVersion(key Key) (string, *Metadata, error) {
+	meta, err := readMetadata(blobio, key)
+	if err != nil && !errors.Is(err, ErrNoExist) {
+		return "", nil, err
+	}
+	if meta != nil && meta.Version != "" {
+		return meta.Version, meta, nil
+	}
+	// content written before versions were recorded
+	attrs, err := blobio.Stat(key)
+	if err != nil {
+		return "", nil, err
+	}
+	return newVersionID(attrs.ModTime), meta, nil
+}
+
+// clone the current content of a key to a version key, sharing
+// storage where the backend can. Keys with no content have nothing
+// to preserve.
+func preserveVersion(key Key) error {
+	version, meta, err := currentVersion(key)
+	if errors.Is(err, ErrNoExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	vkey := versionKey(key, version)
+	// deltas and the sidecar go first, as for any checksummed write
+	if meta != nil {
+		for _, delta := range meta.Deltas {
+			if err = cloneDelta(key, vkey, delta.ID); err != nil {
+				return err
+			}
+		}
+		if err = writeMetadata(blobio, vkey, meta); err != nil {
+			return err
+		}
+	}
+	err = cloneContent(blobio, key, vkey)
+	if errors.Is(err, ErrNoExist) {
+		return nil // removed meanwhile
+	}
+	return err
+}
+
+// list the old versions of a key, newest first.
+func oldVersions(key Key) ([]string, error) {
+	versions := []string{}
+	after := Key{Major: key.Major, Minor: key.Minor}
+	for {
+		keys, err := blobio.List(key.Major, after, DefaultPageSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, listed := range keys {
+			if listed.Minor != key.Minor {
+				keys = nil // past this key's versions
+				break
+			}
+			if base, version, ok := parseVersionKey(listed); ok && base == key {
+				versions = append(versions, version)
+			}
+		}
+		if len(keys) < DefaultPageSize {
+			break
+		}
+		after = keys[len(keys)-1]
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(versions)))
+	return versions, nil
+}
+
+// remove one old version, its sidecar and its deltas.
+func deleteVersion(key Key, version string) error {
+	vkey := versionKey(key, version)
+	replaced, _ := readMetadata(blobio, vkey)
+	err := blobio.Delete(vkey)
+	if err != nil && !errors.Is(err, ErrNoExist) {
+		return err
+	}
+	err = blobio.Delete(metadataKey(vkey))
+	if err != nil && !errors.Is(err, ErrNoExist) {
+		return err
+	}
+	dropDeltas(blobio, vkey, replaced, nil)
+	return nil
+}
+
+// drop old versions of a key beyond the retention limits.
+func pruneVersions(key Key, now time.Time) error {
+	if versioning.keep == 0 && versioning.keepFor == 0 {
+		return nil
+	}
+	versions, err := oldVersions(key)
+	if err != nil {
+		return err
+	}
+	for i, version := range versions {
+		expired := versioning.keepFor > 0 && now.Sub(versionTime(version)) > versioning.keepFor
+		if (versioning.keep > 0 && i >= versioning.keep) || expired {
+			if err = deleteVersion(key, version); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// apply retention to old versions of every key, returning how
+// many keys were checked.
+func PruneAllVersions(now time.Time) (int, error) {
+	if blobio == nil {
+		return 0, ErrNotSupp
+	}
+	versioned := map[Key]bool{}
+	after := Key{}
+	for {
+		keys, err := blobio.List("", after, DefaultPageSize)
+		if err != nil {
+			return 0, err
+		}
+		for _, key := range keys {
+			if base, _, ok := parseVersionKey(key); ok {
+				versioned[base] = true
+			}
+		}
+		if len(keys) < DefaultPageSize {
+			break
+		}
+		after = keys[len(keys)-1]
+	}
+	for key := range versioned {
+		if err := pruneVersions(key, now); err != nil {
+			return 0, err
+		}
+	}
+	if len(versioned) > 0 {
+		log.Printf("Applied retention to versions of %d keys", len(versioned))
+	}
+	return len(versioned), nil
+}
+
+// list the stored versions of a blob, newest first, including
+// the current one if the blob exists.
+func ListVersions(info *pb.BlobInfo) ([]VersionStat, error) {
+	if blobio == nil {
+		return nil, ErrNotSupp
+	}
+	key := keyFromInfo(info)
+	if !validKey(key) {
+		return nil, ErrKey
+	}
+	stats := []VersionStat{}
+	if current, err := StatBlob(info); err == nil {
+		stats = append(stats, VersionStat{
+			Version: current.Version,
+			Size:    current.Size,
+			ModTime: current.ModTime,
+			Current: true,
+		})
+	} else if !errors.Is(err, ErrNoExist) {
+		return nil, err
+	}
+	versions, err := oldVersions(key)
+	if err != nil {
+		return nil, err
+	}
+	for _, version := range versions {
+		if len(stats) > 0 && stats[0].Version == version {
+			continue // preserved but not yet replaced
+		}
+		stat, err := statKey(versionKey(key, version))
+		if errors.Is(err, ErrNoExist) {
+			continue // pruned since listing
+		} else if err != nil {
+			return nil, err
+		}
+		stats = append(stats, VersionStat{
+			Version: version,
+			Size:    stat.Size,
+			ModTime: versionTime(version),
+		})
+	}
+	return stats, nil
+}
+
+// return the key to read for a version of a blob, which is the
+// blob's own key for the current version.
+func resolveVersion(key Key, version string) (Key, error) {
+	if version == "" {
+		return key, nil
+	}
+	current, _, err := currentVersion(key)
+	if err == nil && current == version {
+		return key, nil
+	} else if err != nil && !errors.Is(err, ErrNoExist) {
+		return Key{}, err
+	}
+	if _, err = strconv.ParseUint(version, 10, 64); err != nil {
+		return Key{}, fmt.Errorf("%w: version %q", ErrNoExist, version)
+	}
+	return versionKey(key, version), nil
+}
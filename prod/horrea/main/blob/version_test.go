@@ -0,0 +1,177 @@
+/*
+ * Tests for blob versioning and retention.
+ */
+
+package blob
+
+import (
+	pb "github.com/pleb/prod/horrea/pb"
+
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// configure a backend with versioning and the given retention
+func configureVersioning(t *testing.T, name string, keep int, keepFor time.Duration) {
+	config := testConfig(t)
+	config.Versioning = true
+	config.KeepVersions = keep
+	config.KeepVersionFor = keepFor
+	if err := ConfigureBackend(name, config); err != nil {
+		t.Fatalf("could not configure %s backend: %s", name, err)
+	}
+	t.Cleanup(func() { versioning = retention{} })
+}
+
+// overwrite a blob with the given content
+func writeVersion(t *testing.T, info *pb.BlobInfo, content string) {
+	info.Size = int64(len(content))
+	writeblob := CreateBlob(info)
+	writeblob.AppendChunk([]byte(content))
+	if err := writeblob.WriteContent(); err != nil {
+		t.Fatalf("WriteContent returned error: %s", err)
+	}
+}
+
+// read one version of a blob
+func readVersion(t *testing.T, info *pb.BlobInfo, version string) string {
+	reader, err := CreateVersionReader(info, version, 0, 0)
+	if err != nil {
+		t.Fatalf("could not open version %q: %s", version, err)
+	}
+	defer reader.Close()
+	content := make([]byte, 64)
+	n, _ := reader.Read(content)
+	return string(content[:n])
+}
+
+// test overwrites and deletes keep earlier versions readable,
+// against every backend
+func TestVersionHistory(t *testing.T) {
+	for _, name := range Backends() {
+		t.Run(name, func(t *testing.T) {
+			configureVersioning(t, name, 0, 0)
+			info := &pb.BlobInfo{Major: "major", Minor: "minor"}
+			writeVersion(t, info, "first")
+			writeVersion(t, info, "second")
+			writeVersion(t, info, "third")
+
+			versions, err := ListVersions(info)
+			if err != nil {
+				t.Fatalf("could not list versions: %s", err)
+			} else if len(versions) != 3 || !versions[0].Current || versions[1].Current {
+				t.Fatalf("unexpected versions %v", versions)
+			}
+			stat, err := StatBlob(info)
+			if err != nil {
+				t.Fatalf("could not stat blob: %s", err)
+			} else if stat.Version != versions[0].Version {
+				t.Fatalf("stat version %q, listed %q", stat.Version, versions[0].Version)
+			}
+			for i, expect := range []string{"third", "second", "first"} {
+				if content := readVersion(t, info, versions[i].Version); content != expect {
+					t.Fatalf("version %d read %q, expected %q", i, content, expect)
+				}
+			}
+			if _, err = CreateVersionReader(info, "12345", 0, 0); !errors.Is(err, ErrNoExist) {
+				t.Fatalf("expected ErrNoExist for an unknown version, got %v", err)
+			}
+
+			// old versions stay hidden from listings
+			keys, _, err := ListBlobs("major", "", 0)
+			if err != nil {
+				t.Fatalf("could not list blobs: %s", err)
+			} else if len(keys) != 1 {
+				t.Fatalf("expected one listed blob, found %v", keys)
+			}
+
+			// deleting keeps the deleted content as a version
+			if err = DeleteBlob(info); err != nil {
+				t.Fatalf("could not delete blob: %s", err)
+			}
+			if versions, err = ListVersions(info); err != nil {
+				t.Fatalf("could not list versions: %s", err)
+			} else if len(versions) != 3 || versions[0].Current {
+				t.Fatalf("unexpected versions after delete %v", versions)
+			}
+			if content := readVersion(t, info, versions[0].Version); content != "third" {
+				t.Fatalf("deleted version read %q", content)
+			}
+		})
+	}
+}
+
+// test old versions are pruned by count and by age
+func TestVersionRetention(t *testing.T) {
+	for _, name := range Backends() {
+		t.Run(name, func(t *testing.T) {
+			configureVersioning(t, name, 2, time.Hour)
+			info := &pb.BlobInfo{Major: "major", Minor: "minor"}
+			other := &pb.BlobInfo{Major: "major", Minor: "other"}
+			for _, content := range []string{"one", "two", "three", "four"} {
+				writeVersion(t, info, content)
+			}
+			writeVersion(t, other, "one")
+			writeVersion(t, other, "two")
+
+			// the current content and the two newest old versions
+			versions, err := ListVersions(info)
+			if err != nil {
+				t.Fatalf("could not list versions: %s", err)
+			} else if len(versions) != 3 {
+				t.Fatalf("expected 3 versions, found %v", versions)
+			}
+			if content := readVersion(t, info, versions[2].Version); content != "two" {
+				t.Fatalf("oldest kept version read %q", content)
+			}
+
+			// nothing is old enough to expire yet
+			if _, err = PruneAllVersions(time.Now()); err != nil {
+				t.Fatalf("could not prune versions: %s", err)
+			} else if versions, _ = ListVersions(info); len(versions) != 3 {
+				t.Fatalf("expected 3 versions before expiry, found %v", versions)
+			}
+
+			checked, err := PruneAllVersions(time.Now().Add(2 * time.Hour))
+			if err != nil {
+				t.Fatalf("could not prune versions: %s", err)
+			} else if checked != 2 {
+				t.Fatalf("expected 2 keys checked, got %d", checked)
+			}
+			for _, blob := range []*pb.BlobInfo{info, other} {
+				if versions, _ = ListVersions(blob); len(versions) != 1 || !versions[0].Current {
+					t.Fatalf("expected only the current version, found %v", versions)
+				}
+			}
+		})
+	}
+}
+
+// test versions share storage with the content they preserve on
+// backends able to clone, rather than copying it
+func TestVersionClonesContent(t *testing.T) {
+	configureVersioning(t, LocalBackend, 0, 0)
+	local := blobio.(*localBackend)
+	info := &pb.BlobInfo{Major: "major", Minor: "minor"}
+	key := keyFromInfo(info)
+	writeVersion(t, info, "first")
+	path, _ := local.constructFilePath(key)
+	first, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("could not stat content: %s", err)
+	}
+	writeVersion(t, info, "second")
+	versions, err := ListVersions(info)
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("unexpected versions %v, %v", versions, err)
+	}
+	vpath, _ := local.constructFilePath(versionKey(key, versions[1].Version))
+	preserved, err := os.Stat(vpath)
+	if err != nil {
+		t.Fatalf("could not stat version: %s", err)
+	} else if !os.SameFile(first, preserved) {
+		t.Fatalf("expected the version to share the replaced file")
+	}
+}
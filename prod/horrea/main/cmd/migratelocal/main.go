@@ -0,0 +1,36 @@
+/*
+ * Converts a flat local horrea store to the sharded layout.
+ */
+
+/*
+ * Stores created before directory sharding keep every blob in one
+ * directory. Run this once against such a store, with the server
+ * stopped, to move the files into hash prefix directories in place.
+ * An interrupted run is finished by running it again.
+ *
+ * Usage: migratelocal [-dir DIRECTORY]
+ */
+
+package main
+
+import (
+	"github.com/pleb/prod/horrea/main/blob"
+
+	"flag"
+	"log"
+	"os"
+)
+
+func main() {
+	dir := flag.String("dir", os.Getenv("HORREA_LOCALDIR"),
+		"local store directory, defaults to $HORREA_LOCALDIR")
+	flag.Parse()
+	if *dir == "" {
+		log.Fatalf("no store directory given")
+	}
+	moved, err := blob.MigrateLocal(*dir)
+	if err != nil {
+		log.Fatalf("migration of %s failed: %v", *dir, err)
+	}
+	log.Printf("migrated %s, moved %d files", *dir, moved)
+}
@@ -0,0 +1,77 @@
+/*
+ * Stream compression codecs, shared by on-the-wire and at-rest
+ * compression. Codecs are named by the lowercase name of their
+ * pb.Compression value, and "none" (or "") passes data through.
+ */
+
+package codec
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+)
+
+// Names of supported codecs.
+const (
+	None = "none"
+	Gzip = "gzip"
+)
+
+var ErrUnknown = errors.New("unknown compression codec")
+
+type codec struct {
+	compress   func(w io.Writer) io.WriteCloser
+	decompress func(r io.Reader) (io.ReadCloser, error)
+}
+
+var codecs = map[string]codec{
+	Gzip: {
+		compress: func(w io.Writer) io.WriteCloser {
+			return gzip.NewWriter(w)
+		},
+		decompress: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// report whether the named codec is supported.
+func Supported(name string) bool {
+	_, ok := codecs[name]
+	return ok || name == None || name == ""
+}
+
+// wrap a writer so data written is compressed. Closing the
+// returned writer flushes it, but doesn't close the underlying.
+func NewWriter(name string, w io.Writer) (io.WriteCloser, error) {
+	if name == None || name == "" {
+		return nopWriteCloser{w}, nil
+	}
+	c, ok := codecs[name]
+	if !ok {
+		return nil, ErrUnknown
+	}
+	return c.compress(w), nil
+}
+
+// wrap a reader so data read from it is decompressed. Closing
+// the returned reader doesn't close the underlying.
+func NewReader(name string, r io.Reader) (io.ReadCloser, error) {
+	if name == None || name == "" {
+		return io.NopCloser(r), nil
+	}
+	c, ok := codecs[name]
+	if !ok {
+		return nil, ErrUnknown
+	}
+	return c.decompress(r)
+}
@@ -0,0 +1,141 @@
+/*
+ * Tests for stream compression codecs.
+ */
+
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// compress data with the named codec, in the given write sizes
+func compress(t *testing.T, name string, data []byte, writeSize int) []byte {
+	encoded := &bytes.Buffer{}
+	writer, err := NewWriter(name, encoded)
+	if err != nil {
+		t.Fatalf("could not create %q writer: %s", name, err)
+	}
+	for len(data) > 0 {
+		n := min(writeSize, len(data))
+		if _, err = writer.Write(data[:n]); err != nil {
+			t.Fatalf("could not write: %s", err)
+		}
+		data = data[n:]
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatalf("could not close writer: %s", err)
+	}
+	return encoded.Bytes()
+}
+
+// decompress data with the named codec
+func decompress(name string, encoded []byte) ([]byte, error) {
+	reader, err := NewReader(name, bytes.NewReader(encoded))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// test data survives a round trip through every codec
+func TestRoundTrip(t *testing.T) {
+	random := make([]byte, 200000)
+	rand.Read(random)
+	inputs := map[string][]byte{
+		"empty":      {},
+		"repetitive": bytes.Repeat([]byte("horrea "), 30000),
+		"random":     random,
+	}
+	for _, name := range []string{"", None, Gzip} {
+		for label, data := range inputs {
+			encoded := compress(t, name, data, 4096)
+			decoded, err := decompress(name, encoded)
+			if err != nil {
+				t.Fatalf("%q %s: could not decompress: %s", name, label, err)
+			} else if !bytes.Equal(decoded, data) {
+				t.Fatalf("%q %s: round trip changed the data", name, label)
+			}
+			if name == Gzip && label == "repetitive" && len(encoded) >= len(data)/10 {
+				t.Fatalf("expected repetitive data to compress, got %d of %d bytes",
+					len(encoded), len(data))
+			}
+		}
+	}
+}
+
+// test closing a writer leaves the underlying writer open
+func TestWriterClose(t *testing.T) {
+	encoded := &closeRecorder{}
+	writer, err := NewWriter(Gzip, encoded)
+	if err != nil {
+		t.Fatalf("could not create writer: %s", err)
+	}
+	writer.Write([]byte("data"))
+	if err = writer.Close(); err != nil {
+		t.Fatalf("could not close writer: %s", err)
+	} else if encoded.closed {
+		t.Fatalf("closing the codec closed the underlying writer")
+	}
+	if decoded, err := decompress(Gzip, encoded.Bytes()); err != nil || string(decoded) != "data" {
+		t.Fatalf("expected closed stream to decode, got %q, %v", decoded, err)
+	}
+}
+
+// writer recording whether it was closed
+type closeRecorder struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (writer *closeRecorder) Close() error {
+	writer.closed = true
+	return nil
+}
+
+// test truncated and corrupt gzip streams fail rather than
+// returning short or wrong data
+func TestCorruptInput(t *testing.T) {
+	data := make([]byte, 100000)
+	rand.Read(data)
+	encoded := compress(t, Gzip, data, len(data))
+
+	for _, cut := range []int{0, 5, len(encoded) / 2, len(encoded) - 4} {
+		_, err := decompress(Gzip, encoded[:cut])
+		if err == nil {
+			t.Fatalf("expected error decoding stream cut at %d of %d", cut, len(encoded))
+		}
+	}
+	if _, err := decompress(Gzip, []byte("not a gzip stream")); err == nil {
+		t.Fatalf("expected error decoding garbage")
+	}
+	damaged := bytes.Clone(encoded)
+	damaged[len(damaged)-6] ^= 0xff // in the trailing CRC
+	if _, err := decompress(Gzip, damaged); err == nil {
+		t.Fatalf("expected error decoding stream with a bad checksum")
+	}
+}
+
+// test unknown codec names are refused
+func TestUnknownCodec(t *testing.T) {
+	for _, name := range []string{"zstd", "GZIP", "brotli"} {
+		if Supported(name) {
+			t.Fatalf("expected %q unsupported", name)
+		}
+		if _, err := NewWriter(name, io.Discard); !errors.Is(err, ErrUnknown) {
+			t.Fatalf("expected ErrUnknown creating %q writer, got %v", name, err)
+		}
+		if _, err := NewReader(name, bytes.NewReader(nil)); !errors.Is(err, ErrUnknown) {
+			t.Fatalf("expected ErrUnknown creating %q reader, got %v", name, err)
+		}
+	}
+	for _, name := range []string{"", None, Gzip} {
+		if !Supported(name) {
+			t.Fatalf("expected %q supported", name)
+		}
+	}
+}
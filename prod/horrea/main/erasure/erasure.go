@@ -0,0 +1,240 @@
+/*
+ * Reed-Solomon erasure coding over GF(2^8). Data is split into
+ * equal-sized data shards, and parity shards are computed so that
+ * any data-shard-count of the shards rebuild the rest.
+ */
+
+/*
+ * The code is systematic: its encoding matrix is a Vandermonde
+ * matrix multiplied by the inverse of its top square, so the top
+ * rows are the identity and data shards are stored as-is. Any
+ * square selection of rows from such a matrix is invertible, which
+ * is what lets any large enough set of shards rebuild the data.
+ */
+
+package erasure
+
+import (
+	"errors"
+)
+
+// Largest total shard count the field allows.
+const MaxShards = 256
+
+var ErrShardCount = errors.New("invalid erasure shard counts")
+var ErrShardSize = errors.New("erasure shards differ in size")
+var ErrTooFewShards = errors.New("too few erasure shards to rebuild")
+
+// primitive polynomial generating the field.
+const fieldPolynomial = 0x11d
+
+var (
+	expTable [510]byte      // powers of the generator, twice over.
+	logTable [256]byte      // discrete logs, for non-zero values.
+	mulTable [256][256]byte // products of every pair of values.
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		expTable[i] = byte(x)
+		expTable[i+255] = byte(x)
+		logTable[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= fieldPolynomial
+		}
+	}
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			mulTable[a][b] = expTable[int(logTable[a])+int(logTable[b])]
+		}
+	}
+}
+
+// return the inverse of a non-zero field value.
+func inverse(a byte) byte {
+	return expTable[255-int(logTable[a])]
+}
+
+// return a raised to the given power.
+func power(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	} else if a == 0 {
+		return 0
+	}
+	return expTable[(int(logTable[a])*n)%255]
+}
+
+// Encoder for a fixed number of data and parity shards.
+type Coder struct {
+	data   int      // data shards per stripe.
+	parity int      // parity shards per stripe.
+	matrix [][]byte // encoding matrix, one row per shard.
+}
+
+// create a coder for the given shard counts.
+func New(data, parity int) (*Coder, error) {
+	if data < 1 || parity < 0 || data+parity > MaxShards {
+		return nil, ErrShardCount
+	}
+	total := data + parity
+	vandermonde := make([][]byte, total)
+	for r := range vandermonde {
+		vandermonde[r] = make([]byte, data)
+		for c := range vandermonde[r] {
+			vandermonde[r][c] = power(byte(r), c)
+		}
+	}
+	top, err := invert(vandermonde[:data])
+	if err != nil {
+		return nil, err
+	}
+	return &Coder{data: data, parity: parity, matrix: multiply(vandermonde, top)}, nil
+}
+
+// return the number of data shards.
+func (coder *Coder) DataShards() int {
+	return coder.data
+}
+
+// return the number of parity shards.
+func (coder *Coder) ParityShards() int {
+	return coder.parity
+}
+
+// compute the parity shards from the data shards. All shards
+// must be allocated and the same size.
+func (coder *Coder) Encode(shards [][]byte) error {
+	if len(shards) != coder.data+coder.parity {
+		return ErrShardCount
+	}
+	size := len(shards[0])
+	for _, shard := range shards {
+		if len(shard) != size {
+			return ErrShardSize
+		}
+	}
+	for p := coder.data; p < len(shards); p++ {
+		coder.combine(shards[p], coder.matrix[p], shards[:coder.data])
+	}
+	return nil
+}
+
+// rebuild missing shards, given as nil or empty, in place from
+// those present. At least as many shards as there are data shards
+// must be present.
+func (coder *Coder) Reconstruct(shards [][]byte) error {
+	if len(shards) != coder.data+coder.parity {
+		return ErrShardCount
+	}
+	size, present := -1, []int{}
+	for i, shard := range shards {
+		if len(shard) == 0 {
+			continue
+		} else if size >= 0 && len(shard) != size {
+			return ErrShardSize
+		}
+		size = len(shard)
+		present = append(present, i)
+	}
+	if len(present) < coder.data {
+		return ErrTooFewShards
+	} else if len(present) == len(shards) {
+		return nil
+	}
+
+	// invert the rows of the shards used to recover the data
+	present = present[:coder.data]
+	rows := make([][]byte, coder.data)
+	inputs := make([][]byte, coder.data)
+	for i, shard := range present {
+		rows[i] = coder.matrix[shard]
+		inputs[i] = shards[shard]
+	}
+	decode, err := invert(rows)
+	if err != nil {
+		return err
+	}
+	for d := 0; d < coder.data; d++ {
+		if len(shards[d]) == 0 {
+			shards[d] = make([]byte, size)
+			coder.combine(shards[d], decode[d], inputs)
+		}
+	}
+	for p := coder.data; p < len(shards); p++ {
+		if len(shards[p]) == 0 {
+			shards[p] = make([]byte, size)
+			coder.combine(shards[p], coder.matrix[p], shards[:coder.data])
+		}
+	}
+	return nil
+}
+
+// set out to the sum of inputs weighted by coefficients.
+func (coder *Coder) combine(out, coefficients []byte, inputs [][]byte) {
+	clear(out)
+	for i, input := range inputs {
+		products := &mulTable[coefficients[i]]
+		for b, value := range input {
+			out[b] ^= products[value]
+		}
+	}
+}
+
+// return the product of two matrices.
+func multiply(a, b [][]byte) [][]byte {
+	product := make([][]byte, len(a))
+	for r := range a {
+		product[r] = make([]byte, len(b[0]))
+		for c := range product[r] {
+			var sum byte
+			for i := range b {
+				sum ^= mulTable[a[r][i]][b[i][c]]
+			}
+			product[r][c] = sum
+		}
+	}
+	return product
+}
+
+// return the inverse of a square matrix, by Gauss-Jordan
+// elimination.
+func invert(matrix [][]byte) ([][]byte, error) {
+	n := len(matrix)
+	work := make([][]byte, n)
+	for r := range work {
+		work[r] = make([]byte, 2*n)
+		copy(work[r], matrix[r])
+		work[r][n+r] = 1
+	}
+	for c := 0; c < n; c++ {
+		pivot := c
+		for pivot < n && work[pivot][c] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, ErrShardCount // singular
+		}
+		work[c], work[pivot] = work[pivot], work[c]
+		scale := inverse(work[c][c])
+		for i := range work[c] {
+			work[c][i] = mulTable[scale][work[c][i]]
+		}
+		for r := 0; r < n; r++ {
+			if r == c || work[r][c] == 0 {
+				continue
+			}
+			factor := work[r][c]
+			for i := range work[r] {
+				work[r][i] ^= mulTable[factor][work[c][i]]
+			}
+		}
+	}
+	inverse := make([][]byte, n)
+	for r := range work {
+		inverse[r] = work[r][n:]
+	}
+	return inverse, nil
+}
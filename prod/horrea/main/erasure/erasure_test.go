@@ -0,0 +1,73 @@
+/*
+ * Tests for Reed-Solomon erasure coding.
+ */
+
+package erasure
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+// make random data shards with room for parity
+func makeShards(coder *Coder, size int) [][]byte {
+	shards := make([][]byte, coder.DataShards()+coder.ParityShards())
+	for i := range shards {
+		shards[i] = make([]byte, size)
+		if i < coder.DataShards() {
+			rand.Read(shards[i])
+		}
+	}
+	return shards
+}
+
+// test the data survives losing any set of shards up to the
+// parity count
+func TestReconstruct(t *testing.T) {
+	coder, err := New(4, 2)
+	if err != nil {
+		t.Fatalf("could not create coder: %s", err)
+	}
+	shards := makeShards(coder, 1000)
+	if err = coder.Encode(shards); err != nil {
+		t.Fatalf("could not encode: %s", err)
+	}
+	for a := 0; a < 6; a++ {
+		for b := a; b < 6; b++ {
+			damaged := make([][]byte, len(shards))
+			copy(damaged, shards)
+			damaged[a], damaged[b] = nil, nil
+			if err = coder.Reconstruct(damaged); err != nil {
+				t.Fatalf("could not rebuild without %d and %d: %s", a, b, err)
+			}
+			for i := range shards {
+				if !bytes.Equal(damaged[i], shards[i]) {
+					t.Fatalf("shard %d wrong after losing %d and %d", i, a, b)
+				}
+			}
+		}
+	}
+
+	damaged := make([][]byte, len(shards))
+	copy(damaged[3:], shards[3:])
+	if err = coder.Reconstruct(damaged); !errors.Is(err, ErrTooFewShards) {
+		t.Fatalf("expected ErrTooFewShards, got %v", err)
+	}
+}
+
+// test shard counts and sizes are checked
+func TestShardChecks(t *testing.T) {
+	for _, counts := range [][2]int{{0, 2}, {3, -1}, {200, 57}} {
+		if _, err := New(counts[0], counts[1]); !errors.Is(err, ErrShardCount) {
+			t.Fatalf("expected ErrShardCount for %v, got %v", counts, err)
+		}
+	}
+	coder, _ := New(2, 1)
+	shards := makeShards(coder, 10)
+	shards[2] = make([]byte, 9)
+	if err := coder.Encode(shards); !errors.Is(err, ErrShardSize) {
+		t.Fatalf("expected ErrShardSize, got %v", err)
+	}
+}
@@ -0,0 +1,202 @@
+/*
+ * Per-client bandwidth and concurrency limits.
+ */
+
+/*
+ * PUT, GET, patch, upload part, export and import streams are limited
+ * per client, identified by peer address. Authorization metadata isn't
+ * verified, so keying on it would let a client dodge its limits, and
+ * grow the table of clients without bound, by sending a fresh token
+ * with each stream. A client may have a number of streams open at
+ * once, and may move a number of bytes per second across all of
+ * them, with up to a second's worth in a burst.
+ *
+ * A stream over the byte rate is slowed down rather than failed, so
+ * a transfer already under way completes. A new stream is refused
+ * with RESOURCE_EXHAUSTED while its client is at its stream limit or
+ * already waiting on its byte rate, so one client's bulk transfer
+ * can't starve everyone else's.
+ *
+ * Limits hold per server. Message sizes are counted as they are on
+ * the wire, before any decompression.
+ */
+
+package main
+
+import (
+	pb "github.com/pleb/prod/horrea/pb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"context"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// methods subject to per-client limits.
+var limitedMethods = map[string]bool{
+	pb.Horrea_PutContent_FullMethodName:    true,
+	pb.Horrea_GetContent_FullMethodName:    true,
+	pb.Horrea_PatchContent_FullMethodName:  true,
+	pb.Horrea_UploadPart_FullMethodName:    true,
+	pb.Horrea_ExportContent_FullMethodName: true,
+	pb.Horrea_ImportContent_FullMethodName: true,
+}
+
+// limits shared by the clients of a server.
+type clientLimits struct {
+	rate    int64 // bytes per second per client, 0 for no limit.
+	streams int   // open streams per client, 0 for no limit.
+
+	mu      sync.Mutex
+	clients map[string]*clientUsage
+}
+
+// usage by one client.
+type clientUsage struct {
+	streams int       // streams open.
+	due     time.Time // time the bytes moved so far are paid for.
+}
+
+// stream counting the bytes moved against its client's rate.
+type limitedStream struct {
+	grpc.ServerStream
+	limits *clientLimits
+	usage  *clientUsage
+}
+
+// gRPC server options applying the configured limits, if any.
+func serverOptions() []grpc.ServerOption {
+	if cfg.ClientMiBps <= 0 && cfg.ClientStreams <= 0 {
+		return nil
+	}
+	limits := &clientLimits{
+		rate:    int64(max(cfg.ClientMiBps, 0)) << 20,
+		streams: max(cfg.ClientStreams, 0),
+		clients: map[string]*clientUsage{},
+	}
+	return []grpc.ServerOption{grpc.StreamInterceptor(limits.intercept)}
+}
+
+// identify the client of a request by its peer host.
+func clientID(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		address := p.Addr.String()
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			return "peer " + host
+		}
+		return "peer " + address
+	}
+	return ""
+}
+
+// report whether a client is behind on its byte rate. The lock
+// must be held.
+func (limits *clientLimits) behind(usage *clientUsage, now time.Time) bool {
+	return limits.rate > 0 && usage.due.Sub(now) > time.Second
+}
+
+// open a stream for a client, failing with RESOURCE_EXHAUSTED if
+// it is over its limits.
+func (limits *clientLimits) acquire(id string) (*clientUsage, error) {
+	limits.mu.Lock()
+	defer limits.mu.Unlock()
+	now := time.Now()
+	usage, ok := limits.clients[id]
+	if !ok {
+		// forget clients idle long enough to have a full burst again
+		for other, idle := range limits.clients {
+			if idle.streams == 0 && idle.due.Before(now) {
+				delete(limits.clients, other)
+			}
+		}
+		usage = &clientUsage{due: now}
+		limits.clients[id] = usage
+	}
+	if limits.streams > 0 && usage.streams >= limits.streams {
+		return nil, status.Errorf(codes.ResourceExhausted,
+			"client has %d streams open", usage.streams)
+	} else if limits.behind(usage, now) {
+		return nil, status.Errorf(codes.ResourceExhausted,
+			"client over %d bytes per second", limits.rate)
+	}
+	usage.streams++
+	return usage, nil
+}
+
+// close a stream opened for a client.
+func (limits *clientLimits) release(usage *clientUsage) {
+	limits.mu.Lock()
+	defer limits.mu.Unlock()
+	usage.streams--
+}
+
+// count bytes moved by a client, and wait until its rate allows
+// them.
+func (limits *clientLimits) take(ctx context.Context, usage *clientUsage, n int) error {
+	if limits.rate <= 0 {
+		return nil
+	}
+	limits.mu.Lock()
+	now := time.Now()
+	if usage.due.Before(now) {
+		usage.due = now
+	}
+	usage.due = usage.due.Add(time.Duration(int64(n) * int64(time.Second) / limits.rate))
+	wait := usage.due.Sub(now) - time.Second
+	limits.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+// apply limits to the streams of limited methods.
+func (limits *clientLimits) intercept(service any, stream grpc.ServerStream,
+	info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if !limitedMethods[info.FullMethod] {
+		return handler(service, stream)
+	}
+	usage, err := limits.acquire(clientID(stream.Context()))
+	if err != nil {
+		log.Printf("Refused %s stream, %v", info.FullMethod, err)
+		return err
+	}
+	defer limits.release(usage)
+	return handler(service, &limitedStream{ServerStream: stream, limits: limits, usage: usage})
+}
+
+func (stream *limitedStream) RecvMsg(m any) error {
+	if err := stream.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return stream.pace(m)
+}
+
+func (stream *limitedStream) SendMsg(m any) error {
+	if err := stream.pace(m); err != nil {
+		return err
+	}
+	return stream.ServerStream.SendMsg(m)
+}
+
+// count a message against the client's rate.
+func (stream *limitedStream) pace(m any) error {
+	if message, ok := m.(proto.Message); ok {
+		return stream.limits.take(stream.Context(), stream.usage, proto.Size(message))
+	}
+	return nil
+}
@@ -13,10 +13,8 @@
  * Consumes:
  *    Iudex     - Guards concurrent file accesses
  *
- * TODO eventually should maintain a caching layer, but this
- * requires some work to shard inputs and will add state to
- * this service. But probably worth it for shared inputs.
- * TODO the cloud storage aspect is unfinished right now.
+ * Shared inputs are served from an optional read cache, held in
+ * memory and on local disk, in front of the backend.
  */
 
 package main
@@ -34,21 +32,56 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"time"
 )
 
 type HorreaConfig struct {
-	Port           int    `env:"PORT"         envDefault:55412`
-	ChunkSizeKiB   int    `env:"CSIZEKIB"    envDefault:"64"`
-	MaxFileSizeGiB int    `env:"FSIZEGIB"    envDefault:"10"`
-	LocalBacked    bool   `env:"LOCALBACKED"  envDefault:"false"`
-	LocalDirectory string `env:"LOCALDIR"  envDefault:"/tmp/pleb"`
+	Port           int      `env:"PORT"         envDefault:"55412"`
+	ChunkSizeKiB   int      `env:"CSIZEKIB"    envDefault:"64"`
+	MaxFileSizeGiB int      `env:"FSIZEGIB"    envDefault:"10"`
+	Backend        string   `env:"BACKEND"`
+	LocalBacked    bool     `env:"LOCALBACKED"  envDefault:"false"`
+	LocalDirectory string   `env:"LOCALDIR"  envDefault:"/tmp/pleb"`
+	S3Endpoint     string   `env:"S3ENDPOINT"`
+	S3Region       string   `env:"S3REGION"     envDefault:"us-east-1"`
+	S3Bucket       string   `env:"S3BUCKET"     envDefault:"pleb"`
+	S3Prefix       string   `env:"S3PREFIX"`
+	S3PathStyle    bool     `env:"S3PATHSTYLE"  envDefault:"false"`
+	S3PartSizeMiB  int      `env:"S3PARTSIZEMIB" envDefault:"8"`
+	CompressAtRest string   `env:"COMPRESSATREST"`
+	Dedup          bool     `env:"DEDUP"        envDefault:"false"`
+	UploadTTLHours int      `env:"UPLOADTTLHOURS" envDefault:"24"`
+	CacheMiB       int      `env:"CACHEMIB"     envDefault:"0"`
+	DiskCacheDir   string   `env:"DISKCACHEDIR"`
+	DiskCacheMiB   int      `env:"DISKCACHEMIB" envDefault:"0"`
+	Versioning     bool     `env:"VERSIONING"   envDefault:"false"`
+	KeepVersions   int      `env:"KEEPVERSIONS" envDefault:"0"`
+	KeepVersionHrs int      `env:"KEEPVERSIONHOURS" envDefault:"0"`
+	ReplicaDirs    []string `env:"REPLICADIRS"`
+	WriteQuorum    int      `env:"WRITEQUORUM"  envDefault:"0"`
+	ShardDirs      []string `env:"SHARDDIRS"`
+	ParityShards   int      `env:"PARITYSHARDS" envDefault:"2"`
+	MasterKeyFile  string   `env:"MASTERKEYFILE"`
+	ScrubHours     int      `env:"SCRUBHOURS"   envDefault:"24"`
+	ScrubMiBps     int      `env:"SCRUBMIBPS"   envDefault:"16"`
+	PackKiB        int      `env:"PACKKIB"      envDefault:"0"`
+	PackFileMiB    int      `env:"PACKFILEMIB"  envDefault:"4"`
+	HotDir         string   `env:"HOTDIR"       envDefault:"/tmp/pleb-hot"`
+	ColdBackend    string   `env:"COLDBACKEND"  envDefault:"s3"`
+	ColdDir        string   `env:"COLDDIR"`
+	ColdAfterHrs   int      `env:"COLDAFTERHOURS" envDefault:"168"`
+	HotCapacityMiB int      `env:"HOTCAPACITYMIB" envDefault:"0"`
+	LifecycleFile  string   `env:"LIFECYCLEFILE"`
+	ClientMiBps    int      `env:"CLIENTMIBPS"  envDefault:"0"`
+	ClientStreams  int      `env:"CLIENTSTREAMS" envDefault:"0"`
 }
 
 const cfgPrefix = "HORREA_"
 
 var (
 	cfg = HorreaConfig{}
-	srv = grpc.NewServer()
+	srv *grpc.Server
 )
 
 type server struct {
@@ -59,14 +92,165 @@ type server struct {
 func setup() error {
 	config.LoadConfig(&cfg, cfgPrefix)
 	// additional initialization based on config
-	err := blob.ConfigureBackend(cfg.LocalBacked,
-		cfg.LocalDirectory)
+	srv = grpc.NewServer(serverOptions()...)
+	storage, err := backendConfig()
+	if err == nil {
+		err = blob.ConfigureBackend(backendName(), storage)
+	}
 	if err != nil {
 		log.Printf("failed to init blob backend: %v", err)
 	}
 	return err
 }
 
+// name of the configured blob backend. An explicit backend
+// takes precedence over the local-backed flag.
+func backendName() string {
+	if cfg.Backend != "" {
+		return cfg.Backend
+	} else if cfg.LocalBacked {
+		return blob.LocalBackend
+	}
+	return blob.S3Backend
+}
+
+// storage configuration passed to the blob backend. Object
+// store credentials come from the standard AWS variables so
+// they are not logged with the rest of the config.
+func backendConfig() (*blob.Config, error) {
+	keys, err := masterKeys()
+	if err != nil {
+		return nil, err
+	}
+	rules := []blob.LifecycleRule{}
+	if cfg.LifecycleFile != "" {
+		if rules, err = blob.LoadLifecycleFile(cfg.LifecycleFile); err != nil {
+			return nil, err
+		}
+	}
+	return &blob.Config{
+		LocalDirectory: cfg.LocalDirectory,
+		S3Endpoint:     cfg.S3Endpoint,
+		S3Region:       cfg.S3Region,
+		S3Bucket:       cfg.S3Bucket,
+		S3Prefix:       cfg.S3Prefix,
+		S3AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		S3SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		S3PathStyle:    cfg.S3PathStyle,
+		S3PartSize:     cfg.S3PartSizeMiB * 1024 * 1024,
+		Compression:    cfg.CompressAtRest,
+		Dedup:          cfg.Dedup,
+		CacheSize:      int64(cfg.CacheMiB) << 20,
+		DiskCacheDir:   cfg.DiskCacheDir,
+		DiskCacheSize:  int64(cfg.DiskCacheMiB) << 20,
+		Versioning:     cfg.Versioning,
+		KeepVersions:   cfg.KeepVersions,
+		KeepVersionFor: time.Duration(cfg.KeepVersionHrs) * time.Hour,
+		ReplicaDirs:    cfg.ReplicaDirs,
+		WriteQuorum:    cfg.WriteQuorum,
+		ShardDirs:      cfg.ShardDirs,
+		ParityShards:   cfg.ParityShards,
+		MasterKeys:     keys,
+		PackThreshold:  int64(cfg.PackKiB) << 10,
+		PackSize:       int64(cfg.PackFileMiB) << 20,
+		HotDir:         cfg.HotDir,
+		ColdBackend:    cfg.ColdBackend,
+		ColdDir:        cfg.ColdDir,
+		ColdAfter:      time.Duration(cfg.ColdAfterHrs) * time.Hour,
+		HotCapacity:    int64(cfg.HotCapacityMiB) << 20,
+		Lifecycle:      rules,
+	}, nil
+}
+
+// master keys for encryption at rest, oldest first: those in the
+// key file, then the one in the environment, which is read apart
+// from the rest of the config so it is not logged.
+func masterKeys() ([][]byte, error) {
+	keys := [][]byte{}
+	if cfg.MasterKeyFile != "" {
+		loaded, err := blob.LoadKeyFile(cfg.MasterKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, loaded...)
+	}
+	if text := os.Getenv(cfgPrefix + "MASTERKEY"); text != "" {
+		key, err := blob.ParseKey(text)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// lifetime of a resumable upload session.
+func uploadTTL() time.Duration {
+	return time.Duration(cfg.UploadTTLHours) * time.Hour
+}
+
+// periodically discard expired upload sessions and old versions,
+// repair replicas or shards, move cold blobs off the hot tier,
+// re-wrap data keys under the current master key, compact packs,
+// expire blobs by the lifecycle rules, and fold patches into blobs.
+func housekeeping() {
+	for ; ; time.Sleep(time.Hour) {
+		n, err := blob.ExpireUploads(time.Now())
+		if err != nil {
+			log.Printf("failed to expire uploads: %v", err)
+		} else if n > 0 {
+			log.Printf("expired %d abandoned uploads", n)
+		}
+		if cfg.Versioning && cfg.KeepVersionHrs > 0 {
+			if _, err = blob.PruneAllVersions(time.Now()); err != nil {
+				log.Printf("failed to prune versions: %v", err)
+			}
+		}
+		switch backendName() {
+		case blob.ReplicatedBackend:
+			if _, err = blob.RepairReplicas(int64(cfg.ScrubMiBps) << 20); err != nil {
+				log.Printf("failed to repair replicas: %v", err)
+			}
+		case blob.ErasureBackend:
+			if _, err = blob.RepairShards(int64(cfg.ScrubMiBps) << 20); err != nil {
+				log.Printf("failed to repair shards: %v", err)
+			}
+		case blob.TieredBackend:
+			if _, err = blob.DemoteCold(time.Now()); err != nil {
+				log.Printf("failed to demote cold blobs: %v", err)
+			}
+		}
+		if cfg.MasterKeyFile != "" || os.Getenv(cfgPrefix+"MASTERKEY") != "" {
+			if _, err = blob.RotateKeys(); err != nil {
+				log.Printf("failed to rotate keys: %v", err)
+			}
+		}
+		if cfg.PackKiB > 0 {
+			if _, err = blob.CompactPacks(); err != nil {
+				log.Printf("failed to compact packs: %v", err)
+			}
+		}
+		if cfg.LifecycleFile != "" {
+			if _, err = blob.ApplyLifecycle(time.Now()); err != nil {
+				log.Printf("failed to apply lifecycle rules: %v", err)
+			}
+		}
+		if _, err = blob.CompactDeltas(time.Now()); err != nil {
+			log.Printf("failed to compact deltas: %v", err)
+		}
+	}
+}
+
+// periodically verify stored content, quarantining corrupt blobs.
+func scrubber() {
+	for {
+		time.Sleep(time.Duration(cfg.ScrubHours) * time.Hour)
+		if _, err := blob.Scrub(int64(cfg.ScrubMiBps) << 20); err != nil {
+			log.Printf("failed to scrub: %v", err)
+		}
+	}
+}
+
 // run gRPC server and wait for shutdown
 func run(done context.CancelFunc) {
 	defer done()
@@ -78,6 +262,10 @@ func run(done context.CancelFunc) {
 	}
 	defer lis.Close()
 	pb.RegisterHorreaServer(srv, &server{})
+	go housekeeping()
+	if cfg.ScrubHours > 0 {
+		go scrubber()
+	}
 	log.Printf("server listening at %v", lis.Addr())
 	if err := srv.Serve(lis); err != nil {
 		log.Printf("failed to serve: %v", err)
@@ -89,6 +277,10 @@ func run(done context.CancelFunc) {
 func shutdown() {
 	log.Printf("shutting down horrea server")
 	srv.GracefulStop()
+	if stats, err := blob.ReadCacheStats(); err == nil {
+		log.Printf("read cache served %d from memory, %d from disk, %d misses",
+			stats.MemoryHits, stats.DiskHits, stats.Misses)
+	}
 }
 
 // entrypoint for horrea server.
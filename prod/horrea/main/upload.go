@@ -0,0 +1,162 @@
+/*
+ * Validation of streamed uploads.
+ */
+
+/*
+ * A PUT stream is one BlobInfo message followed by data chunks
+ * totalling exactly info.Size bytes. Malformed streams are rejected
+ * with InvalidArgument, and streams that end early with DataLoss.
+ * Either way the pending write is aborted, so nothing is persisted.
+ *
+ * The chunks may carry a compressed stream, named alongside the
+ * BlobInfo. Sizes are checked against the decompressed content.
+ */
+
+package main
+
+import (
+	"github.com/pleb/prod/horrea/main/codec"
+	pb "github.com/pleb/prod/horrea/pb"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"io"
+	"strings"
+)
+
+type upload struct {
+	info     *pb.BlobInfo // declared blob attributes.
+	codec    string       // encoding of the chunk stream.
+	received int64        // content bytes received so far.
+}
+
+// reader over the data of a stream's chunks.
+type chunkReader struct {
+	up      *upload                    // upload being received.
+	stream  pb.Horrea_PutContentServer // client stream.
+	pending []byte                     // data not yet returned.
+}
+
+// reader over decoded upload content.
+type contentReader struct {
+	up      *upload   // upload being received.
+	decoder io.Reader // decompressor over the chunks.
+}
+
+// largest blob accepted by PUT, in bytes.
+func maxBlobSize() int64 {
+	return int64(cfg.MaxFileSizeGiB) << 30
+}
+
+// codec name for a wire compression value.
+func codecName(compression pb.Compression) string {
+	return strings.ToLower(compression.String())
+}
+
+// validate the opening message of a PUT stream.
+func startUpload(in *pb.PutContentReq, err error) (*upload, error) {
+	if err == io.EOF {
+		return nil, status.Error(codes.InvalidArgument,
+			"empty stream, expected blob info")
+	} else if err != nil {
+		return nil, err
+	}
+	info := in.GetInfo()
+	if info == nil {
+		return nil, status.Error(codes.InvalidArgument,
+			"first message must carry blob info")
+	} else if err = validateInfo(info); err != nil {
+		return nil, err
+	} else if !codec.Supported(codecName(in.Compression)) {
+		return nil, status.Errorf(codes.Unimplemented,
+			"unsupported compression %s", in.Compression)
+	}
+	return &upload{info: info, codec: codecName(in.Compression)}, nil
+}
+
+// validate the attributes of a blob about to be uploaded.
+func validateInfo(info *pb.BlobInfo) error {
+	switch {
+	case info.Major == "" || info.Minor == "":
+		return status.Error(codes.InvalidArgument,
+			"blob info must have major and minor keys")
+	case info.Size < 0:
+		return status.Errorf(codes.InvalidArgument,
+			"invalid blob size %d", info.Size)
+	case info.Size > maxBlobSize():
+		return status.Errorf(codes.InvalidArgument,
+			"blob size %d exceeds limit of %d bytes", info.Size, maxBlobSize())
+	}
+	return nil
+}
+
+// validate a subsequent message, returning its data.
+func (up *upload) accept(in *pb.PutContentReq) ([]byte, error) {
+	chunk := in.GetChunk()
+	if chunk == nil {
+		return nil, status.Error(codes.InvalidArgument,
+			"expected data chunk, blob info already sent")
+	}
+	return chunk.Data, nil
+}
+
+// open a reader over the decoded content of the rest of the
+// stream. Errors it returns are already gRPC status errors.
+func (up *upload) content(stream pb.Horrea_PutContentServer) (io.Reader, error) {
+	chunks := &chunkReader{up: up, stream: stream}
+	decoder, err := codec.NewReader(up.codec, chunks)
+	if err == io.EOF {
+		return &contentReader{up: up, decoder: chunks}, nil // no data at all
+	} else if err != nil {
+		return nil, up.decodeError(err)
+	}
+	return &contentReader{up: up, decoder: decoder}, nil
+}
+
+// map a decoding failure onto a status, leaving stream errors.
+func (up *upload) decodeError(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	return status.Errorf(codes.InvalidArgument,
+		"malformed %s stream, %v", up.codec, err)
+}
+
+// validate the stream once the client has finished sending.
+func (up *upload) finish() error {
+	if up.received != up.info.Size {
+		return status.Errorf(codes.DataLoss,
+			"expected file %d bytes, is %d bytes", up.info.Size, up.received)
+	}
+	return nil
+}
+
+func (reader *chunkReader) Read(data []byte) (int, error) {
+	for len(reader.pending) == 0 {
+		in, err := reader.stream.Recv()
+		if err != nil {
+			return 0, err // io.EOF once the client is done sending
+		}
+		if reader.pending, err = reader.up.accept(in); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(data, reader.pending)
+	reader.pending = reader.pending[n:]
+	return n, nil
+}
+
+func (reader *contentReader) Read(data []byte) (int, error) {
+	up := reader.up
+	n, err := reader.decoder.Read(data)
+	up.received += int64(n)
+	if up.received > up.info.Size {
+		return 0, status.Errorf(codes.InvalidArgument,
+			"expected file %d bytes, received more", up.info.Size)
+	}
+	if err != nil && err != io.EOF {
+		return n, up.decodeError(err)
+	}
+	return n, err
+}